@@ -0,0 +1,126 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Reports whether path names an archive format -archive can write
+func archiveFormat(path string) (string, bool) {
+	switch {
+	case strings.HasSuffix(path, ".zip"):
+		return "zip", true
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		return "tar.gz", true
+	}
+	return "", false
+}
+
+// Packs the files written by a run, plus the run manifest and recipe if
+// withManifest, into one .zip or .tar.gz for handoff. Files are stored under
+// their path relative to the output folder; the packed output files are then
+// removed, leaving the archive, the manifest and the recipe.
+func archiveOutputs(archivePath string, summary *runSummary, withManifest bool) error {
+	format, _ := archiveFormat(archivePath)
+	files := summary.files
+	for _, name := range []string{"run-manifest.json", "recipe.json"} {
+		path := filepath.Join(summary.outputDir, name)
+		if _, err := os.Stat(path); withManifest && err == nil {
+			files = append(files[:len(files):len(files)], path)
+		}
+	}
+
+	tmp := tempPath(archivePath)
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	var add func(name string, info os.FileInfo, r io.Reader) error
+	var finish func() error
+	if format == "zip" {
+		zw := zip.NewWriter(out)
+		add = func(name string, info os.FileInfo, r io.Reader) error {
+			header, err := zip.FileInfoHeader(info)
+			if err != nil {
+				return err
+			}
+			header.Name, header.Method = name, zip.Deflate
+			w, err := zw.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(w, r)
+			return err
+		}
+		finish = zw.Close
+	} else {
+		gz := gzip.NewWriter(out)
+		tw := tar.NewWriter(gz)
+		add = func(name string, info os.FileInfo, r io.Reader) error {
+			header, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			header.Name = name
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, r)
+			return err
+		}
+		finish = func() error {
+			if err := tw.Close(); err != nil {
+				return err
+			}
+			return gz.Close()
+		}
+	}
+
+	pack := func() error {
+		for _, path := range files {
+			name, err := filepath.Rel(summary.outputDir, path)
+			if err != nil {
+				return err
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			info, err := f.Stat()
+			if err == nil {
+				err = add(filepath.ToSlash(name), info, f)
+			}
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+		}
+		return finish()
+	}
+	if err := pack(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, archivePath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	for _, path := range summary.files {
+		os.Remove(path)
+	}
+	fmt.Printf("Packed %d files into %s\n", len(files), archivePath)
+	summary.files = []string{archivePath}
+	return nil
+}
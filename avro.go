@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// -format avro: the -columns of the entries are written as Avro object
+// container files, with the schema in each file's header. The schema is a
+// record of nullable strings, one per column, or the one -avro-schema reads,
+// whose fields are filled from the columns of the same names and may also be
+// int, long, float, double or boolean. The values of a file are collected and
+// written as one block when it is finished.
+type avroSchema struct {
+	Type   string      `json:"type"`
+	Name   string      `json:"name"`
+	Fields []avroField `json:"fields"`
+
+	text string // the schema as written to files
+}
+
+type avroField struct {
+	Name string `json:"name"`
+	Type any    `json:"type"`
+
+	kind   string // the type, or the non-null type of a union with null
+	null   int    // index of null in the union, or -1 when not nullable
+	column int    // index in the -columns
+}
+
+// Avro names are letters, digits and underscores, not starting with a digit
+func avroName(s string) string {
+	name := []byte(parquetName(s))
+	for i, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 || name[0] >= '0' && name[0] <= '9' {
+		return "_" + string(name)
+	}
+	return string(name)
+}
+
+// A schema with a nullable string field per column, in a record named after
+// the entries' element
+func inferAvroSchema(record string, columns *tableColumns) *avroSchema {
+	type field struct {
+		Name    string   `json:"name"`
+		Type    []string `json:"type"`
+		Default any      `json:"default"`
+	}
+	s := &avroSchema{Type: "record", Name: avroName(record)}
+	fields := make([]field, len(columns.names))
+	for i, name := range columns.names {
+		fields[i] = field{Name: name, Type: []string{"null", "string"}}
+		s.Fields = append(s.Fields, avroField{Name: name, kind: "string", null: 0, column: i})
+	}
+	text, _ := json.Marshal(struct {
+		Type   string  `json:"type"`
+		Name   string  `json:"name"`
+		Fields []field `json:"fields"`
+	}{s.Type, s.Name, fields})
+	s.text = string(text)
+	return s
+}
+
+// Reads an -avro-schema file, matching its fields to the columns by name.
+// Without -columns each field is read from the path of its name.
+func loadAvroSchema(path string, columns []string) (*avroSchema, *tableColumns, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &avroSchema{}
+	if err := json.Unmarshal(content, s); err != nil {
+		return nil, nil, fmt.Errorf("invalid Avro schema %s: %v", path, err)
+	}
+	if s.Type != "record" || len(s.Fields) == 0 {
+		return nil, nil, fmt.Errorf("Avro schema %s must be a record with fields", path)
+	}
+	var compact bytes.Buffer
+	json.Compact(&compact, content)
+	s.text = compact.String()
+
+	if len(columns) == 0 {
+		for _, f := range s.Fields {
+			columns = append(columns, f.Name)
+		}
+	}
+	table, err := parseColumns(columns, "avro")
+	if err != nil {
+		return nil, nil, err
+	}
+	used := make([]bool, len(table.names))
+	for i := range s.Fields {
+		f := &s.Fields[i]
+		if err := f.parseType(); err != nil {
+			return nil, nil, fmt.Errorf("Avro schema %s: field %s: %v", path, f.Name, err)
+		}
+		f.column = -1
+		for j, name := range table.names {
+			if name == f.Name {
+				f.column, used[j] = j, true
+			}
+		}
+		if f.column < 0 {
+			return nil, nil, fmt.Errorf("Avro schema %s: no column for field %s", path, f.Name)
+		}
+	}
+	for j, ok := range used {
+		if !ok {
+			return nil, nil, fmt.Errorf("Avro schema %s has no field %s for that column", path, table.names[j])
+		}
+	}
+	return s, table, nil
+}
+
+var avroKinds = []string{"string", "int", "long", "float", "double", "boolean"}
+
+// Reads a field's type: a primitive type, or a union of null and one
+func (f *avroField) parseType() error {
+	f.null = -1
+	switch t := f.Type.(type) {
+	case string:
+		f.kind = t
+	case []any:
+		if len(t) != 2 {
+			return fmt.Errorf("only unions of null and one type are supported")
+		}
+		for i, member := range t {
+			name, _ := member.(string)
+			if name == "null" {
+				f.null = i
+			} else {
+				f.kind = name
+			}
+		}
+		if f.null < 0 {
+			return fmt.Errorf("only unions of null and one type are supported")
+		}
+	}
+	for _, kind := range avroKinds {
+		if f.kind == kind {
+			return nil
+		}
+	}
+	return fmt.Errorf("type %v is not supported (use %s, or a union of null and one)", f.Type, strings.Join(avroKinds, ", "))
+}
+
+// Collects the records of an Avro file
+type avroWriter struct {
+	schema  *avroSchema
+	columns *tableColumns
+	deflate bool
+	block   bytes.Buffer
+	count   int64
+}
+
+func newAvroWriter(schema *avroSchema, columns *tableColumns, deflate bool) *avroWriter {
+	return &avroWriter{schema: schema, columns: columns, deflate: deflate}
+}
+
+func (a *avroWriter) long(buf *bytes.Buffer, v int64) {
+	buf.Write(binary.AppendUvarint(nil, zigzag(v)))
+}
+
+func (a *avroWriter) bytes(buf *bytes.Buffer, s string) {
+	a.long(buf, int64(len(s)))
+	buf.WriteString(s)
+}
+
+// Adds an entry's fields as a record
+func (a *avroWriter) add(raw string) error {
+	n, err := parseNode(raw)
+	if err != nil {
+		return err
+	}
+	for _, f := range a.schema.Fields {
+		values := a.columns.paths[f.column].values(n, nil)
+		if len(values) == 0 {
+			if f.null < 0 {
+				return fmt.Errorf("no value for %s, which the schema doesn't allow to be null", f.Name)
+			}
+			a.long(&a.block, int64(f.null))
+			continue
+		}
+		if f.null >= 0 {
+			a.long(&a.block, int64(1-f.null))
+		}
+		value := strings.Join(values, "|")
+		if err := a.value(f, value); err != nil {
+			return fmt.Errorf("%s: %v", f.Name, err)
+		}
+	}
+	a.count++
+	return nil
+}
+
+// Encodes a value as the field's type
+func (a *avroWriter) value(f avroField, value string) error {
+	switch f.kind {
+	case "string":
+		a.bytes(&a.block, value)
+	case "int", "long":
+		bits := 64
+		if f.kind == "int" {
+			bits = 32
+		}
+		n, err := strconv.ParseInt(value, 10, bits)
+		if err != nil {
+			return fmt.Errorf("%q is not a valid %s", value, f.kind)
+		}
+		a.long(&a.block, n)
+	case "float", "double":
+		x, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a valid %s", value, f.kind)
+		}
+		if f.kind == "float" {
+			binary.Write(&a.block, binary.LittleEndian, math.Float32bits(float32(x)))
+		} else {
+			binary.Write(&a.block, binary.LittleEndian, math.Float64bits(x))
+		}
+	case "boolean":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		if b {
+			a.block.WriteByte(1)
+		} else {
+			a.block.WriteByte(0)
+		}
+	}
+	return nil
+}
+
+// Writes the file: the header with the schema, then the records as a block
+func (a *avroWriter) writeTo(w io.Writer) error {
+	codec := "null"
+	data := a.block.Bytes()
+	if a.deflate {
+		codec = "deflate"
+		var buf bytes.Buffer
+		zw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+	// derived from the schema and data, so equal runs write equal files
+	sum := sha256.Sum256(append([]byte(a.schema.text), data...))
+	sync := sum[:16]
+
+	var file bytes.Buffer
+	file.WriteString("Obj\x01")
+	a.long(&file, 2)
+	a.bytes(&file, "avro.schema")
+	a.bytes(&file, a.schema.text)
+	a.bytes(&file, "avro.codec")
+	a.bytes(&file, codec)
+	a.long(&file, 0)
+	file.Write(sync)
+	if a.count > 0 {
+		a.long(&file, a.count)
+		a.long(&file, int64(len(data)))
+		file.Write(data)
+		file.Write(sync)
+	}
+	_, err := w.Write(file.Bytes())
+	return err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Known answers from the Avro 1.11 specification: an object container file
+// is "Obj\x01", the metadata map, a 16-byte sync marker, then blocks of a
+// record count, a byte size, the records and the sync marker again. Longs
+// and ints are zigzag varints, strings a length and UTF-8 bytes, unions the
+// index of the branch then its value, floats and doubles little-endian IEEE
+// 754 and booleans one byte.
+func TestAvroKnownAnswer(t *testing.T) {
+	columns, err := parseColumns([]string{"title", "@n"}, "avro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := inferAvroSchema("book", columns)
+	const schemaText = `{"type":"record","name":"book","fields":[` +
+		`{"name":"title","type":["null","string"],"default":null},` +
+		`{"name":"n","type":["null","string"],"default":null}]}`
+	if schema.text != schemaText {
+		t.Errorf("schema %s, want %s", schema.text, schemaText)
+	}
+
+	entries := []string{`<book n="1"><title>Dune</title></book>`, `<book n="2"/>`}
+	records := []byte{
+		0x02, 0x08, 'D', 'u', 'n', 'e', // title: branch 1, "Dune"
+		0x02, 0x02, '1', // n: branch 1, "1"
+		0x00,            // title: branch 0, null
+		0x02, 0x02, '2', // n: branch 1, "2"
+	}
+	for _, deflate := range []bool{false, true} {
+		w := newAvroWriter(schema, columns, deflate)
+		for _, e := range entries {
+			if err := w.add(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var out bytes.Buffer
+		if err := w.writeTo(&out); err != nil {
+			t.Fatal(err)
+		}
+		file := out.Bytes()
+
+		codec := "null"
+		if deflate {
+			codec = "deflate"
+		}
+		var header bytes.Buffer
+		header.WriteString("Obj\x01")
+		header.WriteByte(0x04) // a map block of 2 entries
+		header.WriteByte(0x16) // 11
+		header.WriteString("avro.schema")
+		header.Write([]byte{0xb0, 0x02}) // 152
+		header.WriteString(schemaText)
+		header.WriteByte(0x14) // 10
+		header.WriteString("avro.codec")
+		header.WriteByte(byte(len(codec) * 2))
+		header.WriteString(codec)
+		header.WriteByte(0x00) // end of the map
+		if len(schemaText) != 152 || !bytes.HasPrefix(file, header.Bytes()) {
+			t.Fatalf("codec %s: header\n%q, want\n%q", codec, file[:min(len(file), header.Len())], header.Bytes())
+		}
+
+		rest := file[header.Len():]
+		if len(rest) < 16+2+16 {
+			t.Fatalf("codec %s: %d bytes after the header", codec, len(rest))
+		}
+		sync := rest[:16]
+		if !bytes.Equal(rest[len(rest)-16:], sync) {
+			t.Errorf("codec %s: block doesn't end with the sync marker", codec)
+		}
+		block := rest[16 : len(rest)-16]
+		if block[0] != 0x04 { // 2 records
+			t.Errorf("codec %s: block of %d records, want 2", codec, block[0]/2)
+		}
+		size, data := int(block[1])/2, block[2:]
+		if size != len(data) {
+			t.Errorf("codec %s: block size %d, want %d", codec, size, len(data))
+		}
+		if deflate {
+			// raw deflate, without the zlib header
+			if data, err = io.ReadAll(flate.NewReader(bytes.NewReader(data))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(data, records) {
+			t.Errorf("codec %s: records % x, want % x", codec, data, records)
+		}
+	}
+}
+
+func TestAvroKnownAnswerTypes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schema.avsc")
+	err := os.WriteFile(path, []byte(`{"type": "record", "name": "r", "fields": [
+		{"name": "i", "type": "int"},
+		{"name": "l", "type": "long"},
+		{"name": "big", "type": "long"},
+		{"name": "f", "type": "float"},
+		{"name": "d", "type": "double"},
+		{"name": "b", "type": "boolean"},
+		{"name": "o", "type": ["long", "null"]}
+	]}`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, columns, err := loadAvroSchema(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newAvroWriter(schema, columns, false)
+	if err := w.add(`<r><i>1</i><l>-64</l><big>64</big><f>1.5</f><d>0.1</d><b>true</b></r>`); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		0x02,       // int 1
+		0x7f,       // long -64
+		0x80, 0x01, // long 64
+		0x00, 0x00, 0xc0, 0x3f, // float 1.5
+		0x9a, 0x99, 0x99, 0x99, 0x99, 0x99, 0xb9, 0x3f, // double 0.1
+		0x01, // true
+		0x02, // o: branch 1, null
+	}
+	if !bytes.Equal(w.block.Bytes(), want) {
+		t.Errorf("record % x, want % x", w.block.Bytes(), want)
+	}
+
+	for _, entry := range []string{
+		`<r><i>2147483648</i><l>1</l><big>1</big><f>1</f><d>1</d><b>true</b></r>`,
+		`<r><i>1</i><l>1</l><big>1</big><f>1</f><d>1</d><b>yes</b></r>`,
+		`<r><l>1</l><big>1</big><f>1</f><d>1</d><b>true</b></r>`,
+	} {
+		if err := newAvroWriter(schema, columns, false).add(entry); err == nil {
+			t.Errorf("%s was written, want an error", entry)
+		}
+	}
+}
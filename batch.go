@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// One input of a batch run
+type batchSource struct {
+	input    string    // URL, or path of a local or extracted file
+	name     string    // output subfolder
+	modified time.Time // zero if unknown
+}
+
+// Selects the files of a batch by name and modification time
+type fileFilter struct {
+	include       []string // glob patterns, any of which must match
+	exclude       []string
+	modifiedAfter time.Time
+}
+
+func newFileFilter(opts options) (fileFilter, error) {
+	f := fileFilter{include: opts.includeFiles, exclude: opts.excludeFiles}
+	for _, pattern := range append(f.include, f.exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return f, fmt.Errorf("invalid file pattern %q: %v", pattern, err)
+		}
+	}
+	if opts.modifiedAfter != "" {
+		t, err := parseDate(opts.modifiedAfter)
+		if err != nil {
+			return f, fmt.Errorf("invalid -modified-after %q: expected a date like 2024-01-01", opts.modifiedAfter)
+		}
+		f.modifiedAfter = t
+	}
+	return f, nil
+}
+
+// Parses a date or RFC 3339 timestamp, as used by -modified-after and
+// sitemap <lastmod>
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, s)
+}
+
+// Reports whether any file filter was given
+func (f fileFilter) active() bool {
+	return len(f.include) > 0 || len(f.exclude) > 0 || !f.modifiedAfter.IsZero()
+}
+
+// Reports whether a file with this name passes the filter. Patterns match
+// the base name; files with an unknown modification time pass
+// -modified-after.
+func (f fileFilter) keep(name string, modified time.Time) bool {
+	base := path.Base(filepath.ToSlash(name))
+	matches := func(patterns []string) bool {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, base); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if len(f.include) > 0 && !matches(f.include) {
+		return false
+	}
+	if matches(f.exclude) {
+		return false
+	}
+	return f.modifiedAfter.IsZero() || modified.IsZero() || modified.After(f.modifiedAfter)
+}
+
+// Applies the filter to sources, reporting how many were left out
+func (f fileFilter) apply(sources []batchSource) []batchSource {
+	var kept []batchSource
+	for _, s := range sources {
+		if f.keep(s.input, s.modified) {
+			kept = append(kept, s)
+		}
+	}
+	if skipped := len(sources) - len(kept); skipped > 0 {
+		fmt.Printf("Skipping %d of %d files excluded by -include-files, -exclude-files or -modified-after\n", skipped, len(sources))
+	}
+	return kept
+}
+
+// Lists the .xml files in dir, or extracted from an archive, as a batch
+func localSources(paths []string) ([]batchSource, error) {
+	var sources []batchSource
+	for _, p := range paths {
+		if filepath.Ext(p) != ".xml" {
+			continue
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, batchSource{input: p, modified: info.ModTime()})
+	}
+	return sources, nil
+}
+
+// Names each source's output folder after its file name, without
+// extensions, numbering repeated names
+func nameSources(sources []batchSource) {
+	seen := make(map[string]int)
+	for i, s := range sources {
+		name := filepath.Base(s.input)
+		if u, err := url.Parse(s.input); err == nil && u.Scheme != "" && u.Host != "" {
+			name = path.Base(u.Path)
+		}
+		for _, ext := range []string{".gz", ".zip", ".tar", ".xml"} {
+			name = strings.TrimSuffix(name, ext)
+		}
+		name = safeFileName(name)
+		if seen[name]++; seen[name] > 1 {
+			name = fmt.Sprintf("%s-%d", name, seen[name])
+		}
+		sources[i].name = name
+	}
+}
+
+// Runs the extraction on every source, opts.batchWorkers at a time, each
+// writing to its own subfolder of opts.outputDir. Finished sources are
+// written to progress, if given. A source that fails is reported and the
+// rest still run, unless opts.failFast is set.
+func runBatch(ctx context.Context, opts options, sources []batchSource, summary *runSummary, progress io.Writer) error {
+	if opts.dryRun {
+		for _, s := range sources {
+			fmt.Printf("Would process %s into %s\n", s.input, filepath.Join(opts.outputDir, s.name))
+		}
+		return nil
+	}
+
+	// a signal, or with -fail-fast the first failure, stops new files from
+	// starting
+	var mu sync.Mutex
+	var failures []string
+	stopped := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return ctx.Err() != nil || opts.failFast && len(failures) > 0
+	}
+	queue := make(chan batchSource)
+	var wg sync.WaitGroup
+	gate := newMemoryGate()
+	for range opts.batchWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range queue {
+				if stopped() {
+					continue
+				}
+				if gate.acquire() && opts.batchWorkers > 1 {
+					mu.Lock()
+					summary.adapt("memory is near -max-memory, so files are processed one at a time instead of %d (-workers)", opts.batchWorkers)
+					mu.Unlock()
+				}
+
+				// the filters chose the file; they don't apply inside it
+				fileOpts := opts
+				fileOpts.includeFiles, fileOpts.excludeFiles, fileOpts.modifiedAfter = nil, nil, ""
+				if strings.Contains(s.input, "://") {
+					fileOpts.url = s.input
+				} else {
+					fileOpts.url, fileOpts.inputPath = "", s.input
+				}
+				fileOpts.outputDir = filepath.Join(opts.outputDir, s.name)
+				result, err := run(ctx, fileOpts)
+				gate.release()
+
+				mu.Lock()
+				summary.adaptations = append(summary.adaptations, result.adaptations...)
+				summary.ids = max(summary.ids, result.ids)
+				summary.matches += result.matches
+				summary.files = append(summary.files, result.files...)
+				summary.partial = summary.partial || result.partial
+				summary.interrupted = summary.interrupted || result.interrupted
+				switch {
+				case err != nil:
+					fmt.Printf("Error processing %s: %v\n", s.input, err)
+					failures = append(failures, fmt.Sprintf("%s: %v", s.input, err))
+				case !result.partial && progress != nil:
+					fmt.Fprintln(progress, s.input)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, s := range sources {
+		if stopped() {
+			break
+		}
+		queue <- s
+	}
+	close(queue)
+	wg.Wait()
+
+	if len(failures) > 0 {
+		fmt.Printf("%d of %d files failed:\n", len(failures), len(sources))
+		for _, f := range failures {
+			fmt.Println(" ", f)
+		}
+		if opts.failFast {
+			return fmt.Errorf("Error: stopped after a file failed (-fail-fast)")
+		}
+		return fmt.Errorf("Error: %d of %d files failed", len(failures), len(sources))
+	}
+	fmt.Printf("Processed %d files\n", len(sources))
+	return nil
+}
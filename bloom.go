@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A Bloom filter over 64-bit ID hashes, answering "definitely not an ID"
+// without touching the on-disk set
+type bloomFilter struct {
+	bits []uint64
+	m    uint64 // number of bits
+	k    uint64 // number of probes
+}
+
+// Sizes a filter for n IDs at the given false-positive rate
+func newBloomFilter(n int, fp float64) *bloomFilter {
+	n = max(n, 1)
+	m := uint64(math.Ceil(-float64(n) * math.Log(fp) / (math.Ln2 * math.Ln2)))
+	m = max(m, 64)
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	return &bloomFilter{bits: make([]uint64, (m+63)/64), m: m, k: max(k, 1)}
+}
+
+// Probes use double hashing on the two halves of the ID hash
+func (b *bloomFilter) probe(h uint64, i uint64) uint64 {
+	return (h&0xffffffff + i*(h>>32|1)) % b.m
+}
+
+func (b *bloomFilter) add(h uint64) {
+	for i := uint64(0); i < b.k; i++ {
+		p := b.probe(h, i)
+		b.bits[p/64] |= 1 << (p % 64)
+	}
+}
+
+func (b *bloomFilter) mayContain(h uint64) bool {
+	for i := uint64(0); i < b.k; i++ {
+		p := b.probe(h, i)
+		if b.bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func hashID(id string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return h.Sum64()
+}
+
+// A set of IDs kept on disk for -bloom: a data file of length-prefixed IDs
+// and an index of (hash, offset) records sorted by hash, fronted by a Bloom
+// filter so most misses never read the disk
+type idStore struct {
+	dir   string
+	data  *os.File
+	index *os.File
+	count int
+	bloom *bloomFilter
+}
+
+// A (hash, data offset) record of the index
+type idRecord struct {
+	hash   uint64
+	offset uint64
+}
+
+const (
+	idRecordSize = 16
+	idRunSize    = 1 << 20 // records sorted in memory before spilling a run
+)
+
+// Builds an idStore from a stream of IDs. Records are sorted in runs of
+// idRunSize and merged, so memory stays bounded however many IDs there are.
+type idStoreBuilder struct {
+	store  *idStore
+	dataW  *bufio.Writer
+	offset uint64
+	buf    []idRecord
+	runs   []string
+}
+
+func newIDStoreBuilder() (*idStoreBuilder, error) {
+	dir, err := os.MkdirTemp("", "ds-xml-ids-")
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.Create(filepath.Join(dir, "ids.dat"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &idStoreBuilder{
+		store: &idStore{dir: dir, data: data},
+		dataW: bufio.NewWriter(data),
+	}, nil
+}
+
+func (b *idStoreBuilder) add(id string) error {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(id)))
+	if _, err := b.dataW.Write(lenBuf[:n]); err != nil {
+		return err
+	}
+	if _, err := b.dataW.WriteString(id); err != nil {
+		return err
+	}
+	b.buf = append(b.buf, idRecord{hash: hashID(id), offset: b.offset})
+	b.offset += uint64(n + len(id))
+	b.store.count++
+	if len(b.buf) == idRunSize {
+		return b.spill()
+	}
+	return nil
+}
+
+// Writes the buffered records to a sorted run file
+func (b *idStoreBuilder) spill() error {
+	sort.Slice(b.buf, func(i, j int) bool { return b.buf[i].hash < b.buf[j].hash })
+	path := filepath.Join(b.store.dir, fmt.Sprintf("run-%d", len(b.runs)))
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, r := range b.buf {
+		writeIDRecord(w, r)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	b.runs = append(b.runs, path)
+	b.buf = b.buf[:0]
+	return f.Close()
+}
+
+// Merges the runs into the index and builds the Bloom filter
+func (b *idStoreBuilder) finish(fp float64) (*idStore, error) {
+	if err := b.dataW.Flush(); err != nil {
+		return nil, err
+	}
+	if len(b.buf) > 0 {
+		if err := b.spill(); err != nil {
+			return nil, err
+		}
+	}
+	s := b.store
+	s.bloom = newBloomFilter(s.count, fp)
+
+	index, err := os.Create(filepath.Join(s.dir, "ids.idx"))
+	if err != nil {
+		return nil, err
+	}
+	s.index = index
+	w := bufio.NewWriter(index)
+
+	h := &runHeap{}
+	for _, path := range b.runs {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		run := &idRun{r: bufio.NewReader(f)}
+		if run.next() {
+			heap.Push(h, run)
+		}
+	}
+	for h.Len() > 0 {
+		run := (*h)[0]
+		writeIDRecord(w, run.head)
+		s.bloom.add(run.head.hash)
+		if run.next() {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Discards a partially built store
+func (b *idStoreBuilder) abort() {
+	b.store.close()
+}
+
+func writeIDRecord(w *bufio.Writer, r idRecord) {
+	var rec [idRecordSize]byte
+	binary.BigEndian.PutUint64(rec[:8], r.hash)
+	binary.BigEndian.PutUint64(rec[8:], r.offset)
+	w.Write(rec[:])
+}
+
+// A sorted run being merged
+type idRun struct {
+	r    *bufio.Reader
+	head idRecord
+}
+
+func (r *idRun) next() bool {
+	var rec [idRecordSize]byte
+	if _, err := io.ReadFull(r.r, rec[:]); err != nil {
+		return false
+	}
+	r.head = idRecord{hash: binary.BigEndian.Uint64(rec[:8]), offset: binary.BigEndian.Uint64(rec[8:])}
+	return true
+}
+
+type runHeap []*idRun
+
+func (h runHeap) Len() int           { return len(h) }
+func (h runHeap) Less(i, j int) bool { return h[i].head.hash < h[j].head.hash }
+func (h runHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)        { *h = append(*h, x.(*idRun)) }
+func (h *runHeap) Pop() any {
+	old := *h
+	run := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return run
+}
+
+// Reports whether id is in the set, checking the Bloom filter first and
+// then binary searching the index for the exact ID
+func (s *idStore) contains(id string) bool {
+	h := hashID(id)
+	if !s.bloom.mayContain(h) {
+		return false
+	}
+	i := sort.Search(s.count, func(i int) bool {
+		r, err := s.record(i)
+		return err != nil || r.hash >= h
+	})
+	for ; i < s.count; i++ {
+		r, err := s.record(i)
+		if err != nil || r.hash != h {
+			return false
+		}
+		if stored, err := s.readID(r.offset); err == nil && stored == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *idStore) record(i int) (idRecord, error) {
+	var rec [idRecordSize]byte
+	if _, err := s.index.ReadAt(rec[:], int64(i)*idRecordSize); err != nil {
+		return idRecord{}, err
+	}
+	return idRecord{hash: binary.BigEndian.Uint64(rec[:8]), offset: binary.BigEndian.Uint64(rec[8:])}, nil
+}
+
+func (s *idStore) readID(offset uint64) (string, error) {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n, err := s.data.ReadAt(lenBuf[:], int64(offset))
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	length, size := binary.Uvarint(lenBuf[:n])
+	if size <= 0 {
+		return "", fmt.Errorf("corrupt ID store at offset %d", offset)
+	}
+	id := make([]byte, length)
+	if _, err := s.data.ReadAt(id, int64(offset)+int64(size)); err != nil {
+		return "", err
+	}
+	return string(id), nil
+}
+
+// Closes and removes the store's files
+func (s *idStore) close() {
+	if s.data != nil {
+		s.data.Close()
+	}
+	if s.index != nil {
+		s.index.Close()
+	}
+	os.RemoveAll(s.dir)
+}
+
+// Builds a matcher whose literal IDs live in an on-disk idStore, streaming
+// them from r so the full list is never held in memory. Returns the number
+// of IDs read.
+func newBloomMatcher(r io.Reader, opts options) (*matcher, int, error) {
+	m, err := newMatcher(nil, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	b, err := newIDStoreBuilder()
+	if err != nil {
+		return nil, 0, err
+	}
+	count := 0
+	err = scanIDs(r, false, opts.headerMode(), func(id string) error {
+		count++
+		id = m.normalize(id)
+		if opts.refWildcard && strings.Contains(id, "*") {
+			m.addWildcard(id)
+			return nil
+		}
+		return b.add(id)
+	})
+	if err != nil {
+		b.abort()
+		return nil, 0, err
+	}
+	if m.store, err = b.finish(opts.bloomFP); err != nil {
+		b.abort()
+		return nil, 0, err
+	}
+	return m, count, nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Re-serializes an entry in a stable form so that formatting differences in
+// the source (attribute order, indentation between elements, quoting,
+// escaping and the choice of namespace prefixes) do not change it
+func canonicalize(raw string) (string, error) {
+	decoder := newDecoder(strings.NewReader(raw))
+	var buf bytes.Buffer
+	encoder := xml.NewEncoder(&buf)
+
+	// whitespace between elements is formatting, not content, unless the
+	// element also holds text, like the space in <p><b>a</b> <i>b</i></p>
+	var tokens []xml.Token
+	var open []int // indexes in tokens of the open start elements
+	mixed := make(map[int]bool)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return "", err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			open = append(open, len(tokens))
+		case xml.EndElement:
+			open = open[:len(open)-1]
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 && len(open) > 0 {
+				mixed[open[len(open)-1]] = true
+			}
+		}
+		tokens = append(tokens, xml.CopyToken(token))
+	}
+
+	for i, token := range tokens {
+		switch t := token.(type) {
+		case xml.StartElement:
+			open = append(open, i)
+			// the encoder declares each element's namespace itself
+			var attrs []xml.Attr
+			for _, a := range t.Attr {
+				if _, ok := nsDecl(a); !ok {
+					attrs = append(attrs, a)
+				}
+			}
+			sort.Slice(attrs, func(i, j int) bool {
+				if attrs[i].Name.Space != attrs[j].Name.Space {
+					return attrs[i].Name.Space < attrs[j].Name.Space
+				}
+				return attrs[i].Name.Local < attrs[j].Name.Local
+			})
+			t.Attr = attrs
+			token = t
+		case xml.EndElement:
+			open = open[:len(open)-1]
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) == 0 && (len(open) == 0 || !mixed[open[len(open)-1]]) {
+				continue
+			}
+		case xml.Comment, xml.ProcInst, xml.Directive:
+			continue
+		}
+		if err := encoder.EncodeToken(token); err != nil {
+			return "", err
+		}
+	}
+
+	if err := encoder.Flush(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Returns the hex SHA-256 of an entry's canonical form
+func hashEntry(raw string) (string, error) {
+	canonical, err := canonicalize(raw)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Adds an attribute to the root element of a captured entry
+func addAttr(raw, name, value string) string {
+	decoder := newDecoder(strings.NewReader(raw))
+	token, err := decoder.RawToken()
+	for err == nil {
+		if _, ok := token.(xml.StartElement); ok {
+			break
+		}
+		token, err = decoder.RawToken()
+	}
+	if err != nil {
+		return raw
+	}
+	end := tagInsertAt(raw[:decoder.InputOffset()])
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(value))
+	return raw[:end] + " " + name + `="` + escaped.String() + `"` + raw[end:]
+}
+
+// Stamps each entry with the hash of its canonical form, for cheap change
+// detection between deliveries
+func addHashes(entries []entry, attr string) ([]entry, error) {
+	for i, e := range entries {
+		sum, err := hashEntry(e.raw)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].raw = addAttr(e.raw, attr, sum)
+	}
+	return entries, nil
+}
+
+const xmlNamespaceURI = "http://www.w3.org/XML/1998/namespace"
+
+// Serializes an entry as Exclusive XML Canonicalization (without comments):
+// double-quoted attributes in canonical order, namespace declarations only
+// where they are first used, C14N escaping, and no comments. Whitespace is
+// kept as-is, as the spec requires.
+func c14n(raw string) (string, error) {
+	decoder := newDecoder(strings.NewReader(raw))
+	var buf bytes.Buffer
+
+	// prefix -> URI bindings declared in the entry, and those already
+	// rendered in the output, per open element
+	type scope struct {
+		declared map[string]string
+		rendered map[string]string
+		qname    string
+	}
+	stack := []scope{{declared: map[string]string{"xml": xmlNamespaceURI}, rendered: map[string]string{"": ""}}}
+
+	lookup := func(m func(scope) map[string]string, prefix string) (string, bool) {
+		for i := len(stack) - 1; i >= 0; i-- {
+			if uri, ok := m(stack[i])[prefix]; ok {
+				return uri, true
+			}
+		}
+		return "", false
+	}
+	declared := func(s scope) map[string]string { return s.declared }
+	rendered := func(s scope) map[string]string { return s.rendered }
+
+	// finds a prefix bound to uri, preferring the default namespace for
+	// elements; attributes can't use the default namespace
+	prefixFor := func(uri string, allowDefault bool) (string, bool) {
+		if uri == xmlNamespaceURI {
+			return "xml", true
+		}
+		if allowDefault {
+			if d, ok := lookup(declared, ""); ok && d == uri {
+				return "", true
+			}
+		}
+		for i := len(stack) - 1; i >= 0; i-- {
+			for prefix, u := range stack[i].declared {
+				if u == uri && prefix != "" {
+					if current, _ := lookup(declared, prefix); current == uri {
+						return prefix, true
+					}
+				}
+			}
+		}
+		return "", false
+	}
+
+	generated := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return "", err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			s := scope{declared: map[string]string{}, rendered: map[string]string{}}
+			var attrs []xml.Attr
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == "xmlns":
+					s.declared[a.Name.Local] = a.Value
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					s.declared[""] = a.Value
+				default:
+					attrs = append(attrs, a)
+				}
+			}
+			stack = append(stack, s)
+			top := &stack[len(stack)-1]
+
+			// the namespaces this element visibly uses
+			used := map[string]string{}
+			elemPrefix := ""
+			if t.Name.Space != "" {
+				p, ok := prefixFor(t.Name.Space, true)
+				if !ok {
+					top.declared[""] = t.Name.Space
+				}
+				elemPrefix = p
+			}
+			used[elemPrefix] = t.Name.Space
+
+			type renderedAttr struct {
+				uri, local, qname, value string
+			}
+			var out []renderedAttr
+			for _, a := range attrs {
+				qname := a.Name.Local
+				if a.Name.Space != "" {
+					p, ok := prefixFor(a.Name.Space, false)
+					if !ok {
+						generated++
+						p = fmt.Sprintf("ns%d", generated)
+						top.declared[p] = a.Name.Space
+					}
+					qname = p + ":" + a.Name.Local
+					if p != "xml" {
+						used[p] = a.Name.Space
+					}
+				}
+				out = append(out, renderedAttr{a.Name.Space, a.Name.Local, qname, a.Value})
+			}
+
+			qname := t.Name.Local
+			if elemPrefix != "" {
+				qname = elemPrefix + ":" + t.Name.Local
+			}
+			top.qname = qname
+
+			// declarations not already in effect in the output
+			var prefixes []string
+			for p, uri := range used {
+				if current, ok := lookup(rendered, p); !ok || current != uri {
+					prefixes = append(prefixes, p)
+				}
+			}
+			sort.Strings(prefixes)
+
+			buf.WriteString("<" + qname)
+			for _, p := range prefixes {
+				top.rendered[p] = used[p]
+				if p == "" {
+					buf.WriteString(` xmlns="` + c14nAttrEscape(used[p]) + `"`)
+				} else {
+					buf.WriteString(" xmlns:" + p + `="` + c14nAttrEscape(used[p]) + `"`)
+				}
+			}
+			sort.Slice(out, func(i, j int) bool {
+				if out[i].uri != out[j].uri {
+					return out[i].uri < out[j].uri
+				}
+				return out[i].local < out[j].local
+			})
+			for _, a := range out {
+				buf.WriteString(" " + a.qname + `="` + c14nAttrEscape(a.value) + `"`)
+			}
+			buf.WriteString(">")
+		case xml.EndElement:
+			top := stack[len(stack)-1]
+			buf.WriteString("</" + top.qname + ">")
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			buf.WriteString(c14nTextEscape(string(t)))
+		case xml.ProcInst:
+			buf.WriteString("<?" + t.Target)
+			if len(t.Inst) > 0 {
+				buf.WriteString(" " + string(t.Inst))
+			}
+			buf.WriteString("?>")
+		}
+	}
+	return buf.String(), nil
+}
+
+var c14nTextReplacer = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+
+var c14nAttrReplacer = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+
+func c14nTextEscape(s string) string {
+	return c14nTextReplacer.Replace(s)
+}
+
+func c14nAttrEscape(s string) string {
+	return c14nAttrReplacer.Replace(s)
+}
+
+// Rewrites each entry in exclusive canonical form
+func canonicalizeEntries(entries []entry) ([]entry, error) {
+	for i, e := range entries {
+		canonical, err := c14n(e.raw)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].raw = canonical
+	}
+	return entries, nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// A character encoding inputs may be read in and output files written in,
+// besides UTF-8
+type charset struct {
+	name      string     // as written in XML declarations
+	table     *[256]rune // the character of each byte, for single-byte charsets
+	bigEndian bool       // for UTF-16
+}
+
+func (c *charset) utf16() bool {
+	return c.table == nil
+}
+
+var (
+	latin1Table  [256]rune
+	cp1252Table  [256]rune
+	cp1252Extras = [32]rune{
+		'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8D, 'Ž', 0x8F,
+		0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9D, 'ž', 'Ÿ',
+	}
+)
+
+func init() {
+	for i := range 256 {
+		latin1Table[i] = rune(i)
+		cp1252Table[i] = rune(i)
+	}
+	copy(cp1252Table[0x80:0xA0], cp1252Extras[:])
+}
+
+// Finds a charset by the names XML declarations and -encoding use for it,
+// case-insensitively. UTF-8 and its subset US-ASCII give nil.
+func lookupCharset(name string) (*charset, error) {
+	switch strings.ToUpper(strings.TrimSpace(name)) {
+	case "", "UTF-8", "UTF8", "US-ASCII", "ASCII":
+		return nil, nil
+	case "ISO-8859-1", "ISO8859-1", "ISO_8859-1", "LATIN1", "LATIN-1", "L1":
+		return &charset{name: "ISO-8859-1", table: &latin1Table}, nil
+	case "WINDOWS-1252", "CP1252":
+		return &charset{name: "windows-1252", table: &cp1252Table}, nil
+	case "UTF-16", "UTF-16LE":
+		return &charset{name: "UTF-16"}, nil
+	case "UTF-16BE":
+		return &charset{name: "UTF-16", bigEndian: true}, nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %q (use UTF-8, ISO-8859-1, windows-1252, UTF-16LE or UTF-16BE)", name)
+}
+
+// For xml.Decoder.CharsetReader, so files declaring another encoding, like
+// output written with -output-encoding, can be read back
+func charsetReader(label string, input io.Reader) (io.Reader, error) {
+	c, err := lookupCharset(label)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return input, nil
+	}
+	return c.newReader(input), nil
+}
+
+var declaredEncoding = regexp.MustCompile(`^\s*<\?xml[^>]*?\sencoding\s*=\s*["']([^"']*)["']`)
+
+// Works out the encoding of a file from its first bytes: a byte order mark,
+// UTF-16 text without one, or the XML declaration
+func detectCharset(head []byte) (*charset, error) {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xEF, 0xBB, 0xBF}):
+		return nil, nil
+	case bytes.HasPrefix(head, []byte{0xFF, 0xFE}), bytes.HasPrefix(head, []byte{'<', 0, '?', 0}):
+		return &charset{name: "UTF-16"}, nil
+	case bytes.HasPrefix(head, []byte{0xFE, 0xFF}), bytes.HasPrefix(head, []byte{0, '<', 0, '?'}):
+		return &charset{name: "UTF-16", bigEndian: true}, nil
+	}
+	if m := declaredEncoding.FindSubmatch(head); m != nil {
+		return lookupCharset(string(m[1]))
+	}
+	return nil, nil
+}
+
+// Replaces the encoding an XML declaration names, adding one if it has none
+func setDeclaredEncoding(text, name string) string {
+	if m := declaredEncoding.FindStringSubmatchIndex(text); m != nil {
+		return text[:m[2]] + name + text[m[3]:]
+	}
+	if strings.HasPrefix(text, "<?xml") {
+		if end := strings.Index(text, "?>"); end != -1 {
+			return text[:end] + ` encoding="` + name + `"` + text[end:]
+		}
+	}
+	return text
+}
+
+// Makes a UTF-8 copy in dir of an input in another encoding, declaring
+// UTF-8, so entries can be copied from it byte for byte. override is the
+// -encoding to read it as; by default the encoding is detected. Returns the
+// path to read: the input itself when it is UTF-8 already.
+func utf8Input(path, override, dir string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, 64*1024)
+	head, err := r.Peek(1024)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", err
+	}
+	var c *charset
+	if override != "" {
+		c, err = lookupCharset(override)
+	} else {
+		c, err = detectCharset(head)
+	}
+	if err != nil {
+		return "", err
+	}
+	if c == nil {
+		return path, nil
+	}
+	fmt.Printf("Converting the input from %s to UTF-8\n", c.name)
+
+	dest := filepath.Join(dir, filepath.Base(path))
+	out, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(out)
+	decoded := bufio.NewReaderSize(c.newReader(r), 64*1024)
+	// the declaration is at the very start, within the first block
+	first, err := decoded.Peek(4096)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		out.Close()
+		return "", err
+	}
+	text := setDeclaredEncoding(string(first), "UTF-8")
+	decoded.Discard(len(first))
+	w.WriteString(text)
+	_, err = io.Copy(w, decoded)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// A whole file's text in UTF-8, declaring UTF-8, whatever it was written in
+func toUTF8(data []byte) ([]byte, error) {
+	c, err := detectCharset(data)
+	if err != nil || c == nil {
+		return data, err
+	}
+	decoded, err := io.ReadAll(c.newReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(setDeclaredEncoding(string(decoded), "UTF-8")), nil
+}
+
+// Decodes text in the charset to UTF-8
+func (c *charset) newReader(r io.Reader) io.Reader {
+	return &charsetDecoder{c: c, r: r, first: true}
+}
+
+type charsetDecoder struct {
+	c     *charset
+	r     io.Reader
+	in    []byte // undecoded bytes: half a UTF-16 code unit or surrogate pair
+	out   []byte // decoded bytes not yet read
+	first bool   // a UTF-16 byte order mark may come next
+	err   error
+}
+
+func (d *charsetDecoder) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			if d.err == io.EOF && len(d.in) > 0 {
+				d.in = nil
+				return 0, fmt.Errorf("%s text ends in the middle of a character", d.c.name)
+			}
+			return 0, d.err
+		}
+		buf := make([]byte, 32*1024)
+		n, err := d.r.Read(buf)
+		d.err = err
+		d.decode(append(d.in, buf[:n]...))
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func (d *charsetDecoder) decode(in []byte) {
+	d.in = nil
+	if !d.c.utf16() {
+		for _, b := range in {
+			d.out = utf8.AppendRune(d.out, d.c.table[b])
+		}
+		return
+	}
+	for len(in) >= 2 {
+		u := d.unit(in)
+		if d.first {
+			d.first = false
+			if u == 0xFEFF {
+				in = in[2:]
+				continue
+			}
+			if u == 0xFFFE {
+				// a byte order mark the other way round
+				d.c = &charset{name: d.c.name, bigEndian: !d.c.bigEndian}
+				in = in[2:]
+				continue
+			}
+		}
+		if utf16.IsSurrogate(rune(u)) {
+			if len(in) < 4 {
+				break
+			}
+			d.out = utf8.AppendRune(d.out, utf16.DecodeRune(rune(u), rune(d.unit(in[2:]))))
+			in = in[4:]
+			continue
+		}
+		d.out = utf8.AppendRune(d.out, rune(u))
+		in = in[2:]
+	}
+	d.in = append([]byte(nil), in...)
+}
+
+func (d *charsetDecoder) unit(b []byte) uint16 {
+	if d.c.bigEndian {
+		return uint16(b[0])<<8 | uint16(b[1])
+	}
+	return uint16(b[1])<<8 | uint16(b[0])
+}
+
+// Encodes UTF-8 text in the charset. Each Write must hold whole characters;
+// those the charset lacks are written as character references.
+func (c *charset) newWriter(w io.Writer) io.Writer {
+	return &charsetEncoder{c: c, w: w}
+}
+
+type charsetEncoder struct {
+	c   *charset
+	w   io.Writer
+	buf []byte
+}
+
+func (e *charsetEncoder) Write(p []byte) (int, error) {
+	e.buf = e.buf[:0]
+	for _, r := range string(p) {
+		if e.c.utf16() {
+			if r >= 0x10000 {
+				r1, r2 := utf16.EncodeRune(r)
+				e.buf = e.c.appendUnit(e.c.appendUnit(e.buf, uint16(r1)), uint16(r2))
+			} else {
+				e.buf = e.c.appendUnit(e.buf, uint16(r))
+			}
+			continue
+		}
+		if b, ok := e.c.encodeByte(r); ok {
+			e.buf = append(e.buf, b)
+		} else {
+			e.buf = append(e.buf, "&#"+strconv.Itoa(int(r))+";"...)
+		}
+	}
+	if _, err := e.w.Write(e.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *charset) appendUnit(b []byte, u uint16) []byte {
+	if c.bigEndian {
+		return append(b, byte(u>>8), byte(u))
+	}
+	return append(b, byte(u), byte(u>>8))
+}
+
+func (c *charset) encodeByte(r rune) (byte, bool) {
+	if r < 0x80 || (r < 0x100 && c.table[r] == r) {
+		return byte(r), true
+	}
+	for i, t := range c.table[0x80:0xA0] {
+		if t == r {
+			return byte(0x80 + i), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Checkpoint interval used by -resume when -checkpoint is not given
+const defaultCheckpointEvery = 5 * time.Minute
+
+// checkpoint.json: how far a run got, written periodically so an
+// interrupted run can continue with -resume
+type checkpoint struct {
+	Input     string    `json:"input"`
+	InputSize int64     `json:"input_size"`
+	Offset    int64     `json:"offset"`   // where the next unread token starts
+	Open      []string  `json:"open"`     // raw start tags of the elements open at offset
+	Entries   int       `json:"entries"`  // entries captured so far
+	LogSize   int64     `json:"log_size"` // bytes of checkpoint.entries they take
+	SavedAt   time.Time `json:"saved_at"`
+}
+
+// Saves a run's progress: every captured entry is appended to
+// checkpoint.entries, and checkpoint.json records the input offset reached
+// and how much of that log it covers. Resuming replays the logged entries
+// through the same emit chain and continues parsing from the offset.
+type checkpointer struct {
+	dir       string
+	every     time.Duration
+	last      time.Time
+	input     string
+	inputSize int64
+
+	log     *os.File
+	w       *bufio.Writer
+	logSize int64
+	entries int
+
+	resume *checkpoint // the checkpoint being resumed from, or nil
+}
+
+func newCheckpointer(dir string, every time.Duration, resume bool, input string) (*checkpointer, error) {
+	info, err := os.Stat(input)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("Error creating output directory: %v", err)
+	}
+	cp := &checkpointer{dir: dir, every: every, last: time.Now(), input: input, inputSize: info.Size()}
+
+	flags := os.O_CREATE | os.O_RDWR | os.O_TRUNC
+	if resume {
+		content, err := os.ReadFile(filepath.Join(dir, "checkpoint.json"))
+		switch {
+		case os.IsNotExist(err):
+			fmt.Println("No checkpoint found, starting from the beginning")
+		case err != nil:
+			return nil, err
+		default:
+			var saved checkpoint
+			if err := json.Unmarshal(content, &saved); err != nil {
+				return nil, fmt.Errorf("invalid checkpoint: %v", err)
+			}
+			if saved.InputSize != cp.inputSize {
+				return nil, fmt.Errorf("the input has changed since the checkpoint (%d bytes, now %d)", saved.InputSize, cp.inputSize)
+			}
+			cp.resume = &saved
+			flags = os.O_RDWR
+		}
+	}
+
+	if cp.log, err = os.OpenFile(filepath.Join(dir, "checkpoint.entries"), flags, 0644); err != nil {
+		return nil, err
+	}
+	if cp.resume != nil {
+		// drop entries logged after the checkpoint was saved; they are
+		// captured again from the offset
+		if err := cp.log.Truncate(cp.resume.LogSize); err != nil {
+			cp.log.Close()
+			return nil, err
+		}
+		cp.logSize, cp.entries = cp.resume.LogSize, cp.resume.Entries
+	}
+	if _, err := cp.log.Seek(cp.logSize, io.SeekStart); err != nil {
+		cp.log.Close()
+		return nil, err
+	}
+	cp.w = bufio.NewWriter(cp.log)
+	return cp, nil
+}
+
+// Feeds the entries logged before the checkpoint to emit and rejected
+func (cp *checkpointer) replay(emit, rejected func(entry) error) error {
+	if cp.resume == nil {
+		return nil
+	}
+	fmt.Printf("Resuming from input offset %d with %d entries already captured\n", cp.resume.Offset, cp.resume.Entries)
+	r := bufio.NewReader(io.NewSectionReader(cp.log, 0, cp.resume.LogSize))
+	for {
+		kind, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		offset, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		var fields [2]string
+		for i := range fields {
+			size, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			buf := make([]byte, size)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return err
+			}
+			fields[i] = string(buf)
+		}
+		e := entry{ref: fields[0], raw: fields[1], offset: int64(offset)}
+		if kind == 'r' {
+			if rejected != nil {
+				err = rejected(e)
+			}
+		} else {
+			err = emit(e)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Appends a captured entry to the log; kind is 'm' for a match or 'r' for a
+// rejected entry kept by -split
+func (cp *checkpointer) record(kind byte, e entry) error {
+	cp.w.WriteByte(kind)
+	var buf [binary.MaxVarintLen64]byte
+	size := binary.PutUvarint(buf[:], uint64(e.offset))
+	cp.w.Write(buf[:size])
+	n := int64(1 + size)
+	for _, s := range []string{e.ref, e.raw} {
+		size := binary.PutUvarint(buf[:], uint64(len(s)))
+		cp.w.Write(buf[:size])
+		if _, err := cp.w.WriteString(s); err != nil {
+			return fmt.Errorf("Error writing checkpoint: %v", err)
+		}
+		n += int64(size + len(s))
+	}
+	cp.logSize += n
+	cp.entries++
+	return nil
+}
+
+// Reports whether a checkpoint is due
+func (cp *checkpointer) due() bool {
+	return time.Since(cp.last) >= cp.every
+}
+
+// Writes checkpoint.json for the input offset reached, with the start tags
+// of the elements open there
+func (cp *checkpointer) save(offset int64, open []string) error {
+	if err := cp.w.Flush(); err != nil {
+		return fmt.Errorf("Error writing checkpoint: %v", err)
+	}
+	if err := cp.log.Sync(); err != nil {
+		return fmt.Errorf("Error writing checkpoint: %v", err)
+	}
+	content, err := json.MarshalIndent(checkpoint{
+		Input:     cp.input,
+		InputSize: cp.inputSize,
+		Offset:    offset,
+		Open:      open,
+		Entries:   cp.entries,
+		LogSize:   cp.logSize,
+		SavedAt:   time.Now().UTC(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(cp.dir, "checkpoint.json"), append(content, '\n')); err != nil {
+		return fmt.Errorf("Error writing checkpoint: %v", err)
+	}
+	cp.last = time.Now()
+	fmt.Printf("Checkpoint saved at input offset %d (%d entries captured)\n", offset, cp.entries)
+	return nil
+}
+
+// Closes the log, keeping the checkpoint for a later -resume
+func (cp *checkpointer) close() {
+	cp.w.Flush()
+	cp.log.Close()
+}
+
+// Removes the checkpoint, and the partial.json of a run it continued, once
+// the run has completed
+func (cp *checkpointer) done() {
+	cp.log.Close()
+	os.Remove(filepath.Join(cp.dir, "checkpoint.entries"))
+	os.Remove(filepath.Join(cp.dir, "checkpoint.json"))
+	os.Remove(filepath.Join(cp.dir, "partial.json"))
+}
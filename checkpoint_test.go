@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A context that reports itself cancelled once Err has been asked a number
+// of times, to interrupt a run part way through its input
+type cancelAfter struct {
+	context.Context
+	checks int
+}
+
+func (c *cancelAfter) Err() error {
+	if c.checks--; c.checks < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestInterruptAndResume(t *testing.T) {
+	var doc, ids strings.Builder
+	doc.WriteString("<catalog>\n")
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&doc, "<book n=\"%d\"><title>t%d</title></book>\n", i, i)
+		if i%3 == 0 {
+			fmt.Fprintln(&ids, i)
+		}
+	}
+	doc.WriteString("</catalog>\n")
+	dir := testDir(t, map[string]string{"in.xml": doc.String(), "ids.csv": ids.String()})
+	output := filepath.Join(dir, "output")
+
+	opts := testOptions(t, "-node", "book", "-ref", "@n", "-csv", "ids.csv", "-checkpoint", "1h")
+	opts.inputPath = filepath.Join(dir, "in.xml")
+	summary, err := run(&cancelAfter{Context: context.Background(), checks: 20}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !summary.partial || !summary.interrupted {
+		t.Fatalf("the run was not cut short: %+v", summary)
+	}
+	if summary.matches == 0 || summary.matches >= 6667 {
+		t.Fatalf("interrupted after %d matches, want some but not all", summary.matches)
+	}
+	for _, name := range []string{"checkpoint.json", "checkpoint.entries", "partial.json", "book_@n_part-1.xml"} {
+		if _, err := os.Stat(filepath.Join(output, name)); err != nil {
+			t.Fatalf("after the interrupted run: %v", err)
+		}
+	}
+
+	opts = testOptions(t, "-node", "book", "-ref", "@n", "-csv", "ids.csv", "-resume")
+	opts.inputPath = filepath.Join(dir, "in.xml")
+	summary, err = run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("resuming: %v", err)
+	}
+	if summary.partial {
+		t.Fatal("the resumed run was cut short")
+	}
+	content, err := os.ReadFile(filepath.Join(output, "book_@n_part-1.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(content), "<book "); n != 6667 {
+		t.Errorf("the resumed run wrote %d entries, want 6667", n)
+	}
+	for i := 0; i < 20000; i += 3 {
+		if !strings.Contains(string(content), fmt.Sprintf(`<book n="%d">`, i)) {
+			t.Fatalf("entry %d is missing from the resumed output", i)
+		}
+	}
+	for _, name := range []string{"checkpoint.json", "checkpoint.entries", "partial.json"} {
+		if _, err := os.Stat(filepath.Join(output, name)); err == nil {
+			t.Errorf("%s was left after the run completed", name)
+		}
+	}
+}
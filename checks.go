@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// One validation rule in a -checks file
+type check struct {
+	Name     string   `json:"name"`
+	Field    string   `json:"field"` // child path or @attr, like -sort-by
+	Required bool     `json:"required"`
+	Pattern  string   `json:"pattern"`
+	Min      *float64 `json:"min"`
+	Max      *float64 `json:"max"`
+
+	path *pathExpr
+	re   *regexp.Regexp
+}
+
+// Reads a checks file, e.g.
+//
+//	{"checks": [
+//	  {"name": "has-title", "field": "title", "required": true},
+//	  {"name": "isbn-13", "field": "isbn", "pattern": "^[0-9]{13}$"},
+//	  {"name": "price", "field": "price", "min": 0, "max": 10000}
+//	]}
+func loadChecks(path string) ([]*check, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f struct {
+		Checks []*check `json:"checks"`
+	}
+	if err := json.Unmarshal(content, &f); err != nil {
+		return nil, fmt.Errorf("invalid checks file %s: %v", path, err)
+	}
+	if len(f.Checks) == 0 {
+		return nil, fmt.Errorf("checks file %s has no checks", path)
+	}
+	for _, c := range f.Checks {
+		if c.Field == "" {
+			return nil, fmt.Errorf("check %q: field is required", c.Name)
+		}
+		if c.Name == "" {
+			c.Name = c.Field
+		}
+		c.path = parseFieldPath(c.Field)
+		if c.Pattern != "" {
+			if c.re, err = regexp.Compile(c.Pattern); err != nil {
+				return nil, fmt.Errorf("check %q: invalid pattern: %v", c.Name, err)
+			}
+		}
+	}
+	return f.Checks, nil
+}
+
+// A failed check for one entry
+type violation struct {
+	check string
+	field string
+	value string
+	msg   string
+}
+
+// Evaluates the check against an entry
+func (c *check) validate(n *node) []violation {
+	var found []violation
+	fail := func(value, msg string) {
+		found = append(found, violation{check: c.Name, field: c.Field, value: value, msg: msg})
+	}
+
+	values := c.path.values(n, nil)
+	present := false
+	for _, v := range values {
+		if v != "" {
+			present = true
+		}
+	}
+	if !present {
+		if c.Required {
+			fail("", "missing")
+		}
+		return found
+	}
+
+	for _, v := range values {
+		if c.re != nil && !c.re.MatchString(v) {
+			fail(v, fmt.Sprintf("does not match %s", c.Pattern))
+		}
+		if c.Min == nil && c.Max == nil {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		switch {
+		case err != nil:
+			fail(v, "not a number")
+		case c.Min != nil && f < *c.Min:
+			fail(v, fmt.Sprintf("below minimum %g", *c.Min))
+		case c.Max != nil && f > *c.Max:
+			fail(v, fmt.Sprintf("above maximum %g", *c.Max))
+		}
+	}
+	return found
+}
+
+// Runs the checks, and the -xsd schema if given, over the entries, writing
+// every violation to <base>_violations.csv with the entry's position and ref
+// value so it can be traced back to the source record. Schema errors are
+// reported under the check "xsd". With drop, invalid entries are removed
+// from the result.
+func validateEntries(entries []entry, checks []*check, schema *xsdSchema, out outputTarget, baseName string, drop bool) ([]entry, []string, error) {
+	var schemaErrors [][]string
+	if schema != nil {
+		var err error
+		if schemaErrors, err = schema.entries(entries); err != nil {
+			return nil, nil, fmt.Errorf("running xmllint: %v", err)
+		}
+	}
+	rows := [][]string{{"entry", "ref", "check", "field", "value", "message"}}
+	failures := make(map[string]int)
+	valid := entries[:0]
+	invalid := 0
+	for i, e := range entries {
+		n, err := parseNode(e.raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		var found []violation
+		for _, c := range checks {
+			found = append(found, c.validate(n)...)
+		}
+		if schemaErrors != nil {
+			for _, msg := range schemaErrors[i] {
+				found = append(found, violation{check: "xsd", msg: msg})
+			}
+		}
+		for _, v := range found {
+			failures[v.check]++
+			rows = append(rows, []string{strconv.Itoa(i + 1), e.ref, v.check, v.field, v.value, v.msg})
+		}
+		if len(found) > 0 {
+			invalid++
+			if drop {
+				continue
+			}
+		}
+		valid = append(valid, e)
+	}
+
+	fmt.Printf("%d of %d entries failed validation\n", invalid, len(entries))
+	for _, c := range checks {
+		fmt.Printf("  %s: %d violations\n", c.Name, failures[c.Name])
+	}
+	if schema != nil {
+		fmt.Printf("  xsd: %d violations\n", failures["xsd"])
+	}
+	if drop && invalid > 0 {
+		fmt.Printf("Excluded %d invalid entries from the output\n", invalid)
+	}
+	if len(rows) == 1 {
+		return valid, nil, nil
+	}
+
+	path, err := out.claim(filepath.Join(out.dir, safeFileName(baseName+"_violations.csv")))
+	if err != nil {
+		return nil, nil, err
+	}
+	if out.dryRun {
+		fmt.Printf("Would write %s\n", path)
+		return valid, nil, nil
+	}
+	if err := out.prepare(); err != nil {
+		return nil, nil, err
+	}
+	var buf bytes.Buffer
+	if err := csv.NewWriter(&buf).WriteAll(rows); err != nil {
+		return nil, nil, err
+	}
+	if err := writeFileAtomic(path, buf.Bytes()); err != nil {
+		return nil, nil, err
+	}
+	fmt.Println("Violations written to", path)
+	return valid, []string{path}, nil
+}
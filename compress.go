@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// Writes compressed chunk files on background goroutines, one per CPU, so
+// gzip compression of each chunk overlaps with parsing and with the other
+// chunks instead of running after them
+type chunkPool struct {
+	out   outputTarget
+	slots chan struct{}
+	wg    sync.WaitGroup
+
+	mu      sync.Mutex
+	results []error // per chunk, in submission order
+	failed  error   // the first failure
+}
+
+func newChunkPool(out outputTarget) *chunkPool {
+	return &chunkPool{out: out, slots: make(chan struct{}, runtime.GOMAXPROCS(0))}
+}
+
+// Starts writing a chunk, waiting while every goroutine is busy so no more
+// than one chunk per CPU is held in memory
+func (p *chunkPool) write(n int, path string, entries []entry) {
+	p.mu.Lock()
+	i := len(p.results)
+	p.results = append(p.results, nil)
+	p.mu.Unlock()
+
+	p.slots <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		err := writeToXML(path, entries, p.out.compress, p.out.root)
+		<-p.slots
+		if err != nil {
+			fmt.Printf("Error writing chunk %d to XML file: %v\n", n, err)
+		} else {
+			fmt.Printf("Captured nodes successfully written to %s\n", path)
+		}
+		p.mu.Lock()
+		p.results[i] = err
+		if err != nil && p.failed == nil {
+			p.failed = err
+		}
+		p.mu.Unlock()
+	}()
+}
+
+// Returns the first error of the chunks finished so far
+func (p *chunkPool) err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.failed
+}
+
+// Waits for every chunk, returning each one's error in submission order
+func (p *chunkPool) wait() []error {
+	p.wg.Wait()
+	return p.results
+}
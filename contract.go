@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The structure a -contract file says the input has
+type contract struct {
+	Strict   bool            `json:"strict"` // fail on elements and attributes not listed
+	Elements []*contractRule `json:"elements"`
+
+	byParent map[string][]*contractRule
+	declared map[string]bool
+}
+
+// An expected element or attribute and how often it occurs in each of its
+// parent elements
+type contractRule struct {
+	Path string `json:"path"` // slash path from the document element; @attr for an attribute
+	Min  *int   `json:"min"`  // default 1
+	Max  *int   `json:"max"`  // default unbounded
+
+	parent string
+	step   string
+
+	// what the scan found
+	parents   int // parent elements checked
+	failures  int // parents outside min..max
+	firstLine int
+	lowest    int
+	highest   int
+}
+
+// Reads a contract file, e.g.
+//
+//	{"strict": false, "elements": [
+//	  {"path": "catalog/book", "min": 1},
+//	  {"path": "catalog/book/@id"},
+//	  {"path": "catalog/book/isbn", "max": 1},
+//	  {"path": "catalog/book/price", "min": 0, "max": 1}
+//	]}
+func loadContract(path string) (*contract, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c contract
+	if err := json.Unmarshal(content, &c); err != nil {
+		return nil, fmt.Errorf("invalid contract file %s: %v", path, err)
+	}
+	if len(c.Elements) == 0 {
+		return nil, fmt.Errorf("contract file %s lists no elements", path)
+	}
+	c.byParent = make(map[string][]*contractRule)
+	c.declared = make(map[string]bool)
+	for _, r := range c.Elements {
+		r.Path = strings.Trim(r.Path, "/")
+		if r.Path == "" {
+			return nil, fmt.Errorf("contract element without a path")
+		}
+		if c.declared[r.Path] {
+			return nil, fmt.Errorf("contract lists %s twice", r.Path)
+		}
+		if i := strings.LastIndex(r.Path, "/"); i >= 0 {
+			r.parent, r.step = r.Path[:i], r.Path[i+1:]
+		} else {
+			r.step = r.Path
+		}
+		if strings.Contains(r.parent, "@") {
+			return nil, fmt.Errorf("contract path %s: only the last step can be an @attr", r.Path)
+		}
+		if r.Min == nil {
+			one := 1
+			r.Min = &one
+		}
+		if r.Max != nil && *r.Max < *r.Min {
+			return nil, fmt.Errorf("contract path %s: max is below min", r.Path)
+		}
+		c.byParent[r.parent] = append(c.byParent[r.parent], r)
+		// listing a path declares its ancestors too
+		for p := r.Path; p != ""; p = parentPath(p) {
+			c.declared[p] = true
+		}
+	}
+	return &c, nil
+}
+
+func parentPath(p string) string {
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		return p[:i]
+	}
+	return ""
+}
+
+// Records how often a rule's element or attribute occurred in one parent
+func (r *contractRule) observe(count, line int) {
+	if r.parents == 0 || count < r.lowest {
+		r.lowest = count
+	}
+	if r.parents == 0 || count > r.highest {
+		r.highest = count
+	}
+	r.parents++
+	if count < *r.Min || r.Max != nil && count > *r.Max {
+		if r.failures == 0 {
+			r.firstLine = line
+		}
+		r.failures++
+	}
+}
+
+// Scans the input, or its first limit bytes if limit is set, and compares
+// it with the contract. The differences are printed as a diff: - for
+// expectations the input breaks, + for content the contract doesn't list.
+func checkContract(filePath string, entities map[string]string, c *contract, limit int64) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	var limited *io.LimitedReader
+	if limit > 0 {
+		limited = &io.LimitedReader{R: f, N: limit}
+		r = limited
+	}
+
+	// one frame per open element, counting its children and attributes;
+	// the first stands for the document itself
+	type frame struct {
+		path   string
+		counts map[string]int
+		line   int
+	}
+	stack := []*frame{{counts: make(map[string]int)}}
+	seen := make(map[string]int)
+	complete := true
+	decoder := newInputDecoder(bufio.NewReader(r), entities)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if limited != nil && limited.N == 0 {
+				// the sample ended mid-document
+				complete = false
+				break
+			}
+			return fmt.Errorf("Error reading XML: %v", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			parent := stack[len(stack)-1]
+			path := t.Name.Local
+			if parent.path != "" {
+				path = parent.path + "/" + path
+			}
+			parent.counts[t.Name.Local]++
+			seen[path]++
+			line, _ := decoder.InputPos()
+			fr := &frame{path: path, counts: make(map[string]int), line: line}
+			for _, a := range t.Attr {
+				if a.Name.Space == "xmlns" || a.Name.Local == "xmlns" {
+					continue
+				}
+				fr.counts["@"+a.Name.Local]++
+				seen[path+"/@"+a.Name.Local]++
+			}
+			stack = append(stack, fr)
+		case xml.EndElement:
+			fr := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			for _, rule := range c.byParent[fr.path] {
+				rule.observe(fr.counts[rule.step], fr.line)
+			}
+		}
+	}
+	if complete {
+		for _, rule := range c.byParent[""] {
+			rule.observe(stack[0].counts[rule.step], 1)
+		}
+	}
+
+	var diff []string
+	for _, rule := range c.Elements {
+		if rule.failures == 0 {
+			continue
+		}
+		expected := fmt.Sprintf("%d..", *rule.Min)
+		if rule.Max != nil {
+			expected += fmt.Sprint(*rule.Max)
+		}
+		parent := "document"
+		if rule.parent != "" {
+			parent = rule.parent[strings.LastIndex(rule.parent, "/")+1:]
+		}
+		if rule.highest == 0 {
+			diff = append(diff, fmt.Sprintf("- %s: expected %s per %s, never found", rule.Path, expected, parent))
+			continue
+		}
+		diff = append(diff, fmt.Sprintf("- %s: expected %s per %s, found %d..%d; %d of %d %s elements differ (first at line %d)",
+			rule.Path, expected, parent, rule.lowest, rule.highest, rule.failures, rule.parents, parent, rule.firstLine))
+	}
+	failed := len(diff)
+
+	// content the contract doesn't list: with strict any of it fails,
+	// otherwise only new children of listed elements are reported
+	var undeclared []string
+	for path := range seen {
+		if !c.declared[path] && (c.Strict || c.declared[parentPath(path)]) {
+			undeclared = append(undeclared, path)
+		}
+	}
+	sort.Strings(undeclared)
+	for _, path := range undeclared {
+		diff = append(diff, fmt.Sprintf("+ %s: not in the contract (%d occurrences)", path, seen[path]))
+	}
+	if c.Strict {
+		failed = len(diff)
+	}
+
+	scanned := "the input"
+	if !complete {
+		scanned = fmt.Sprintf("the first %d bytes of the input", limit)
+	}
+	if len(diff) > 0 {
+		fmt.Printf("Contract differences in %s:\n", scanned)
+		for _, line := range diff {
+			fmt.Println(" ", line)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("Error: the input does not match the contract (%d differences)", failed)
+	}
+	fmt.Printf("Checked %s against the contract\n", scanned)
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// Tallies matching entries for -count and -report-unmatched, in total and
+// per matched ID
+type matchCounter struct {
+	total int
+	perID map[string]int
+}
+
+func newMatchCounter() *matchCounter {
+	return &matchCounter{perID: make(map[string]int)}
+}
+
+func (c *matchCounter) add(e entry) {
+	c.total++
+	if e.ref != "" {
+		c.perID[e.ref]++
+	}
+}
+
+// Prints the totals. When the literal ID list is known every ID is listed,
+// including those without matches, so gaps in coverage stand out; otherwise
+// only the matched values are.
+func (c *matchCounter) report(ids []string, m *matcher, literal bool) {
+	fmt.Printf("Matching entries: %d\n", c.total)
+
+	var keys []string
+	if literal && len(ids) > 0 {
+		keys = distinctIDs(ids, m)
+		covered := 0
+		for _, id := range keys {
+			if c.perID[id] > 0 {
+				covered++
+			}
+		}
+		fmt.Printf("IDs with matches: %d of %d\n", covered, len(keys))
+	} else {
+		for id := range c.perID {
+			keys = append(keys, id)
+		}
+		sort.Strings(keys)
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	fmt.Println("Matches per ID:")
+	for _, id := range keys {
+		fmt.Printf("  %s\t%d\n", id, c.perID[id])
+	}
+}
+
+// Normalizes the IDs as the matcher compares them, dropping duplicates
+func distinctIDs(ids []string, m *matcher) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		id = m.normalize(id)
+		if !seen[id] {
+			seen[id] = true
+			keys = append(keys, id)
+		}
+	}
+	return keys
+}
+
+// A report file and its CSV rows
+type idReport struct {
+	name string
+	rows [][]string
+}
+
+// Writes <base>_unmatched.csv listing the IDs never found under an id header,
+// which -csv skips so the file can be fed back in, and with multi
+// <base>_multiple.csv listing the IDs matched more than once with their counts
+func (c *matchCounter) writeReports(out outputTarget, baseName string, ids []string, m *matcher, multi bool) ([]string, int, error) {
+	var unmatched, multiple [][]string
+	for _, id := range distinctIDs(ids, m) {
+		switch n := c.perID[id]; {
+		case n == 0:
+			unmatched = append(unmatched, []string{id})
+		case n > 1:
+			multiple = append(multiple, []string{id, strconv.Itoa(n)})
+		}
+	}
+	fmt.Printf("%d IDs were not found in the XML\n", len(unmatched))
+
+	reports := []idReport{{baseName + "_unmatched.csv", append([][]string{{"id"}}, unmatched...)}}
+	if multi {
+		fmt.Printf("%d IDs matched more than once\n", len(multiple))
+		reports = append(reports, idReport{baseName + "_multiple.csv", append([][]string{{"id", "count"}}, multiple...)})
+	}
+
+	files, err := writeReportFiles(out, reports)
+	return files, len(unmatched), err
+}
+
+// Writes report files to the output folder, returning the paths written
+func writeReportFiles(out outputTarget, reports []idReport) ([]string, error) {
+	if err := out.prepare(); err != nil {
+		return nil, err
+	}
+	var written []string
+	for _, r := range reports {
+		path, err := out.claim(filepath.Join(out.dir, safeFileName(r.name)))
+		if err != nil {
+			return written, err
+		}
+		if out.dryRun {
+			fmt.Printf("Would write %s\n", path)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := csv.NewWriter(&buf).WriteAll(r.rows); err != nil {
+			return written, err
+		}
+		if err := writeFileAtomic(path, buf.Bytes()); err != nil {
+			return written, err
+		}
+		fmt.Printf("Report written to %s\n", path)
+		written = append(written, path)
+	}
+	return written, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestReportUnmatched(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"in.xml":  `<catalog><book><isbn>1</isbn></book><book><isbn>2</isbn></book></catalog>`,
+		"all.csv": "1\n2\n",
+		"ids.csv": "1\n3\n4\n",
+	})
+	tests := []struct {
+		csv  string
+		want string
+	}{
+		// the header is there even when every ID was found
+		{"all.csv", "id\n"},
+		{"ids.csv", "id\n3\n4\n"},
+	}
+	for _, test := range tests {
+		opts := testOptions(t, "-node", "book", "-ref", "isbn", "-csv", test.csv, "-report-unmatched", "-force")
+		opts.inputPath = filepath.Join(dir, "in.xml")
+		if _, err := run(context.Background(), opts); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "output", "book_isbn_unmatched.csv")
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: report:\n%s\nwant\n%s", test.csv, got, test.want)
+		}
+	}
+
+	// and -csv skips it when the report is passed back in
+	var ids []string
+	captureStdout(t, func() {
+		var err error
+		if ids, err = readCSV(filepath.Join(dir, "output", "book_isbn_unmatched.csv"), false, headerAuto); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if !slices.Equal(ids, []string{"3", "4"}) {
+		t.Errorf("read back %q, want [3 4]", ids)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Runs -decompress-cmd with r as its input, e.g. `zstd -d -c`, saving what
+// it prints to dest
+func decompress(ctx context.Context, command string, r io.Reader, dest string) error {
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	cmd := shellCommand(ctx, command)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = r, out, os.Stderr
+	runErr := cmd.Run()
+	closeErr := out.Close()
+	if runErr == nil {
+		runErr = closeErr
+	}
+	if runErr != nil {
+		os.Remove(dest)
+		return fmt.Errorf("-decompress-cmd %q failed: %v", command, runErr)
+	}
+	if info, err := os.Stat(dest); err == nil && info.Size() == 0 {
+		os.Remove(dest)
+		return fmt.Errorf("-decompress-cmd %q printed nothing; it must write the XML to stdout", command)
+	}
+	return nil
+}
+
+// The name of a file once decompressed: without its last extension, ending
+// in .xml, e.g. feed.xml.zst -> feed.xml and feed.7z -> feed.xml
+func decompressedName(path string) string {
+	name := strings.TrimSuffix(path, filepath.Ext(path))
+	if filepath.Ext(name) != ".xml" {
+		name += ".xml"
+	}
+	return name
+}
+
+// Finds a compressed XML file in dir for -decompress-cmd, named like
+// feed.xml.zst
+func findCompressedXML(dir string) (string, error) {
+	fmt.Printf("Searching for *.xml.* in dir: %s\n", dir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("Error reading directory: %v", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.Contains(entry.Name(), ".xml.") {
+			return filepath.Join(dir, entry.Name()), nil
+		}
+	}
+	return "", fmt.Errorf("No compressed .xml file (like feed.xml.zst) found in directory: %s", dir)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Tracks how many entries each ref value has had output, for -dedupe and
+// -max-per-id
+type deduper struct {
+	limit int // entries kept per ref value; 1 for -dedupe
+	seen  map[string]int
+	order []string
+}
+
+func newDeduper(limit int) *deduper {
+	return &deduper{limit: limit, seen: make(map[string]int)}
+}
+
+// Reports whether an entry with the ref value is still within the limit,
+// counting the ones over it
+func (d *deduper) keep(ref string) bool {
+	d.seen[ref]++
+	if d.seen[ref] == 1 {
+		d.order = append(d.order, ref)
+	}
+	return d.seen[ref] <= d.limit
+}
+
+// Prints the IDs seen more often than the limit and writes them to
+// <base>_duplicates.csv (for -dedupe) or <base>_over_limit.csv with the
+// number of times each was seen
+func (d *deduper) report(out outputTarget, baseName string) ([]string, error) {
+	var over []string
+	for _, ref := range d.order {
+		if d.seen[ref] > d.limit {
+			over = append(over, ref)
+		}
+	}
+	if len(over) == 0 {
+		if d.limit == 1 {
+			fmt.Println("No duplicate entries found")
+		}
+		return nil, nil
+	}
+
+	dropped := 0
+	rows := [][]string{{"id", "count"}}
+	if d.limit > 1 {
+		rows[0] = append(rows[0], "dropped")
+	}
+	for _, ref := range over {
+		dropped += d.seen[ref] - d.limit
+		row := []string{ref, strconv.Itoa(d.seen[ref])}
+		if d.limit > 1 {
+			row = append(row, strconv.Itoa(d.seen[ref]-d.limit))
+		}
+		rows = append(rows, row)
+	}
+	name := baseName + "_duplicates.csv"
+	if d.limit == 1 {
+		fmt.Printf("Dropped %d duplicate entries of %d IDs\n", dropped, len(over))
+	} else {
+		name = baseName + "_over_limit.csv"
+		fmt.Printf("Dropped %d entries over -max-per-id %d for %d IDs\n", dropped, d.limit, len(over))
+	}
+
+	// list the most repeated first
+	sort.SliceStable(over, func(i, j int) bool { return d.seen[over[i]] > d.seen[over[j]] })
+	for _, ref := range over[:min(len(over), 10)] {
+		fmt.Printf("  %s\tseen %d times\n", ref, d.seen[ref])
+	}
+	return writeReportFiles(out, []idReport{{name, rows}})
+}
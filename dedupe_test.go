@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDedupeReport(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"in.xml": `<catalog>` +
+			`<book><isbn>a,1</isbn></book><book><isbn>a,1</isbn></book>` +
+			`<book><isbn>say "b"</isbn></book><book><isbn>say "b"</isbn></book><book><isbn>say "b"</isbn></book>` +
+			`<book><isbn>c</isbn></book></catalog>`,
+		"ids.csv": ".\n",
+	})
+	// a pattern matches, and dedupes, by the ref value itself
+	opts := testOptions(t, "-node", "book", "-ref", "isbn", "-csv", "ids.csv", "-ref-regex", "-dedupe")
+	opts.inputPath = filepath.Join(dir, "in.xml")
+	if _, err := run(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "output", "book_isbn_duplicates.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "id,count\n\"a,1\",2\n\"say \"\"b\"\"\",3\n"
+	if string(got) != want {
+		t.Errorf("report:\n%s\nwant\n%s", got, want)
+	}
+}
+
+// Excluded entries match no ID, so there is nothing to count them by
+func TestDedupeExclude(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"in.xml":  `<catalog><book><isbn>1</isbn></book><book><isbn>2</isbn></book><book><isbn>3</isbn></book></catalog>`,
+		"ids.csv": "1\n",
+	})
+	for _, args := range [][]string{{"-dedupe"}, {"-max-per-id", "1"}} {
+		opts := testOptions(t, append([]string{"-node", "book", "-ref", "isbn", "-csv", "ids.csv", "-exclude", "-force"}, args...)...)
+		opts.inputPath = filepath.Join(dir, "in.xml")
+		if _, err := run(context.Background(), opts); err == nil || !strings.Contains(err.Error(), "-exclude") {
+			t.Errorf("%v: got %v, want it refused with -exclude", args, err)
+		}
+	}
+}
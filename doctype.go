@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Longest replacement text an entity may expand to, so a DOCTYPE of nested
+// entities can't blow up memory
+const maxEntityLength = 1 << 20
+
+// Past the allowance, the entity references a decoder reads may expand to at
+// most ratio times the input read, so a document repeating references to a
+// big entity can't blow up memory either
+const (
+	expansionAllowance = 16 << 20
+	expansionRatio     = 10
+)
+
+// -trust-entities: the input is trusted, so external entities and DTDs the
+// DOCTYPE refers to are loaded and entity expansion isn't limited. By default
+// only internal entities are read and nothing is fetched.
+var trustEntities atomic.Bool
+
+// An xml.Decoder for entries and output files, whose entity references have
+// been expanded, so one to an undeclared entity fails
+func newDecoder(r io.Reader) *xml.Decoder {
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = charsetReader
+	return decoder
+}
+
+// An xml.Decoder for an input, knowing the entities its DOCTYPE declares so
+// entries referring to them parse instead of failing with an undefined entity
+func newInputDecoder(r io.Reader, entities map[string]string) *xml.Decoder {
+	if len(entities) > 0 && !trustEntities.Load() {
+		r = &expansionLimit{r: r, entities: entities}
+	}
+	decoder := newDecoder(r)
+	decoder.Entity = entities
+	return decoder
+}
+
+// Replaces references to the declared entities in raw, an entry copied from
+// the input, by their escaped text, so the entry stays well-formed without
+// the DOCTYPE declaring them. Comments, CDATA sections and processing
+// instructions are left as they are.
+func expandEntities(raw string, entities map[string]string) string {
+	if len(entities) == 0 || !strings.Contains(raw, "&") {
+		return raw
+	}
+	var b strings.Builder
+	for i := 0; i < len(raw); {
+		skipped := false
+		for _, markup := range [][2]string{{"<!--", "-->"}, {"<![CDATA[", "]]>"}, {"<?", "?>"}} {
+			if !strings.HasPrefix(raw[i:], markup[0]) {
+				continue
+			}
+			end := strings.Index(raw[i+len(markup[0]):], markup[1])
+			if end == -1 {
+				b.WriteString(raw[i:])
+				return b.String()
+			}
+			end += i + len(markup[0]) + len(markup[1])
+			b.WriteString(raw[i:end])
+			i, skipped = end, true
+			break
+		}
+		if skipped {
+			continue
+		}
+		if raw[i] == '&' {
+			if semi := strings.IndexByte(raw[i:], ';'); semi > 1 {
+				name := raw[i+1 : i+semi]
+				if value, ok := entities[name]; ok && predefinedEntities[name] == "" {
+					entityEscaper.WriteString(&b, value)
+					i += semi + 1
+					continue
+				}
+			}
+		}
+		b.WriteByte(raw[i])
+		i++
+	}
+	return b.String()
+}
+
+// Escapes an entity's text for both element content and attribute values
+var entityEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;", "'", "&apos;")
+
+// Counts what the references to declared entities in the input expand to
+// before the decoder reads them, failing once that is too much
+type expansionLimit struct {
+	r        io.Reader
+	entities map[string]string
+	read     int64
+	expanded int64
+	tail     []byte // a reference cut off at the end of the last read
+}
+
+func (l *expansionLimit) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	data := p[:n]
+	if l.tail != nil {
+		data, l.tail = append(l.tail, data...), nil
+	}
+	for {
+		amp := bytes.IndexByte(data, '&')
+		if amp == -1 {
+			break
+		}
+		data = data[amp:]
+		// entity names are short; a longer one isn't declared anyway
+		semi := bytes.IndexByte(data[:min(len(data), 64)], ';')
+		if semi == -1 {
+			if len(data) < 64 && err == nil {
+				l.tail = bytes.Clone(data)
+			}
+			break
+		}
+		l.expanded += int64(len(l.entities[string(data[1:semi])]))
+		data = data[semi+1:]
+	}
+	if l.expanded > expansionAllowance && l.expanded > expansionRatio*l.read {
+		return 0, fmt.Errorf("entity references expand to %d bytes, %d times the input read; use -trust-entities if the input is trusted", l.expanded, l.expanded/l.read)
+	}
+	return n, err
+}
+
+// What comes before an input's root element: its XML declaration and
+// DOCTYPE as written, and the internal entities the DOCTYPE declares
+type prolog struct {
+	declaration string
+	doctype     string
+	entities    map[string]string
+}
+
+// Reads the prolog of an XML file. System IDs of external entities and DTDs
+// are resolved against dir, the directory of the input as given.
+func readProlog(filePath, dir string) (prolog, error) {
+	var p prolog
+	f, err := os.Open(filePath)
+	if err != nil {
+		return p, err
+	}
+	defer f.Close()
+	decoder := xml.NewDecoder(bufio.NewReader(f))
+	for {
+		from := decoder.InputOffset()
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			return p, nil
+		}
+		if err != nil {
+			return p, err
+		}
+		var text *string
+		switch t := token.(type) {
+		case xml.StartElement:
+			return p, nil
+		case xml.ProcInst:
+			if t.Target == "xml" {
+				text = &p.declaration
+			}
+		case xml.Directive:
+			if strings.HasPrefix(string(t), "DOCTYPE") {
+				if p.entities, err = parseEntities(string(t), dir); err != nil {
+					return p, fmt.Errorf("DOCTYPE: %v", err)
+				}
+				text = &p.doctype
+			}
+		}
+		if text != nil {
+			raw := make([]byte, decoder.InputOffset()-from)
+			if _, err := f.ReadAt(raw, from); err != nil {
+				return p, err
+			}
+			*text = string(raw)
+		}
+	}
+}
+
+// The declaration and DOCTYPE to start output files with, or "" when the
+// input has neither
+func (p prolog) text() string {
+	if p.doctype == "" && p.declaration == "" {
+		return ""
+	}
+	declaration := p.declaration
+	if declaration == "" {
+		declaration = strings.TrimSuffix(xml.Header, "\n")
+	}
+	if p.doctype == "" {
+		return declaration + "\n"
+	}
+	return declaration + "\n" + p.doctype + "\n"
+}
+
+// Reads the internal entities of a DOCTYPE, e.g. <!ENTITY co "Acme &#38; Co">,
+// with character references and other entities in their values expanded.
+// Parameter entities and entities that can't be expanded are left out, as
+// are external entities unless -trust-entities is set, when they are loaded
+// along with the external DTD; references to them still fail when an entry
+// uses them.
+func parseEntities(doctype, dir string) (map[string]string, error) {
+	var external []string
+	if id := doctypeSystemID.FindStringSubmatch(doctype); id != nil {
+		external = append(external, id[1]+id[2])
+		if trustEntities.Load() {
+			// declarations of the internal subset come first and are binding
+			dtd, err := loadExternal(external[0], dir)
+			if err != nil {
+				return nil, fmt.Errorf("external DTD: %v", err)
+			}
+			doctype += "\n" + dtd
+		}
+	}
+	literals := make(map[string]string)
+	for i := 0; i < len(doctype); {
+		switch c := doctype[i]; {
+		case strings.HasPrefix(doctype[i:], "<!ENTITY"):
+			name, value, system, next, ok := entityDecl(doctype, i+len("<!ENTITY"))
+			if _, seen := literals[name]; ok && !seen {
+				// the first declaration of an entity is binding
+				switch {
+				case system == "":
+					literals[name] = value
+				case trustEntities.Load():
+					text, err := loadExternal(system, dir)
+					if err != nil {
+						return nil, fmt.Errorf("external entity %s: %v", name, err)
+					}
+					literals[name] = text
+				default:
+					external = append(external, system)
+				}
+			}
+			i = next
+		case c == '"' || c == '\'':
+			// a quoted string of another declaration
+			end := strings.IndexByte(doctype[i+1:], c)
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			i += end + 2
+		default:
+			i++
+		}
+	}
+
+	defs := make(map[string]string, len(literals))
+	var expand func(name string, open map[string]bool) (string, error)
+	expand = func(name string, open map[string]bool) (string, error) {
+		if v, ok := defs[name]; ok {
+			return v, nil
+		}
+		if open[name] {
+			return "", fmt.Errorf("entity %s refers to itself", name)
+		}
+		open[name] = true
+		defer delete(open, name)
+
+		literal := literals[name]
+		var b strings.Builder
+		for {
+			amp := strings.IndexByte(literal, '&')
+			if amp == -1 {
+				b.WriteString(literal)
+				break
+			}
+			b.WriteString(literal[:amp])
+			semi := strings.IndexByte(literal[amp:], ';')
+			if semi == -1 {
+				return "", fmt.Errorf("entity %s: unterminated reference", name)
+			}
+			ref := literal[amp+1 : amp+semi]
+			literal = literal[amp+semi+1:]
+			switch {
+			case strings.HasPrefix(ref, "#"):
+				r, err := charRef(ref[1:])
+				if err != nil {
+					return "", fmt.Errorf("entity %s: %v", name, err)
+				}
+				b.WriteRune(r)
+			case predefinedEntities[ref] != "":
+				b.WriteString(predefinedEntities[ref])
+			default:
+				if _, ok := literals[ref]; !ok {
+					return "", fmt.Errorf("entity %s refers to undeclared entity %s", name, ref)
+				}
+				v, err := expand(ref, open)
+				if err != nil {
+					return "", err
+				}
+				b.WriteString(v)
+			}
+			if b.Len() > maxEntityLength && !trustEntities.Load() {
+				return "", fmt.Errorf("entity %s expands to more than %d bytes", name, maxEntityLength)
+			}
+		}
+		defs[name] = b.String()
+		return defs[name], nil
+	}
+	for name := range literals {
+		expand(name, make(map[string]bool))
+	}
+	if len(external) > 0 && !trustEntities.Load() {
+		fmt.Printf("Warning: not loading the external entities and DTDs the DOCTYPE refers to (%s); use -trust-entities if the input is trusted\n", strings.Join(external, ", "))
+	}
+	return defs, nil
+}
+
+var doctypeSystemID = regexp.MustCompile(`^DOCTYPE\s+[^\s\[>]+\s+(?:SYSTEM|PUBLIC\s+(?:"[^"]*"|'[^']*'))\s*(?:"([^"]*)"|'([^']*)')`)
+
+// Reads an external entity or DTD from its system ID, a URL or a path
+// relative to dir
+func loadExternal(systemID, dir string) (string, error) {
+	var r io.Reader
+	if u, err := url.Parse(systemID); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		client := http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Get(systemID)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("%s: %s", systemID, resp.Status)
+		}
+		r = resp.Body
+	} else {
+		path := systemID
+		if err == nil && u.Scheme == "file" {
+			path = u.Path
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		r = f
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	if data, err = toUTF8(data); err != nil {
+		return "", err
+	}
+	// without its text declaration, <?xml encoding="..."?>
+	text := string(data)
+	if strings.HasPrefix(text, "<?xml") {
+		if end := strings.Index(text, "?>"); end != -1 {
+			text = text[end+2:]
+		}
+	}
+	return text, nil
+}
+
+var predefinedEntities = map[string]string{"lt": "<", "gt": ">", "amp": "&", "apos": "'", "quot": `"`}
+
+// Reads one <!ENTITY ...> declaration from just after its keyword, returning
+// the name of a general entity with either its literal value, when it is
+// internal, or the system ID to load it from, and where the declaration ends
+func entityDecl(s string, i int) (name, value, system string, next int, ok bool) {
+	skipSpace := func() {
+		for i < len(s) && strings.IndexByte(" \t\r\n", s[i]) >= 0 {
+			i++
+		}
+	}
+	skipSpace()
+	parameter := i < len(s) && s[i] == '%'
+	if parameter {
+		i++
+		skipSpace()
+	}
+	start := i
+	for i < len(s) && strings.IndexByte(" \t\r\n\"'>", s[i]) < 0 {
+		i++
+	}
+	name = s[start:i]
+	skipSpace()
+	// an internal entity's value is its first quoted string; an external
+	// one's system ID follows SYSTEM, or PUBLIC and its public ID
+	internal := i < len(s) && (s[i] == '"' || s[i] == '\'')
+	public := strings.HasPrefix(s[i:], "PUBLIC")
+	var quoted []string
+	var unquoted strings.Builder
+	// skip to the closing >, past any quoted strings
+	for i < len(s) && s[i] != '>' {
+		if q := s[i]; q == '"' || q == '\'' {
+			end := strings.IndexByte(s[i+1:], q)
+			if end == -1 {
+				return "", "", "", len(s), false
+			}
+			quoted = append(quoted, s[i+1:i+1+end])
+			i += end + 2
+			continue
+		}
+		unquoted.WriteByte(s[i])
+		i++
+	}
+	switch {
+	case internal:
+		value = quoted[0]
+	case public && len(quoted) > 1:
+		system = quoted[1]
+	case !public && len(quoted) > 0:
+		system = quoted[0]
+	}
+	// unparsed entities, which name a notation, can't be referred to in text
+	unparsed := strings.Contains(unquoted.String(), "NDATA")
+	return name, value, system, i + 1, (internal || system != "") && !unparsed && !parameter && name != ""
+}
+
+// Decodes the number of a character reference, e.g. 169 or x2014
+func charRef(ref string) (rune, error) {
+	digits, base := ref, 10
+	if strings.HasPrefix(ref, "x") {
+		digits, base = ref[1:], 16
+	}
+	n, err := strconv.ParseUint(digits, base, 32)
+	if err != nil || n > 0x10FFFF {
+		return 0, fmt.Errorf("invalid character reference &#%s;", ref)
+	}
+	return rune(n), nil
+}
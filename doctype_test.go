@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExpandEntities(t *testing.T) {
+	entities := map[string]string{"co": `Acme & "Co"`, "amp": "&"}
+	tests := []struct{ raw, want string }{
+		{`<pub>&co;</pub>`, `<pub>Acme &amp; &quot;Co&quot;</pub>`},
+		{`<pub name="&co;"/>`, `<pub name="Acme &amp; &quot;Co&quot;"/>`},
+		{`<pub>&amp;&lt;&#38;</pub>`, `<pub>&amp;&lt;&#38;</pub>`},
+		{`<pub>&other;</pub>`, `<pub>&other;</pub>`},
+		{`<!-- &co; --><![CDATA[&co;]]><?pi &co;?>`, `<!-- &co; --><![CDATA[&co;]]><?pi &co;?>`},
+	}
+	for _, test := range tests {
+		if got := expandEntities(test.raw, entities); got != test.want {
+			t.Errorf("expandEntities(%q) = %q, want %q", test.raw, got, test.want)
+		}
+	}
+}
+
+// Entities one input declares are written out expanded and are not defined
+// for the next input of a batch
+func TestEntitiesScopedToInput(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"a.xml":   `<!DOCTYPE catalog [<!ENTITY co "Acme &amp; Co">]><catalog><book n="1"><pub>&co;</pub></book></catalog>`,
+		"b.xml":   `<catalog><book n="1"><pub>&co;</pub></book></catalog>`,
+		"ids.csv": "1\n",
+	})
+
+	opts := testOptions(t, "-node", "book", "-ref", "@n", "-csv", "ids.csv", "-verify")
+	opts.inputPath = filepath.Join(dir, "a.xml")
+	if _, err := run(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "output", "book_@n_part-1.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), `<pub>Acme &amp; Co</pub>`) {
+		t.Errorf("the entity was not expanded in the output:\n%s", content)
+	}
+
+	opts = testOptions(t, "-node", "book", "-ref", "@n", "-csv", "ids.csv", "-force")
+	opts.inputPath = filepath.Join(dir, "b.xml")
+	if _, err := run(context.Background(), opts); err == nil {
+		t.Error("an entity declared by another input was defined")
+	}
+}
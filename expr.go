@@ -0,0 +1,642 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A small CEL-like expression language for -filter, e.g.
+//
+//	entry.status == "active" && entry.country in ["US", "CA"]
+//
+// entry.name reads the first child element called name (entry.a.b nests),
+// entry["@id"] or entry.a["@id"] reads an attribute. Values are strings,
+// numbers, booleans, lists or null (for a missing field). Supported are
+// == != < <= > >= && || ! in, list literals, has(), size(), int(), double()
+// and the string methods contains(), startsWith(), endsWith() and matches().
+
+// A parsed -filter expression
+type filterExpr struct {
+	root celNode
+}
+
+type celNode interface {
+	eval(entry *node) (any, error)
+}
+
+// Parses a -filter expression
+func parseFilter(s string) (*filterExpr, error) {
+	p := &celParser{}
+	if err := p.tokenize(s); err != nil {
+		return nil, err
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("invalid filter: unexpected %q", p.tokens[p.pos].text)
+	}
+	return &filterExpr{root: root}, nil
+}
+
+// Reports whether an entry passes the filter; the expression must be boolean
+func (f *filterExpr) matches(entry *node) (bool, error) {
+	v, err := f.root.eval(entry)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("filter must evaluate to a boolean, got %s", celString(v))
+	}
+	return b, nil
+}
+
+type celToken struct {
+	kind tokenKind
+	text string
+}
+
+type celParser struct {
+	tokens []celToken
+	pos    int
+}
+
+func (p *celParser) tokenize(s string) error {
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"' || r == '\'':
+			var b strings.Builder
+			end := i + 1
+			for ; end < len(runes) && runes[end] != r; end++ {
+				if runes[end] == '\\' && end+1 < len(runes) {
+					end++
+				}
+				b.WriteRune(runes[end])
+			}
+			if end == len(runes) {
+				return fmt.Errorf("invalid filter: unterminated string")
+			}
+			p.tokens = append(p.tokens, celToken{tokString, b.String()})
+			i = end + 1
+		case unicode.IsDigit(r):
+			end := i
+			for end < len(runes) && (unicode.IsDigit(runes[end]) || runes[end] == '.') {
+				end++
+			}
+			p.tokens = append(p.tokens, celToken{tokNumber, string(runes[i:end])})
+			i = end
+		case unicode.IsLetter(r) || r == '_':
+			end := i
+			for end < len(runes) && (unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end]) || runes[end] == '_') {
+				end++
+			}
+			p.tokens = append(p.tokens, celToken{tokName, string(runes[i:end])})
+			i = end
+		default:
+			op := ""
+			for _, candidate := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ",", ".", "-"} {
+				if strings.HasPrefix(string(runes[i:]), candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return fmt.Errorf("invalid filter: unexpected %q", r)
+			}
+			p.tokens = append(p.tokens, celToken{tokOp, op})
+			i += len([]rune(op))
+		}
+	}
+	return nil
+}
+
+func (p *celParser) peek() (celToken, bool) {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos], true
+	}
+	return celToken{}, false
+}
+
+func (p *celParser) accept(kind tokenKind, text string) bool {
+	if t, ok := p.peek(); ok && t.kind == kind && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *celParser) expect(text string) error {
+	if !p.accept(tokOp, text) {
+		return fmt.Errorf("invalid filter: expected %q", text)
+	}
+	return nil
+}
+
+func (p *celParser) parseOr() (celNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokOp, "||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &celBinary{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *celParser) parseAnd() (celNode, error) {
+	left, err := p.parseRelation()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokOp, "&&") {
+		right, err := p.parseRelation()
+		if err != nil {
+			return nil, err
+		}
+		left = &celBinary{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *celParser) parseRelation() (celNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	t, ok := p.peek()
+	if !ok {
+		return left, nil
+	}
+	isRelop := t.kind == tokOp && strings.Contains(" == != < <= > >= ", " "+t.text+" ")
+	if isRelop || (t.kind == tokName && t.text == "in") {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &celBinary{op: t.text, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *celParser) parseUnary() (celNode, error) {
+	if p.accept(tokOp, "!") {
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &celNot{inner: inner}, nil
+	}
+	if p.accept(tokOp, "-") {
+		t, ok := p.peek()
+		if !ok || t.kind != tokNumber {
+			return nil, fmt.Errorf("invalid filter: expected a number after -")
+		}
+		p.pos++
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter: bad number %q", t.text)
+		}
+		return &celLiteral{value: -f}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *celParser) parsePostfix() (celNode, error) {
+	n, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept(tokOp, "."):
+			t, ok := p.peek()
+			if !ok || t.kind != tokName {
+				return nil, fmt.Errorf("invalid filter: expected a name after .")
+			}
+			p.pos++
+			if p.accept(tokOp, "(") {
+				args, err := p.parseArgs()
+				if err != nil {
+					return nil, err
+				}
+				n = &celCall{name: t.text, target: n, args: args}
+			} else {
+				n = &celField{target: n, name: t.text}
+			}
+		case p.accept(tokOp, "["):
+			index, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			n = &celIndex{target: n, index: index}
+		default:
+			return n, nil
+		}
+	}
+}
+
+// Parses call arguments after the opening parenthesis
+func (p *celParser) parseArgs() ([]celNode, error) {
+	var args []celNode
+	if p.accept(tokOp, ")") {
+		return args, nil
+	}
+	for {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.accept(tokOp, ")") {
+			return args, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *celParser) parsePrimary() (celNode, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("invalid filter: unexpected end of expression")
+	}
+	p.pos++
+
+	switch t.kind {
+	case tokString:
+		return &celLiteral{value: t.text}, nil
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter: bad number %q", t.text)
+		}
+		return &celLiteral{value: f}, nil
+	case tokName:
+		switch t.text {
+		case "true":
+			return &celLiteral{value: true}, nil
+		case "false":
+			return &celLiteral{value: false}, nil
+		case "null":
+			return &celLiteral{value: nil}, nil
+		case "entry":
+			return &celEntry{}, nil
+		}
+		if p.accept(tokOp, "(") {
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			return &celCall{name: t.text, args: args}, nil
+		}
+		return nil, fmt.Errorf("invalid filter: unknown name %q", t.text)
+	case tokOp:
+		switch t.text {
+		case "(":
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+		case "[":
+			var items []celNode
+			if !p.accept(tokOp, "]") {
+				for {
+					item, err := p.parseOr()
+					if err != nil {
+						return nil, err
+					}
+					items = append(items, item)
+					if p.accept(tokOp, "]") {
+						break
+					}
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+			}
+			return &celList{items: items}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid filter: unexpected %q", t.text)
+}
+
+type celLiteral struct {
+	value any
+}
+
+func (n *celLiteral) eval(entry *node) (any, error) {
+	return n.value, nil
+}
+
+type celEntry struct{}
+
+func (n *celEntry) eval(entry *node) (any, error) {
+	return entry, nil
+}
+
+type celList struct {
+	items []celNode
+}
+
+func (n *celList) eval(entry *node) (any, error) {
+	var list []any
+	for _, item := range n.items {
+		v, err := item.eval(entry)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+// entry.name: the first child element with that name, or null
+type celField struct {
+	target celNode
+	name   string
+}
+
+func (n *celField) eval(entry *node) (any, error) {
+	v, err := n.target.eval(entry)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	parent, ok := v.(*node)
+	if !ok {
+		return nil, fmt.Errorf("cannot read field %s of %s", n.name, celString(v))
+	}
+	if children := parent.childrenNamed(n.name); len(children) > 0 {
+		return children[0], nil
+	}
+	return nil, nil
+}
+
+// entry["@attr"], entry["name"] or list[i]
+type celIndex struct {
+	target celNode
+	index  celNode
+}
+
+func (n *celIndex) eval(entry *node) (any, error) {
+	v, err := n.target.eval(entry)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	index, err := n.index.eval(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := v.(type) {
+	case *node:
+		key := celString(index)
+		if strings.HasPrefix(key, "@") {
+			if value, ok := t.attrValue(key[1:]); ok {
+				return value, nil
+			}
+			return nil, nil
+		}
+		if children := t.childrenNamed(key); len(children) > 0 {
+			return children[0], nil
+		}
+		return nil, nil
+	case []any:
+		f, ok := celNumber(index)
+		if !ok || int(f) < 0 || int(f) >= len(t) {
+			return nil, fmt.Errorf("list index %s out of range", celString(index))
+		}
+		return t[int(f)], nil
+	}
+	return nil, fmt.Errorf("cannot index %s", celString(v))
+}
+
+type celNot struct {
+	inner celNode
+}
+
+func (n *celNot) eval(entry *node) (any, error) {
+	v, err := n.inner.eval(entry)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return nil, fmt.Errorf("! needs a boolean, got %s", celString(v))
+	}
+	return !b, nil
+}
+
+type celBinary struct {
+	op          string
+	left, right celNode
+}
+
+func (n *celBinary) eval(entry *node) (any, error) {
+	l, err := n.left.eval(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	// && and || short-circuit
+	if n.op == "&&" || n.op == "||" {
+		lb, ok := l.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs booleans, got %s", n.op, celString(l))
+		}
+		if (n.op == "&&" && !lb) || (n.op == "||" && lb) {
+			return lb, nil
+		}
+		r, err := n.right.eval(entry)
+		if err != nil {
+			return nil, err
+		}
+		rb, ok := r.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs booleans, got %s", n.op, celString(r))
+		}
+		return rb, nil
+	}
+
+	r, err := n.right.eval(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.op == "in" {
+		list, ok := r.([]any)
+		if !ok {
+			return nil, fmt.Errorf("in needs a list, got %s", celString(r))
+		}
+		for _, item := range list {
+			if celEqual(l, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	switch n.op {
+	case "==":
+		return celEqual(l, r), nil
+	case "!=":
+		return !celEqual(l, r), nil
+	}
+	// ordering comparisons are false when a side is missing
+	if l == nil || r == nil {
+		return false, nil
+	}
+	return compareValues(celCompared(l), celCompared(r), n.op), nil
+}
+
+// A function call: size(x), has(x), int(x), double(x), or a string method
+// like x.contains("y")
+type celCall struct {
+	name   string
+	target celNode // nil for global functions
+	args   []celNode
+}
+
+func (n *celCall) eval(entry *node) (any, error) {
+	var args []any
+	for _, arg := range n.args {
+		v, err := arg.eval(entry)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+
+	if n.target == nil {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s() takes one argument", n.name)
+		}
+		switch n.name {
+		case "has":
+			return args[0] != nil, nil
+		case "size":
+			if list, ok := args[0].([]any); ok {
+				return float64(len(list)), nil
+			}
+			return float64(len([]rune(celString(args[0])))), nil
+		case "int", "double":
+			f, ok := celNumber(args[0])
+			if !ok {
+				return nil, fmt.Errorf("%s(): %q is not a number", n.name, celString(args[0]))
+			}
+			if n.name == "int" {
+				f = float64(int64(f))
+			}
+			return f, nil
+		}
+		return nil, fmt.Errorf("unknown function %s()", n.name)
+	}
+
+	target, err := n.target.eval(entry)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%s() takes one argument", n.name)
+	}
+	s, arg := celString(target), celString(args[0])
+	switch n.name {
+	case "contains":
+		return strings.Contains(s, arg), nil
+	case "startsWith":
+		return strings.HasPrefix(s, arg), nil
+	case "endsWith":
+		return strings.HasSuffix(s, arg), nil
+	case "matches":
+		re, err := compileCached(arg)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(s), nil
+	}
+	return nil, fmt.Errorf("unknown method %s()", n.name)
+}
+
+var regexCache = make(map[string]*regexp.Regexp)
+
+func compileCached(pattern string) (*regexp.Regexp, error) {
+	if re, ok := regexCache[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexCache[pattern] = re
+	return re, nil
+}
+
+// Converts a value to the string it is compared as
+func celString(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	case *node:
+		return strings.TrimSpace(t.textContent())
+	case []any:
+		var items []string
+		for _, item := range t {
+			items = append(items, celString(item))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	return fmt.Sprint(v)
+}
+
+// Converts a value to the string it is compared as, reading fields of the
+// entry in the -locale
+func celCompared(v any) string {
+	if _, ok := v.(*node); ok {
+		return localized(celString(v))
+	}
+	return celString(v)
+}
+
+func celNumber(v any) (float64, bool) {
+	if f, ok := v.(float64); ok {
+		return f, true
+	}
+	f, err := strconv.ParseFloat(celCompared(v), 64)
+	return f, err == nil
+}
+
+// Compares two values for equality, numerically when both are numbers
+func celEqual(l, r any) bool {
+	if l == nil || r == nil {
+		return l == nil && r == nil
+	}
+	if lb, ok := l.(bool); ok {
+		rb, ok := r.(bool)
+		return ok && lb == rb
+	}
+	return compareValues(celCompared(l), celCompared(r), "=")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	entry := `<book id="b1" lang="en"><title>The Big Sleep</title><year>2021</year><price>9.50</price>` +
+		`<quote>say "hi"</quote><tags><tag>noir</tag><tag>crime</tag></tags></book>`
+	n, err := parseNode(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`entry.year == 2021`, true},
+		{`entry.year == "2021"`, true},
+		{`entry.year != 2021`, false},
+		{`entry.price == 9.5`, true},
+		{`entry.price < 10 && entry.price >= 9.5`, true},
+		{`entry.price > 10`, false},
+		{`"10" > "9"`, true},
+		{`"b" > "a"`, true},
+		{`-1 < 0`, true},
+		{`entry["@id"] == "b1"`, true},
+		{`entry['@lang'] in ["en", "fr"]`, true},
+		{`entry["@lang"] in ["de"]`, false},
+		{`entry["title"] == "The Big Sleep"`, true},
+		{`entry.tags.tag == "noir"`, true},
+		{`entry.tags["tag"] in ["crime"]`, false},
+		{`entry.quote == "say \"hi\""`, true},
+		{`entry.isbn == null`, true},
+		{`entry["@isbn"] == null`, true},
+		{`entry.isbn.prefix == null`, true},
+		{`entry.isbn > 1 || entry.isbn < 1`, false},
+		{`has(entry.title) && !has(entry.isbn)`, true},
+		{`size(entry.title) == 13`, true},
+		{`size(["a", "b", "c"]) == 3`, true},
+		{`int(entry.price) == 9`, true},
+		{`double("1.5") == 1.5`, true},
+		{`["x", 2][1] == 2`, true},
+		{`entry.title.contains("Big") && entry.title.startsWith("The") && entry.title.endsWith("Sleep")`, true},
+		{`entry.title.matches("^The [A-Z]")`, true},
+		{`entry.title.matches("^Big")`, false},
+		{`true == true && false != true`, true},
+		{`!(entry.year > 2020) || false`, false},
+		// && and || don't evaluate what can't change their result
+		{`false && size()`, false},
+		{`true || frob(1)`, true},
+	}
+	for _, test := range tests {
+		f, err := parseFilter(test.expr)
+		if err != nil {
+			t.Errorf("parseFilter(%s): %v", test.expr, err)
+			continue
+		}
+		got, err := f.matches(n)
+		if err != nil || got != test.want {
+			t.Errorf("%s = %v, %v, want %v", test.expr, got, err, test.want)
+		}
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	n, err := parseNode(`<book><title>Emma</title></book>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct{ expr, err string }{
+		{`entry.title ==`, "unexpected end"},
+		{`entry.title = "Emma"`, "unexpected"},
+		{`entry.title == "Emma`, "unterminated string"},
+		{`title == "Emma"`, "unknown name"},
+		{`entry. == 1`, "expected a name"},
+		{`(true`, `expected ")"`},
+		{`- "1" < 0`, "expected a number"},
+		{`entry.title`, "must evaluate to a boolean"},
+		{`1 && true`, "needs booleans"},
+		{`!entry.title`, "needs a boolean"},
+		{`"Emma" in "Emma"`, "needs a list"},
+		{`frob(1)`, "unknown function"},
+		{`entry.title.frob("x")`, "unknown method"},
+		{`size()`, "takes one argument"},
+		{`int(entry.title) == 1`, "not a number"},
+		{`[1, 2][5] == 1`, "out of range"},
+		{`entry.title.matches("(")`, "missing closing )"},
+	}
+	for _, test := range tests {
+		f, err := parseFilter(test.expr)
+		if err == nil {
+			_, err = f.matches(n)
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got %v, want an error about %s", test.expr, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// -print-fields: instead of writing the matched entries, the values of some
+// of their fields are printed to stdout, by path like -columns. One field's
+// values are printed one per line, a repeated element's each on its own;
+// several fields as CSV, a row per entry after a row of the field names.
+// Progress messages go to stderr, so the values can be piped. It isn't named
+// -extract, as ds-xml extract runs a normal extraction.
+type extractor struct {
+	fields *tableColumns
+	values int
+}
+
+// Checks -print-fields and the flags about output files it can't be combined
+// with, since none are written
+func (opts *options) checkPrintFields() error {
+	switch {
+	case len(opts.printFields) == 0:
+		return nil
+	case opts.format != "xml":
+		return fmt.Errorf("-print-fields prints values instead of writing entries, so cannot be combined with -format or -template")
+	case opts.split || opts.partitionBy != "" || opts.shards > 0:
+		return fmt.Errorf("-print-fields cannot be combined with -split, -partition-by or -shards")
+	case opts.verify || opts.archive != "":
+		return fmt.Errorf("-print-fields writes no output files, so cannot be combined with -verify or -archive")
+	case opts.rules != "" || opts.indexURL != "":
+		return fmt.Errorf("-print-fields cannot be combined with -rules or -index-url")
+	}
+	_, err := parseFieldList("-print-fields", opts.printFields, "csv")
+	return err
+}
+
+func newExtractor(specs []string) *extractor {
+	// -print-fields was checked when the flags were read
+	fields, _ := parseFieldList("-print-fields", specs, "csv")
+	return &extractor{fields: fields}
+}
+
+// Prints the values of the entries' fields to w
+func (x *extractor) write(w io.Writer, entries []entry) error {
+	out := bufio.NewWriter(w)
+	several := len(x.fields.paths) > 1
+	if several {
+		out.WriteString(x.fields.header())
+	}
+	for _, e := range entries {
+		n, err := parseNode(e.raw)
+		if err != nil {
+			return fmt.Errorf("the entry at offset %d: %v", e.offset, err)
+		}
+		if several {
+			fields := make([]string, len(x.fields.paths))
+			for i, p := range x.fields.paths {
+				values := p.values(n, nil)
+				fields[i] = strings.Join(values, "|")
+				x.values += len(values)
+			}
+			out.WriteString(x.fields.row(fields) + "\n")
+			continue
+		}
+		for _, value := range x.fields.paths[0].values(n, nil) {
+			out.WriteString(value + "\n")
+			x.values++
+		}
+	}
+	return out.Flush()
+}
@@ -0,0 +1,80 @@
+package main
+
+import "fmt"
+
+// Per-entry checks applied as entries are captured: the -xpath predicate,
+// -where conditions and the -filter expression
+type entryFilter struct {
+	xpath      *xpathExpr
+	conditions []exprNode
+	filter     *filterExpr
+	ids        []string
+
+	// -tombstone and -deleted: the condition marking an entry as deleted and
+	// whether to keep live entries, tombstones or both
+	tombstone exprNode
+	deleted   string
+	// entries passing the other checks, counted by kind
+	live, tombstones int
+}
+
+// Values of -deleted
+var deletedModes = []string{"exclude", "only", "include"}
+
+// Reports whether any check is configured
+func (f *entryFilter) active() bool {
+	return (f.xpath != nil && f.xpath.predicate != nil) || len(f.conditions) > 0 || f.filter != nil || f.tombstone != nil
+}
+
+// Reports whether an entry passes every check. An xpath comparison against
+// $id sets the entry's ref to the ID that matched.
+func (f *entryFilter) keep(e *entry) (bool, error) {
+	if !f.active() {
+		return true, nil
+	}
+	n, err := parseNode(e.raw)
+	if err != nil {
+		return false, err
+	}
+
+	if f.xpath != nil {
+		id, ok := f.xpath.eval(n, f.ids)
+		if !ok {
+			return false, nil
+		}
+		e.ref = id
+	}
+
+	// -where conditions use the -xpath predicate syntax, e.g. "price > 100"
+	ctx := &evalContext{ids: f.ids}
+	for _, cond := range f.conditions {
+		if !cond.truth(n, ctx) {
+			return false, nil
+		}
+	}
+
+	if f.filter != nil {
+		if ok, err := f.filter.matches(n); err != nil || !ok {
+			return false, err
+		}
+	}
+
+	if f.tombstone == nil {
+		return true, nil
+	}
+	if f.tombstone.truth(n, ctx) {
+		f.tombstones++
+		return f.deleted != "exclude", nil
+	}
+	f.live++
+	return f.deleted != "only", nil
+}
+
+// Prints how many matching entries were live and how many tombstones
+func (f *entryFilter) reportDeleted() {
+	if f.tombstone == nil {
+		return
+	}
+	kept := map[string]string{"exclude": "left out tombstones", "only": "kept tombstones only", "include": "kept both"}[f.deleted]
+	fmt.Printf("Found %d live entries and %d tombstones; %s\n", f.live, f.tombstones, kept)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// -indent and -minify: the whitespace between the elements of an entry is
+// replaced, by a newline and indentation per level or by nothing. The rest
+// is copied from the source as is, including attribute quoting, entities,
+// CDATA and all of the content of elements with mixed content, where
+// whitespace is text.
+type layout struct {
+	indent string
+	minify bool
+	depth  int // of entries below the document root: 1, or 0 with -no-root
+}
+
+// Reads an -indent: a number of spaces, or the spaces and tabs to indent by,
+// with \t for a tab
+func parseIndent(s string) (string, error) {
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+		return strings.Repeat(" ", n), nil
+	}
+	s = strings.ReplaceAll(s, `\t`, "\t")
+	if strings.Trim(s, " \t") != "" {
+		return "", fmt.Errorf("invalid -indent %q: expected a number of spaces or a string of spaces and tabs", s)
+	}
+	return s, nil
+}
+
+// Checks -indent and -minify, setting opts.layout when either is given
+func (opts *options) parseLayout() error {
+	switch {
+	case opts.indent == "" && !opts.minify:
+		return nil
+	case opts.indent != "" && opts.minify:
+		return fmt.Errorf("-indent and -minify cannot be combined")
+	case opts.c14n:
+		return fmt.Errorf("-indent and -minify cannot be combined with -c14n, whose form is fixed")
+	}
+	indent, err := parseIndent(opts.indent)
+	if err != nil {
+		return err
+	}
+	opts.layout = &layout{indent: indent, minify: opts.minify, depth: 1}
+	if opts.noRoot {
+		opts.layout.depth = 0
+	}
+	return nil
+}
+
+// Checks -format and -template and the flags about XML output they can't be
+// combined with. -template sets the format to template.
+func (opts *options) checkFormat() error {
+	name := "-format " + opts.format
+	if opts.template != "" {
+		if opts.format != "xml" {
+			return fmt.Errorf("-template cannot be combined with -format %s", opts.format)
+		}
+		if _, err := loadTemplate(opts.template); err != nil {
+			return fmt.Errorf("invalid -template: %v", err)
+		}
+		opts.format, name = "template", "-template"
+	}
+	table := opts.format == "csv" || opts.format == "tsv" || opts.format == "parquet" || opts.format == "avro"
+	switch {
+	case opts.avroSchema != "" && opts.format != "avro":
+		return fmt.Errorf("-avro-schema requires -format avro")
+	case opts.avroSchema != "":
+		if _, _, err := loadAvroSchema(opts.avroSchema, opts.columns); err != nil {
+			return err
+		}
+	case table:
+		if _, err := parseColumns(opts.columns, opts.format); err != nil {
+			return err
+		}
+	case len(opts.columns) > 0:
+		return fmt.Errorf("-columns requires -format csv, tsv, parquet or avro")
+	}
+	switch {
+	case opts.format == "xml":
+		return nil
+	case opts.format != "json" && opts.format != "ndjson" && opts.format != "template" && !table:
+		return fmt.Errorf("-format must be xml, json, ndjson, csv, tsv, parquet or avro")
+	case opts.root != "" || opts.preserveRoot || opts.noRoot || opts.keepDoctype:
+		return fmt.Errorf("%s cannot be combined with -root, -preserve-root, -no-root or -keep-doctype", name)
+	case opts.c14n || opts.indent != "" || opts.minify:
+		return fmt.Errorf("%s cannot be combined with -c14n, -indent or -minify", name)
+	case opts.outputEncoding != "":
+		return fmt.Errorf("%s is always written in UTF-8, so cannot be combined with -output-encoding", name)
+	case opts.verify:
+		return fmt.Errorf("-verify reads output files back as XML, so cannot be combined with %s", name)
+	}
+	return nil
+}
+
+// A token of an entry with its source
+type rawToken struct {
+	token xml.Token
+	raw   string
+	empty bool // a self-closing start tag, whose end has no source
+	mixed bool // a start tag whose element holds text and other nodes
+	nodes bool // a start tag whose element holds other nodes
+}
+
+// Lays out an entry
+func (l layout) apply(raw string) (string, error) {
+	depth := l.depth
+	decoder := newDecoder(strings.NewReader(raw))
+	var tokens []rawToken
+	var open []int // indexes in tokens of the open start tags
+	// per open element: whether it holds text and other nodes
+	var hasText, hasNodes []bool
+	for {
+		from := decoder.InputOffset()
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		t := rawToken{token: xml.CopyToken(token), raw: raw[from:decoder.InputOffset()]}
+		switch token := token.(type) {
+		case xml.StartElement:
+			if len(open) > 0 {
+				hasNodes[len(open)-1] = true
+			}
+			open = append(open, len(tokens))
+			hasText, hasNodes = append(hasText, false), append(hasNodes, false)
+		case xml.EndElement:
+			if len(open) == 0 {
+				return "", fmt.Errorf("unexpected </%s>", token.Name.Local)
+			}
+			start := &tokens[open[len(open)-1]]
+			start.empty = t.raw == ""
+			start.mixed = hasText[len(open)-1] && hasNodes[len(open)-1]
+			start.nodes = hasNodes[len(open)-1]
+			open, hasText, hasNodes = open[:len(open)-1], hasText[:len(hasText)-1], hasNodes[:len(hasNodes)-1]
+		case xml.CharData:
+			// CDATA is text even when it is only whitespace
+			if len(open) > 0 && (len(bytes.TrimSpace(token)) > 0 || strings.HasPrefix(t.raw, "<![CDATA[")) {
+				hasText[len(open)-1] = true
+			}
+		default:
+			if len(open) > 0 {
+				hasNodes[len(open)-1] = true
+			}
+		}
+		tokens = append(tokens, t)
+	}
+
+	var b strings.Builder
+	newline := func() {
+		if !l.minify && b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		if !l.minify {
+			b.WriteString(strings.Repeat(l.indent, depth))
+		}
+	}
+	verbatim := 0   // open elements inside a mixed one, copied as is
+	var ends []bool // per open element: whether its end tag goes on a line of its own
+	for _, t := range tokens {
+		if verbatim > 0 {
+			b.WriteString(t.raw)
+			switch t.token.(type) {
+			case xml.StartElement:
+				verbatim++
+			case xml.EndElement:
+				if verbatim--; verbatim == 0 {
+					depth--
+				}
+			}
+			continue
+		}
+		switch token := t.token.(type) {
+		case xml.StartElement:
+			newline()
+			b.WriteString(t.raw)
+			depth++
+			if t.mixed {
+				verbatim = 1
+				continue
+			}
+			ends = append(ends, t.nodes)
+		case xml.EndElement:
+			depth--
+			if ends[len(ends)-1] {
+				newline()
+			}
+			ends = ends[:len(ends)-1]
+			b.WriteString(t.raw)
+		case xml.CharData:
+			if len(bytes.TrimSpace(token)) > 0 || strings.HasPrefix(t.raw, "<![CDATA[") {
+				b.WriteString(t.raw)
+			}
+		default:
+			newline()
+			b.WriteString(t.raw)
+		}
+	}
+	return b.String(), nil
+}
+
+// Lays out each entry
+func (l layout) entries(entries []entry) ([]entry, error) {
+	for i, e := range entries {
+		raw, err := l.apply(e.raw)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].raw = raw
+	}
+	return entries, nil
+}
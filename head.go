@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// -head: prints the first n characters of the input, reading no more of it
+// than that
+func printHead(path string, n int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		c, _, err := r.ReadRune()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		b.WriteRune(c)
+	}
+	fmt.Printf("Scanned XML content (first %d characters):\n", n)
+	fmt.Println(b.String())
+	return nil
+}
+
+// -head-entries: prints the first n entries under -node, indented, reading
+// the input only up to the end of the last of them
+func printHeadEntries(path string, entities map[string]string, parent nodePath, n int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	decoder := newInputDecoder(bufio.NewReader(f), entities)
+	pretty := layout{indent: "  "}
+	var stack []string
+	start := int64(-1) // of the entry being read
+	depth := 0         // of its element
+	tagEnd := 0        // where its start tag ends in it
+	printed := 0
+	// namespaces declared by the open elements, and those the entry uses
+	// from its ancestors, to declare on it
+	var ns []xml.Attr
+	var nsMarks []int
+	inherited := make(map[string]string)
+	used := make(map[string]bool)
+	for printed < n {
+		from := decoder.InputOffset()
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			if start < 0 && parent.matches(stack) {
+				start, depth = from, len(stack)
+				tagEnd = int(decoder.InputOffset() - from)
+				clear(inherited)
+				clear(used)
+				for _, a := range ns {
+					if prefix, _ := nsDecl(a); prefix != "xml" {
+						inherited[prefix] = a.Value
+					}
+				}
+				for _, a := range t.Attr {
+					if prefix, ok := nsDecl(a); ok {
+						delete(inherited, prefix)
+					}
+				}
+			}
+			nsMarks = append(nsMarks, len(ns))
+			for _, a := range t.Attr {
+				if _, ok := nsDecl(a); ok {
+					ns = append(ns, a)
+				}
+			}
+			if start >= 0 {
+				usePrefixes(t, inherited, used)
+			}
+		case xml.EndElement:
+			if len(stack) == 0 {
+				return fmt.Errorf("unexpected </%s>", t.Name.Local)
+			}
+			stack = stack[:len(stack)-1]
+			ns = ns[:nsMarks[len(nsMarks)-1]]
+			nsMarks = nsMarks[:len(nsMarks)-1]
+			if start < 0 || len(stack) >= depth {
+				continue
+			}
+			// the entry is copied from the file, which the decoder has read past
+			raw := make([]byte, decoder.InputOffset()-start)
+			if _, err := f.ReadAt(raw, start); err != nil {
+				return err
+			}
+			text := declareNamespaces(string(raw), tagInsertAt(string(raw[:tagEnd])), used, inherited)
+			entry, err := pretty.apply(expandEntities(text, entities))
+			if err != nil {
+				return fmt.Errorf("the entry at offset %d: %v", start, err)
+			}
+			printed++
+			fmt.Printf("Entry %d, at offset %d:\n%s\n", printed, start, entry)
+			start = -1
+		}
+	}
+	if printed == 0 {
+		fmt.Printf("No %s nodes found.\n", strings.Join(parent.steps, "/"))
+	}
+	return nil
+}
+
+// Notes which inherited prefixes a start tag read with RawToken uses, in
+// its name, its attribute names or QName values such as xsi:type="dc:Period"
+func usePrefixes(t xml.StartElement, inherited map[string]string, used map[string]bool) {
+	use := func(prefix string) {
+		if _, ok := inherited[prefix]; ok {
+			used[prefix] = true
+		}
+	}
+	// an unprefixed element is in the default namespace
+	use(t.Name.Space)
+	for _, a := range t.Attr {
+		if _, ok := nsDecl(a); ok {
+			continue
+		}
+		if a.Name.Space != "" {
+			use(a.Name.Space)
+		}
+		if prefix, _, ok := strings.Cut(a.Value, ":"); ok {
+			use(prefix)
+		}
+	}
+}
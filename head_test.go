@@ -0,0 +1,31 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHeadEntriesNamespaces(t *testing.T) {
+	dir := testDir(t, map[string]string{"in.xml": `<catalog xmlns="urn:cat" xmlns:dc="urn:dc" xmlns:xlink="urn:xlink" xmlns:unused="urn:u">
+<dc:record xlink:href="a"><dc:creator>Ann</dc:creator><creator>A</creator></dc:record>
+<dc:record xmlns:dc="urn:other"><dc:creator>Bob</dc:creator></dc:record>
+</catalog>`})
+	parent, _ := parseNodePath("record")
+	out := captureStdout(t, func() {
+		if err := printHeadEntries(filepath.Join(dir, "in.xml"), nil, parent, 2); err != nil {
+			t.Fatal(err)
+		}
+	})
+	for _, want := range []string{
+		`<dc:record xlink:href="a" xmlns="urn:cat" xmlns:dc="urn:dc" xmlns:xlink="urn:xlink">`,
+		`<dc:record xmlns:dc="urn:other">`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "unused") {
+		t.Errorf("an unused namespace was declared:\n%s", out)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// How the first line of an ID list is treated
+type headerMode int
+
+const (
+	headerAuto headerMode = iota // skip it if it looks like a header
+	headerSkip                   // -header: always skip it
+	headerKeep                   // -no-header: it holds IDs
+)
+
+// Lines read ahead of the first to compare it against the rest
+const headerLookahead = 100
+
+// Column names that mark the first line as a header
+var headerNames = map[string]bool{
+	"id": true, "ids": true, "identifier": true, "ref": true, "reference": true,
+	"key": true, "code": true, "sku": true, "isbn": true, "ean": true,
+	"doi": true, "uuid": true, "guid": true, "pattern": true,
+}
+
+// Reports whether the first of lines should be skipped as a header, printing
+// a notice when it is
+func skipHeader(lines []string, mode headerMode) bool {
+	switch mode {
+	case headerSkip:
+		fmt.Printf("Skipping CSV header row %q\n", lines[0])
+		return true
+	case headerKeep:
+		return false
+	}
+	if !looksLikeHeader(lines[0], lines[1:]) {
+		return false
+	}
+	fmt.Printf("Warning: the first CSV line %q looks like a header row and was skipped; use -no-header to keep it as IDs or -header to always skip it\n", lines[0])
+	return true
+}
+
+// Reports whether first is a header: a field is named like an ID column, or
+// it has no digits where nearly all of the following lines do
+func looksLikeHeader(first string, rest []string) bool {
+	for _, field := range strings.Split(first, ",") {
+		field = strings.Trim(strings.TrimSpace(field), `"'`)
+		lower := strings.ToLower(field)
+		if headerNames[lower] {
+			return true
+		}
+		for _, suffix := range []string{"_id", " id", "-id", "_ids", "_ref"} {
+			if strings.HasSuffix(lower, suffix) {
+				return true
+			}
+		}
+		// camelCase like orderId or OrderID
+		if n := len(field); n > 2 && (strings.HasSuffix(field, "Id") || strings.HasSuffix(field, "ID")) && unicode.IsLower(rune(field[n-3])) {
+			return true
+		}
+	}
+
+	if len(rest) == 0 || strings.IndexFunc(first, unicode.IsDigit) >= 0 {
+		return false
+	}
+	withDigits := 0
+	for _, line := range rest {
+		if strings.IndexFunc(line, unicode.IsDigit) >= 0 {
+			withDigits++
+		}
+	}
+	return withDigits*10 >= len(rest)*9
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// -exec-hook: an external command each matched entry is piped through, for
+// custom logic in any language. Exit status 0 keeps the entry, replaced by
+// what the command prints if it prints anything; 1 leaves it out; any other
+// status stops the run.
+type execHook struct {
+	ctx     context.Context
+	command string
+	json    bool // -exec-hook-format json
+	ran     int
+	dropped int
+	changed int
+}
+
+// What a json hook reads and prints
+type hookMessage struct {
+	Ref    string `json:"ref,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	XML    string `json:"xml"`
+}
+
+func newExecHook(ctx context.Context, command, format string) (*execHook, error) {
+	if format != "xml" && format != "json" {
+		return nil, fmt.Errorf("-exec-hook-format must be xml or json")
+	}
+	return &execHook{ctx: ctx, command: command, json: format == "json"}, nil
+}
+
+// Runs the hook on an entry, reporting whether to keep it
+func (h *execHook) apply(e *entry) (bool, error) {
+	input := []byte(e.raw)
+	if h.json {
+		var err error
+		if input, err = json.Marshal(hookMessage{Ref: e.ref, Offset: e.offset, XML: e.raw}); err != nil {
+			return false, err
+		}
+	}
+	var out bytes.Buffer
+	cmd := shellCommand(h.ctx, h.command)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(input), &out, os.Stderr
+	cmd.Env = append(os.Environ(), "DSXML_REF="+e.ref, "DSXML_OFFSET="+strconv.FormatInt(e.offset, 10))
+	h.ran++
+	err := cmd.Run()
+	var exit *exec.ExitError
+	switch {
+	case errors.As(err, &exit) && exit.ExitCode() == 1:
+		h.dropped++
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("-exec-hook failed on the entry at offset %d: %v", e.offset, err)
+	}
+
+	printed := strings.TrimSpace(out.String())
+	if printed == "" {
+		return true, nil
+	}
+	if h.json {
+		var msg hookMessage
+		if err := json.Unmarshal([]byte(printed), &msg); err != nil {
+			return false, fmt.Errorf("-exec-hook printed invalid JSON for the entry at offset %d: %v", e.offset, err)
+		}
+		if printed = msg.XML; printed == "" {
+			return true, nil
+		}
+	}
+	if _, err := parseNode(printed); err != nil {
+		return false, fmt.Errorf("-exec-hook printed malformed XML for the entry at offset %d: %v", e.offset, err)
+	}
+	if printed != e.raw {
+		e.raw = printed
+		h.changed++
+	}
+	return true, nil
+}
+
+func (h *execHook) report() {
+	fmt.Printf("Exec hook ran on %d entries: %d left out, %d changed\n", h.ran, h.dropped, h.changed)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Completed source URLs of an -index-url run, one per line, so an
+// interrupted run can be resumed with -index-resume
+const indexProgressFile = "index-done.txt"
+
+// Reads the sources listed in an index: the URL in the text of every element
+// named element, e.g. the <loc> elements of a sitemap index, with the
+// <lastmod> date of the same record if it has one. URLs listed more than
+// once are read once.
+func readIndex(r io.Reader, element string) ([]batchSource, error) {
+	decoder := xml.NewDecoder(r)
+	var sources []batchSource
+	seen := make(map[string]bool)
+
+	// one record per open element; a <loc> or <lastmod> fills in its parent
+	type record struct {
+		url, lastmod string
+		text         strings.Builder
+	}
+	var stack []*record
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return sources, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			stack = append(stack, &record{})
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		case xml.EndElement:
+			r := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				switch t.Name.Local {
+				case element:
+					parent.url = strings.TrimSpace(r.text.String())
+				case "lastmod":
+					parent.lastmod = strings.TrimSpace(r.text.String())
+				}
+			}
+			if r.url == "" || seen[r.url] {
+				continue
+			}
+			seen[r.url] = true
+			s := batchSource{input: r.url}
+			if modified, err := parseDate(r.lastmod); err == nil {
+				s.modified = modified
+			}
+			sources = append(sources, s)
+		}
+	}
+}
+
+// Reads the URLs recorded as done by an earlier run
+func readIndexProgress(path string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			done[line] = true
+		}
+	}
+	return done, scanner.Err()
+}
+
+// Downloads the index at opts.indexURL and runs the extraction on every data
+// file it lists as a batch. Finished files are recorded so -index-resume can
+// skip them.
+func runIndex(ctx context.Context, opts options) (*runSummary, error) {
+	summary := &runSummary{input: opts.indexURL, outputDir: opts.outputDir}
+	switch {
+	case opts.url != "":
+		return summary, fmt.Errorf("Error: -index-url cannot be combined with -url")
+	case opts.csvPath == "-":
+		return summary, fmt.Errorf("Error: -index-url cannot read IDs from stdin")
+	case opts.head > 0:
+		return summary, fmt.Errorf("Error: -index-url cannot be combined with -head")
+	case opts.batchWorkers < 1:
+		return summary, fmt.Errorf("Error: -workers must be at least 1")
+	}
+	files, err := newFileFilter(opts)
+	if err != nil {
+		return summary, fmt.Errorf("Error: %v", err)
+	}
+
+	fmt.Println("Downloading index from url:", opts.indexURL)
+	tempDir, err := os.MkdirTemp("", "ds-xml-index-")
+	if err != nil {
+		return summary, fmt.Errorf("Error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := "index.xml"
+	if u, err := url.Parse(opts.indexURL); err == nil && path.Base(u.Path) != "/" {
+		fileName = path.Base(u.Path)
+	}
+	downloaded, err := downloadFile(ctx, opts.indexURL, filepath.Join(tempDir, safeFileName(fileName)), opts.archivePassword, "")
+	if err != nil {
+		return summary, fmt.Errorf("Error downloading index: %v", err)
+	}
+	f, err := os.Open(downloaded[0])
+	if err != nil {
+		return summary, fmt.Errorf("Error reading index: %v", err)
+	}
+	sources, err := readIndex(f, opts.indexElement)
+	f.Close()
+	if err != nil {
+		return summary, fmt.Errorf("Error parsing index: %v", err)
+	}
+	if len(sources) == 0 {
+		return summary, fmt.Errorf("Error: no <%s> elements found in the index", opts.indexElement)
+	}
+	fmt.Printf("Index lists %d files\n", len(sources))
+	nameSources(sources)
+	sources = files.apply(sources)
+
+	var done map[string]bool
+	progressPath := filepath.Join(opts.outputDir, indexProgressFile)
+	if opts.indexResume {
+		if done, err = readIndexProgress(progressPath); err != nil {
+			return summary, fmt.Errorf("Error reading index progress: %v", err)
+		}
+	}
+	var pending []batchSource
+	for _, s := range sources {
+		if !done[s.input] {
+			pending = append(pending, s)
+		}
+	}
+	if skipped := len(sources) - len(pending); skipped > 0 {
+		fmt.Printf("Resuming: skipping %d files already processed\n", skipped)
+	}
+	if opts.dryRun {
+		return summary, runBatch(ctx, opts, pending, summary, nil)
+	}
+
+	if err := os.MkdirAll(opts.outputDir, os.ModePerm); err != nil {
+		return summary, fmt.Errorf("Error creating output directory: %v", err)
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if !opts.indexResume {
+		flags |= os.O_TRUNC
+	}
+	progress, err := os.OpenFile(progressPath, flags, 0644)
+	if err != nil {
+		return summary, fmt.Errorf("Error recording index progress: %v", err)
+	}
+	defer progress.Close()
+
+	if err := runBatch(ctx, opts, pending, summary, progress); err != nil {
+		if opts.failFast {
+			return summary, err
+		}
+		return summary, fmt.Errorf("%v; rerun with -index-resume to retry them", err)
+	}
+	return summary, nil
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ds-xml inspect <file.xml>: scans a document and prints its structure,
+// every element and attribute path with how often it occurs and example
+// values, then suggests -node and -ref values, so the right ones can be
+// found without opening a huge file in an editor.
+func inspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	var opts options
+	var scanSize byteSize
+	var examples, maxDepth int
+	fs.Var(&scanSize, "scan-size", "Scan only the first part of the input, e.g. 100MB, to report on a huge file quickly")
+	fs.IntVar(&examples, "examples", 3, "Example values to show per element and attribute")
+	fs.IntVar(&maxDepth, "max-depth", 0, "Show only elements this many levels deep or less (default all)")
+	fs.StringVar(&opts.encoding, "encoding", "", "Encoding of the input when its XML declaration is missing or wrong")
+	fs.BoolVar(&opts.trustEntities, "trust-entities", false, "Trust the input: load external entities and DTDs and don't limit entity expansion")
+	fs.Usage = func() {
+		fmt.Println("Usage: ds-xml inspect <file.xml>")
+		fs.PrintDefaults()
+	}
+
+	// the file may come before or after the flags
+	var input string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		input, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if input == "" && fs.NArg() > 0 {
+		input = fs.Arg(0)
+	}
+	if input == "" {
+		fs.Usage()
+		return fmt.Errorf("Error: inspect needs a file")
+	}
+	tempDir, err := os.MkdirTemp("", "ds-xml-")
+	if err != nil {
+		return fmt.Errorf("Error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	source, entities, err := scanSource(input, opts, tempDir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Inspecting XML file:", input)
+	s := &structure{examples: examples, entities: entities}
+	complete, err := s.scan(source, int64(scanSize))
+	if err != nil {
+		return fmt.Errorf("Error reading XML: %v", err)
+	}
+	scanned := "the input"
+	if !complete {
+		scanned = fmt.Sprintf("the first %d bytes of the input", int64(scanSize))
+	}
+	fmt.Printf("Structure of %s:\n", scanned)
+	s.print(s.document, 0, maxDepth)
+	s.suggest()
+	return nil
+}
+
+// Readies an input to be scanned by inspect or stats: checks -encoding,
+// converts the input to UTF-8 in dir if needed and reads the entities its
+// DOCTYPE declares. Returns the path to read and the entities.
+func scanSource(input string, opts options, dir string) (string, map[string]string, error) {
+	if _, err := lookupCharset(opts.encoding); err != nil {
+		return "", nil, fmt.Errorf("Error: %v", err)
+	}
+	trustEntities.Store(opts.trustEntities)
+	source, err := utf8Input(input, opts.encoding, dir)
+	if err != nil {
+		return "", nil, fmt.Errorf("Error reading XML file: %v", err)
+	}
+	prolog, err := readProlog(source, filepath.Dir(input))
+	if err != nil {
+		return "", nil, fmt.Errorf("Error reading XML: %v", err)
+	}
+	return source, prolog.entities, nil
+}
+
+// Values kept per path, as hashes, to tell whether its values are unique
+const inspectedValues = 10000
+
+// An element or attribute path found by inspect
+type inspectedPath struct {
+	name     string // the element's name, or @ and the attribute's
+	path     string // slash path from the document element
+	parent   *inspectedPath
+	children []*inspectedPath // in order of first appearance
+	count    int
+	closed   int // elements whose end was read, so their children counted
+
+	// occurrences in each parent element, for elements
+	parents int // parents it occurred in
+	lowest  int
+	highest int
+
+	examples []string
+	values   map[uint64]bool // the first distinct values
+	repeated bool            // a value occurred twice
+	overflow bool            // more distinct values than were kept
+}
+
+// What inspect found in a document
+type structure struct {
+	examples int
+	entities map[string]string // the input declares
+	document *inspectedPath
+	paths    map[string]*inspectedPath
+	names    map[string]int // local element names and the number of paths they end
+}
+
+// Finds or adds the child of p with the given name
+func (s *structure) child(p *inspectedPath, name string) *inspectedPath {
+	path := name
+	if p.path != "" {
+		path = p.path + "/" + name
+	}
+	if c, ok := s.paths[path]; ok {
+		return c
+	}
+	c := &inspectedPath{name: name, path: path, parent: p, values: make(map[uint64]bool)}
+	s.paths[path] = c
+	p.children = append(p.children, c)
+	if !strings.HasPrefix(name, "@") {
+		s.names[localName(name)]++
+	}
+	return c
+}
+
+// Records a value of p
+func (s *structure) value(p *inspectedPath, value string) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return
+	}
+	if len(p.examples) < s.examples && !slices.Contains(p.examples, value) {
+		p.examples = append(p.examples, value)
+	}
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	switch sum := h.Sum64(); {
+	case p.values[sum]:
+		p.repeated = true
+	case len(p.values) < inspectedValues:
+		p.values[sum] = true
+	default:
+		p.overflow = true
+	}
+}
+
+// Scans the input, or its first limit bytes if limit is set, reporting
+// whether all of it was read
+func (s *structure) scan(filePath string, limit int64) (bool, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	var limited *io.LimitedReader
+	if limit > 0 {
+		limited = &io.LimitedReader{R: f, N: limit}
+		r = limited
+	}
+
+	s.document = &inspectedPath{}
+	s.paths = make(map[string]*inspectedPath)
+	s.names = make(map[string]int)
+	// one frame per open element, counting its children and holding the
+	// start of its text
+	type frame struct {
+		path   *inspectedPath
+		counts map[*inspectedPath]int
+		text   strings.Builder
+	}
+	stack := []*frame{{path: s.document, counts: make(map[*inspectedPath]int)}}
+	// read raw, so names keep their prefixes
+	decoder := newInputDecoder(bufio.NewReader(r), s.entities)
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF && len(stack) > 1 {
+			err = fmt.Errorf("unexpected EOF")
+		}
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			if limited != nil && limited.N == 0 {
+				// the scan ended mid-document
+				return false, nil
+			}
+			return false, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			parent := stack[len(stack)-1]
+			p := s.child(parent.path, qualifiedName(t.Name))
+			p.count++
+			parent.counts[p]++
+			for _, a := range t.Attr {
+				if _, ok := nsDecl(a); ok {
+					continue
+				}
+				attr := s.child(p, "@"+qualifiedName(a.Name))
+				attr.count++
+				s.value(attr, a.Value)
+			}
+			stack = append(stack, &frame{path: p, counts: make(map[*inspectedPath]int)})
+		case xml.EndElement:
+			fr := stack[len(stack)-1]
+			if name := qualifiedName(t.Name); fr.path == s.document || fr.path.name != name {
+				return false, fmt.Errorf("unexpected </%s>", name)
+			}
+			stack = stack[:len(stack)-1]
+			fr.path.closed++
+			for c, n := range fr.counts {
+				if c.parents == 0 || n < c.lowest {
+					c.lowest = n
+				}
+				if n > c.highest {
+					c.highest = n
+				}
+				c.parents++
+			}
+			s.value(fr.path, fr.text.String())
+		case xml.CharData:
+			// only the start of long text is kept
+			if fr := stack[len(stack)-1]; fr.text.Len() < 200 {
+				fr.text.Write(t)
+			}
+		}
+	}
+}
+
+// Prints p's children, indented by their depth
+func (s *structure) print(p *inspectedPath, depth, maxDepth int) {
+	if maxDepth > 0 && depth >= maxDepth {
+		return
+	}
+	for _, c := range p.children {
+		var details []string
+		details = append(details, fmt.Sprint(c.count))
+		// per parent, of the parents read to the end
+		if !strings.HasPrefix(c.name, "@") && p != s.document && p.closed > 0 {
+			lowest := c.lowest
+			if c.parents < p.closed {
+				// some parents didn't have it
+				lowest = 0
+			}
+			switch {
+			case lowest == 1 && c.highest == 1:
+			case lowest == c.highest:
+				details = append(details, fmt.Sprintf("%d per %s", lowest, p.name))
+			default:
+				details = append(details, fmt.Sprintf("%d-%d per %s", lowest, c.highest, p.name))
+			}
+		}
+		if strings.HasPrefix(c.name, "@") && c.count < p.count {
+			details = append(details, fmt.Sprintf("on %d of %d", c.count, p.count))
+		}
+		switch {
+		case c.count < 2 || c.repeated:
+		case c.overflow:
+			details = append(details, fmt.Sprintf("unique in the first %d", inspectedValues))
+		case len(c.values) == c.count:
+			details = append(details, "unique")
+		}
+		line := fmt.Sprintf("%s%s (%s)", strings.Repeat("  ", depth), c.name, strings.Join(details, "; "))
+		if len(c.examples) > 0 {
+			var quoted []string
+			for _, e := range c.examples {
+				if len([]rune(e)) > 40 {
+					e = string([]rune(e)[:40]) + "…"
+				}
+				quoted = append(quoted, fmt.Sprintf("%q", e))
+			}
+			line += " e.g. " + strings.Join(quoted, ", ")
+		}
+		fmt.Println(line)
+		s.print(c, depth+1, maxDepth)
+	}
+}
+
+// Suggests -node and -ref values: the element occurring most often among
+// those with children or attributes, and its children or attributes found
+// once in each with unique values
+func (s *structure) suggest() {
+	var node *inspectedPath
+	for _, p := range s.paths {
+		if strings.HasPrefix(p.name, "@") || len(p.children) == 0 || p.count < 2 {
+			continue
+		}
+		if node == nil || p.count > node.count || p.count == node.count && len(p.path) < len(node.path) {
+			node = p
+		}
+	}
+	if node == nil {
+		fmt.Println("No repeated elements found to suggest -node from")
+		return
+	}
+	// -node and -ref match names without their prefixes
+	name := localName(node.name)
+	if s.names[name] > 1 {
+		// another path ends in the same name
+		steps := strings.Split(node.path, "/")
+		for i, step := range steps {
+			steps[i] = localName(step)
+		}
+		name = strings.Join(steps, "/")
+	}
+	local := func(c *inspectedPath) string {
+		if attr, ok := strings.CutPrefix(c.name, "@"); ok {
+			return "@" + localName(attr)
+		}
+		return localName(c.name)
+	}
+	shared := make(map[string]int)
+	for _, c := range node.children {
+		shared[local(c)]++
+	}
+	var refs []string
+	for _, c := range node.children {
+		once := c.count == node.count && (strings.HasPrefix(c.name, "@") || c.lowest == 1 && c.highest == 1 && c.parents == node.closed)
+		// a name left ambiguous without its prefix would match both
+		if once && !c.repeated && (c.overflow || len(c.values) == c.count) && shared[local(c)] == 1 {
+			refs = append(refs, "-ref "+local(c))
+		}
+	}
+	suggestion := "-node " + name
+	if len(refs) > 0 {
+		suggestion += " with " + strings.Join(refs, " or ")
+	}
+	fmt.Printf("Suggested: %s (%d %s elements)\n", suggestion, node.count, node.name)
+}
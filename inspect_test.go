@@ -0,0 +1,30 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInspectPrefixes(t *testing.T) {
+	dir := testDir(t, map[string]string{"in.xml": `<catalog xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:xlink="http://www.w3.org/1999/xlink">
+<dc:record xlink:href="a"><dc:creator>Ann</dc:creator><creator>A</creator></dc:record>
+<dc:record xlink:href="b"><dc:creator>Bob</dc:creator><creator>B</creator></dc:record>
+</catalog>`})
+	out := captureStdout(t, func() {
+		if err := inspect([]string{filepath.Join(dir, "in.xml")}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	for _, want := range []string{
+		"  dc:record (2; 2 per catalog)",
+		`    @xlink:href (2; unique) e.g. "a", "b"`,
+		`    dc:creator (2; unique) e.g. "Ann", "Bob"`,
+		`    creator (2; unique) e.g. "A", "B"`,
+		"Suggested: -node record with -ref @href (2 dc:record elements)",
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+)
+
+// -format json and ndjson: each entry is written as a JSON object, in files
+// holding a JSON array of them or one object per line. Child elements become keys, in document order, and
+// elements repeated under one parent an array; attributes become keys
+// prefixed with @, and text beside attributes or child elements the key
+// #text. Keys keep the names' prefixes, as in dc:creator or @xlink:href. Values are strings as written, since XML has no types.
+func entryJSON(raw string) (string, error) {
+	n, err := parseNode(raw)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	writeJSONObject(&b, n)
+	return b.String(), nil
+}
+
+// Writes an element's value: its text alone, or an object
+func writeJSONValue(b *strings.Builder, n *node) {
+	if len(n.children) == 0 && len(jsonAttrs(n)) == 0 {
+		writeJSONString(b, n.text)
+		return
+	}
+	writeJSONObject(b, n)
+}
+
+func writeJSONObject(b *strings.Builder, n *node) {
+	b.WriteString("{")
+	first := true
+	key := func(name string) {
+		if !first {
+			b.WriteString(",")
+		}
+		first = false
+		writeJSONString(b, name)
+		b.WriteString(":")
+	}
+	for _, a := range jsonAttrs(n) {
+		key("@" + qualifiedName(a.Name))
+		writeJSONString(b, a.Value)
+	}
+	if text := strings.TrimSpace(n.text); text != "" {
+		// the whole text when it stands alone, as in a value
+		if len(n.children) == 0 {
+			text = n.text
+		}
+		key("#text")
+		writeJSONString(b, text)
+	}
+
+	// children grouped by name, in order of first appearance
+	var names []string
+	byName := make(map[string][]*node)
+	for _, c := range n.children {
+		if _, ok := byName[c.qname]; !ok {
+			names = append(names, c.qname)
+		}
+		byName[c.qname] = append(byName[c.qname], c)
+	}
+	for _, name := range names {
+		key(name)
+		group := byName[name]
+		if len(group) == 1 {
+			writeJSONValue(b, group[0])
+			continue
+		}
+		b.WriteString("[")
+		for i, c := range group {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			writeJSONValue(b, c)
+		}
+		b.WriteString("]")
+	}
+	b.WriteString("}")
+}
+
+// An element's attributes, less namespace declarations
+func jsonAttrs(n *node) []xml.Attr {
+	var attrs []xml.Attr
+	for _, a := range n.attr {
+		if a.Name.Space != "xmlns" && a.Name.Local != "xmlns" {
+			attrs = append(attrs, a)
+		}
+	}
+	return attrs
+}
+
+// Writes s as a JSON string, leaving <, > and & as they are
+func writeJSONString(b *strings.Builder, s string) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	b.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+// Converts an entry to the output format, keeping its XML for anything that
+// still reads it, such as -partition-by
+func (r rootElement) formatEntry(e entry) (entry, error) {
+	var err error
+	switch {
+	case e.formatted != "" || e.rendered:
+	case r.template != nil:
+		e.formatted, err = r.template.render(e)
+		e.rendered = true
+	case r.format == "parquet" || r.format == "avro":
+		// written by the sink, which collects the values
+	case r.columns != nil:
+		e.formatted, err = r.columns.entryRow(e.raw)
+	case r.format != "":
+		e.formatted, err = entryJSON(e.raw)
+	}
+	return e, err
+}
+
+func (r rootElement) formatEntries(entries []entry) error {
+	for i, e := range entries {
+		var err error
+		if entries[i], err = r.formatEntry(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
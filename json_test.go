@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestEntryJSON(t *testing.T) {
+	tests := []struct{ raw, want string }{
+		{`<record id="7"><tag>a</tag><tag>b</tag></record>`, `{"@id":"7","tag":["a","b"]}`},
+		{`<record><title lang="en">T</title></record>`, `{"title":{"@lang":"en","#text":"T"}}`},
+		{
+			`<book xmlns:dc="http://purl.org/dc/elements/1.1/" xml:lang="en"><dc:creator>Ann</dc:creator><creator>Bob</creator><link xlink:href="x"/></book>`,
+			`{"@xml:lang":"en","dc:creator":"Ann","creator":"Bob","link":{"@xlink:href":"x"}}`,
+		},
+	}
+	for _, test := range tests {
+		got, err := entryJSON(test.raw)
+		if err != nil {
+			t.Errorf("entryJSON(%q): %v", test.raw, err)
+		} else if got != test.want {
+			t.Errorf("entryJSON(%q) = %s, want %s", test.raw, got, test.want)
+		}
+	}
+	for _, raw := range []string{`<a><b></a></b>`, `<a><b>`, `<a></a></b>`} {
+		if _, err := entryJSON(raw); err == nil {
+			t.Errorf("entryJSON(%q) accepted malformed XML", raw)
+		}
+	}
+}
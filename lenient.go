@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"strings"
+	"sync/atomic"
+)
+
+// -lenient: the input is parsed in the decoder's non-strict mode, so
+// unescaped ampersands, unknown entities, unquoted attributes and unclosed
+// tags don't stop the run. Entries are still copied from the source as is,
+// except the tokens the decoder had to recover, which are written out
+// well-formed instead.
+var lenient atomic.Bool
+
+// Lets the decoder of the input recover from malformed XML, knowing the
+// HTML entities like &nbsp; exports often use undeclared
+func relax(decoder *xml.Decoder) {
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	known := make(map[string]string, len(xml.HTMLEntity)+len(decoder.Entity))
+	maps.Copy(known, xml.HTMLEntity)
+	maps.Copy(known, decoder.Entity)
+	decoder.Entity = known
+}
+
+// The message of a syntax error without its line, which counts from where
+// the decoder started rather than the start of the input
+func tokenError(err error) string {
+	var syntax *xml.SyntaxError
+	if errors.As(err, &syntax) {
+		return syntax.Msg
+	}
+	return err.Error()
+}
+
+// Repairs the tokens of one parse in -lenient mode, warning about each
+type recovery struct {
+	content  []byte            // the input, for line numbers, unless it is streamed
+	entities map[string]string // the input declares, which its text may use
+	pos      int64             // where line was counted up to
+	line     int
+	count    int
+
+	// the qualified names of the open elements, "" for self-closing ones
+	open []string
+	// the end tag just read closed another element; the one it names
+	// follows without a tag of its own
+	pending bool
+	// source of the token after a void element, read before closing it
+	carried   []byte
+	carriedAt int64
+}
+
+func newRecovery(content []byte, entities map[string]string) *recovery {
+	return &recovery{content: content, entities: entities, line: 1}
+}
+
+// Logs a recovered error at offset, a position in the input
+func (r *recovery) warn(offset int64, format string, args ...any) {
+	r.count++
+	if r.content == nil {
+		// a streamed input has no lines to count
+		fmt.Printf("Warning: offset %d: %s\n", offset, fmt.Sprintf(format, args...))
+		return
+	}
+	if offset >= r.pos && offset <= int64(len(r.content)) {
+		r.line += bytes.Count(r.content[r.pos:offset], []byte("\n"))
+		r.pos = offset
+	}
+	fmt.Printf("Warning: line %d: %s\n", r.line, fmt.Sprintf(format, args...))
+}
+
+// Whether the input ended before all its elements were closed
+func endedEarly(err error) bool {
+	var syntax *xml.SyntaxError
+	return errors.As(err, &syntax) && syntax.Msg == "unexpected EOF"
+}
+
+// The source of a token and where it starts. To close a void element like
+// <br> the decoder reads the token after it first, so that token's source
+// comes with the end element made up for the void one.
+func (r *recovery) source(token xml.Token, text []byte, offset int64) ([]byte, int64) {
+	if r.carried != nil {
+		text, offset = r.carried, r.carriedAt
+		r.carried = nil
+		return text, offset
+	}
+	if _, ok := token.(xml.EndElement); ok && len(text) > 0 && !bytes.HasPrefix(text, []byte("</")) {
+		r.carried, r.carriedAt = bytes.Clone(text), offset
+		return nil, offset
+	}
+	return text, offset
+}
+
+// A start tag as it should be copied: raw when it is well-formed, or
+// rewritten with its attribute values quoted and escaped
+func (r *recovery) start(raw []byte, offset int64) []byte {
+	token, err := newInputDecoder(bytes.NewReader(raw), r.entities).RawToken()
+	if t, ok := token.(xml.StartElement); ok && err == nil {
+		r.push(qualifiedName(t.Name), raw)
+		return raw
+	}
+
+	decoder := newInputDecoder(bytes.NewReader(raw), r.entities)
+	relax(decoder)
+	token, _ = decoder.RawToken()
+	t, ok := token.(xml.StartElement)
+	if !ok {
+		return raw
+	}
+	name := qualifiedName(t.Name)
+	r.warn(offset, "malformed start tag of <%s>: %s", name, tokenError(err))
+	var b strings.Builder
+	b.WriteString("<" + name)
+	for _, a := range t.Attr {
+		b.WriteString(" " + qualifiedName(a.Name) + `="`)
+		xml.EscapeText(&b, []byte(a.Value))
+		b.WriteString(`"`)
+	}
+	if bytes.HasSuffix(raw, []byte("/>")) {
+		b.WriteString("/>")
+	} else {
+		b.WriteString(">")
+	}
+	repaired := []byte(b.String())
+	r.push(name, repaired)
+	return repaired
+}
+
+func (r *recovery) push(name string, tag []byte) {
+	if bytes.HasSuffix(tag, []byte("/>")) {
+		name = ""
+	}
+	r.open = append(r.open, name)
+}
+
+// An end tag as it should be copied: the decoder closes elements left open,
+// and void elements like <br>, without one in the source
+func (r *recovery) end(raw []byte, offset int64) []byte {
+	if len(r.open) == 0 {
+		return raw
+	}
+	name := r.open[len(r.open)-1]
+	r.open = r.open[:len(r.open)-1]
+	switch {
+	case name == "":
+		// self-closing
+		return raw
+	case len(raw) == 0:
+		if r.pending {
+			r.pending = false
+		} else {
+			r.warn(offset, "closed <%s>, which was left open", name)
+		}
+	case strings.TrimSpace(string(raw[2:len(raw)-1])) != name:
+		r.warn(offset, "closed <%s>, which was left open, before %s", name, raw)
+		r.pending = true
+	default:
+		return raw
+	}
+	return []byte("</" + name + ">")
+}
+
+// Reports the end tag next starts with when it closes none of the open
+// elements. The decoder would close them all looking for its element and
+// then fail, so such a tag is read raw and dropped instead.
+func (r *recovery) stray(next []byte) (string, bool) {
+	if r.pending || r.carried != nil || len(r.open) > 0 && r.open[len(r.open)-1] == "" {
+		// the decoder has a token of its own to return first
+		return "", false
+	}
+	if !bytes.HasPrefix(next, []byte("</")) {
+		return "", false
+	}
+	end := bytes.IndexByte(next, '>')
+	if end == -1 {
+		return "", false
+	}
+	name := localName(strings.TrimSpace(string(next[2:end])))
+	for _, open := range r.open {
+		if open != "" && localName(open) == name {
+			return "", false
+		}
+	}
+	return string(next[:end+1]), true
+}
+
+// A qualified name without its prefix, as the decoder matches end tags
+func localName(name string) string {
+	if i := strings.IndexByte(name, ':'); i != -1 {
+		return name[i+1:]
+	}
+	return name
+}
+
+var textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// Text as it should be copied: raw unless it has ampersands that don't start
+// an entity or character reference it may use, when it is escaped again
+func (r *recovery) charData(t xml.CharData, raw []byte, offset int64) []byte {
+	if bytes.IndexByte(raw, '&') == -1 {
+		return raw
+	}
+	decoder := newInputDecoder(bytes.NewReader(raw), r.entities)
+	var err error
+	for err == nil {
+		_, err = decoder.Token()
+	}
+	if err == io.EOF {
+		return raw
+	}
+	r.warn(offset, "text not escaped: %s", tokenError(err))
+	return []byte(textEscaper.Replace(string(t)))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLenientEndTags(t *testing.T) {
+	tests := []struct {
+		name, input, want string
+	}{
+		{
+			"mismatched",
+			`<catalog><book n="1"><title>bad</x></title></book></catalog>`,
+			`<book n="1"><title>bad</title></book>`,
+		},
+		{
+			"stray",
+			`<catalog><book n="1"><title>t</title></y></book></catalog>`,
+			`<book n="1"><title>t</title></book>`,
+		},
+		{
+			"closes an outer element",
+			`<catalog><book n="1"><title>open</book></catalog>`,
+			`<book n="1"><title>open</title></book>`,
+		},
+		{
+			"after the root",
+			`<catalog><book n="1"><title>t</title></book></catalog></catalog>`,
+			`<book n="1"><title>t</title></book>`,
+		},
+		{
+			"unclosed root",
+			`<book n="1"><title>bad</x>`,
+			`<book n="1"><title>bad</title></book>`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testDir(t, map[string]string{"in.xml": test.input, "ids.csv": "1\n"})
+			opts := testOptions(t, "-node", "book", "-ref", "@n", "-csv", "ids.csv", "-lenient", "-no-root")
+			opts.inputPath = filepath.Join(dir, "in.xml")
+			if _, err := run(context.Background(), opts); err != nil {
+				t.Fatal(err)
+			}
+			content, err := os.ReadFile(filepath.Join(dir, "output", "book_@n_part-1.xml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(content); got != test.want+"\n" {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// How numbers and dates are written in the documents a -locale stands for
+type locale struct {
+	decimal  rune   // decimal separator
+	groups   string // digit group separators
+	dayFirst bool   // 03/04/2024 is 3 April rather than March 4
+}
+
+// -locale: when set, filters read the numbers and dates in the document the
+// way the locale writes them
+var filterLocale atomic.Pointer[locale]
+
+// Parses a -locale like de, de-DE, fr_FR or en-US
+func parseLocale(s string) (*locale, error) {
+	tag := strings.ToLower(strings.ReplaceAll(s, "_", "-"))
+	lang, region, _ := strings.Cut(tag, "-")
+	switch {
+	case region == "ch" && (lang == "de" || lang == "fr" || lang == "it"):
+		return &locale{decimal: '.', groups: "'’", dayFirst: true}, nil
+	case region == "us" || region == "ph" || (lang == "en" && region == ""):
+		return &locale{decimal: '.', groups: ",", dayFirst: false}, nil
+	}
+	switch lang {
+	case "en", "ja", "zh", "ko", "he", "th", "hi", "ga", "mt":
+		return &locale{decimal: '.', groups: ",", dayFirst: true}, nil
+	case "de", "nl", "es", "it", "pt", "da", "id", "tr", "el", "ro", "hr", "sl", "sr", "is", "vi":
+		return &locale{decimal: ',', groups: ".", dayFirst: true}, nil
+	case "fr", "sv", "nb", "no", "nn", "fi", "pl", "cs", "sk", "ru", "uk", "hu", "bg", "lt", "lv", "et":
+		return &locale{decimal: ',', groups: "   ", dayFirst: true}, nil
+	}
+	return nil, fmt.Errorf("unsupported -locale %q (use a language like de, fr or en, optionally with a region like en-GB)", s)
+}
+
+var localDate = regexp.MustCompile(`^(\d{1,4})[./-](\d{1,2})[./-](\d{1,4})(?:[ T](\d{1,2}):(\d{2})(?::(\d{2}))?)?$`)
+
+// A document value as filters compare it: a number in the plain form of
+// filter literals, like 1234.5, or a date as ISO 8601, like 2024-04-03, which
+// orders correctly as a string. Other values, and all values without a
+// -locale, are returned as they are.
+func localized(s string) string {
+	l := filterLocale.Load()
+	if l == nil {
+		return s
+	}
+	if f, ok := l.number(s); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	if d, ok := l.date(s); ok {
+		return d
+	}
+	return s
+}
+
+// Reads a number written like 1.234,5 or -0,75, where digit groups, if any,
+// must all be of three digits
+func (l *locale) number(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	var b strings.Builder
+	digits := 0      // in the current group
+	grouped := false // a group separator was seen
+	decimal := false
+	for i, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+			digits++
+		case (r == '-' || r == '+') && i == 0:
+			b.WriteRune(r)
+		case r == l.decimal && !decimal:
+			if grouped && digits != 3 {
+				return 0, false
+			}
+			b.WriteByte('.')
+			decimal = true
+			digits = 0
+		case strings.ContainsRune(l.groups, r) && !decimal:
+			if digits == 0 || digits > 3 || (grouped && digits != 3) {
+				return 0, false
+			}
+			grouped = true
+			digits = 0
+		default:
+			return 0, false
+		}
+	}
+	if grouped && !decimal && digits != 3 {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(b.String(), 64)
+	return f, err == nil
+}
+
+// Reads a date like 03/04/2024 or 3.4.2024 14:30 in the locale's order, or
+// one starting with a four-digit year, as ISO 8601
+func (l *locale) date(s string) (string, bool) {
+	m := localDate.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return "", false
+	}
+	var year, month, day string
+	switch {
+	case len(m[1]) == 4:
+		year, month, day = m[1], m[2], m[3]
+	case len(m[3]) != 4:
+		return "", false
+	case l.dayFirst:
+		day, month, year = m[1], m[2], m[3]
+	default:
+		month, day, year = m[1], m[2], m[3]
+	}
+	mo, _ := strconv.Atoi(month)
+	d, _ := strconv.Atoi(day)
+	if mo < 1 || mo > 12 || d < 1 || d > 31 {
+		return "", false
+	}
+	date := fmt.Sprintf("%s-%02d-%02d", year, mo, d)
+	if m[4] != "" {
+		h, _ := strconv.Atoi(m[4])
+		date += fmt.Sprintf("T%02d:%s", h, m[5])
+		if m[6] != "" {
+			date += ":" + m[6]
+		}
+	}
+	return date, true
+}
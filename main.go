@@ -5,148 +5,1923 @@ import (
 	"archive/zip"
 	"bufio"
 	"bytes"
+	"cmp"
 	"compress/gzip"
+	"context"
 	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
+// Settings collected from the command line
+type options struct {
+	parentNode         string
+	refNodes           stringList
+	matchAll           bool
+	matchAny           bool
+	url                string
+	indexURL           string
+	indexElement       string
+	batchWorkers       int
+	includeFiles       stringList
+	excludeFiles       stringList
+	modifiedAfter      string
+	inputPath          string // set for each file of a batch
+	indexResume        bool
+	failFast           bool
+	outputDir          string
+	csvPath            string
+	idsFromClipboard   bool
+	head               int
+	headEntries        int
+	chunkSize          int
+	chunkBytes         byteSize
+	compress           string
+	archive            string
+	force              bool
+	appendSuffix       bool
+	header             bool
+	noHeader           bool
+	verify             bool
+	archiveManifest    bool
+	archivePassword    string
+	archivePasswordCmd string
+	decompressCmd      string
+	encoding           string
+	outputEncoding     string
+	queryPack          string
+	lenient            bool
+	trustEntities      bool
+	locale             string
+	maxMemory          byteSize
+	maxExtractSize     byteSize
+	maxExtractFileSize byteSize
+	maxExtractFiles    int
+	skipMalformed      bool
+	execHook           string
+	execHookFormat     string
+	root               string
+	contract           string
+	contractSample     byteSize
+	preserveRoot       bool
+	noRoot             bool
+	format             string
+	columns            stringList
+	avroSchema         string
+	template           string
+	xslt               string
+	xsltScope          string
+	xsd                string
+	xsdScope           string
+	printFields        stringList
+	values             *os.File // where -print-fields prints, stdout
+	keepDoctype        bool
+	prolog             string            // the input's declaration and DOCTYPE, for -keep-doctype
+	entities           map[string]string // the internal entities its DOCTYPE declares
+	recipe             *recipe           // the recipe being run, if any
+	chunkGroups        bool
+	groupBy            string
+	partitionBy        string
+	dryRun             bool
+	maxDuration        time.Duration
+	shards             int
+	shardBy            string
+	xpath              string
+	refRegex           bool
+	refWildcard        bool
+	matchFold          bool
+	matchTrim          bool
+	matchCollapse      bool
+	normalize          string
+	fuzzy              int
+	bloom              bool
+	bloomFP            float64
+	exclude            bool
+	excludeCSV         string
+	related            stringList
+	referenced         stringList
+	where              stringList
+	filter             string
+	tombstone          string
+	deleted            string
+	hash               bool
+	hashAttr           string
+	ordinal            bool
+	ordinalAttr        string
+	offsetAttr         string
+	c14n               bool
+	indent             string
+	minify             bool
+	layout             *layout // from -indent or -minify
+	keepComments       bool
+	keepPIs            bool
+	rules              string
+	limit              int
+	sample             int
+	sampleRate         float64
+	seed               uint64
+	seeded             bool
+	count              bool
+	split              bool
+	dedupe             bool
+	maxPerID           int
+	checkpoint         time.Duration
+	resume             bool
+	checks             string
+	dropInvalid        bool
+	sortBy             string
+	sortDesc           bool
+	sortAs             string
+	keep               stringList
+	drop               stringList
+	redact             stringList
+	redactSalt         string
+	truncate           stringList
+	truncMarker        string
+	openOutput         bool
+	reportUnmatched    bool
+	reportMultiple     bool
+	skip               int
+	notifyEmail        string
+	notifySlack        string
+	notifyTeams        string
+	notifyTmpl         string
+	notifyOn           string
+	smtpAddr           string
+}
+
+// How the first line of the CSV is treated, from -header and -no-header
+func (o options) headerMode() headerMode {
+	switch {
+	case o.header:
+		return headerSkip
+	case o.noHeader:
+		return headerKeep
+	}
+	return headerAuto
+}
+
+// A flag that may be given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// A size in bytes given like 100MB, 1.5GB, 512KiB or 4096
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(value string) error {
+	units := []struct {
+		suffix string
+		factor float64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"B", 1},
+	}
+	number, factor := strings.TrimSpace(value), 1.0
+	for _, u := range units {
+		if n, ok := strings.CutSuffix(strings.ToUpper(number), strings.ToUpper(u.suffix)); ok {
+			number, factor = strings.TrimSpace(n), u.factor
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil || f <= 0 {
+		return fmt.Errorf("invalid size %q: expected e.g. 100MB", value)
+	}
+	*b = byteSize(f * factor)
+	return nil
+}
+
+// What a run did, used for notifications
+type runSummary struct {
+	input       string
+	outputDir   string
+	ids         int
+	matches     int
+	files       []string
+	duration    time.Duration
+	partial     bool   // stopped by -max-duration or a signal
+	interrupted bool   // stopped by SIGINT or SIGTERM
+	offset      int64  // input offset reached by a partial run
+	manifest    string // run-manifest.json written for the run, if any
+
+	// fingerprints of the files read, for the recipe
+	inputFile    *manifestFile
+	idsFile      *manifestFile
+	excludedFile *manifestFile
+
+	// how the run changed strategy to stay within -max-memory
+	adaptations []string
+
+	// IDs never found, counted with -report-unmatched
+	unmatched        int
+	countedUnmatched bool
+
+	queryPack *packRecord // the query pack the run came from
+
+	deleted *deletedRecord // live entries and tombstones, with -tombstone
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "self-update" {
+		if err := selfUpdate(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	// ds-xml run recipe.json [flags]: repeat a run from its recipe, with
+	// any flags given after it overriding the recipe's
+	var fromRecipe *recipe
+	if len(os.Args) > 2 && os.Args[1] == "run" {
+		r, args, err := loadRecipe(os.Args[2])
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Running recipe %s: %s\n", os.Args[2], strings.Join(args, " "))
+		fromRecipe = r
+		os.Args = append(append([]string{os.Args[0]}, args...), os.Args[3:]...)
+	}
+	// ds-xml extract [flags] is the same as ds-xml [flags], e.g.
+	// ds-xml extract --query-pack q.tgz
+	if len(os.Args) > 1 && os.Args[1] == "extract" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	// -query-pack: the pack's flags come first, so ones given on the command
+	// line override them
+	var pack *queryPack
+	var packed map[string]bool // flags only the pack set
+	if path := queryPackArg(os.Args[1:]); path != "" {
+		dir, err := os.MkdirTemp("", "ds-xml-pack-")
+		if err != nil {
+			fmt.Println("Error creating temp directory:", err)
+			os.Exit(1)
+		}
+		defer os.RemoveAll(dir)
+		p, args, err := loadQueryPack(path, dir)
+		if err != nil {
+			os.RemoveAll(dir)
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Running query pack %s version %s: %s\n", path, p.Version, strings.Join(args, " "))
+		pack, packed = p, make(map[string]bool)
+		given := givenFlags(os.Args[1:])
+		for name := range p.set {
+			packed[name] = !given[name]
+		}
+		os.Args = append(append([]string{os.Args[0]}, args...), os.Args[1:]...)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		if err := inspect(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "stats" {
+		if err := stats(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		if err := validate(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rechunk" {
+		if err := rechunk(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Command-line flags
-	parentNode := flag.String("node", "", "Parent node to search for")
-	refNode := flag.String("ref", "", "Reference node containing ID")
-	urlFlag := flag.String("url", "", "URL to download xml from")
-	scanFlag := flag.Int("head", 0, "Scan and print the first N characters of the xml")
-	chunkSize := flag.Int("chunk", 0, "Number of entries per output xml file (default: all in one file)")
+	var opts options
+	opts.define(flag.CommandLine)
 	flag.Parse()
+	opts.recipe = fromRecipe
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "seed" {
+			opts.seeded = true
+		}
+	})
 
-	if *parentNode == "" && *scanFlag == 0 {
+	if opts.parentNode == "" && opts.xpath == "" && len(opts.referenced) == 0 && opts.rules == "" && opts.head == 0 {
 		fmt.Println("Usage: ds-xml -node <parentNode> -ref <refNode>")
+		fmt.Println("   or: ds-xml -xpath <expression>")
+		fmt.Println("   or: ds-xml -referenced-by <node>:<field>")
+		fmt.Println("   or: ds-xml -rules <rules.json>")
+		fmt.Println("   or: ds-xml rechunk <file.xml> -node <parentNode> -chunk <N>")
+		fmt.Println("   or: ds-xml inspect <file.xml>")
+		fmt.Println("   or: ds-xml stats <file.xml> [-node <parentNode>]")
+		fmt.Println("   or: ds-xml validate <file.xml> [-all]")
+		fmt.Println("   or: ds-xml run <recipe.json>")
+		fmt.Println("   or: ds-xml self-update [-allow-downgrade]")
 		return
 	}
 
+	if err := opts.prepare(); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	if len(opts.printFields) > 0 {
+		// only the values go to stdout, so they can be piped
+		opts.values, os.Stdout = os.Stdout, os.Stderr
+	}
+
+	// the first SIGINT or SIGTERM stops the run at the next entry boundary
+	// and writes what was captured; a second one kills it as usual
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		fmt.Println("Stopping, press Ctrl+C again to abort immediately")
+	}()
+
+	password, err := archivePassword(opts)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	opts.archivePassword = password
+
+	opts.outputDir = "output"
+	start := time.Now()
+	var summary *runSummary
+	if opts.indexURL != "" {
+		summary, err = runIndex(ctx, opts)
+	} else {
+		summary, err = run(ctx, opts)
+	}
+	summary.duration = time.Since(start)
+	if ctx.Err() != nil {
+		summary.interrupted = true
+	}
+	unmet := false
+	if pack != nil {
+		summary.queryPack = pack.record()
+		if err == nil && !summary.partial {
+			if violated := pack.check(summary); len(violated) > 0 {
+				summary.queryPack.Violated, unmet = violated, true
+				err = fmt.Errorf("Error: the run doesn't meet the expectations of query pack %s version %s:\n  %s", pack.path, pack.Version, strings.Join(violated, "\n  "))
+			}
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+	if !opts.dryRun {
+		if err := writeManifest(summary, start, err); err != nil {
+			fmt.Println("Error writing run manifest:", err)
+		}
+		if err == nil && !summary.partial && len(summary.files) > 0 {
+			if err := writeRecipe(summary, packed); err != nil {
+				fmt.Println("Error writing recipe:", err)
+			}
+		}
+	}
+	if opts.archive != "" {
+		if opts.dryRun && summary.matches > 0 {
+			fmt.Printf("Would pack the output files into %s\n", opts.archive)
+		} else if len(summary.files) > 0 {
+			if err := archiveOutputs(opts.archive, summary, opts.archiveManifest); err != nil {
+				fmt.Println("Error writing archive:", err)
+			}
+		}
+	}
+
+	if opts.head == 0 && opts.headEntries == 0 && (err != nil || opts.notifyOn == "always") {
+		notify(opts, summary, err)
+	}
+	if opts.openOutput && err == nil && len(summary.files) > 0 {
+		if err := openFolder(summary.outputDir); err != nil {
+			fmt.Println("Error opening output folder:", err)
+		}
+	}
+	if summary.interrupted {
+		os.Exit(exitInterrupted)
+	}
+	if summary.partial {
+		os.Exit(exitPartial)
+	}
+	if unmet {
+		os.Exit(exitExpectations)
+	}
+}
+
+// Defines the command-line flags on fs
+func (opts *options) define(fs *flag.FlagSet) {
+	fs.StringVar(&opts.parentNode, "node", "", "Parent node to search for (a slash path like catalog/book limits it to that position)")
+	fs.Var(&opts.refNodes, "ref", "Reference node containing ID (use node@attr or @attr to match an attribute); repeatable")
+	fs.BoolVar(&opts.matchAny, "match-any", false, "With several -ref, match if any of them holds an ID (default)")
+	fs.BoolVar(&opts.matchAll, "match-all", false, "With several -ref, match only if all of them hold an ID")
+	fs.StringVar(&opts.url, "url", "", "URL to download xml from")
+	fs.BoolVar(&opts.header, "header", false, "The first line of the CSV is a header row; skip it")
+	fs.BoolVar(&opts.noHeader, "no-header", false, "The first line of the CSV holds IDs, even if it looks like a header")
+	fs.StringVar(&opts.indexURL, "index-url", "", "URL of an index XML (e.g. a sitemap) listing data files to download and process")
+	fs.StringVar(&opts.indexElement, "index-element", "loc", "Element of the -index-url index holding each file URL")
+	fs.IntVar(&opts.batchWorkers, "workers", 4, "Number of files of a batch processed at once")
+	fs.Var(&opts.includeFiles, "include-files", "In batch runs, only process files whose name matches this glob; repeatable")
+	fs.Var(&opts.excludeFiles, "exclude-files", "In batch runs, skip files whose name matches this glob; repeatable")
+	fs.StringVar(&opts.modifiedAfter, "modified-after", "", "In batch runs, only process files modified after this date (e.g. 2024-01-01)")
+	fs.BoolVar(&opts.indexResume, "index-resume", false, "Skip -index-url files finished by an earlier run")
+	fs.BoolVar(&opts.failFast, "fail-fast", false, "Stop a batch run at the first file that fails")
+	fs.StringVar(&opts.csvPath, "csv", "", "CSV file of reference IDs, or - to read them from stdin (default: the .csv next to ds-xml)")
+	fs.BoolVar(&opts.idsFromClipboard, "ids-from-clipboard", false, "Read the IDs from the clipboard, one per line or comma-separated, instead of a CSV")
+	fs.IntVar(&opts.head, "head", 0, "Scan and print the first N characters of the xml")
+	fs.IntVar(&opts.headEntries, "head-entries", 0, "Print the first N -node entries of the xml, indented")
+	fs.IntVar(&opts.chunkSize, "chunk", 0, "Number of entries per output xml file (default: all in one file)")
+	fs.Var(&opts.chunkBytes, "chunk-size", "Maximum size of each output xml file, e.g. 100MB (KB/MB/GB are powers of 1000, KiB/MiB/GiB of 1024)")
+	fs.StringVar(&opts.compress, "compress", "", "Compress output xml files as they are written: gzip")
+	fs.BoolVar(&opts.verify, "verify", false, "Re-read the output files after writing and check they hold exactly the captured entries")
+	fs.BoolVar(&opts.force, "force", false, "Overwrite existing output files")
+	fs.BoolVar(&opts.appendSuffix, "append-suffix", false, "Write alongside existing output files, adding a suffix like _v2")
+	fs.StringVar(&opts.archive, "archive", "", "Pack the output files into one .zip or .tar.gz archive")
+	fs.BoolVar(&opts.archiveManifest, "archive-manifest", true, "Include run-manifest.json in the -archive")
+	fs.StringVar(&opts.root, "root", "", "Root element wrapping the output entries, with any attributes and xmlns, e.g. 'records xmlns=\"urn:acme:feed\"' (default \"root\")")
+	fs.StringVar(&opts.format, "format", "xml", "Format to write entries in: xml, json for files holding a JSON array of objects, ndjson for one object per line, csv or tsv for a row of -columns each, or parquet or avro for a table of -columns")
+	fs.StringVar(&opts.avroSchema, "avro-schema", "", "With -format avro, a schema (.avsc) whose fields are filled from the -columns of the same names, instead of one of nullable strings")
+	fs.StringVar(&opts.template, "template", "", "Go text/template file to render each entry through instead of writing XML, e.g. report.html.tmpl")
+	fs.StringVar(&opts.xslt, "xslt", "", "XSLT stylesheet to transform each captured entry by before writing it, with xsltproc")
+	fs.StringVar(&opts.xsltScope, "xslt-scope", "entry", "What -xslt transforms: each entry, or each output document")
+	fs.StringVar(&opts.xsd, "xsd", "", "XML Schema to validate each matched entry against, with xmllint")
+	fs.StringVar(&opts.xsdScope, "xsd-scope", "entry", "What -xsd validates: each entry, or each output document")
+	fs.Var(&opts.printFields, "print-fields", "Print the values of these fields of the matched entries instead of writing them, by path like doi or @id; repeatable or comma-separated")
+	fs.Var(&opts.columns, "columns", "With -format csv, tsv, parquet or avro, the fields of each row, by path like title, @id or author@role; repeatable or comma-separated")
+	fs.BoolVar(&opts.noRoot, "no-root", false, "Write the entries alone, one after another, without a root element or XML declaration")
+	fs.BoolVar(&opts.preserveRoot, "preserve-root", false, "Wrap the output entries in the input's own root element, with its attributes and namespace declarations")
+	fs.BoolVar(&opts.keepDoctype, "keep-doctype", false, "Start output files with the input's XML declaration and DOCTYPE, so entities it declares stay defined")
+	fs.StringVar(&opts.archivePassword, "archive-password", "", "Password of encrypted (ZipCrypto or AES) zip downloads (default: $DSXML_ARCHIVE_PASSWORD)")
+	fs.StringVar(&opts.archivePasswordCmd, "archive-password-cmd", "", "Command printing the password of encrypted zip downloads, e.g. a credential helper")
+	fs.StringVar(&opts.queryPack, "query-pack", "", "Run the extraction a query pack (.tgz, .zip or folder holding query.json) describes, failing if its expected counts aren't met")
+	fs.BoolVar(&opts.trustEntities, "trust-entities", false, "Trust the input: load the external entities and DTD its DOCTYPE refers to, from files or URLs, and don't limit entity expansion")
+	fs.BoolVar(&opts.lenient, "lenient", false, "Parse malformed XML, such as unescaped & or unclosed tags, repairing it and logging a warning for each error recovered")
+	fs.BoolVar(&opts.skipMalformed, "skip-malformed", false, "Leave out entries that are not well-formed instead of stopping, listing them in <base>_errors.csv")
+	opts.maxExtractSize, opts.maxExtractFileSize = byteSize(unpackLimits.total), byteSize(unpackLimits.file)
+	fs.Var(&opts.maxExtractSize, "max-extract-size", "Most a downloaded archive may unpack to, e.g. 20GB")
+	fs.Var(&opts.maxExtractFileSize, "max-extract-file-size", "Most one file of a downloaded archive may unpack to, e.g. 10GB")
+	fs.IntVar(&opts.maxExtractFiles, "max-extract-files", unpackLimits.files, "Most files a downloaded archive may hold")
+	fs.StringVar(&opts.decompressCmd, "decompress-cmd", "", "Command that decompresses the input from stdin to stdout, e.g. \"zstd -d -c\", for formats not handled natively")
+	fs.StringVar(&opts.encoding, "encoding", "", "Encoding of the input when its XML declaration is missing or wrong: UTF-8, ISO-8859-1, windows-1252, UTF-16LE or UTF-16BE")
+	fs.StringVar(&opts.outputEncoding, "output-encoding", "", "Encoding to write output files in: ISO-8859-1, windows-1252, UTF-16LE or UTF-16BE (default UTF-8)")
+	fs.Var(&opts.maxMemory, "max-memory", "Memory the run should stay within, e.g. 4GiB; inputs too big for it are streamed and batch runs process fewer files at once")
+	fs.DurationVar(&opts.maxDuration, "max-duration", 0, "Stop gracefully after this long, keeping partial output (e.g. 2h)")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "Print the input, IDs, matches and planned output files without writing anything")
+	fs.StringVar(&opts.partitionBy, "partition-by", "", "Write one output series per distinct value of a field (child element or @attr)")
+	fs.StringVar(&opts.groupBy, "group-by", "", "Keep entries sharing this field (child element or @attr) in the same chunk")
+	fs.BoolVar(&opts.chunkGroups, "chunk-groups", false, "Never split entries sharing a ref value across chunk files")
+	fs.IntVar(&opts.shards, "shards", 0, "Distribute entries across N output series by hash")
+	fs.StringVar(&opts.shardBy, "shard-by", "ref", "Value to hash when sharding: ref, entry or a field like @type")
+	fs.StringVar(&opts.xpath, "xpath", "", "XPath expression selecting and filtering entries (e.g. //article[author/@id = $id])")
+	fs.BoolVar(&opts.refRegex, "ref-regex", false, "Treat CSV entries as regular expressions matched against the ref value")
+	fs.BoolVar(&opts.refWildcard, "ref-wildcard", false, "Let CSV IDs containing * match by prefix, suffix or wildcard (e.g. ORD-2024-*)")
+	fs.BoolVar(&opts.matchFold, "match-fold", false, "Compare IDs case-insensitively")
+	fs.BoolVar(&opts.matchTrim, "match-trim", true, "Trim surrounding whitespace before comparing IDs")
+	fs.BoolVar(&opts.matchCollapse, "match-collapse", false, "Collapse inner runs of whitespace to one space before comparing IDs")
+	fs.BoolVar(&opts.bloom, "bloom", false, "Keep the IDs in an on-disk set behind a Bloom filter to bound memory")
+	fs.Float64Var(&opts.bloomFP, "bloom-fp", 0.01, "False-positive rate of the -bloom filter")
+	fs.IntVar(&opts.fuzzy, "fuzzy", 0, "Also match ref values within this Levenshtein distance of an ID")
+	fs.StringVar(&opts.normalize, "normalize", "", "Normalize IDs before comparing: isbn13, doi, ean or trim-leading-zeros (comma-separated)")
+	fs.BoolVar(&opts.exclude, "exclude", false, "Output the entries whose ref value is NOT in the CSV")
+	fs.StringVar(&opts.excludeCSV, "exclude-csv", "", "CSV file of IDs whose entries are left out even when they match")
+	fs.StringVar(&opts.locale, "locale", "", "Read numbers and dates compared by -where, -xpath and -filter as written in this locale, e.g. de (1.234,5 and 31.12.2024) or en-US")
+	fs.StringVar(&opts.execHook, "exec-hook", "", "Command each matched entry is piped to; exit 0 keeps it (replaced by any output), exit 1 leaves it out, e.g. 'python3 check.py'")
+	fs.StringVar(&opts.execHookFormat, "exec-hook-format", "xml", "What -exec-hook reads and prints: xml, or json as {\"ref\", \"offset\", \"xml\"}")
+	fs.Var(&opts.where, "where", "Keep only entries satisfying a condition like 'price > 100'; repeatable")
+	fs.StringVar(&opts.filter, "filter", "", "CEL-like expression entries must satisfy, e.g. 'entry.status == \"active\"'")
+	fs.StringVar(&opts.tombstone, "tombstone", "", "Condition marking an entry as deleted, in the syntax of -where, e.g. '@status = \"deleted\"'")
+	fs.StringVar(&opts.deleted, "deleted", "exclude", "With -tombstone, whether to exclude deleted entries, keep only them or include them")
+	fs.BoolVar(&opts.hash, "hash", false, "Add a SHA-256 of each entry's canonical form as an attribute")
+	fs.StringVar(&opts.hashAttr, "hash-attr", "hash", "Attribute name used by -hash")
+	fs.BoolVar(&opts.ordinal, "ordinal", false, "Stamp each entry with its position in the output and its byte offset in the input")
+	fs.StringVar(&opts.ordinalAttr, "ordinal-attr", "ordinal", "Attribute name used by -ordinal for the position")
+	fs.StringVar(&opts.offsetAttr, "offset-attr", "offset", "Attribute name used by -ordinal for the input offset")
+	fs.BoolVar(&opts.c14n, "c14n", false, "Write entries in Exclusive XML Canonicalization form")
+	fs.StringVar(&opts.indent, "indent", "", "Re-indent entries by this many spaces, or a string of spaces and tabs (\\t for a tab)")
+	fs.BoolVar(&opts.minify, "minify", false, "Remove the whitespace between the elements of entries")
+	fs.BoolVar(&opts.keepComments, "keep-comments", false, "Keep comments inside entries instead of dropping them")
+	fs.BoolVar(&opts.keepPIs, "keep-pis", false, "Keep processing instructions inside entries instead of dropping them")
+	fs.StringVar(&opts.rules, "rules", "", "JSON rules file describing several extractions to run in one pass")
+	fs.IntVar(&opts.limit, "limit", 0, "Stop after N matching entries")
+	fs.BoolVar(&opts.reportUnmatched, "report-unmatched", false, "Write a report of the CSV IDs never found in the XML")
+	fs.BoolVar(&opts.reportMultiple, "report-multiple", false, "With -report-unmatched, also report IDs matched more than once")
+	fs.BoolVar(&opts.openOutput, "open-output", false, "Open the output folder in the file manager when the run finishes")
+	fs.Var(&opts.keep, "keep", "Write only these child elements of entries, by path like title or meta/date; repeatable or comma-separated")
+	fs.Var(&opts.drop, "drop", "Leave these child elements out of entries, by path like fulltext or meta/notes; repeatable or comma-separated")
+	fs.Var(&opts.redact, "redact", "Scrub a field: <path>=blank, hash or fixed:<value>, e.g. customer/email=hash or @id=blank; repeatable")
+	fs.StringVar(&opts.redactSalt, "redact-salt", "", "Secret that -redact hashes are keyed with (HMAC-SHA256), so they can't be reversed by hashing guesses (default: $DSXML_REDACT_SALT)")
+	fs.Var(&opts.truncate, "truncate", "Cap the text of a field: <field>=<length>, e.g. description=500; repeatable")
+	fs.StringVar(&opts.truncMarker, "truncate-marker", "…", "Marker appended to text cut by -truncate")
+	fs.StringVar(&opts.sortBy, "sort-by", "", "Order output entries by a child element (or @attr) of each entry")
+	fs.BoolVar(&opts.sortDesc, "desc", false, "Sort -sort-by in descending order")
+	fs.StringVar(&opts.sortAs, "sort-as", "lexical", "How -sort-by compares keys: lexical or numeric")
+	fs.StringVar(&opts.checks, "checks", "", "JSON file of validation checks run against each matched entry")
+	fs.BoolVar(&opts.dropInvalid, "drop-invalid", false, "Leave entries that fail -checks out of the output")
+	fs.StringVar(&opts.contract, "contract", "", "JSON file of the elements and attributes the input must have; checked before extracting")
+	fs.Var(&opts.contractSample, "contract-sample", "Check -contract against only the first part of the input, e.g. 50MB (default: all of it)")
+	fs.IntVar(&opts.maxPerID, "max-per-id", 0, "Keep at most N entries per ref value and report the IDs that had more")
+	fs.DurationVar(&opts.checkpoint, "checkpoint", 0, "Save progress this often so an interrupted run can be continued with -resume (e.g. 10m)")
+	fs.BoolVar(&opts.resume, "resume", false, "Continue from the checkpoint left by an interrupted run")
+	fs.BoolVar(&opts.dedupe, "dedupe", false, "Drop entries whose ref value was already output and report the duplicates")
+	fs.BoolVar(&opts.split, "split", false, "Also write the non-matching entries, to <base>_rest files")
+	fs.BoolVar(&opts.count, "count", false, "Report how many entries match, in total and per ID, without writing output")
+	fs.IntVar(&opts.sample, "sample", 0, "Output a uniformly random sample of N matching entries")
+	fs.Float64Var(&opts.sampleRate, "sample-rate", 0, "Output a uniformly random share of the matching entries, e.g. 0.01 for 1%")
+	fs.Uint64Var(&opts.seed, "seed", 0, "Random seed for -sample and -sample-rate, to repeat a sample (default: random)")
+	fs.IntVar(&opts.skip, "skip", 0, "Skip the first N matching entries")
+	fs.Var(&opts.referenced, "referenced-by", "Find records of another type that reference the IDs: <node>:<field>; repeatable")
+	fs.Var(&opts.related, "related", "Also capture related records referenced by matched entries: <fk>=<node>:<key>; repeatable")
+	fs.StringVar(&opts.notifyEmail, "notify-email", "", "Comma-separated addresses to email a run summary to")
+	fs.StringVar(&opts.notifySlack, "notify-slack", "", "Slack incoming webhook URL to post a run summary to")
+	fs.StringVar(&opts.notifyTeams, "notify-teams", "", "Microsoft Teams incoming webhook URL to post a run summary to")
+	fs.StringVar(&opts.notifyTmpl, "notify-template", "", "Go text/template file for Slack/Teams messages")
+	fs.StringVar(&opts.notifyOn, "notify-on", "always", "When to send notifications: always or failure")
+	fs.StringVar(&opts.smtpAddr, "smtp", "localhost:25", "SMTP server host:port for -notify-email")
+}
+
+// Checks the parsed flags and applies the process-wide settings they make
+func (opts *options) prepare() error {
+	if opts.notifyOn != "always" && opts.notifyOn != "failure" {
+		return fmt.Errorf("-notify-on must be always or failure")
+	}
+	if _, ok := archiveFormat(opts.archive); opts.archive != "" && !ok {
+		return fmt.Errorf("-archive must end in .zip, .tar.gz or .tgz")
+	}
+	if opts.force && opts.appendSuffix {
+		return fmt.Errorf("--force and --append-suffix cannot be combined")
+	}
+	if _, err := parseRoot(opts.root); err != nil {
+		return err
+	}
+	if opts.root != "" && opts.preserveRoot {
+		return fmt.Errorf("-root and -preserve-root cannot be combined")
+	}
+	if err := opts.checkNoRoot(); err != nil {
+		return err
+	}
+	if err := opts.checkFormat(); err != nil {
+		return err
+	}
+	if err := opts.checkXSLT(); err != nil {
+		return err
+	}
+	if err := opts.checkXSD(); err != nil {
+		return err
+	}
+	if err := opts.checkPrintFields(); err != nil {
+		return err
+	}
+	if err := opts.parseLayout(); err != nil {
+		return err
+	}
+	for _, name := range []string{opts.encoding, opts.outputEncoding} {
+		if _, err := lookupCharset(name); err != nil {
+			return err
+		}
+	}
+	lenient.Store(opts.lenient)
+	trustEntities.Store(opts.trustEntities)
+	if opts.maxMemory > 0 {
+		setMemoryLimit(int64(opts.maxMemory))
+	}
+	if opts.maxExtractFiles < 1 {
+		return fmt.Errorf("-max-extract-files must be at least 1")
+	}
+	unpackLimits.total, unpackLimits.file, unpackLimits.files = int64(opts.maxExtractSize), int64(opts.maxExtractFileSize), opts.maxExtractFiles
+	if opts.locale != "" {
+		l, err := parseLocale(opts.locale)
+		if err != nil {
+			return err
+		}
+		filterLocale.Store(l)
+	}
+	if opts.archive != "" {
+		paths, err := claimPaths([]string{opts.archive}, opts.force, opts.appendSuffix)
+		if err != nil {
+			return err
+		}
+		opts.archive = paths[0]
+	}
+	return nil
+}
+
+// Runs the extraction described by opts, stopping early with partial output
+// when ctx is cancelled or -max-duration passes
+func run(ctx context.Context, opts options) (summary *runSummary, err error) {
+	summary = &runSummary{}
+	// a signal while the outputs are written stops after the current file
+	writeCtx := ctx
+	if opts.maxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.maxDuration)
+		defer cancel()
+	}
+
+	var xpathExpr *xpathExpr
+	var parent nodePath
+	if opts.parentNode != "" {
+		var err error
+		parent, err = parseNodePath(opts.parentNode)
+		if err != nil {
+			return summary, fmt.Errorf("Error parsing -node: %v", err)
+		}
+	}
+	if opts.xpath != "" {
+		if opts.parentNode != "" || len(opts.refNodes) > 0 {
+			return summary, fmt.Errorf("Error: -xpath cannot be combined with -node or -ref")
+		}
+		var err error
+		xpathExpr, err = parseXPath(opts.xpath)
+		if err != nil {
+			return summary, fmt.Errorf("Error parsing xpath: %v", err)
+		}
+		parent = xpathExpr.path
+	}
+
+	var rules []rule
+	if opts.rules != "" {
+		if opts.parentNode != "" || opts.xpath != "" {
+			return summary, fmt.Errorf("Error: -rules cannot be combined with -node or -xpath")
+		}
+		var err error
+		rules, err = loadRules(opts.rules)
+		if err != nil {
+			return summary, fmt.Errorf("Error reading rules: %v", err)
+		}
+	}
+
+	if opts.refRegex && opts.refWildcard {
+		return summary, fmt.Errorf("Error: -ref-regex and -ref-wildcard cannot be combined")
+	}
+	if opts.bloom {
+		switch {
+		case opts.refRegex || opts.fuzzy > 0:
+			return summary, fmt.Errorf("Error: -bloom cannot be combined with -ref-regex or -fuzzy")
+		case opts.rules != "":
+			return summary, fmt.Errorf("Error: -bloom cannot be combined with -rules")
+		case opts.bloomFP <= 0 || opts.bloomFP >= 1:
+			return summary, fmt.Errorf("Error: -bloom-fp must be between 0 and 1")
+		}
+	}
+	if opts.reportUnmatched {
+		switch {
+		case len(opts.refNodes) == 0:
+			return summary, fmt.Errorf("Error: -report-unmatched requires -ref")
+		case opts.refRegex || opts.refWildcard || opts.bloom:
+			return summary, fmt.Errorf("Error: -report-unmatched needs literal IDs and cannot be combined with -ref-regex, -ref-wildcard or -bloom")
+		case opts.exclude:
+			return summary, fmt.Errorf("Error: -report-unmatched cannot be combined with -exclude")
+		}
+	}
+	if opts.reportMultiple && !opts.reportUnmatched {
+		return summary, fmt.Errorf("Error: -report-multiple requires -report-unmatched")
+	}
+	if opts.sortAs != "lexical" && opts.sortAs != "numeric" {
+		return summary, fmt.Errorf("Error: -sort-as must be lexical or numeric")
+	}
+	if opts.dedupe && len(opts.refNodes) == 0 && (xpathExpr == nil || !xpathExpr.usesIDs) {
+		return summary, fmt.Errorf("Error: -dedupe requires -ref or an -xpath using $id")
+	}
+	// excluded entries match no ID, so there is none to count them by
+	if opts.dedupe && opts.exclude {
+		return summary, fmt.Errorf("Error: -dedupe cannot be combined with -exclude")
+	}
+	if opts.maxPerID != 0 {
+		switch {
+		case opts.maxPerID < 0:
+			return summary, fmt.Errorf("Error: -max-per-id must be at least 1")
+		case opts.dedupe:
+			return summary, fmt.Errorf("Error: -dedupe and -max-per-id cannot be combined (-dedupe is -max-per-id 1)")
+		case len(opts.refNodes) == 0 && (xpathExpr == nil || !xpathExpr.usesIDs):
+			return summary, fmt.Errorf("Error: -max-per-id requires -ref or an -xpath using $id")
+		case opts.exclude:
+			return summary, fmt.Errorf("Error: -max-per-id cannot be combined with -exclude")
+		}
+	}
+	if (opts.checkpoint > 0 || opts.resume) && opts.rules != "" {
+		return summary, fmt.Errorf("Error: -checkpoint and -resume cannot be combined with -rules")
+	}
+	if opts.sampleRate < 0 || opts.sampleRate > 1 {
+		return summary, fmt.Errorf("Error: -sample-rate must be between 0 and 1, e.g. 0.01 for 1%%")
+	}
+	if opts.sample > 0 && opts.sampleRate > 0 {
+		return summary, fmt.Errorf("Error: -sample and -sample-rate cannot be combined")
+	}
+	if opts.split && (opts.limit > 0 || opts.skip > 0 || opts.sample > 0 || opts.sampleRate > 0 || opts.count) {
+		return summary, fmt.Errorf("Error: -split cannot be combined with -limit, -skip, -sample, -sample-rate or -count")
+	}
+	if opts.count && (opts.sample > 0 || opts.sampleRate > 0) {
+		return summary, fmt.Errorf("Error: -count cannot be combined with -sample or -sample-rate")
+	}
+	if opts.sample > 0 && opts.limit > 0 {
+		return summary, fmt.Errorf("Error: -sample and -limit cannot be combined")
+	}
+	if opts.fuzzy < 0 {
+		return summary, fmt.Errorf("Error: -fuzzy must not be negative")
+	}
+	if opts.fuzzy > 0 && opts.refRegex {
+		return summary, fmt.Errorf("Error: -fuzzy cannot be combined with -ref-regex")
+	}
+	if _, err := parseNormalizers(opts.normalize); err != nil {
+		return summary, fmt.Errorf("Error: %v", err)
+	}
+
+	if opts.idsFromClipboard && opts.csvPath != "" {
+		return summary, fmt.Errorf("Error: -ids-from-clipboard and -csv cannot be combined")
+	}
+
+	if opts.header && opts.noHeader {
+		return summary, fmt.Errorf("Error: -header and -no-header cannot be combined")
+	}
+
+	if opts.matchAll && opts.matchAny {
+		return summary, fmt.Errorf("Error: -match-all and -match-any cannot be combined")
+	}
+
+	if opts.exclude && len(opts.refNodes) == 0 {
+		return summary, fmt.Errorf("Error: -exclude requires -ref (use not() with -xpath)")
+	}
+	if opts.excludeCSV != "" {
+		switch {
+		case len(opts.refNodes) == 0:
+			return summary, fmt.Errorf("Error: -exclude-csv requires -ref")
+		case opts.rules != "":
+			return summary, fmt.Errorf("Error: -exclude-csv cannot be combined with -rules")
+		}
+	}
+
+	var conditions []exprNode
+	whereUsesIDs := false
+	for _, w := range opts.where {
+		cond, usesIDs, err := parsePredicate(w)
+		if err != nil {
+			return summary, fmt.Errorf("Error parsing -where %q: %v", w, err)
+		}
+		conditions = append(conditions, cond)
+		whereUsesIDs = whereUsesIDs || usesIDs
+	}
+
+	var tombstone exprNode
+	if opts.tombstone != "" {
+		var usesIDs bool
+		var err error
+		tombstone, usesIDs, err = parsePredicate(opts.tombstone)
+		switch {
+		case err != nil:
+			return summary, fmt.Errorf("Error parsing -tombstone %q: %v", opts.tombstone, err)
+		case usesIDs:
+			return summary, fmt.Errorf("Error: -tombstone cannot refer to $id")
+		case opts.rules != "":
+			return summary, fmt.Errorf("Error: -tombstone cannot be combined with -rules")
+		}
+	}
+	if !slices.Contains(deletedModes, opts.deleted) {
+		return summary, fmt.Errorf("Error: -deleted must be exclude, only or include")
+	}
+	if opts.deleted != "exclude" && opts.tombstone == "" {
+		return summary, fmt.Errorf("Error: -deleted requires -tombstone")
+	}
+
+	var filter *filterExpr
+	if opts.filter != "" {
+		var err error
+		filter, err = parseFilter(opts.filter)
+		if err != nil {
+			return summary, fmt.Errorf("Error parsing -filter: %v", err)
+		}
+	}
+
+	var relations []relation
+	for _, spec := range opts.related {
+		r, err := parseRelation(spec)
+		if err != nil {
+			return summary, fmt.Errorf("Error: %v", err)
+		}
+		relations = append(relations, r)
+	}
+
+	var checks []*check
+	if opts.checks != "" {
+		var err error
+		checks, err = loadChecks(opts.checks)
+		if err != nil {
+			return summary, fmt.Errorf("Error reading checks: %v", err)
+		}
+	} else if opts.dropInvalid && (opts.xsd == "" || opts.xsdScope != "entry") {
+		return summary, fmt.Errorf("Error: -drop-invalid requires -checks or -xsd")
+	}
+
+	var inputContract *contract
+	if opts.contract != "" {
+		var err error
+		inputContract, err = loadContract(opts.contract)
+		if err != nil {
+			return summary, fmt.Errorf("Error reading contract: %v", err)
+		}
+	} else if opts.contractSample > 0 {
+		return summary, fmt.Errorf("Error: -contract-sample requires -contract")
+	}
+
+	project, err := parseProjection(opts.keep, opts.drop)
+	if err != nil {
+		return summary, fmt.Errorf("Error: %v", err)
+	}
+
+	var redact *redactor
+	for _, spec := range opts.redact {
+		r, err := parseRedaction(spec)
+		if err != nil {
+			return summary, fmt.Errorf("Error: %v", err)
+		}
+		if redact == nil {
+			redact = &redactor{salt: cmp.Or(opts.redactSalt, os.Getenv("DSXML_REDACT_SALT"))}
+		}
+		redact.rules = append(redact.rules, r)
+	}
+	if opts.redactSalt != "" && redact == nil {
+		return summary, fmt.Errorf("Error: -redact-salt requires -redact")
+	}
+
+	var truncations []truncation
+	for _, spec := range opts.truncate {
+		t, err := parseTruncation(spec)
+		if err != nil {
+			return summary, fmt.Errorf("Error: %v", err)
+		}
+		truncations = append(truncations, t)
+	}
+
+	var xslt *xsltTransform
+	if opts.xslt != "" {
+		if opts.rules != "" {
+			return summary, fmt.Errorf("Error: -xslt cannot be combined with -rules")
+		}
+		if xslt, err = newXSLT(ctx, opts.xslt, opts.trustEntities); err != nil {
+			return summary, fmt.Errorf("Error: %v", err)
+		}
+	}
+
+	var xsd *xsdSchema
+	if opts.xsd != "" {
+		if opts.rules != "" {
+			return summary, fmt.Errorf("Error: -xsd cannot be combined with -rules")
+		}
+		if xsd, err = newXSD(ctx, opts.xsd, opts.trustEntities); err != nil {
+			return summary, fmt.Errorf("Error: %v", err)
+		}
+	}
+
+	var referrers []referrer
+	for _, spec := range opts.referenced {
+		r, err := parseReferrer(spec)
+		if err != nil {
+			return summary, fmt.Errorf("Error: %v", err)
+		}
+		referrers = append(referrers, r)
+	}
+
+	switch opts.compress {
+	case "", "gzip":
+	case "zstd":
+		return summary, fmt.Errorf("Error: -compress zstd is not supported; use gzip")
+	default:
+		return summary, fmt.Errorf("Error: -compress must be gzip")
+	}
+
+	if opts.partitionBy != "" && (opts.shards > 0 || opts.groupBy != "" || opts.chunkGroups) {
+		return summary, fmt.Errorf("Error: -partition-by cannot be combined with -shards, -group-by or -chunk-groups")
+	}
+	if opts.shards > 0 {
+		if opts.shardBy == "" {
+			return summary, fmt.Errorf("Error: -shard-by must be ref, entry or a field like @type")
+		}
+		if opts.shardBy == "ref" && len(opts.refNodes) == 0 && (xpathExpr == nil || !xpathExpr.usesIDs) {
+			return summary, fmt.Errorf("Error: -shard-by ref requires -ref or an -xpath using $id")
+		}
+	}
+
 	// Get local dir
 	execPath, err := os.Executable()
 	if err != nil {
-		fmt.Println("Error getting executable path:", err)
-		return
+		return summary, fmt.Errorf("Error getting executable path: %v", err)
+	}
+	dir := filepath.Dir(execPath)
+
+	files, err := newFileFilter(opts)
+	if err != nil {
+		return summary, fmt.Errorf("Error: %v", err)
+	}
+	// with file filters, a folder or an archive of several files is a batch
+	batch := files.active() && opts.inputPath == ""
+	if batch {
+		switch {
+		case opts.csvPath == "-":
+			return summary, fmt.Errorf("Error: batch runs cannot read IDs from stdin")
+		case opts.head > 0 || opts.headEntries > 0:
+			return summary, fmt.Errorf("Error: -head and -head-entries cannot be combined with -include-files, -exclude-files or -modified-after")
+		case opts.batchWorkers < 1:
+			return summary, fmt.Errorf("Error: -workers must be at least 1")
+		}
+	}
+
+	var xmlFilePath string
+	var batchFiles []string
+
+	if opts.inputPath != "" {
+		xmlFilePath = opts.inputPath
+	} else if opts.url != "" {
+		// Download from url
+		fmt.Println("Downloading file from url:", opts.url)
+		tempDir, err := os.MkdirTemp("", "ds-xml-")
+		if err != nil {
+			return summary, fmt.Errorf("Error creating temp directory: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+
+		// extract filename from url, without any query string
+		fileName := opts.url
+		if u, err := url.Parse(opts.url); err == nil {
+			fileName = path.Base(u.Path)
+		}
+		tempFilePath := filepath.Join(tempDir, safeFileName(fileName))
+
+		// download and extract file
+		extracted, err := downloadFile(ctx, opts.url, tempFilePath, opts.archivePassword, opts.decompressCmd)
+		if err != nil {
+			return summary, fmt.Errorf("Error downloading xml file: %v", err)
+		}
+		xmlFilePath, batchFiles = extracted[0], extracted
+		fmt.Println("xml file downloaded to:", xmlFilePath)
+
+		// check if file exists
+		if _, err := os.Stat(xmlFilePath); os.IsNotExist(err) {
+			return summary, fmt.Errorf("Error: Extracted XML file does not exist: %s", xmlFilePath)
+		}
+
+	} else if batch {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return summary, fmt.Errorf("Error reading directory: %v", err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				batchFiles = append(batchFiles, filepath.Join(dir, entry.Name()))
+			}
+		}
+	} else if opts.decompressCmd != "" {
+		compressed, err := findCompressedXML(dir)
+		if err != nil {
+			return summary, err
+		}
+		f, err := os.Open(compressed)
+		if err != nil {
+			return summary, fmt.Errorf("Error reading XML file: %v", err)
+		}
+		defer f.Close()
+		tempDir, err := os.MkdirTemp("", "ds-xml-")
+		if err != nil {
+			return summary, fmt.Errorf("Error creating temp directory: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+		fmt.Printf("Decompressing %s with: %s\n", compressed, opts.decompressCmd)
+		xmlFilePath = filepath.Join(tempDir, decompressedName(filepath.Base(compressed)))
+		if err := decompress(ctx, opts.decompressCmd, f, xmlFilePath); err != nil {
+			return summary, fmt.Errorf("Error: %v", err)
+		}
+		summary.input = compressed
+	} else {
+		// check for required xml in local dir
+		xmlFilePath, err = findFileByExtension(dir, ".xml")
+		if err != nil {
+			return summary, err
+		}
+	}
+	if summary.input == "" {
+		summary.input = xmlFilePath
+	}
+	if opts.url != "" {
+		summary.input = opts.url
+	}
+
+	if batch {
+		if opts.url == "" {
+			summary.input = dir
+		}
+		summary.outputDir = opts.outputDir
+		sources, err := localSources(batchFiles)
+		if err != nil {
+			return summary, fmt.Errorf("Error listing files: %v", err)
+		}
+		sources = files.apply(sources)
+		if len(sources) == 0 {
+			return summary, fmt.Errorf("Error: no .xml files left to process after filtering")
+		}
+		nameSources(sources)
+		return summary, runBatch(ctx, opts, sources, summary, nil)
+	}
+
+	if opts.head > 0 && opts.headEntries > 0 {
+		return summary, fmt.Errorf("Error: -head and -head-entries cannot be combined")
+	}
+	if opts.head > 0 {
+		if err := printHead(xmlFilePath, opts.head); err != nil {
+			return summary, fmt.Errorf("Error reading XML file: %v", err)
+		}
+		return summary, nil
+	}
+	if opts.headEntries > 0 {
+		if opts.parentNode == "" {
+			return summary, fmt.Errorf("Error: -head-entries requires -node")
+		}
+		tempDir, err := os.MkdirTemp("", "ds-xml-")
+		if err != nil {
+			return summary, fmt.Errorf("Error creating temp directory: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+		source, entities, err := scanSource(xmlFilePath, opts, tempDir)
+		if err != nil {
+			return summary, err
+		}
+		if err := printHeadEntries(source, entities, parent, opts.headEntries); err != nil {
+			return summary, fmt.Errorf("Error reading XML: %v", err)
+		}
+		return summary, nil
+	}
+
+	if !opts.dryRun {
+		if summary.inputFile, err = fingerprint(xmlFilePath, summary.input); err != nil {
+			return summary, fmt.Errorf("Error reading XML file: %v", err)
+		}
+		if opts.recipe != nil {
+			checkRecipeFile("input", opts.recipe.Input, summary.inputFile)
+		}
+	}
+
+	// entries are copied from the input as is, so read a UTF-8 copy of it
+	tempDir, err := os.MkdirTemp("", "ds-xml-")
+	if err != nil {
+		return summary, fmt.Errorf("Error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	inputDir := filepath.Dir(xmlFilePath)
+	if xmlFilePath, err = utf8Input(xmlFilePath, opts.encoding, tempDir); err != nil {
+		return summary, fmt.Errorf("Error reading XML file: %v", err)
+	}
+
+	// entities the DOCTYPE declares are known to the decoders of this input
+	prolog, err := readProlog(xmlFilePath, inputDir)
+	if err != nil {
+		return summary, fmt.Errorf("Error reading XML: %v", err)
+	}
+	opts.entities = prolog.entities
+	if opts.keepDoctype {
+		opts.prolog = prolog.text()
+	}
+
+	if opts.preserveRoot {
+		root, err := sourceRoot(xmlFilePath, opts.entities)
+		if err != nil {
+			return summary, fmt.Errorf("Error reading the root element: %v", err)
+		}
+		if _, err := parseRoot(root); err != nil {
+			return summary, fmt.Errorf("Error: %v", err)
+		}
+		opts.root = root
+	}
+
+	// a vendor schema change fails here rather than producing an empty extract
+	if inputContract != nil {
+		if err := checkContract(xmlFilePath, opts.entities, inputContract, int64(opts.contractSample)); err != nil {
+			return summary, err
+		}
+	}
+
+	if len(rules) > 0 {
+		summary.outputDir = opts.outputDir
+		out := newOutputTarget(summary.outputDir, opts)
+		out.ctx = writeCtx
+		return summary, runRules(ctx, xmlFilePath, rules, opts.rules, opts, out, summary)
+	}
+
+	// an xpath only needs the CSV when it refers to $id
+	var referenceIDs []string
+	var m *matcher
+	// without -ref every entry is captured, so no CSV is needed just to split
+	// a document
+	if len(opts.refNodes) > 0 || len(referrers) > 0 || xpathExpr != nil && xpathExpr.usesIDs || whereUsesIDs {
+		var idSource io.Reader = os.Stdin
+		if opts.idsFromClipboard {
+			text, err := readClipboard()
+			if err != nil {
+				return summary, fmt.Errorf("Error reading the clipboard: %v", err)
+			}
+			if strings.TrimSpace(text) == "" {
+				return summary, fmt.Errorf("Error: the clipboard holds no IDs")
+			}
+			fmt.Println("Reading IDs from the clipboard")
+			idSource = strings.NewReader(text)
+		} else if opts.csvPath == "-" {
+			fmt.Println("Reading IDs from stdin")
+		} else {
+			// Check for csv
+			csvFilePath := opts.csvPath
+			if csvFilePath == "" {
+				csvFilePath, err = findFileByExtension(dir, ".csv")
+				if err != nil {
+					return summary, err
+				}
+			}
+
+			if !opts.dryRun {
+				if summary.idsFile, err = fingerprint(csvFilePath, csvFilePath); err != nil {
+					return summary, fmt.Errorf("Error reading CSV: %v", err)
+				}
+				if opts.recipe != nil {
+					checkRecipeFile("CSV", opts.recipe.IDs, summary.idsFile)
+				}
+			}
+
+			// Get IDs from CSV
+			fmt.Println("Reading IDs from CSV file:", csvFilePath)
+			f, err := os.Open(csvFilePath)
+			if err != nil {
+				return summary, fmt.Errorf("Error reading CSV: %v", err)
+			}
+			defer f.Close()
+			idSource = f
+		}
+
+		if opts.bloom && (xpathExpr != nil || whereUsesIDs) {
+			return summary, fmt.Errorf("Error: -bloom cannot be combined with $id in -xpath or -where")
+		}
+		if opts.bloom {
+			m, summary.ids, err = newBloomMatcher(idSource, opts)
+			if err != nil {
+				return summary, fmt.Errorf("Error reading CSV: %v", err)
+			}
+			defer m.close()
+			fmt.Printf("Indexed %d IDs on disk behind a Bloom filter\n", summary.ids)
+		} else {
+			referenceIDs, err = readIDs(idSource, opts.refRegex, opts.headerMode())
+			if err != nil {
+				return summary, fmt.Errorf("Error reading CSV: %v", err)
+			}
+			summary.ids = len(referenceIDs)
+		}
+	}
+
+	if m == nil {
+		m, err = newMatcher(referenceIDs, opts)
+		if err != nil {
+			return summary, fmt.Errorf("Error reading CSV: %v", err)
+		}
+	}
+
+	var deny *matcher
+	if opts.excludeCSV != "" {
+		if !opts.dryRun {
+			if summary.excludedFile, err = fingerprint(opts.excludeCSV, opts.excludeCSV); err != nil {
+				return summary, fmt.Errorf("Error reading -exclude-csv: %v", err)
+			}
+			if opts.recipe != nil {
+				checkRecipeFile("exclusion CSV", opts.recipe.Excluded, summary.excludedFile)
+			}
+		}
+		fmt.Println("Reading excluded IDs from CSV file:", opts.excludeCSV)
+		var n int
+		if deny, n, err = readExclusions(opts.excludeCSV, opts); err != nil {
+			return summary, fmt.Errorf("Error reading -exclude-csv: %v", err)
+		}
+		fmt.Printf("Entries with any of %d excluded IDs will be left out\n", n)
+	}
+
+	// Ensure output folder exists
+	out := newOutputTarget(opts.outputDir, opts)
+	summary.outputDir = out.dir
+	if opts.xsltScope == "document" {
+		out.root.xslt = xslt
+	}
+	if opts.xsdScope == "document" {
+		out.root.xsd = xsd
+	}
+
+	if len(referrers) > 0 {
+		files, err := findReferrers(xmlFilePath, opts.entities, m, referrers, out)
+		summary.files = append(summary.files, files...)
+		if err != nil {
+			return summary, err
+		}
+		// the lookup can be run on its own
+		if len(parent.steps) == 0 {
+			return summary, nil
+		}
+	}
+
+	// Parse XML
+	fmt.Println("Parsing XML file:", xmlFilePath)
+	summary.noteStreaming(xmlFilePath)
+	sel := selection{parent: parent, matchAll: opts.matchAll, exclude: opts.exclude}
+	for _, ref := range opts.refNodes {
+		sel.refs = append(sel.refs, parseRef(ref, parent.name()))
+	}
+	filters := &entryFilter{xpath: xpathExpr, conditions: conditions, filter: filter, ids: referenceIDs, tombstone: tombstone, deleted: opts.deleted}
+	var hook *execHook
+	if opts.execHook != "" {
+		if hook, err = newExecHook(ctx, opts.execHook, opts.execHookFormat); err != nil {
+			return summary, fmt.Errorf("Error: %v", err)
+		}
+	}
+	var matchingEntries []entry
+	skipped := 0
+	var sample *reservoir
+	var rate *rateSampler
+	if opts.sample > 0 {
+		sample = newReservoir(opts.sample, newSampleRand(opts.seed, opts.seeded))
+	} else if opts.sampleRate > 0 {
+		rate = &rateSampler{rng: newSampleRand(opts.seed, opts.seeded), rate: opts.sampleRate}
+	}
+	var counter *matchCounter
+	if opts.count || opts.reportUnmatched {
+		counter = newMatchCounter()
+	}
+	var dedupe *deduper
+	if opts.dedupe {
+		dedupe = newDeduper(1)
+	} else if opts.maxPerID > 0 {
+		dedupe = newDeduper(opts.maxPerID)
+	}
+	// with -split the entries that do not match are kept too
+	var rest []entry
+	c := newCapture(sel, m)
+	c.deny = deny
+	c.keepComments, c.keepPIs = opts.keepComments, opts.keepPIs
+	if opts.split {
+		c.rejected = func(e entry) error {
+			rest = append(rest, e)
+			return nil
+		}
+	}
+	c.emit = func(e entry) error {
+		ok, err := filters.keep(&e)
+		if err != nil {
+			return fmt.Errorf("Error filtering entries: %v", err)
+		}
+		if ok && hook != nil {
+			if ok, err = hook.apply(&e); err != nil {
+				return err
+			}
+		}
+		if !ok {
+			if opts.split {
+				rest = append(rest, e)
+			}
+			return nil
+		}
+		if dedupe != nil && !dedupe.keep(e.ref) {
+			return nil
+		}
+		if skipped < opts.skip {
+			skipped++
+			return nil
+		}
+		if counter != nil {
+			counter.add(e)
+		}
+		if opts.count {
+			if opts.limit > 0 && counter.total >= opts.limit {
+				return errStopParsing
+			}
+			return nil
+		}
+		if sample != nil {
+			sample.add(e)
+			return nil
+		}
+		if rate != nil && !rate.keep() {
+			return nil
+		}
+		matchingEntries = append(matchingEntries, e)
+		if opts.limit > 0 && len(matchingEntries) >= opts.limit {
+			fmt.Printf("Reached -limit of %d entries, stopping early\n", opts.limit)
+			return errStopParsing
+		}
+		return nil
+	}
+	var cp *checkpointer
+	stopped := false
+	if (opts.checkpoint > 0 || opts.resume) && !opts.dryRun {
+		every := opts.checkpoint
+		if every == 0 {
+			every = defaultCheckpointEvery
+		}
+		var cpErr error
+		if cp, cpErr = newCheckpointer(summary.outputDir, every, opts.resume, xmlFilePath); cpErr != nil {
+			return summary, fmt.Errorf("Error: %v", cpErr)
+		}
+		defer func() {
+			// a run cut short keeps its checkpoint to be resumed
+			if err == nil && !summary.partial {
+				cp.done()
+			} else {
+				cp.close()
+			}
+		}()
+		if cp.resume != nil {
+			// the output files of the run being continued are written again
+			out.force = true
+		}
+		emit, rejected := c.emit, c.rejected
+		c.emit = func(e entry) error {
+			if err := cp.record('m', e); err != nil {
+				return err
+			}
+			return emit(e)
+		}
+		if rejected != nil {
+			c.rejected = func(e entry) error {
+				if err := cp.record('r', e); err != nil {
+					return err
+				}
+				return rejected(e)
+			}
+		}
+		if err := cp.replay(emit, rejected); err == errStopParsing {
+			// the replayed entries already reached -limit
+			stopped = true
+		} else if err != nil {
+			return summary, fmt.Errorf("Error reading checkpoint: %v", err)
+		}
+	}
+	refPart := strings.Join(opts.refNodes, "+")
+	if xpathExpr != nil {
+		refPart = "xpath"
+	} else if refPart == "" {
+		refPart = "all"
+	}
+	baseName := fmt.Sprintf("%s_%s", strings.Join(parent.steps, "-"), refPart)
+	if opts.exclude {
+		baseName += "_excluded"
+	}
+
+	// existing output would only stop the run after the whole parse
+	if !opts.count && len(opts.printFields) == 0 {
+		first := "_part-1"
+		if opts.partitionBy != "" {
+			first = "_*_part-1"
+		} else if opts.shards > 0 {
+			first = "_shard-*_part-1"
+		}
+		if err := out.checkFree(safeFileName(baseName) + first + out.extension()); err != nil {
+			return summary, fmt.Errorf("Error: %v", err)
+		}
+	}
+	var malformed *[]malformedEntry
+	if opts.skipMalformed {
+		malformed = new([]malformedEntry)
+	}
+	var parseErr error
+	if !stopped {
+		parseErr = parseXMLMulti(ctx, xmlFilePath, opts.entities, []*capture{c}, cp, malformed)
+	}
+	if parseErr != nil {
+		var partial *partialError
+		if !errors.As(parseErr, &partial) {
+			return summary, fmt.Errorf("Error parsing XML: %v", parseErr)
+		}
+		summary.stopEarly(partial, opts)
+	} else {
+		out.ctx = writeCtx
+	}
+	c.reportMixed()
+	filters.reportDeleted()
+	if filters.tombstone != nil {
+		summary.deleted = &deletedRecord{Mode: opts.deleted, Live: filters.live, Tombstones: filters.tombstones}
+	}
+	if opts.count {
+		// -count reports coverage without writing any output
+		summary.matches = counter.total
+		m.reportFuzzy()
+		counter.report(referenceIDs, m, len(sel.refs) > 0 && !opts.refRegex && !opts.refWildcard)
+		return summary, nil
+	}
+	if hook != nil {
+		hook.report()
+	}
+	if sample != nil {
+		matchingEntries = sample.sample()
+		fmt.Printf("Sampled %d of %d matching entries\n", len(matchingEntries), sample.seen)
+	}
+	if rate != nil {
+		fmt.Printf("Sampled %d of %d matching entries\n", rate.kept, rate.seen)
+	}
+	summary.matches = len(matchingEntries)
+	m.reportFuzzy()
+	if deny != nil {
+		fmt.Printf("Left out %d matching entries listed in %s\n", c.excluded, opts.excludeCSV)
+	}
+
+	if malformed != nil && len(*malformed) > 0 {
+		files, err := writeErrorReport(out, baseName, *malformed)
+		summary.files = append(summary.files, files...)
+		if err != nil {
+			return summary, fmt.Errorf("Error writing errors report: %v", err)
+		}
+	}
+
+	if len(checks) > 0 || xsd != nil && opts.xsdScope == "entry" {
+		var schema *xsdSchema
+		if opts.xsdScope == "entry" {
+			schema = xsd
+		}
+		var files []string
+		matchingEntries, files, err = validateEntries(matchingEntries, checks, schema, out, baseName, opts.dropInvalid)
+		summary.files = append(summary.files, files...)
+		if err != nil {
+			return summary, fmt.Errorf("Error validating entries: %v", err)
+		}
+		summary.matches = len(matchingEntries)
+	}
+
+	if opts.sortBy != "" {
+		spec := sortSpec{key: parseFieldPath(opts.sortBy), desc: opts.sortDesc, numeric: opts.sortAs == "numeric"}
+		matchingEntries, err = sortEntries(matchingEntries, spec)
+		if err != nil {
+			return summary, fmt.Errorf("Error sorting entries: %v", err)
+		}
+	}
+
+	if project != nil {
+		matchingEntries, err = project.entries(matchingEntries)
+		if err == nil {
+			rest, err = project.entries(rest)
+		}
+		if err != nil {
+			return summary, fmt.Errorf("Error projecting entries: %v", err)
+		}
+	}
+
+	if redact != nil {
+		matchingEntries, err = redact.entries(matchingEntries)
+		if err == nil {
+			rest, err = redact.entries(rest)
+		}
+		if err == nil && len(matchingEntries)+len(rest) > 0 {
+			err = redact.checkMatched()
+		}
+		if err != nil {
+			return summary, fmt.Errorf("Error redacting entries: %v", err)
+		}
+	}
+
+	if len(truncations) > 0 {
+		matchingEntries, err = truncateEntries(matchingEntries, truncations, opts.truncMarker)
+		if err == nil {
+			rest, err = truncateEntries(rest, truncations, opts.truncMarker)
+		}
+		if err != nil {
+			return summary, fmt.Errorf("Error truncating entries: %v", err)
+		}
+	}
+
+	// before -hash and -ordinal, which stamp the entries as written
+	if xslt != nil && opts.xsltScope == "entry" {
+		matchingEntries, err = xslt.entries(matchingEntries)
+		if err == nil {
+			rest, err = xslt.entries(rest)
+		}
+		if err != nil {
+			return summary, fmt.Errorf("Error transforming entries with -xslt: %v", err)
+		}
+	}
+
+	if opts.hash {
+		matchingEntries, err = addHashes(matchingEntries, opts.hashAttr)
+		if err == nil {
+			rest, err = addHashes(rest, opts.hashAttr)
+		}
+		if err != nil {
+			return summary, fmt.Errorf("Error hashing entries: %v", err)
+		}
+	}
+
+	// after -hash, so an entry's hash doesn't change with its position
+	if opts.ordinal {
+		matchingEntries = addOrdinals(matchingEntries, opts.ordinalAttr, opts.offsetAttr)
+		rest = addOrdinals(rest, opts.ordinalAttr, opts.offsetAttr)
+	}
+
+	if opts.c14n {
+		matchingEntries, err = canonicalizeEntries(matchingEntries)
+		if err == nil {
+			rest, err = canonicalizeEntries(rest)
+		}
+		if err != nil {
+			return summary, fmt.Errorf("Error canonicalizing entries: %v", err)
+		}
+	}
+	if opts.layout != nil {
+		matchingEntries, err = opts.layout.entries(matchingEntries)
+		if err == nil {
+			rest, err = opts.layout.entries(rest)
+		}
+		if err != nil {
+			return summary, fmt.Errorf("Error laying out entries: %v", err)
+		}
+	}
+
+	if dedupe != nil {
+		files, err := dedupe.report(out, baseName)
+		summary.files = append(summary.files, files...)
+		if err != nil {
+			return summary, fmt.Errorf("Error writing duplicates report: %v", err)
+		}
+	}
+
+	if opts.reportUnmatched {
+		files, unmatched, err := counter.writeReports(out, baseName, referenceIDs, m, opts.reportMultiple)
+		summary.files = append(summary.files, files...)
+		summary.unmatched, summary.countedUnmatched = unmatched, true
+		if err != nil {
+			return summary, fmt.Errorf("Error writing ID report: %v", err)
+		}
+	}
+
+	if len(opts.printFields) > 0 {
+		x := newExtractor(opts.printFields)
+		if err := x.write(opts.values, matchingEntries); err != nil {
+			return summary, fmt.Errorf("Error extracting values: %v", err)
+		}
+		fmt.Printf("Extracted %d values from %d entries\n", x.values, len(matchingEntries))
+		return summary, nil
+	}
+
+	if len(rest) > 0 {
+		fmt.Printf("%d entries did not match\n", len(rest))
+		if err := out.prepare(); err != nil {
+			return summary, err
+		}
+		files, err := out.writeChunks(baseName+"_rest", rest)
+		summary.files = append(summary.files, files...)
+		if err != nil {
+			return summary, err
+		}
+		if opts.verify && !opts.dryRun {
+			if err := verifyOutputs(files, rest, out.root.bare()); err != nil {
+				return summary, err
+			}
+		}
+	}
+
+	if len(matchingEntries) == 0 {
+		fmt.Println("No matching entries found.")
+		return summary, nil
+	}
+	if out.root.columns != nil {
+		if err := out.root.columns.checkMatched(matchingEntries); err != nil {
+			return summary, fmt.Errorf("Error: -columns: %v", err)
+		}
+	}
+
+	if err := out.prepare(); err != nil {
+		return summary, err
+	}
+
+	written := len(summary.files)
+	if opts.partitionBy != "" {
+		files, err := out.writePartitions(baseName, opts.partitionBy, matchingEntries)
+		summary.files = append(summary.files, files...)
+		if err != nil {
+			return summary, err
+		}
+	} else if opts.shards > 0 {
+		// each shard is its own series of chunks
+		for i, shard := range shardEntries(matchingEntries, opts.shards, opts.shardBy) {
+			if len(shard) == 0 {
+				continue
+			}
+			files, err := out.writeChunks(fmt.Sprintf("%s_shard-%d", baseName, i+1), shard)
+			summary.files = append(summary.files, files...)
+			if err != nil {
+				return summary, err
+			}
+		}
+	} else {
+		files, err := out.writeChunks(baseName, matchingEntries)
+		summary.files = append(summary.files, files...)
+		if err != nil {
+			return summary, err
+		}
+	}
+	if opts.verify && !opts.dryRun {
+		if err := verifyOutputs(summary.files[written:], matchingEntries, out.root.bare()); err != nil {
+			return summary, err
+		}
+	}
+
+	// second pass for records related to the matched entries
+	for _, r := range relations {
+		related, err := extractRelated(xmlFilePath, r, matchingEntries, opts)
+		if err != nil {
+			return summary, fmt.Errorf("Error capturing related %s records: %v", r.node.name(), err)
+		}
+		if len(related) == 0 {
+			fmt.Printf("No related %s records found.\n", r.node.name())
+			continue
+		}
+		relatedName := fmt.Sprintf("%s_related-%s", baseName, strings.Join(r.node.steps, "-"))
+		files, err := out.writeChunks(relatedName, related)
+		summary.files = append(summary.files, files...)
+		if err != nil {
+			return summary, err
+		}
+	}
+
+	if summary.partial {
+		if err := writePartialRecord(out, summary); err != nil {
+			return summary, fmt.Errorf("Error recording partial run: %v", err)
+		}
+	}
+
+	if opts.dryRun {
+		fmt.Printf("Dry run: %s with %d IDs would produce %d matching entries; nothing was written\n", summary.input, summary.ids, summary.matches)
+	}
+	return summary, nil
+}
+
+// Where and how output files are written
+type outputTarget struct {
+	dir       string
+	chunkSize int
+	maxBytes  int64     // -chunk-size
+	compress  bool      // write .xml.gz files
+	byGroup   bool      // -chunk-groups
+	groupBy   *pathExpr // -group-by field, or nil to group by ref value
+	dryRun    bool      // only print the planned files
+	root      rootElement
+
+	force        bool // overwrite existing files
+	appendSuffix bool // write alongside existing files
+
+	ctx context.Context // when cancelled, stop before the next file
+}
+
+func newOutputTarget(dir string, opts options) outputTarget {
+	o := outputTarget{dir: dir, chunkSize: opts.chunkSize, maxBytes: int64(opts.chunkBytes), compress: opts.compress == "gzip", byGroup: opts.chunkGroups, dryRun: opts.dryRun,
+		force: opts.force, appendSuffix: opts.appendSuffix}
+	// -root was checked when the flags were read
+	o.root, _ = parseRoot(opts.root)
+	o.root.prolog = opts.prolog
+	if opts.noRoot {
+		o.root = rootElement{}
+	}
+	switch opts.format {
+	case "json":
+		o.root = jsonArray
+	case "ndjson":
+		o.root = jsonLines
+	case "csv", "tsv", "parquet":
+		// -columns was checked when the flags were read
+		columns, _ := parseColumns(opts.columns, opts.format)
+		o.root = rootElement{format: opts.format, columns: columns}
+	case "avro":
+		// as were -columns and -avro-schema
+		o.root = rootElement{format: opts.format}
+		if opts.avroSchema != "" {
+			o.root.avro, o.root.columns, _ = loadAvroSchema(opts.avroSchema, opts.columns)
+		} else {
+			o.root.columns, _ = parseColumns(opts.columns, opts.format)
+			record := "entry"
+			if parent, err := parseNodePath(opts.parentNode); err == nil && opts.parentNode != "" {
+				record = parent.name()
+			}
+			o.root.avro = inferAvroSchema(record, o.root.columns)
+		}
+	case "template":
+		// -template was read when the flags were checked
+		o.root = rootElement{format: opts.format}
+		o.root.template, _ = loadTemplate(opts.template)
+	}
+	// -output-encoding was checked when the flags were read
+	o.root.encoding, _ = lookupCharset(opts.outputEncoding)
+	if opts.groupBy != "" {
+		o.byGroup = true
+		o.groupBy = parseFieldPath(opts.groupBy)
 	}
-	dir := filepath.Dir(execPath)
+	return o
+}
 
-	var xmlFilePath string
+// Extension of output files
+func (o outputTarget) extension() string {
+	ext := ".xml"
+	switch o.root.format {
+	case "":
+	case "parquet", "avro":
+		// compressed inside the file
+		return "." + o.root.format
+	case "template":
+		ext = o.root.template.ext
+	default:
+		ext = "." + o.root.format
+	}
+	if o.compress {
+		ext += ".gz"
+	}
+	return ext
+}
 
-	if *urlFlag != "" {
-		// Download from url
-		fmt.Println("Downloading file from url:", *urlFlag)
-		tempDir := os.TempDir()
+// Ensures the output folder exists, unless this is a dry run
+func (o outputTarget) prepare() error {
+	if o.dryRun {
+		return nil
+	}
+	if err := os.MkdirAll(o.dir, os.ModePerm); err != nil {
+		return fmt.Errorf("Error creating output directory: %v", err)
+	}
+	return nil
+}
 
-		// extract filename from url
-		fileName := filepath.Base(*urlFlag)
-		tempFilePath := filepath.Join(tempDir, fileName)
+// Writes entries to numbered chunk files of at most chunkSize entries and
+// maxBytes bytes each, returning the paths written
+func (o outputTarget) writeChunks(baseName string, entries []entry) ([]string, error) {
+	if err := o.root.formatEntries(entries); err != nil {
+		return nil, fmt.Errorf("Error converting entries to %s: %v", o.root.format, err)
+	}
+	chunks := planChunks(entries, o.chunkSize, o.maxBytes, o.root, o.byGroup, o.groupBy)
+	paths := make([]string, len(chunks))
+	for i := range chunks {
+		// generate output file name for chunk
+		outputFileName := safeFileName(fmt.Sprintf("%s_part-%d%s", baseName, i+1, o.extension()))
+		paths[i] = filepath.Join(o.dir, outputFileName)
+	}
+	paths, err := claimPaths(paths, o.force, o.appendSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("Error: %v", err)
+	}
 
-		// download and extract file
-		xmlFilePath, err = downloadFile(*urlFlag, tempFilePath)
-		if err != nil {
-			fmt.Println("Error downloading xml file:", err)
-			return
+	var written []string
+	failed := 0
+	// compressed chunks are written in parallel
+	var pool *chunkPool
+	if o.compress && !o.dryRun {
+		pool = newChunkPool(o)
+	}
+	interrupted := false
+	for i, chunk := range chunks {
+		if o.ctx != nil && o.ctx.Err() != nil {
+			interrupted = true
+			break
 		}
-		defer os.Remove(xmlFilePath)
-		fmt.Println("xml file downloaded to:", xmlFilePath)
-
-		// check if file exists
-		if _, err := os.Stat(xmlFilePath); os.IsNotExist(err) {
-			fmt.Println("Error: Extracted XML file does not exist:", xmlFilePath)
-			return
+		outputFilePath := paths[i]
+		if o.dryRun {
+			fmt.Printf("Would write chunk %d (%d entries) to %s\n", i+1, len(chunk), outputFilePath)
+			continue
 		}
 
-	} else {
-		// check for required xml in local dir
-		xmlFilePath, err = findFileByExtension(dir, ".xml")
-		if err != nil {
-			fmt.Println(err)
-			return
+		// Write the output XML file
+		fmt.Printf("Writing chunk %d to %s ... \n", i+1, outputFilePath)
+		if pool != nil {
+			pool.write(i+1, outputFilePath, chunk)
+		} else if err := writeToXML(outputFilePath, chunk, o.compress, o.root); err != nil {
+			fmt.Printf("Error writing chunk %d to XML file: %v\n", i+1, err)
+			failed++
+		} else {
+			fmt.Printf("Captured nodes successfully written to %s\n", outputFilePath)
+			written = append(written, outputFilePath)
 		}
 	}
-
-	if *scanFlag > 0 {
-		content, err := os.ReadFile(xmlFilePath)
-		if err != nil {
-			fmt.Println("Error reading XML file:", err)
-			return
+	if pool != nil {
+		for i, err := range pool.wait() {
+			if err != nil {
+				failed++
+			} else {
+				written = append(written, paths[i])
+			}
 		}
-		fmt.Printf("Scanned XML content (first %d characters):\n", *scanFlag)
-		fmt.Println(string(content[:min(*scanFlag, len(content))]))
-		return
 	}
 
-	// Check for csv
-	csvFilePath, err := findFileByExtension(dir, ".csv")
-	if err != nil {
-		fmt.Println(err)
-		return
+	if interrupted {
+		return written, fmt.Errorf("Error: interrupted after writing %d of %d chunks of %s", len(written), len(chunks), baseName)
 	}
-
-	// Get IDs from CSV
-	fmt.Println("Reading IDs from CSV file:", csvFilePath)
-	referenceIDs, err := readCSV(csvFilePath)
-	if err != nil {
-		fmt.Println("Error reading CSV:", err)
-		return
+	if failed > 0 {
+		return written, fmt.Errorf("Error: failed to write %d chunk(s) of %s", failed, baseName)
 	}
+	return written, nil
+}
 
-	// Parse XML
-	fmt.Println("Parsing XML file:", xmlFilePath)
-	matchingEntries, err := parseXML(xmlFilePath, referenceIDs, *parentNode, *refNode)
-	if err != nil {
-		fmt.Println("Error parsing XML:", err)
-		return
+// Splits entries into chunks of at most chunkSize entries and, if maxBytes
+// is set, files of at most maxBytes bytes, some of which go to the
+// declaration and root element. With byGroup, entries sharing a
+// ref value (or groupBy field) are kept together and chunks only rotate
+// between groups; a group larger than the limits gets a chunk of its own, as
+// does a single entry larger than maxBytes.
+func planChunks(entries []entry, chunkSize int, maxBytes int64, root rootElement, byGroup bool, groupBy *pathExpr) [][]entry {
+	if len(entries) == 0 {
+		return nil
 	}
-
-	if len(matchingEntries) == 0 {
-		fmt.Println("No matching entries found.")
-	} else {
-		// Ensure output folder exists
-		outputDir := "output"
-		if err := os.MkdirAll(outputDir, os.ModePerm); err != nil {
-			fmt.Println("Error creating output directory:", err)
-			return
+	overhead := root.overhead()
+	if chunkSize <= 0 || chunkSize > len(entries) {
+		chunkSize = len(entries)
+	}
+	full := func(current []entry, size int64, next []entry) bool {
+		if len(current) == 0 {
+			return false
 		}
-
-		// handle chunking
-		totalEntries := len(matchingEntries)
-		chunk := *chunkSize
-		if chunk <= 0 || chunk > totalEntries {
-			chunk = totalEntries
+		if len(current)+len(next) > chunkSize {
+			return true
 		}
+		return maxBytes > 0 && size+root.entriesSize(next) > maxBytes
+	}
 
-		for i := 0; i < totalEntries; i += chunk {
-			end := i + chunk
-			if end > totalEntries {
-				end = totalEntries
+	if !byGroup {
+		var chunks [][]entry
+		start, size := 0, overhead
+		for i := range entries {
+			if full(entries[start:i], size, entries[i:i+1]) {
+				chunks = append(chunks, entries[start:i])
+				start, size = i, overhead
 			}
+			size += root.entrySize(entries[i])
+		}
+		return append(chunks, entries[start:])
+	}
 
-			// generate output file name for chunk
-			refPart := *refNode
-			if refPart == "" {
-				refPart = "all"
-			}
-			outputFileName := fmt.Sprintf("%s_%s_part-%d.xml", *parentNode, refPart, i/chunk+1)
+	// collect the groups in order of first appearance
+	var order []string
+	groups := make(map[string][]entry)
+	for _, e := range entries {
+		key := entryKey(e, groupBy)
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], e)
+	}
 
-			// Write the output XML file
-			outputFilePath := filepath.Join(outputDir, outputFileName)
-			fmt.Printf("Writing chunk %d to %s ... \n", i/chunk+1, outputFilePath)
-			if err := writeToXML(outputFilePath, matchingEntries[i:end]); err != nil {
-				fmt.Printf("Error writing chunk %d to XML file: %v\n", i/chunk+1, err)
-			} else {
-				fmt.Printf("Captured nodes successfully written to %s\n", outputFilePath)
-			}
+	var chunks [][]entry
+	var current []entry
+	size := overhead
+	for _, ref := range order {
+		group := groups[ref]
+		if full(current, size, group) {
+			chunks = append(chunks, current)
+			current, size = nil, overhead
+		}
+		current = append(current, group...)
+		size += root.entriesSize(group)
+	}
+	return append(chunks, current)
+}
+
+// Splits entries into n shards by hashing the ref value, the whole entry or
+// a field of the entry such as @type
+func shardEntries(entries []entry, n int, shardBy string) [][]entry {
+	var field *pathExpr
+	if shardBy != "ref" && shardBy != "entry" {
+		field = parseFieldPath(shardBy)
+	}
+	shards := make([][]entry, n)
+	for _, e := range entries {
+		key := entryKey(e, field)
+		if shardBy == "entry" {
+			key = e.raw
 		}
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		i := h.Sum32() % uint32(n)
+		shards[i] = append(shards[i], e)
 	}
+	return shards
 }
 
 // Locate files in local dir by extension
@@ -167,233 +1942,771 @@ func findFileByExtension(dir string, extension string) (string, error) {
 	return "", fmt.Errorf("No %s file found in directory: %s", extension, dir)
 }
 
-// Reads CSV and returns slice of IDs
-func readCSV(filePath string) ([]string, error) {
+// Reads CSV and returns slice of IDs. With wholeLines each line is one entry
+// (used for regex patterns, which may contain commas).
+func readCSV(filePath string, wholeLines bool, header headerMode) ([]string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
+	return readIDs(file, wholeLines, header)
+}
+
+// Reads the -exclude-csv IDs, compared with ref values the same way as the
+// CSV's but never fuzzily
+func readExclusions(path string, opts options) (*matcher, int, error) {
+	ids, err := readCSV(path, opts.refRegex, opts.headerMode())
+	if err != nil {
+		return nil, 0, err
+	}
+	opts.fuzzy = 0
+	m, err := newMatcher(ids, opts)
+	return m, len(ids), err
+}
+
+// Reads comma or newline separated IDs, e.g. from a CSV file or stdin
+func readIDs(r io.Reader, wholeLines bool, header headerMode) ([]string, error) {
 	var ids []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
+	err := scanIDs(r, wholeLines, header, func(id string) error {
+		ids = append(ids, id)
+		return nil
+	})
+	return ids, err
+}
+
+// Calls fn for each comma or newline separated ID without holding the list.
+// The first line is skipped if it is a header, as decided by header.
+func scanIDs(r io.Reader, wholeLines bool, header headerMode, fn func(string) error) error {
+	emit := func(line string) error {
+		if wholeLines {
+			return fn(line)
 		}
 		split := strings.Split(line, ",")
 		for _, id := range split {
 			id = strings.TrimSpace(id)
-			if id != "" {
-				ids = append(ids, id)
+			if id == "" {
+				continue
 			}
+			if err := fn(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// read ahead to compare the first line with the ones after it
+	scanner := bufio.NewScanner(r)
+	var ahead []string
+	for len(ahead) <= headerLookahead && scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			ahead = append(ahead, line)
+		}
+	}
+	if len(ahead) > 0 && skipHeader(ahead, header) {
+		ahead = ahead[1:]
+	}
+	for _, line := range ahead {
+		if err := emit(line); err != nil {
+			return err
+		}
+	}
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := emit(line); err != nil {
+			return err
 		}
 	}
-	return ids, scanner.Err()
+	return scanner.Err()
 }
 
-func parseXML(filePath string, referenceIDs []string, parentNode, refNode string) ([]string, error) {
-	content, err := os.ReadFile(filePath)
-	if err != nil {
+// A captured parent node and the reference value that matched it
+type entry struct {
+	raw       string
+	ref       string
+	offset    int64  // of the start tag in the input
+	ordinal   int    // position in the output with -ordinal, from 1
+	formatted string // the entry as written with -format json
+	rendered  bool   // formatted by a -template, even if empty
+}
+
+// The entry as written to output files
+func (e entry) written() string {
+	if e.formatted != "" || e.rendered {
+		return e.formatted
+	}
+	return e.raw
+}
+
+// A -ref value: the element holding the ID, and the attribute holding it
+// when the ID is not the element's text
+type refSpec struct {
+	elem string
+	attr string
+}
+
+// Parses a ref spec like "job_reference", "record@id" or "@id" (an attribute
+// of the parent node itself)
+func parseRef(ref, parentNode string) refSpec {
+	spec := refSpec{elem: ref}
+	if i := strings.Index(ref, "@"); i != -1 {
+		spec = refSpec{elem: ref[:i], attr: ref[i+1:]}
+		if spec.elem == "" {
+			spec.elem = parentNode
+		}
+	}
+	return spec
+}
+
+// What parseXML captures and how captured nodes are matched
+type selection struct {
+	parent   nodePath
+	refs     []refSpec // no refs means every parent node matches
+	matchAll bool      // every ref must match rather than any
+	exclude  bool      // keep the parent nodes that do not match
+}
+
+// Captures the parent nodes whose ref values match, or with exclude those
+// whose ref values do not
+func parseXML(filePath string, entities map[string]string, m *matcher, sel selection) ([]entry, error) {
+	c := newCapture(sel, m)
+	if err := parseXMLMulti(context.Background(), filePath, entities, []*capture{c}, nil, nil); err != nil {
 		return nil, err
 	}
+	return c.results, nil
+}
+
+// Capture state for one selection while the document is streamed
+type capture struct {
+	sel          selection
+	m            *matcher
+	deny         *matcher     // -exclude-csv: entries with a ref value on it are never selected
+	buffer       bytes.Buffer // the entry's source text, copied as-is
+	rootEnd      int          // where the entry's start tag ends in buffer
+	offset       int64        // of the entry's start tag in the input
+	captureDepth int
+	insideParent bool
+	denied       bool // the entry being captured has a ref value on the deny list
+	excluded     int  // entries that matched but were on the deny list
+	keepComments bool // copy comments inside entries, which are dropped by default
+	keepPIs      bool // same for processing instructions
+
+	// namespaces declared above the entry, prefix -> URI, and the ones the
+	// entry uses, which are declared again on its element
+	inherited map[string]string
+	used      map[string]bool
+
+	// per ref: the depth of the element whose text is being read, whether it
+	// matched, and the value it matched with
+	refDepths   []int
+	matched     []bool
+	matchedRefs []string
+	refText     []strings.Builder // all text of the ref element, for mixed content
+
+	// per open element of the entry: whether it holds text and child
+	// elements, which makes its content mixed
+	content    []elementContent
+	entryMixed bool
+	mixed      int   // parent nodes with mixed content
+	mixedAt    int64 // offset of the first
+
+	// emit receives each matching entry; by default it collects them in
+	// results. Returning errStopParsing ends the parse early.
+	emit    func(entry) error
+	results []entry
+
+	// rejected, when set, receives the parent nodes that were not selected
+	rejected func(entry) error
+
+	// the entities the input declares, expanded in entries
+	entities map[string]string
+}
+
+// Returned by a capture's emit to stop parsing once it has what it needs
+var errStopParsing = errors.New("stop parsing")
+
+func newCapture(sel selection, m *matcher) *capture {
+	c := &capture{
+		sel:          sel,
+		m:            m,
+		captureDepth: -1,
+		refDepths:    make([]int, len(sel.refs)),
+		matched:      make([]bool, len(sel.refs)),
+		matchedRefs:  make([]string, len(sel.refs)),
+		refText:      make([]strings.Builder, len(sel.refs)),
+		inherited:    make(map[string]string),
+		used:         make(map[string]bool),
+	}
+	c.emit = func(e entry) error {
+		c.results = append(c.results, e)
+		return nil
+	}
+	return c
+}
 
-	var results []string
-	decoder := xml.NewDecoder(bytes.NewReader(content))
-	var currentDepth int
-	var buffer bytes.Buffer
-	var encoder *xml.Encoder
-	var captureDepth = -1
-	var insideParent bool
-	var matchFound bool
+// Streams the document once, feeding every token to each capture so several
+// selections can be extracted in a single pass. Once ctx is done the parse
+// stops at the next entry boundary, returning a partialError.
+// With a checkpointer, progress is saved at entry boundaries and a resumed
+// run continues from the saved offset. With skipped, an entry that can't be
+// parsed is left out and recorded there, and parsing picks up again at the
+// next parent element.
+func parseXMLMulti(ctx context.Context, filePath string, entities map[string]string, captures []*capture, cp *checkpointer, skipped *[]malformedEntry) error {
+	// the input is read whole, unless -max-memory is too low for that
+	var content []byte
+	var src io.ReaderAt
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	streamed := streamInput(info.Size())
+	if streamed {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src = f
+	} else {
+		if content, err = os.ReadFile(filePath); err != nil {
+			return err
+		}
+		src = bytes.NewReader(content)
+	}
 
-	for {
+	for _, c := range captures {
+		c.entities = entities
+	}
+	var rec *recovery
+	if lenient.Load() {
+		rec = newRecovery(content, entities)
+		defer func() {
+			if rec.count > 0 {
+				fmt.Printf("Recovered from %d XML errors (-lenient)\n", rec.count)
+			}
+		}()
+	}
+
+	// Parsing starts at the beginning, or part way in to resume a run or
+	// after a malformed entry. The start tags open there are replayed
+	// ahead of the rest of the document so namespaces and depths line up.
+	var prefix string
+	var startAt int64
+	var window *inputWindow
+	var decoder *xml.Decoder
+	var currentDepth, parentDepth int
+	var stack []string
+	var open []string // raw start tags of the open elements
+	var ns []xml.Attr // namespace declarations of the open elements
+	var nsMarks []int
+	begin := func(at int64, replay []string) {
+		prefix, startAt = strings.Join(replay, ""), at
+		var input io.Reader = io.NewSectionReader(src, at, info.Size()-at)
+		if streamed {
+			window = &inputWindow{r: input, base: int64(len(prefix))}
+			input = window
+		}
+		decoder = newInputDecoder(io.MultiReader(strings.NewReader(prefix), input), entities)
+		if rec != nil {
+			relax(decoder)
+			rec.open, rec.pending, rec.carried = nil, false, nil
+		}
+		currentDepth, stack, open, ns, nsMarks = 0, nil, nil, nil, nil
+	}
+	raw := func(from, to int64) []byte {
+		if from < int64(len(prefix)) {
+			return []byte(prefix[from:to])
+		}
+		if window != nil {
+			return window.slice(from, to)
+		}
+		base := startAt - int64(len(prefix))
+		return content[base+from : base+to]
+	}
+	// the source just ahead of the decoder, enough for a tag, for -lenient
+	ahead := func(from int64) []byte {
+		const n = 256
+		if from < int64(len(prefix)) {
+			return []byte(prefix[from:])
+		}
+		if window != nil {
+			if next := window.buf[from-window.base:]; len(next) >= n {
+				return next[:n]
+			}
+			next := make([]byte, n)
+			read, _ := src.ReadAt(next, from-int64(len(prefix))+startAt)
+			return next[:read]
+		}
+		base := startAt - int64(len(prefix))
+		return content[base+from : min(int64(len(content)), base+from+n)]
+	}
+	if cp != nil && cp.resume != nil {
+		begin(cp.resume.Offset, cp.resume.Open)
+	} else {
+		begin(0, nil)
+	}
+	trackOpen := cp != nil || skipped != nil
+
+	for tokens := 0; ; tokens++ {
+		offset := decoder.InputOffset() - int64(len(prefix)) + startAt
+		if tokens%1024 == 0 && idle(captures) {
+			if err := ctx.Err(); err != nil {
+				// checkpoint where parsing stopped, so -resume continues from it
+				if cp != nil && offset >= startAt {
+					if err := cp.save(offset, open); err != nil {
+						return err
+					}
+				}
+				return &partialError{offset: offset, interrupted: errors.Is(err, context.Canceled)}
+			}
+			if cp != nil && cp.due() && offset >= startAt {
+				if err := cp.save(offset, open); err != nil {
+					return err
+				}
+			}
+		}
+		from := decoder.InputOffset()
+		if window != nil {
+			window.drop(from)
+		}
+		if rec != nil {
+			if tag, ok := rec.stray(ahead(from)); ok {
+				decoder.RawToken()
+				rec.warn(offset, "dropped %s, which closes no open element", tag)
+				continue
+			}
+		}
 		token, err := decoder.Token()
 		if err != nil {
-			if err == io.EOF {
+			if err == io.EOF || (rec != nil && currentDepth == 0 && endedEarly(err)) {
 				break
 			}
-			return nil, err
+			if skipped != nil && (rec == nil || !endedEarly(err)) {
+				// leave out the entry and pick up at the next parent
+				// the decoder's line numbers count from where it started
+				bad := malformedEntry{offset: offset, next: -1, err: tokenError(err)}
+				keep := len(open)
+				for _, c := range captures {
+					if c.insideParent {
+						bad.offset = min(bad.offset, c.offset)
+						keep = min(keep, c.captureDepth-1)
+						c.abandon()
+					}
+				}
+				if keep == len(open) && parentDepth > 0 {
+					keep = min(keep, parentDepth-1)
+				}
+				next, ok := nextBoundary(src, info.Size(), max(offset, bad.offset+1), captures)
+				if ok {
+					bad.next = next
+				}
+				*skipped = append(*skipped, bad)
+				fmt.Printf("Warning: skipped a malformed entry at offset %d: %s\n", bad.offset, bad.err)
+				if !ok {
+					break
+				}
+				begin(next, append([]string(nil), open[:keep]...))
+				continue
+			}
+			if rec == nil || !endedEarly(err) {
+				return err
+			}
+			// close the elements left open
+			token = xml.EndElement{}
+		}
+		text := raw(from, decoder.InputOffset())
+		if rec != nil {
+			text, offset = rec.source(token, text, offset)
 		}
 
 		switch t := token.(type) {
 		case xml.StartElement:
 			currentDepth++
-			if t.Name.Local == parentNode {
-				// Start capturing the parent node
-				insideParent = true
-				captureDepth = currentDepth
-				buffer.Reset()
-				encoder = xml.NewEncoder(&buffer)
-				if err := encoder.EncodeToken(t); err != nil {
-					return nil, err
+			stack = append(stack, t.Name.Local)
+			if rec != nil {
+				text = rec.start(text, offset)
+			}
+			if trackOpen {
+				open = append(open, string(text))
+			}
+			for _, c := range captures {
+				if err := c.start(t, text, offset, stack, currentDepth, ns); err != nil {
+					return err
 				}
-				// if no refNode provided, consider all parent nodes a match
-				if refNode == "" {
-					matchFound = true
+				if c.captureDepth == currentDepth {
+					parentDepth = currentDepth
 				}
-			} else if insideParent {
-				// Capture child nodes of the parent
-				if err := encoder.EncodeToken(t); err != nil {
-					return nil, err
+			}
+			nsMarks = append(nsMarks, len(ns))
+			for _, a := range t.Attr {
+				if _, ok := nsDecl(a); ok {
+					ns = append(ns, a)
 				}
 			}
 		case xml.EndElement:
-			if insideParent {
-				if err := encoder.EncodeToken(t); err != nil {
-					return nil, err
-				}
-				if t.Name.Local == parentNode && currentDepth == captureDepth {
-					// End of the parent node
-					if matchFound {
-						if err := encoder.Flush(); err != nil {
-							return nil, err
-						}
-						results = append(results, buffer.String())
+			// empty for the end of a self-closing element
+			if rec != nil {
+				text = rec.end(text, offset)
+			}
+			for _, c := range captures {
+				if err := c.end(text, currentDepth); err != nil {
+					if err == errStopParsing {
+						return nil
 					}
-					// Reset state for the next parent node
-					buffer.Reset()
-					insideParent = false
-					captureDepth = -1
-					matchFound = false
+					return err
 				}
 			}
 			currentDepth--
+			stack = stack[:len(stack)-1]
+			ns = ns[:nsMarks[len(nsMarks)-1]]
+			nsMarks = nsMarks[:len(nsMarks)-1]
+			if trackOpen {
+				open = open[:len(open)-1]
+			}
 		case xml.CharData:
-			if insideParent {
-				text := strings.TrimSpace(string(t))
-				if refNode != "" && captureDepth != -1 && contains(referenceIDs, text) {
-					matchFound = true
+			if rec != nil {
+				text = rec.charData(t, text, offset)
+			}
+			for _, c := range captures {
+				if err := c.charData(t, text); err != nil {
+					return err
 				}
-				if err := encoder.EncodeToken(t); err != nil {
-					return nil, err
+			}
+		case xml.Comment, xml.ProcInst:
+			for _, c := range captures {
+				c.markup(t, text)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Reports whether no capture is in the middle of an entry
+func idle(captures []*capture) bool {
+	for _, c := range captures {
+		if c.insideParent {
+			return false
+		}
+	}
+	return true
+}
+
+// Tokens are copied to the entry in their source form, raw, so prefixes,
+// quoting and escaping survive; scope holds the namespace declarations of
+// the open ancestors
+func (c *capture) start(t xml.StartElement, raw []byte, offset int64, stack []string, currentDepth int, scope []xml.Attr) error {
+	// a parent nested inside the one being captured is just a child,
+	// the capture only ends when the outermost parent closes
+	if !c.insideParent && c.sel.parent.matches(stack) {
+		// Start capturing the parent node
+		c.insideParent = true
+		c.captureDepth = currentDepth
+		c.buffer.Reset()
+		c.buffer.Write(raw)
+		c.rootEnd = tagInsertAt(string(raw))
+		c.offset = offset
+		c.inheritNamespaces(t, scope)
+		c.useNamespaces(t)
+		c.denied = false
+		c.content, c.entryMixed = append(c.content[:0], elementContent{}), false
+		for i, ref := range c.sel.refs {
+			c.refDepths[i] = -1
+			c.matched[i] = false
+			c.matchedRefs[i] = ""
+			c.refText[i].Reset()
+			if ref.attr != "" && ref.elem == c.sel.parent.name() {
+				c.matchedRefs[i], c.matched[i] = matchAttr(t, ref.attr, c.m)
+				c.denyAttr(t, ref.attr)
+			}
+		}
+	} else if c.insideParent {
+		for i, ref := range c.sel.refs {
+			if t.Name.Local != ref.elem {
+				continue
+			}
+			if ref.attr != "" {
+				if value, ok := matchAttr(t, ref.attr, c.m); ok && !c.matched[i] {
+					c.matchedRefs[i], c.matched[i] = value, true
 				}
+				c.denyAttr(t, ref.attr)
+			} else if c.refDepths[i] == -1 {
+				c.refDepths[i] = currentDepth
+				c.refText[i].Reset()
+			}
+		}
+		c.content[len(c.content)-1].children = true
+		c.content = append(c.content, elementContent{})
+		// Capture child nodes of the parent
+		c.useNamespaces(t)
+		c.buffer.Write(raw)
+	}
+	return nil
+}
+
+func (c *capture) end(raw []byte, currentDepth int) error {
+	if !c.insideParent {
+		return nil
+	}
+	c.buffer.Write(raw)
+	content := c.content[len(c.content)-1]
+	c.content = c.content[:len(c.content)-1]
+	mixed := content.text && content.children
+	c.entryMixed = c.entryMixed || mixed
+	for i := range c.sel.refs {
+		if currentDepth == c.refDepths[i] {
+			if mixed {
+				// text split by inline elements, like The <i>Big</i> Sleep,
+				// is also matched as a whole
+				c.matchText(i, c.refText[i].String())
+			}
+			c.refDepths[i] = -1
+		}
+	}
+	if currentDepth == c.captureDepth {
+		// End of the parent node
+		if c.entryMixed {
+			if c.mixed++; c.mixed == 1 {
+				c.mixedAt = c.offset
 			}
 		}
+		ref, matchFound := combineMatches(c.matched, c.matchedRefs, c.sel.matchAll)
+		selected := matchFound != c.sel.exclude
+		if selected && c.denied {
+			// exclusions win over the IDs the entry matched
+			c.excluded++
+			selected = false
+		}
+		if selected {
+			err := c.emit(entry{raw: c.entryText(), ref: ref, offset: c.offset})
+			if err != nil {
+				return err
+			}
+		} else if c.rejected != nil {
+			if err := c.rejected(entry{raw: c.entryText(), ref: ref, offset: c.offset}); err != nil {
+				return err
+			}
+		}
+		// Reset state for the next parent node
+		c.buffer.Reset()
+		c.insideParent = false
+		c.captureDepth = -1
 	}
+	return nil
+}
 
-	return results, nil
+func (c *capture) charData(t xml.CharData, raw []byte) error {
+	if !c.insideParent {
+		return nil
+	}
+	if len(bytes.TrimSpace(t)) > 0 {
+		c.content[len(c.content)-1].text = true
+	}
+	for i := range c.sel.refs {
+		if c.refDepths[i] == -1 {
+			continue
+		}
+		c.refText[i].Write(t)
+		c.matchText(i, string(t))
+	}
+	c.buffer.Write(raw)
+	return nil
 }
 
-func contains(slice []string, item string) bool {
-	for _, s := range slice {
-		if s == item {
-			return true
+// Matches text of the element of ref i against the IDs and the deny list
+func (c *capture) matchText(i int, text string) {
+	if !c.matched[i] {
+		c.matchedRefs[i], c.matched[i] = c.m.match(text)
+	}
+	if c.deny != nil && !c.denied {
+		_, c.denied = c.deny.match(text)
+	}
+}
+
+// Whether an element holds text and child elements
+type elementContent struct {
+	text     bool
+	children bool
+}
+
+// Warns about parent nodes with mixed content, text interleaved with child
+// elements, which is copied as is but matched differently
+func (c *capture) reportMixed() {
+	if c.mixed == 0 {
+		return
+	}
+	fmt.Printf("Warning: %d %s nodes have mixed content (text between child elements), the first at offset %d. Their text is copied verbatim; text split by child elements is matched both as a whole and piece by piece.\n", c.mixed, c.sel.parent.name(), c.mixedAt)
+}
+
+// Copies a comment or processing instruction inside an entry when the
+// capture keeps them
+func (c *capture) markup(t xml.Token, raw []byte) {
+	if !c.insideParent {
+		return
+	}
+	switch t.(type) {
+	case xml.Comment:
+		if !c.keepComments {
+			return
+		}
+	case xml.ProcInst:
+		if !c.keepPIs {
+			return
 		}
 	}
-	return false
+	c.buffer.Write(raw)
 }
 
-// Writes to an XML file
-func writeToXML(filePath string, capturedNodes []string) error {
-	// Create or overwrite the XML
-	file, err := os.Create(filePath)
-	if err != nil {
-		return fmt.Errorf("Error creating XML file: %v", err)
+// Marks the entry as denied when the named attribute holds an ID of the
+// -exclude-csv list
+func (c *capture) denyAttr(t xml.StartElement, attr string) {
+	if c.deny != nil && !c.denied {
+		_, c.denied = matchAttr(t, attr, c.deny)
 	}
-	defer file.Close()
+}
 
-	// Write XML declaration
-	_, err = file.WriteString(xml.Header)
-	if err != nil {
-		return fmt.Errorf("Error writing XML header: %v", err)
+// Decides whether a parent node matches from the results of each ref,
+// returning the first matched value. With no refs every parent matches.
+func combineMatches(matched []bool, values []string, matchAll bool) (string, bool) {
+	if len(matched) == 0 {
+		return "", true
+	}
+	ref := ""
+	found := matchAll
+	for i, ok := range matched {
+		if ok && ref == "" {
+			ref = values[i]
+		}
+		if matchAll {
+			found = found && ok
+		} else {
+			found = found || ok
+		}
+	}
+	return ref, found
+}
+
+// Returns the value of the named attribute if it holds one of the IDs
+func matchAttr(t xml.StartElement, attr string, m *matcher) (string, bool) {
+	for _, a := range t.Attr {
+		if a.Name.Local != attr {
+			continue
+		}
+		if value, ok := m.match(a.Value); ok {
+			return value, true
+		}
 	}
+	return "", false
+}
 
-	// Write opening root element
-	_, err = file.WriteString("<root>\n")
+// Writes to an XML file
+func writeToXML(filePath string, capturedNodes []entry, compress bool, root rootElement) error {
+	sink, err := createXMLSink(filePath, compress, root)
 	if err != nil {
-		return fmt.Errorf("Error writing root element: %v", err)
+		return err
 	}
 
 	// Write each captured node to file
 	for _, node := range capturedNodes {
-		_, err := file.WriteString(node + "\n")
-		if err != nil {
-			return fmt.Errorf("Error writing to XML file: %v", err)
+		if err := sink.write(node); err != nil {
+			sink.abort()
+			return err
 		}
 	}
-
-	// Write closing root element
-	_, err = file.WriteString("</root>\n")
-	if err != nil {
-		return fmt.Errorf("Error writing closing root element: %v", err)
-	}
-	return nil
+	return sink.finish()
 }
 
 // Downloads a file from a URL and saves it to the specified path
-// handles .zip, .gz, and .tar.gz.
-func downloadFile(url, filePath string) (string, error) {
-	resp, err := http.Get(url)
+// handles .zip, .gz, and .tar.gz. Returns the downloaded file, or the files
+// extracted from it.
+// With decompressCmd the download is piped through it instead, and saved
+// without its compression extension.
+func downloadFile(ctx context.Context, url, filePath, password, decompressCmd string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download file: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to download file: %v", err)
+		return nil, fmt.Errorf("failed to download file: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to download file: HTTP %d", resp.StatusCode)
+		return nil, fmt.Errorf("failed to download file: HTTP %d", resp.StatusCode)
+	}
+
+	if decompressCmd != "" {
+		fmt.Println("Decompressing with:", decompressCmd)
+		dest := decompressedName(filePath)
+		if err := decompress(ctx, decompressCmd, resp.Body, dest); err != nil {
+			return nil, fmt.Errorf("failed to decompress file: %v", err)
+		}
+		return []string{dest}, nil
 	}
 
 	file, err := os.Create(filePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to create file: %v", err)
+		return nil, fmt.Errorf("failed to create file: %v", err)
 	}
 	defer file.Close()
 
 	_, err = io.Copy(file, resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("failed to save file: %v", err)
+		return nil, fmt.Errorf("failed to save file: %v", err)
 	}
 
 	// Handle compressed files based on their extensions
 	switch {
 	case strings.HasSuffix(filePath, ".zip"):
 		fmt.Println("File is a ZIP archive. Extracting...")
-		extractedFiles, err := unzip(filePath, filepath.Dir(filePath))
+		extractedFiles, err := unzip(filePath, filepath.Dir(filePath), password)
 		if err != nil {
-			return "", fmt.Errorf("failed to extract ZIP file: %v", err)
+			return nil, fmt.Errorf("failed to extract ZIP file: %v", err)
 		}
 		err = os.Remove(filePath) // Delete the ZIP file after extraction
 		if err != nil {
-			return "", fmt.Errorf("failed to delete ZIP file: %v", err)
+			return nil, fmt.Errorf("failed to delete ZIP file: %v", err)
 		}
-		// Return the first extracted file (assuming it's the XML file)
-		return extractedFiles[0], nil
+		return extractedFiles, nil
 
 	case strings.HasSuffix(filePath, ".gz") && !strings.HasSuffix(filePath, ".tar.gz"):
 		fmt.Println("File is a GZIP archive. Extracting...")
 		extractedFilePath := strings.TrimSuffix(filePath, ".gz")
 		extractedFile, err := ungzip(filePath, extractedFilePath)
 		if err != nil {
-			return "", fmt.Errorf("failed to extract GZIP file: %v", err)
+			return nil, fmt.Errorf("failed to extract GZIP file: %v", err)
 		}
 		err = os.Remove(filePath) // Delete the GZIP file after extraction
 		if err != nil {
-			return "", fmt.Errorf("failed to delete GZIP file: %v", err)
+			return nil, fmt.Errorf("failed to delete GZIP file: %v", err)
 		}
-		return extractedFile, nil
+		return []string{extractedFile}, nil
 
 	case strings.HasSuffix(filePath, ".tar.gz") || strings.HasSuffix(filePath, ".tgz"):
 		fmt.Println("File is a TAR.GZ archive. Extracting...")
 		extractedFiles, err := untarGz(filePath, filepath.Dir(filePath))
 		if err != nil {
-			return "", fmt.Errorf("failed to extract TAR.GZ file: %v", err)
+			return nil, fmt.Errorf("failed to extract TAR.GZ file: %v", err)
 		}
 		err = os.Remove(filePath) // Delete the TAR.GZ file after extraction
 		if err != nil {
-			return "", fmt.Errorf("failed to delete TAR.GZ file: %v", err)
+			return nil, fmt.Errorf("failed to delete TAR.GZ file: %v", err)
 		}
-		// Return the first extracted file (assuming it's the XML file)
-		return extractedFiles[0], nil
+		return extractedFiles, nil
 	}
 
 	// If the file is not compressed, return the original file path
-	return filePath, nil
+	return []string{filePath}, nil
 }
 
 // Unzips compressed files
-func unzip(src, dest string) ([]string, error) {
+func unzip(src, dest, password string) ([]string, error) {
 	r, err := zip.OpenReader(src)
 	if err != nil {
 		return nil, err
@@ -401,11 +2714,15 @@ func unzip(src, dest string) ([]string, error) {
 	defer r.Close()
 
 	var extractedFiles []string
+	var u unpacking
 
 	for _, f := range r.File {
-		fPath := filepath.Join(dest, f.Name)
-		if !strings.HasPrefix(fPath, filepath.Clean(dest)+string(os.PathSeparator)) {
-			return nil, fmt.Errorf("illegal file path: %s", fPath)
+		fPath, err := memberPath(dest, f.Name)
+		if err != nil {
+			return nil, err
+		}
+		if f.Mode()&os.ModeSymlink != 0 {
+			return nil, fmt.Errorf("%s is a symbolic link, which archives may not hold", f.Name)
 		}
 
 		if f.FileInfo().IsDir() {
@@ -426,18 +2743,21 @@ func unzip(src, dest string) ([]string, error) {
 			return nil, err
 		}
 
-		rc, err := f.Open()
+		rc, err := openZipMember(f, password)
 		if err != nil {
 			outFile.Close()
 			return nil, err
 		}
 
-		_, err = io.Copy(outFile, rc)
+		err = u.copy(outFile, rc, f.Name)
 		outFile.Close()
 		rc.Close()
 		if err != nil {
+			os.Remove(fPath)
 			return nil, err
 		}
+		// keep the member's time for -modified-after
+		os.Chtimes(fPath, f.Modified, f.Modified)
 
 		extractedFiles = append(extractedFiles, fPath)
 	}
@@ -466,8 +2786,10 @@ func ungzip(src, dest string) (string, error) {
 	}
 	defer outFile.Close()
 
-	_, err = io.Copy(outFile, gz)
-	if err != nil {
+	var u unpacking
+	if err := u.copy(outFile, gz, filepath.Base(dest)); err != nil {
+		outFile.Close()
+		os.Remove(dest)
 		return "", fmt.Errorf("failed to extract .gzip file: %v", err)
 	}
 
@@ -490,6 +2812,7 @@ func untarGz(src, dest string) ([]string, error) {
 
 	tarReader := tar.NewReader(gz)
 	var extractedFiles []string
+	var u unpacking
 
 	for {
 		header, err := tarReader.Next()
@@ -500,9 +2823,12 @@ func untarGz(src, dest string) ([]string, error) {
 			return nil, err
 		}
 
-		fPath := filepath.Join(dest, header.Name)
-		if !strings.HasPrefix(fPath, filepath.Clean(dest)+string(os.PathSeparator)) {
-			return nil, fmt.Errorf("illegal file path: %s", fPath)
+		fPath, err := memberPath(dest, header.Name)
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag == tar.TypeSymlink || header.Typeflag == tar.TypeLink {
+			return nil, fmt.Errorf("%s is a link to %s, which archives may not hold", header.Name, header.Linkname)
 		}
 
 		switch header.Typeflag {
@@ -520,11 +2846,13 @@ func untarGz(src, dest string) ([]string, error) {
 			if err != nil {
 				return nil, err
 			}
-			_, err = io.Copy(outFile, tarReader)
+			err = u.copy(outFile, tarReader, header.Name)
 			outFile.Close()
 			if err != nil {
+				os.Remove(fPath)
 				return nil, err
 			}
+			os.Chtimes(fPath, header.ModTime, header.ModTime)
 			extractedFiles = append(extractedFiles, fPath)
 		}
 	}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Parses command-line flags into options as main does, for runs in tests
+func testOptions(t *testing.T, args ...string) options {
+	t.Helper()
+	var opts options
+	fs := flag.NewFlagSet("ds-xml", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	opts.define(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("parsing %v: %v", args, err)
+	}
+	if err := opts.prepare(); err != nil {
+		t.Fatalf("checking %v: %v", args, err)
+	}
+	opts.outputDir = "output"
+	return opts
+}
+
+// Writes files into a new directory and makes it the working directory, for
+// the output folder and any relative paths
+func testDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Chdir(dir)
+	return dir
+}
+
+// Returns what f prints to stdout
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	done := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- string(b)
+	}()
+	f()
+	w.Close()
+	return <-done
+}
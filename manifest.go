@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// run-manifest.json: a machine-readable summary of a run so downstream
+// automation can verify and consume its outputs
+type manifest struct {
+	Version    string         `json:"version"`
+	Status     string         `json:"status"`
+	Error      string         `json:"error,omitempty"`
+	Input      string         `json:"input"`
+	IDs        int            `json:"ids"`
+	Matches    int            `json:"matches"`
+	Started    time.Time      `json:"started"`
+	DurationMS int64          `json:"duration_ms"`
+	Offset     int64          `json:"offset,omitempty"` // input offset reached by a partial run
+	Files      []manifestFile `json:"files"`
+
+	// how the run changed strategy to stay within -max-memory
+	Adaptations []string `json:"adaptations,omitempty"`
+
+	QueryPack *packRecord `json:"query_pack,omitempty"`
+
+	Deleted *deletedRecord `json:"deleted,omitempty"`
+}
+
+// With -tombstone, how many matching entries were live and how many
+// tombstones, and which of them the run kept
+type deletedRecord struct {
+	Mode       string `json:"mode"`
+	Live       int    `json:"live"`
+	Tombstones int    `json:"tombstones"`
+}
+
+type manifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+
+	// with -ordinal, the positions of the file's first and last entries
+	FirstOrdinal int `json:"first_ordinal,omitempty"`
+	LastOrdinal  int `json:"last_ordinal,omitempty"`
+}
+
+// Writes run-manifest.json to the output folder of a run that wrote files
+func writeManifest(summary *runSummary, started time.Time, runErr error) error {
+	if summary.outputDir == "" || (len(summary.files) == 0 && !summary.partial) {
+		return nil
+	}
+
+	m := manifest{
+		Version:    version,
+		Status:     "succeeded",
+		Input:      summary.input,
+		IDs:        summary.ids,
+		Matches:    summary.matches,
+		Started:    started.UTC(),
+		DurationMS: summary.duration.Milliseconds(),
+		Files:      []manifestFile{},
+
+		Adaptations: summary.adaptations,
+		QueryPack:   summary.queryPack,
+		Deleted:     summary.deleted,
+	}
+	if runErr != nil {
+		m.Status = "failed"
+		m.Error = runErr.Error()
+	} else if summary.partial {
+		m.Status = summary.partialStatus()
+		m.Offset = summary.offset
+	}
+
+	for _, path := range summary.files {
+		f, err := describeFile(path)
+		if err != nil {
+			return err
+		}
+		if r, ok := fileOrdinals.Load(f.Path); ok {
+			f.FirstOrdinal, f.LastOrdinal = r.(ordinalRange).first, r.(ordinalRange).last
+		}
+		m.Files = append(m.Files, f)
+	}
+
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(summary.outputDir, "run-manifest.json")
+	if err := writeFileAtomic(path, append(content, '\n')); err != nil {
+		return err
+	}
+	fmt.Println("Run manifest written to", path)
+	summary.manifest = path
+	return nil
+}
+
+// Records the size and SHA-256 of an output file
+func describeFile(path string) (manifestFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return manifestFile{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return manifestFile{}, err
+	}
+	return manifestFile{Path: filepath.ToSlash(path), Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
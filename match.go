@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Decides whether a reference value found in the XML matches the IDs read
+// from the CSV
+type matcher struct {
+	ids      map[string]bool
+	patterns []*regexp.Regexp // set when -ref-regex is used
+	prefixes *trie            // ABC-* wildcards, set when -ref-wildcard is used
+	suffixes *trie            // *-ABC wildcards, stored reversed
+	globs    []string         // other wildcards like A*B*C
+	trim     bool
+	collapse bool
+	fold     bool
+	norms    []func(string) string // -normalize rules
+	store    *idStore              // on-disk IDs, set when -bloom is used
+	fuzzy    int                   // -fuzzy edit distance, 0 for exact matching
+	// fuzzyHits records each value matched by -fuzzy and the ID it matched
+	fuzzyHits map[string]string
+}
+
+// Builds a matcher for the reference IDs. With -ref-regex each ID is compiled
+// as a regular expression instead of being compared literally, and with
+// -ref-wildcard IDs containing * match by prefix, suffix or wildcard.
+func newMatcher(referenceIDs []string, opts options) (*matcher, error) {
+	m := &matcher{
+		ids:      make(map[string]bool, len(referenceIDs)),
+		trim:     opts.matchTrim,
+		collapse: opts.matchCollapse,
+		fold:     opts.matchFold,
+	}
+	if opts.fuzzy > 0 {
+		m.fuzzy = opts.fuzzy
+		m.fuzzyHits = make(map[string]string)
+	}
+	var err error
+	if m.norms, err = parseNormalizers(opts.normalize); err != nil {
+		return nil, err
+	}
+	for _, id := range referenceIDs {
+		if opts.refRegex {
+			if m.fold {
+				id = "(?i)" + id
+			}
+			re, err := regexp.Compile(id)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", id, err)
+			}
+			m.patterns = append(m.patterns, re)
+			continue
+		}
+		id = m.normalize(id)
+		if opts.refWildcard && strings.Contains(id, "*") {
+			m.addWildcard(id)
+			continue
+		}
+		m.ids[id] = true
+	}
+	return m, nil
+}
+
+// Releases the on-disk ID set, if any
+func (m *matcher) close() {
+	if m.store != nil {
+		m.store.close()
+	}
+}
+
+// Stores a wildcard ID in the prefix or suffix trie when it only has a
+// leading or trailing *, otherwise as a general pattern
+func (m *matcher) addWildcard(id string) {
+	switch {
+	case strings.Count(id, "*") == 1 && strings.HasSuffix(id, "*"):
+		if m.prefixes == nil {
+			m.prefixes = &trie{}
+		}
+		m.prefixes.insert(strings.TrimSuffix(id, "*"))
+	case strings.Count(id, "*") == 1 && strings.HasPrefix(id, "*"):
+		if m.suffixes == nil {
+			m.suffixes = &trie{}
+		}
+		m.suffixes.insert(reverse(strings.TrimPrefix(id, "*")))
+	default:
+		m.globs = append(m.globs, id)
+	}
+}
+
+// Applies the -match-trim, -match-collapse, -normalize and -match-fold rules
+// to a value
+func (m *matcher) normalize(value string) string {
+	if m.collapse {
+		value = strings.Join(strings.Fields(value), " ")
+	} else if m.trim {
+		value = strings.TrimSpace(value)
+	}
+	for _, fn := range m.norms {
+		value = fn(value)
+	}
+	if m.fold {
+		value = strings.ToLower(value)
+	}
+	return value
+}
+
+// Reports whether value matches one of the IDs or patterns, returning the
+// normalized value
+func (m *matcher) match(value string) (string, bool) {
+	value = m.normalize(value)
+	if m.ids[value] {
+		return value, true
+	}
+	if m.store != nil && m.store.contains(value) {
+		return value, true
+	}
+	if m.prefixes != nil && m.prefixes.hasPrefixOf(value) {
+		return value, true
+	}
+	if m.suffixes != nil && m.suffixes.hasPrefixOf(reverse(value)) {
+		return value, true
+	}
+	for _, glob := range m.globs {
+		if matchGlob(glob, value) {
+			return value, true
+		}
+	}
+	for _, re := range m.patterns {
+		if re.MatchString(value) {
+			return value, true
+		}
+	}
+	if m.fuzzy > 0 {
+		if id, ok := m.fuzzyMatch(value); ok {
+			return id, true
+		}
+	}
+	return value, false
+}
+
+// Finds the closest ID within the -fuzzy edit distance of value, recording
+// the match for the report
+func (m *matcher) fuzzyMatch(value string) (string, bool) {
+	if id, ok := m.fuzzyHits[value]; ok {
+		return id, true
+	}
+	best, bestDist := "", m.fuzzy+1
+	for id := range m.ids {
+		if abs(len(id)-len(value)) > m.fuzzy {
+			continue
+		}
+		d := levenshtein(id, value, bestDist)
+		if d < bestDist || (d == bestDist && d <= m.fuzzy && id < best) {
+			best, bestDist = id, d
+		}
+	}
+	if bestDist > m.fuzzy {
+		return "", false
+	}
+	m.fuzzyHits[value] = best
+	return best, true
+}
+
+// Prints the values matched by -fuzzy rather than exactly
+func (m *matcher) reportFuzzy() {
+	if len(m.fuzzyHits) == 0 {
+		return
+	}
+	values := make([]string, 0, len(m.fuzzyHits))
+	for v := range m.fuzzyHits {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	fmt.Printf("Fuzzy matches (%d):\n", len(values))
+	for _, v := range values {
+		fmt.Printf("  %q matched ID %q\n", v, m.fuzzyHits[v])
+	}
+}
+
+// Computes the Levenshtein distance between a and b, giving up once it
+// must be at least limit
+func levenshtein(a, b string, limit int) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		rowMin := curr[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+			rowMin = min(rowMin, curr[j])
+		}
+		if rowMin >= limit {
+			return limit
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// A byte-wise prefix tree of wildcard IDs
+type trie struct {
+	children map[byte]*trie
+	terminal bool
+}
+
+func (t *trie) insert(s string) {
+	for i := 0; i < len(s); i++ {
+		if t.children == nil {
+			t.children = make(map[byte]*trie)
+		}
+		next, ok := t.children[s[i]]
+		if !ok {
+			next = &trie{}
+			t.children[s[i]] = next
+		}
+		t = next
+	}
+	t.terminal = true
+}
+
+// Reports whether any stored string is a prefix of s
+func (t *trie) hasPrefixOf(s string) bool {
+	for i := 0; ; i++ {
+		if t.terminal {
+			return true
+		}
+		if i == len(s) {
+			return false
+		}
+		next, ok := t.children[s[i]]
+		if !ok {
+			return false
+		}
+		t = next
+	}
+}
+
+func reverse(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+// Matches s against a pattern where * stands for any run of characters
+func matchGlob(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i == -1 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return len(s) >= len(last) && strings.HasSuffix(s, last)
+}
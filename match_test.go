@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestMatchWhitespace(t *testing.T) {
+	tests := []struct {
+		args  []string
+		value string
+		want  bool
+	}{
+		{nil, " A 1\n", true},
+		// inner whitespace is kept unless -match-collapse is given
+		{nil, "A  1", false},
+		{[]string{"-match-collapse"}, " A \t 1 ", true},
+		{[]string{"-match-trim=false"}, " A 1", false},
+		{[]string{"-match-trim=false"}, "A 1", true},
+	}
+	for _, test := range tests {
+		m, err := newMatcher([]string{"A 1"}, testOptions(t, test.args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.match(test.value); ok != test.want {
+			t.Errorf("%v: match(%q) = %v, want %v", test.args, test.value, ok, test.want)
+		}
+	}
+}
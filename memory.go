@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+)
+
+// -max-memory: a soft limit on the memory a run uses. The Go runtime
+// collects garbage harder as the heap nears it, and rather than run out the
+// run changes strategy: inputs too big for it are streamed instead of read
+// whole, and batch runs process fewer files at once.
+var memoryLimit atomic.Int64
+
+func setMemoryLimit(limit int64) {
+	memoryLimit.Store(limit)
+	debug.SetMemoryLimit(limit)
+}
+
+// Reports whether an input of size bytes should be streamed through a small
+// window instead of read whole, which is faster but needs its size in memory
+func streamInput(size int64) bool {
+	limit := memoryLimit.Load()
+	return limit > 0 && size > limit/2
+}
+
+// Reports whether the heap is over three quarters of -max-memory, after a
+// collection so garbage doesn't count
+func underPressure() bool {
+	limit := memoryLimit.Load()
+	if limit <= 0 {
+		return false
+	}
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	if int64(sample[0].Value.Uint64()) < limit/4*3 {
+		return false
+	}
+	runtime.GC()
+	metrics.Read(sample)
+	return int64(sample[0].Value.Uint64()) >= limit/4*3
+}
+
+// Lets batch workers start files while memory allows: under pressure a file
+// only starts once the others have finished
+type memoryGate struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	running int
+	reduced bool // files were held back
+}
+
+func newMemoryGate() *memoryGate {
+	g := &memoryGate{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// Waits until a file may start; reports whether this is the first time
+// memory pressure held one back
+func (g *memoryGate) acquire() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	first := false
+	for g.running > 0 && underPressure() {
+		if !g.reduced {
+			g.reduced, first = true, true
+		}
+		g.cond.Wait()
+	}
+	g.running++
+	return first
+}
+
+func (g *memoryGate) release() {
+	g.mu.Lock()
+	g.running--
+	g.mu.Unlock()
+	g.cond.Broadcast()
+}
+
+// The input as the decoder reads it, keeping only the bytes from the token
+// being parsed on so raw source can be copied without holding the whole file
+type inputWindow struct {
+	r    io.Reader
+	buf  []byte
+	base int64 // offset in the stream of buf[0]
+}
+
+func (w *inputWindow) Read(p []byte) (int, error) {
+	n, err := w.r.Read(p)
+	w.buf = append(w.buf, p[:n]...)
+	return n, err
+}
+
+// The bytes between two offsets of the stream, which must not have been
+// dropped yet
+func (w *inputWindow) slice(from, to int64) []byte {
+	return w.buf[from-w.base : to-w.base]
+}
+
+// Drops the bytes before offset once enough have piled up
+func (w *inputWindow) drop(offset int64) {
+	if n := offset - w.base; n > 1<<20 {
+		w.buf = append(w.buf[:0], w.buf[n:]...)
+		w.base = offset
+	}
+}
+
+// Notes when the input will be streamed to stay within -max-memory
+func (s *runSummary) noteStreaming(filePath string) {
+	if info, err := os.Stat(filePath); err == nil && streamInput(info.Size()) {
+		s.adapt("%s (%d bytes) is over half of -max-memory, so it is streamed instead of read whole", filepath.Base(filePath), info.Size())
+	}
+}
+
+func (s *runSummary) adapt(format string, args ...any) {
+	note := fmt.Sprintf(format, args...)
+	fmt.Println("Note:", note)
+	s.adaptations = append(s.adaptations, note)
+}
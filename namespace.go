@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/xml"
+	"sort"
+	"strings"
+)
+
+// Returns the prefix an attribute read with Token declares, "" for the
+// default namespace, and whether it is a namespace declaration at all
+func nsDecl(a xml.Attr) (string, bool) {
+	if a.Name.Space == "xmlns" {
+		return a.Name.Local, true
+	}
+	if a.Name.Space == "" && a.Name.Local == "xmlns" {
+		return "", true
+	}
+	return "", false
+}
+
+// Where attributes can be added to a start tag: before its closing > or />
+func tagInsertAt(tag string) int {
+	at := len(tag) - 1
+	if at > 0 && tag[at-1] == '/' {
+		at--
+	}
+	return at
+}
+
+// Starts tracking the namespaces an entry inherits: those declared by its
+// ancestors (scope, in document order) that its own start tag doesn't
+// declare again
+func (c *capture) inheritNamespaces(t xml.StartElement, scope []xml.Attr) {
+	clear(c.inherited)
+	clear(c.used)
+	for _, a := range scope {
+		if prefix, _ := nsDecl(a); prefix != "xml" {
+			c.inherited[prefix] = a.Value
+		}
+	}
+	for _, a := range t.Attr {
+		if prefix, ok := nsDecl(a); ok {
+			delete(c.inherited, prefix)
+		}
+	}
+}
+
+// Notes which inherited prefixes an element of the entry uses, in its name,
+// its attribute names or QName values such as xsi:type="dc:Period"
+func (c *capture) useNamespaces(t xml.StartElement) {
+	if len(c.inherited) == 0 {
+		return
+	}
+	c.useURI(t.Name.Space)
+	for _, a := range t.Attr {
+		if _, ok := nsDecl(a); ok {
+			continue
+		}
+		c.useURI(a.Name.Space)
+		if prefix, _, ok := strings.Cut(a.Value, ":"); ok {
+			if _, bound := c.inherited[prefix]; bound {
+				c.used[prefix] = true
+			}
+		}
+	}
+}
+
+func (c *capture) useURI(uri string) {
+	if uri == "" {
+		return
+	}
+	for prefix, u := range c.inherited {
+		if u == uri {
+			c.used[prefix] = true
+		}
+	}
+}
+
+// The captured entry, with the inherited namespaces it uses declared on its
+// element so its prefixes stay bound once it is taken out of the document,
+// and the entities the input declares expanded
+func (c *capture) entryText() string {
+	raw := declareNamespaces(c.buffer.String(), c.rootEnd, c.used, c.inherited)
+	return expandEntities(raw, c.entities)
+}
+
+// Inserts declarations of the used prefixes, bound as in inherited, into
+// raw at, the end of its element's start tag
+func declareNamespaces(raw string, at int, used map[string]bool, inherited map[string]string) string {
+	if len(used) == 0 {
+		return raw
+	}
+	prefixes := make([]string, 0, len(used))
+	for prefix := range used {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	var decls strings.Builder
+	for _, prefix := range prefixes {
+		decls.WriteString(" xmlns")
+		if prefix != "" {
+			decls.WriteString(":" + prefix)
+		}
+		decls.WriteString(`="`)
+		xml.EscapeText(&decls, []byte(inherited[prefix]))
+		decls.WriteString(`"`)
+	}
+	return raw[:at] + decls.String() + raw[at:]
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Built-in -normalize rules, applied to both the CSV IDs and the XML values
+var normalizers = map[string]func(string) string{
+	"isbn13":             normalizeISBN13,
+	"doi":                normalizeDOI,
+	"ean":                normalizeEAN,
+	"trim-leading-zeros": trimLeadingZeros,
+}
+
+// Looks up the comma-separated -normalize names
+func parseNormalizers(spec string) ([]func(string) string, error) {
+	var fns []func(string) string
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		fn, ok := normalizers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown -normalize %q: expected isbn13, doi, ean or trim-leading-zeros", name)
+		}
+		fns = append(fns, fn)
+	}
+	return fns, nil
+}
+
+// Keeps only the digits of a value, plus a trailing X when allowed
+func digitsOnly(value string, allowX bool) string {
+	var b strings.Builder
+	for i, r := range value {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case allowX && (r == 'X' || r == 'x') && i == len(value)-1:
+			b.WriteByte('X')
+		}
+	}
+	return b.String()
+}
+
+// Strips hyphens and spaces from an ISBN and converts ISBN-10 to ISBN-13, so
+// 0-306-40615-2 and 978-0-306-40615-7 compare equal. Values that are not an
+// ISBN are left unchanged.
+func normalizeISBN13(value string) string {
+	isbn := digitsOnly(value, true)
+	switch len(isbn) {
+	case 13:
+		if strings.Contains(isbn, "X") {
+			return value
+		}
+		return isbn
+	case 10:
+		isbn = "978" + isbn[:9]
+		return isbn + eanCheckDigit(isbn)
+	}
+	return value
+}
+
+// Computes the EAN-13 check digit for the first 12 digits
+func eanCheckDigit(digits string) string {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		d := int(digits[i] - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return fmt.Sprint((10 - sum%10) % 10)
+}
+
+// Lower-cases a DOI and strips resolver and doi: prefixes, since DOIs are
+// case-insensitive
+func normalizeDOI(value string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	for _, prefix := range []string{"https://doi.org/", "http://doi.org/", "https://dx.doi.org/", "http://dx.doi.org/", "doi:"} {
+		if strings.HasPrefix(value, prefix) {
+			return strings.TrimSpace(value[len(prefix):])
+		}
+	}
+	return value
+}
+
+// Strips separators from an EAN and pads UPC-A and shorter codes to 13
+// digits with leading zeros
+func normalizeEAN(value string) string {
+	ean := digitsOnly(value, false)
+	if ean == "" || len(ean) > 13 {
+		return value
+	}
+	return strings.Repeat("0", 13-len(ean)) + ean
+}
+
+// Removes leading zeros, keeping a single 0 for an all-zero value
+func trimLeadingZeros(value string) string {
+	trimmed := strings.TrimLeft(value, "0")
+	if trimmed == "" && value != "" {
+		return "0"
+	}
+	return trimmed
+}
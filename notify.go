@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Default message for Slack and Teams, overridable with -notify-template
+const defaultNotifyTemplate = `{{if .Error}}ds-xml run FAILED{{else}}ds-xml run {{.Status}}{{end}}: {{.Input}}
+{{- if .Error}}
+Error: {{.Error}}{{end}}
+Matched {{.Matches}} entries against {{.IDs}} IDs in {{.Duration}}
+{{- if .Files}}
+Output: {{.OutputDir}} ({{len .Files}} files){{end}}`
+
+// Fields available to -notify-template
+type notifyData struct {
+	Status    string
+	Error     string
+	Input     string
+	IDs       int
+	Matches   int
+	Duration  string
+	OutputDir string
+	Files     []string
+}
+
+// Sends the run summary to every configured notification target
+func notify(opts options, summary *runSummary, runErr error) {
+	if opts.notifyEmail != "" {
+		if err := sendEmailNotification(opts, summary, runErr); err != nil {
+			fmt.Println("Error sending email notification:", err)
+		}
+	}
+
+	if opts.notifySlack == "" && opts.notifyTeams == "" {
+		return
+	}
+	text, err := renderNotification(opts.notifyTmpl, summary, runErr)
+	if err != nil {
+		fmt.Println("Error rendering notification template:", err)
+		return
+	}
+	if opts.notifySlack != "" {
+		if err := postWebhook(opts.notifySlack, map[string]string{"text": text}); err != nil {
+			fmt.Println("Error sending Slack notification:", err)
+		}
+	}
+	if opts.notifyTeams != "" {
+		card := map[string]string{
+			"@type":    "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"summary":  "ds-xml run summary",
+			// Teams renders markdown, which needs two trailing spaces for a line break
+			"text": strings.ReplaceAll(text, "\n", "  \n"),
+		}
+		if err := postWebhook(opts.notifyTeams, card); err != nil {
+			fmt.Println("Error sending Teams notification:", err)
+		}
+	}
+}
+
+// Renders the chat message for a run from the given template file, or the
+// default template when none is set
+func renderNotification(tmplPath string, summary *runSummary, runErr error) (string, error) {
+	text := defaultNotifyTemplate
+	if tmplPath != "" {
+		content, err := os.ReadFile(tmplPath)
+		if err != nil {
+			return "", err
+		}
+		text = string(content)
+	}
+	tmpl, err := template.New("notify").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	data := notifyData{
+		Status:    "succeeded",
+		Input:     summary.input,
+		IDs:       summary.ids,
+		Matches:   summary.matches,
+		Duration:  summary.duration.Round(time.Millisecond).String(),
+		OutputDir: summary.outputDir,
+		Files:     summary.files,
+	}
+	if runErr != nil {
+		data.Status = "failed"
+		data.Error = runErr.Error()
+	} else if summary.partial {
+		data.Status = summary.partialStatus()
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Posts a JSON payload to a chat webhook
+func postWebhook(url string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Formats a plain-text report of a run for notifications
+func formatSummary(summary *runSummary, runErr error) string {
+	var b strings.Builder
+	if runErr != nil {
+		fmt.Fprintf(&b, "Status: FAILED\nError: %v\n", runErr)
+	} else if summary.partial {
+		fmt.Fprintf(&b, "Status: %s (stopped at input offset %d)\n", strings.ToUpper(summary.partialStatus()), summary.offset)
+	} else {
+		b.WriteString("Status: OK\n")
+	}
+	fmt.Fprintf(&b, "Input: %s\n", summary.input)
+	fmt.Fprintf(&b, "Reference IDs: %d\n", summary.ids)
+	fmt.Fprintf(&b, "Matched entries: %d\n", summary.matches)
+	fmt.Fprintf(&b, "Duration: %s\n", summary.duration.Round(time.Millisecond))
+	if len(summary.files) > 0 {
+		b.WriteString("Files written:\n")
+		for _, f := range summary.files {
+			fmt.Fprintf(&b, "  %s\n", f)
+		}
+	}
+	return b.String()
+}
+
+// Emails a run summary to the -notify-email recipients, with the run's
+// run-manifest.json attached when it wrote one. The sender and SMTP
+// credentials come from DSXML_SMTP_FROM, DSXML_SMTP_USER and
+// DSXML_SMTP_PASSWORD.
+func sendEmailNotification(opts options, summary *runSummary, runErr error) error {
+	var to []string
+	for _, addr := range strings.Split(opts.notifyEmail, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			to = append(to, addr)
+		}
+	}
+	if len(to) == 0 {
+		return fmt.Errorf("no recipients in -notify-email")
+	}
+
+	from := os.Getenv("DSXML_SMTP_FROM")
+	if from == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "localhost"
+		}
+		from = "ds-xml@" + hostname
+	}
+
+	status := "succeeded"
+	if runErr != nil {
+		status = "failed"
+	} else if summary.partial {
+		status = summary.partialStatus()
+	}
+
+	msg, err := emailMessage(from, to, status, summary, runErr)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if user := os.Getenv("DSXML_SMTP_USER"); user != "" {
+		host, _, err := net.SplitHostPort(opts.smtpAddr)
+		if err != nil {
+			return fmt.Errorf("invalid -smtp address: %v", err)
+		}
+		auth = smtp.PlainAuth("", user, os.Getenv("DSXML_SMTP_PASSWORD"), host)
+	}
+
+	fmt.Println("Sending email notification to:", strings.Join(to, ", "))
+	return smtp.SendMail(opts.smtpAddr, auth, from, to, msg)
+}
+
+// Builds the email: the plain-text summary alone, or as the first part of a
+// multipart/mixed message with run-manifest.json attached
+func emailMessage(from string, to []string, status string, summary *runSummary, runErr error) ([]byte, error) {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: ds-xml run %s: %s\r\n", status, summary.input)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	text := strings.ReplaceAll(formatSummary(summary, runErr), "\n", "\r\n")
+
+	var manifest []byte
+	if summary.manifest != "" {
+		var err error
+		if manifest, err = os.ReadFile(summary.manifest); err != nil {
+			return nil, fmt.Errorf("reading run manifest: %v", err)
+		}
+	}
+	if manifest == nil {
+		msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+		msg.WriteString(text)
+		return msg.Bytes(), nil
+	}
+
+	parts := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", parts.Boundary())
+	body, err := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=UTF-8"}})
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(body, text)
+
+	attachment, err := parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"application/json"},
+		"Content-Disposition":       {`attachment; filename="run-manifest.json"`},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// base64 lines may be at most 76 characters
+	encoded := base64.StdEncoding.EncodeToString(manifest)
+	for len(encoded) > 76 {
+		io.WriteString(attachment, encoded[:76]+"\r\n")
+		encoded = encoded[76:]
+	}
+	io.WriteString(attachment, encoded+"\r\n")
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEmailAttachesManifest(t *testing.T) {
+	manifest := `{"status": "succeeded", "files": [` + strings.Repeat(`"book_part-1.xml", `, 20) + `"book_part-2.xml"]}` + "\n"
+	path := filepath.Join(t.TempDir(), "run-manifest.json")
+	if err := os.WriteFile(path, []byte(manifest), 0666); err != nil {
+		t.Fatal(err)
+	}
+	summary := &runSummary{input: "in.xml", ids: 2, matches: 2, manifest: path}
+
+	raw, err := emailMessage("ds-xml@host", []string{"ops@example.com"}, "succeeded", summary, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Content-Type %q, %v, want multipart/mixed", msg.Header.Get("Content-Type"), err)
+	}
+
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	text, err := parts.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(text)
+	if !strings.Contains(string(body), "Matched entries: 2") {
+		t.Errorf("first part is %q, want the run summary", body)
+	}
+	attachment, err := parts.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attachment.FileName() != "run-manifest.json" {
+		t.Errorf("attachment named %q, want run-manifest.json", attachment.FileName())
+	}
+	if enc := attachment.Header.Get("Content-Transfer-Encoding"); enc != "base64" {
+		t.Fatalf("attachment encoded as %q, want base64", enc)
+	}
+	encoded, _ := io.ReadAll(attachment)
+	for _, line := range strings.Split(strings.TrimSpace(string(encoded)), "\r\n") {
+		if len(line) > 76 {
+			t.Errorf("base64 line of %d characters, over the limit of 76", len(line))
+		}
+	}
+	got, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(encoded), "\r\n", ""))
+	if err != nil || string(got) != manifest {
+		t.Errorf("attachment is %q, want %q", got, manifest)
+	}
+	if _, err := parts.NextPart(); err != io.EOF {
+		t.Errorf("more parts after the manifest: %v", err)
+	}
+
+	// without a manifest the summary is sent as plain text
+	summary.manifest = ""
+	raw, err = emailMessage("ds-xml@host", []string{"ops@example.com"}, "failed", summary, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = mail.ReadMessage(bytes.NewReader(raw)); err != nil || !strings.HasPrefix(msg.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("Content-Type %q, %v, want text/plain", msg.Header.Get("Content-Type"), err)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+)
+
+// The first and last -ordinal of the entries in each output file written,
+// by path, for the manifest
+var fileOrdinals sync.Map
+
+type ordinalRange struct {
+	first, last int
+}
+
+// Stamps each entry with its position in the output, counting from 1, and
+// the byte offset of its start tag in the input
+func addOrdinals(entries []entry, ordinalAttr, offsetAttr string) []entry {
+	for i, e := range entries {
+		entries[i].ordinal = i + 1
+		raw := addAttr(e.raw, ordinalAttr, strconv.Itoa(i+1))
+		entries[i].raw = addAttr(raw, offsetAttr, strconv.FormatInt(e.offset, 10))
+	}
+	return entries
+}
+
+// Notes an entry's ordinal as written to an output file
+func (s *xmlSink) noteOrdinal(e entry) {
+	if e.ordinal == 0 {
+		return
+	}
+	if s.ordinals.first == 0 {
+		s.ordinals.first = e.ordinal
+	}
+	s.ordinals.last = e.ordinal
+}
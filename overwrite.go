@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Returns the paths to write a series of output files to. Existing files
+// are only overwritten with force; with appendSuffix the whole series is
+// written alongside them with the first free suffix, e.g. book_part-1_v2.xml.
+func claimPaths(paths []string, force, appendSuffix bool) ([]string, error) {
+	exists := func(paths []string) string {
+		for _, p := range paths {
+			if _, err := os.Stat(p); err == nil {
+				return p
+			}
+		}
+		return ""
+	}
+
+	existing := exists(paths)
+	if existing == "" || force {
+		return paths, nil
+	}
+	if !appendSuffix {
+		return nil, fmt.Errorf("%s already exists; use --force to overwrite it or --append-suffix to write alongside it", existing)
+	}
+	for n := 2; ; n++ {
+		suffixed := make([]string, len(paths))
+		for i, p := range paths {
+			suffixed[i] = withSuffix(p, fmt.Sprintf("_v%d", n))
+		}
+		if exists(suffixed) == "" {
+			return suffixed, nil
+		}
+	}
+}
+
+// Inserts suffix before a path's extensions, e.g. a.xml.gz to a_v2.xml.gz
+func withSuffix(path, suffix string) string {
+	for _, ext := range []string{".xml.gz", ".xml", ".json.gz", ".json", ".ndjson.gz", ".ndjson", ".csv.gz", ".csv", ".tsv.gz", ".tsv", ".parquet", ".avro", ".zip", ".tar.gz", ".tgz"} {
+		if base, ok := strings.CutSuffix(path, ext); ok {
+			return base + suffix + ext
+		}
+	}
+	// any other extension of letters, as -template files take
+	name := strings.TrimSuffix(path, ".gz")
+	if ext := filepath.Ext(name); len(ext) > 1 && strings.Trim(ext[1:], "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ") == "" {
+		return name[:len(name)-len(ext)] + suffix + path[len(name)-len(ext):]
+	}
+	return path + suffix
+}
+
+// Fails when a file matching the glob pattern exists in the output folder
+// and claimPaths would refuse to write over it, so a run can stop before
+// parsing its input rather than after
+func (o outputTarget) checkFree(pattern string) error {
+	if o.force || o.appendSuffix {
+		return nil
+	}
+	matches, _ := filepath.Glob(filepath.Join(o.dir, pattern))
+	if len(matches) > 0 {
+		return fmt.Errorf("%s already exists; use --force to overwrite it or --append-suffix to write alongside it", matches[0])
+	}
+	return nil
+}
+
+// Returns the path to write one output file to, see claimPaths
+func (o outputTarget) claim(path string) (string, error) {
+	paths, err := claimPaths([]string{path}, o.force, o.appendSuffix)
+	if err != nil {
+		return "", err
+	}
+	return paths[0], nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Existing output stops a run before its input is parsed, so here the
+// collision is reported rather than the malformed input
+func TestExistingOutputBeforeParse(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"in.xml":  `<catalog><book n="1"></catalog>`,
+		"ids.csv": "1\n",
+	})
+	if err := os.MkdirAll(filepath.Join(dir, "output"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"book_@n_part-1.xml", "book_@n_shard-2_part-1.xml"} {
+		if err := os.WriteFile(filepath.Join(dir, "output", name), nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, args := range [][]string{nil, {"-shards", "2"}} {
+		opts := testOptions(t, append([]string{"-node", "book", "-ref", "@n", "-csv", "ids.csv"}, args...)...)
+		opts.inputPath = filepath.Join(dir, "in.xml")
+		_, err := run(context.Background(), opts)
+		if err == nil || !strings.Contains(err.Error(), "already exists") {
+			t.Errorf("with %v: got %v, want the existing output reported", args, err)
+		}
+	}
+
+	opts := testOptions(t, "-node", "book", "-ref", "@n", "-csv", "ids.csv", "-force")
+	opts.inputPath = filepath.Join(dir, "in.xml")
+	if _, err := run(context.Background(), opts); err == nil || strings.Contains(err.Error(), "already exists") {
+		t.Errorf("with -force: got %v, want the input parsed", err)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"strings"
+)
+
+// -format parquet: the -columns of the entries are written as a Parquet file
+// of one row group, each column an optional UTF-8 string, null where the
+// entry has no such field. Pages are PLAIN-encoded and, with -compress gzip,
+// GZIP-compressed. Parquet is columnar, so a file's rows are collected and
+// written when it is finished.
+type parquetWriter struct {
+	columns *tableColumns
+	gzip    bool
+	values  [][]*string // per column, a value per row
+	rows    int
+}
+
+// Parquet constants from parquet.thrift
+const (
+	parquetByteArray    = 6 // Type
+	parquetOptional     = 1 // FieldRepetitionType
+	parquetUTF8         = 0 // ConvertedType
+	parquetPlain        = 0 // Encoding
+	parquetRLE          = 3
+	parquetUncompressed = 0 // CompressionCodec
+	parquetGzip         = 2
+	parquetDataPage     = 0 // PageType
+)
+
+func newParquetWriter(columns *tableColumns, gzip bool) *parquetWriter {
+	return &parquetWriter{columns: columns, gzip: gzip, values: make([][]*string, len(columns.paths))}
+}
+
+// Adds an entry's fields as a row
+func (p *parquetWriter) add(raw string) error {
+	n, err := parseNode(raw)
+	if err != nil {
+		return err
+	}
+	for i, path := range p.columns.paths {
+		var value *string
+		if values := path.values(n, nil); len(values) > 0 {
+			joined := strings.Join(values, "|")
+			value = &joined
+		}
+		p.values[i] = append(p.values[i], value)
+	}
+	p.rows++
+	return nil
+}
+
+// A column name Parquet readers such as Athena and Spark accept: title for
+// title, id for @id and author_role for author@role
+func parquetName(column string) string {
+	return strings.Trim(strings.NewReplacer("/", "_", "@", "_").Replace(column), "_")
+}
+
+// Writes the file: its column chunks, then the footer describing them
+func (p *parquetWriter) writeTo(w io.Writer) error {
+	var file bytes.Buffer
+	file.WriteString("PAR1")
+	type chunk struct {
+		offset                   int64
+		uncompressed, compressed int64
+	}
+	chunks := make([]chunk, len(p.values))
+	for i, values := range p.values {
+		page := p.page(values)
+		stored := page
+		if p.gzip {
+			var gz bytes.Buffer
+			zw := gzip.NewWriter(&gz)
+			zw.Write(page)
+			if err := zw.Close(); err != nil {
+				return err
+			}
+			stored = gz.Bytes()
+		}
+
+		var header thriftWriter
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(len(stored)))
+		header.begin(5) // DataPageHeader
+		header.i32(1, int32(p.rows))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE) // definition levels
+		header.i32(4, parquetRLE) // repetition levels
+		header.end()
+		header.end()
+
+		chunks[i] = chunk{
+			offset:       int64(file.Len()),
+			uncompressed: int64(header.buf.Len() + len(page)),
+			compressed:   int64(header.buf.Len() + len(stored)),
+		}
+		file.Write(header.buf.Bytes())
+		file.Write(stored)
+	}
+
+	codec := int32(parquetUncompressed)
+	if p.gzip {
+		codec = parquetGzip
+	}
+	var meta thriftWriter
+	meta.i32(1, 1) // version
+	meta.list(2, thriftStruct, len(p.columns.names)+1)
+	meta.elem()
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(p.columns.names)))
+	meta.end()
+	for _, name := range p.columns.names {
+		meta.elem()
+		meta.i32(1, parquetByteArray)
+		meta.i32(3, parquetOptional)
+		meta.binary(4, name)
+		meta.i32(6, parquetUTF8)
+		meta.begin(10) // LogicalType
+		meta.begin(1)  // StringType
+		meta.end()
+		meta.end()
+		meta.end()
+	}
+	meta.i64(3, int64(p.rows))
+	meta.list(4, thriftStruct, 1)
+	meta.elem() // RowGroup
+	meta.list(1, thriftStruct, len(chunks))
+	var total int64
+	for i, c := range chunks {
+		meta.elem() // ColumnChunk
+		meta.i64(2, c.offset)
+		meta.begin(3) // ColumnMetaData
+		meta.i32(1, parquetByteArray)
+		meta.list(2, thriftI32, 2)
+		meta.varint(zigzag(parquetPlain))
+		meta.varint(zigzag(parquetRLE))
+		meta.list(3, thriftBinary, 1)
+		meta.string(p.columns.names[i])
+		meta.i32(4, codec)
+		meta.i64(5, int64(p.rows))
+		meta.i64(6, c.uncompressed)
+		meta.i64(7, c.compressed)
+		meta.i64(9, c.offset)
+		meta.end()
+		meta.end()
+		total += c.uncompressed
+	}
+	meta.i64(2, total)
+	meta.i64(3, int64(p.rows))
+	meta.end()
+	meta.binary(6, "ds-xml version "+version)
+	meta.end()
+
+	file.Write(meta.buf.Bytes())
+	binary.Write(&file, binary.LittleEndian, uint32(meta.buf.Len()))
+	file.WriteString("PAR1")
+	_, err := w.Write(file.Bytes())
+	return err
+}
+
+// A column's data page: the definition levels telling nulls from values,
+// then the values
+func (p *parquetWriter) page(values []*string) []byte {
+	// levels of bit width 1, bit-packed in groups of 8
+	levels := make([]byte, (len(values)+7)/8)
+	for i, v := range values {
+		if v != nil {
+			levels[i/8] |= 1 << (i % 8)
+		}
+	}
+	var hybrid thriftWriter
+	hybrid.varint(uint64(len(levels))<<1 | 1)
+	hybrid.buf.Write(levels)
+
+	var page bytes.Buffer
+	binary.Write(&page, binary.LittleEndian, uint32(hybrid.buf.Len()))
+	page.Write(hybrid.buf.Bytes())
+	for _, v := range values {
+		if v != nil {
+			binary.Write(&page, binary.LittleEndian, uint32(len(*v)))
+			page.WriteString(*v)
+		}
+	}
+	return page.Bytes()
+}
+
+// Thrift compact protocol types, as Parquet metadata is encoded
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// Writes Thrift compact protocol structs; a struct's fields must be written
+// in increasing order of their ids
+type thriftWriter struct {
+	buf  bytes.Buffer
+	last []int16 // the id of the last field written, per open nested struct
+}
+
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	t.buf.Write(binary.AppendUvarint(nil, v))
+}
+
+func (t *thriftWriter) field(id int16, kind byte) {
+	last := int16(0)
+	if n := len(t.last); n > 0 {
+		last = t.last[n-1]
+		t.last[n-1] = id
+	} else {
+		t.last = []int16{id}
+	}
+	if delta := id - last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | kind)
+		return
+	}
+	t.buf.WriteByte(kind)
+	t.varint(zigzag(int64(id)))
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(zigzag(v))
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.string(s)
+}
+
+// Writes a string as a list element
+func (t *thriftWriter) string(s string) {
+	t.varint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+// Starts a list field of n elements of the given type
+func (t *thriftWriter) list(id int16, kind byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | kind)
+		return
+	}
+	t.buf.WriteByte(0xf0 | kind)
+	t.varint(uint64(n))
+}
+
+// Starts a struct field; end finishes it
+func (t *thriftWriter) begin(id int16) {
+	t.field(id, thriftStruct)
+	t.elem()
+}
+
+// Starts a struct that is a list element; end finishes it
+func (t *thriftWriter) elem() {
+	if len(t.last) == 0 {
+		// the top-level struct is open from the start
+		t.last = []int16{0}
+	}
+	t.last = append(t.last, 0)
+}
+
+// Finishes the innermost open struct
+func (t *thriftWriter) end() {
+	t.buf.WriteByte(0)
+	t.last = t.last[:len(t.last)-1]
+}
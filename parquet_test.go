@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// Known answers from the Parquet format specification: "PAR1", the column
+// chunks, the Thrift compact FileMetaData, its length as a little-endian
+// uint32 and "PAR1" again. A v1 data page of an optional column holds its
+// definition levels as a length-prefixed RLE/bit-packed hybrid, then the
+// non-null values, PLAIN-encoded byte arrays each prefixed with its length.
+func TestParquetKnownAnswer(t *testing.T) {
+	columns, err := parseColumns([]string{"title", "@n"}, "parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := [][]byte{
+		{
+			0x02, 0x00, 0x00, 0x00, // 2 bytes of levels
+			0x03, // a bit-packed run of 1 group of 8
+			0x01, // levels 1, 0: "Dune", null
+			0x04, 0x00, 0x00, 0x00, 'D', 'u', 'n', 'e',
+		},
+		{
+			0x02, 0x00, 0x00, 0x00,
+			0x03,
+			0x03, // levels 1, 1
+			0x01, 0x00, 0x00, 0x00, '1',
+			0x01, 0x00, 0x00, 0x00, '2',
+		},
+	}
+	pageHeader := func(size, stored int) []byte {
+		return []byte{
+			0x15, 0x00, // 1: type DATA_PAGE
+			0x15, byte(size * 2), // 2: uncompressed_page_size
+			0x15, byte(stored * 2), // 3: compressed_page_size
+			0x2c,       // 5: data_page_header
+			0x15, 0x04, // 1: num_values 2
+			0x15, 0x00, // 2: encoding PLAIN
+			0x15, 0x06, // 3: definition_level_encoding RLE
+			0x15, 0x06, // 4: repetition_level_encoding RLE
+			0x00, 0x00,
+		}
+	}
+
+	for _, compressed := range []bool{false, true} {
+		w := newParquetWriter(columns, compressed)
+		for _, e := range []string{`<book n="1"><title>Dune</title></book>`, `<book n="2"/>`} {
+			if err := w.add(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var out bytes.Buffer
+		if err := w.writeTo(&out); err != nil {
+			t.Fatal(err)
+		}
+		file := out.Bytes()
+		if !bytes.HasPrefix(file, []byte("PAR1")) || !bytes.HasSuffix(file, []byte("PAR1")) {
+			t.Fatalf("gzip %v: no PAR1 magic", compressed)
+		}
+		footerLen := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+		footer := file[len(file)-8-footerLen : len(file)-8]
+		meta, n, err := readThrift(footer)
+		if err != nil || n != len(footer) {
+			t.Fatalf("gzip %v: footer: read %d of %d bytes: %v", compressed, n, len(footer), err)
+		}
+
+		codec := int64(parquetUncompressed)
+		if compressed {
+			codec = parquetGzip
+		}
+		offset := 4
+		var chunks []any
+		var total int64
+		for i, page := range pages {
+			stored := page
+			if compressed {
+				// gzip output isn't fixed, so its size is read from the page
+				// header, a one-byte varint for pages this small, and the data
+				// must gunzip to the known page
+				size := int(file[offset+5])
+				if size >= 0x80 {
+					t.Fatalf("gzip %v: page %d is over 63 bytes", compressed, i)
+				}
+				stored = file[offset+len(pageHeader(0, 0)):][:size/2]
+				zr, err := gzip.NewReader(bytes.NewReader(stored))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, err := io.ReadAll(zr); err != nil || !bytes.Equal(got, page) {
+					t.Fatalf("gzip %v: page %d is % x, %v, want % x", compressed, i, got, err, page)
+				}
+			}
+			header := pageHeader(len(page), len(stored))
+			want := append(header, stored...)
+			if got := file[offset : offset+len(want)]; !bytes.Equal(got, want) {
+				t.Errorf("gzip %v: column chunk %d is % x, want % x", compressed, i, got, want)
+			}
+			chunks = append(chunks, map[int16]any{
+				2: int64(offset),
+				3: map[int16]any{
+					1: int64(parquetByteArray),
+					2: []any{int64(parquetPlain), int64(parquetRLE)},
+					3: []any{columns.names[i]},
+					4: codec,
+					5: int64(2),
+					6: int64(len(header) + len(page)),
+					7: int64(len(want)),
+					9: int64(offset),
+				},
+			})
+			total += int64(len(header) + len(page))
+			offset += len(want)
+		}
+		if offset != len(file)-8-footerLen {
+			t.Errorf("gzip %v: footer at %d, want %d", compressed, len(file)-8-footerLen, offset)
+		}
+
+		column := func(name string) map[int16]any {
+			return map[int16]any{
+				1:  int64(parquetByteArray),
+				3:  int64(parquetOptional),
+				4:  name,
+				6:  int64(parquetUTF8),
+				10: map[int16]any{1: map[int16]any{}},
+			}
+		}
+		want := map[int16]any{
+			1: int64(1),
+			2: []any{
+				map[int16]any{4: "schema", 5: int64(2)},
+				column("title"),
+				column("n"),
+			},
+			3: int64(2),
+			4: []any{map[int16]any{1: chunks, 2: total, 3: int64(2)}},
+			6: "ds-xml version " + version,
+		}
+		if !reflect.DeepEqual(meta, want) {
+			t.Errorf("gzip %v: footer\n%v, want\n%v", compressed, meta, want)
+		}
+	}
+}
+
+// Reads a Thrift compact protocol struct into its fields by id
+func readThrift(b []byte) (map[int16]any, int, error) {
+	fields := map[int16]any{}
+	var last int16
+	for i := 0; ; {
+		if i >= len(b) {
+			return nil, i, io.ErrUnexpectedEOF
+		}
+		head := b[i]
+		i++
+		if head == 0 {
+			return fields, i, nil
+		}
+		kind := head & 0x0f
+		if delta := int16(head >> 4); delta != 0 {
+			last += delta
+		} else {
+			id, n := binary.Uvarint(b[i:])
+			last, i = int16(id>>1)^-int16(id&1), i+n
+		}
+		v, n, err := readThriftValue(b[i:], kind)
+		if err != nil {
+			return nil, i, err
+		}
+		fields[last], i = v, i+n
+	}
+}
+
+func readThriftValue(b []byte, kind byte) (any, int, error) {
+	switch kind {
+	case 1, 2:
+		return kind == 1, 0, nil
+	case thriftI32, thriftI64:
+		v, n := binary.Uvarint(b)
+		return int64(v>>1) ^ -int64(v&1), n, nil
+	case thriftBinary:
+		size, n := binary.Uvarint(b)
+		return string(b[n : n+int(size)]), n + int(size), nil
+	case thriftList:
+		size, elem, i := int(b[0]>>4), b[0]&0x0f, 1
+		if size == 15 {
+			s, n := binary.Uvarint(b[1:])
+			size, i = int(s), 1+n
+		}
+		list := []any{}
+		for range size {
+			v, n, err := readThriftValue(b[i:], elem)
+			if err != nil {
+				return nil, i, err
+			}
+			list, i = append(list, v), i+n
+		}
+		return list, i, nil
+	case thriftStruct:
+		return readThrift(b)
+	}
+	return nil, 0, fmt.Errorf("unknown Thrift type %d", kind)
+}
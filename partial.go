@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Exit status of a run stopped by -max-duration
+const exitPartial = 3
+
+// Exit status of a run stopped by SIGINT or SIGTERM
+const exitInterrupted = 130
+
+// Returned when parsing stops at the -max-duration deadline or on a signal.
+// The offset is where the next unread entry starts in the input.
+type partialError struct {
+	offset      int64
+	interrupted bool // stopped by a signal rather than -max-duration
+}
+
+func (e *partialError) Error() string {
+	return fmt.Sprintf("stopped at input offset %d", e.offset)
+}
+
+// Written to the output folder when a run is cut short, recording how far
+// it got. The run can only be continued from the checkpoint -checkpoint
+// keeps, named here when there is one.
+type partialRecord struct {
+	Input      string    `json:"input"`
+	Offset     int64     `json:"offset"`
+	Matches    int       `json:"matches"`
+	Reason     string    `json:"reason"` // max-duration or interrupted
+	StoppedAt  time.Time `json:"stopped_at"`
+	Checkpoint string    `json:"checkpoint,omitempty"`
+}
+
+// Writes partial.json for a run stopped by -max-duration or a signal
+func writePartialRecord(out outputTarget, summary *runSummary) error {
+	if out.dryRun {
+		return nil
+	}
+	if err := out.prepare(); err != nil {
+		return err
+	}
+	reason := "max-duration"
+	if summary.interrupted {
+		reason = "interrupted"
+	}
+	checkpoint := filepath.Join(out.dir, "checkpoint.json")
+	if _, err := os.Stat(checkpoint); err != nil {
+		checkpoint = ""
+	}
+	content, err := json.MarshalIndent(partialRecord{
+		Input:      summary.input,
+		Offset:     summary.offset,
+		Matches:    summary.matches,
+		Reason:     reason,
+		StoppedAt:  time.Now().UTC(),
+		Checkpoint: checkpoint,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(out.dir, "partial.json")
+	if err := writeFileAtomic(path, append(content, '\n')); err != nil {
+		return err
+	}
+	fmt.Printf("Partial run: input offset %d recorded in %s\n", summary.offset, path)
+	if checkpoint != "" {
+		fmt.Println("Rerun the same command with -resume to continue it")
+	} else {
+		fmt.Println("Runs given -checkpoint can be continued with -resume")
+	}
+	return nil
+}
+
+// Reports how a cut-short run stopped, for notices and notifications
+func (s *runSummary) partialStatus() string {
+	if s.interrupted {
+		return "interrupted"
+	}
+	return "partial"
+}
+
+// Prints why parsing stopped early and marks the run as partial
+func (s *runSummary) stopEarly(partial *partialError, opts options) {
+	if partial.interrupted {
+		fmt.Println("Interrupted, finishing with partial output")
+		s.interrupted = true
+	} else {
+		fmt.Printf("Reached -max-duration of %s, finishing with partial output\n", opts.maxDuration)
+	}
+	s.partial = true
+	s.offset = partial.offset
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Device names Windows reserves regardless of extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Makes a file name valid on every platform, NTFS included: characters
+// Windows rejects become _, trailing dots and spaces are dropped and reserved
+// device names get a _ suffix
+func safeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 32 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		return "_"
+	}
+	stem, _, _ := strings.Cut(name, ".")
+	if reservedNames[strings.ToUpper(stem)] {
+		name = stem + "_" + name[len(stem):]
+	}
+	return name
+}
+
+// Runs a command line given in a flag through the platform's shell
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// Opens a folder in the platform's file manager for -open-output
+func openFolder(dir string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("explorer", abs)
+	case "darwin":
+		cmd = exec.Command("open", abs)
+	default:
+		cmd = exec.Command("xdg-open", abs)
+	}
+	fmt.Println("Opening output folder:", abs)
+	// explorer exits with status 1 even when it succeeds, so only a failure
+	// to start the command is reported
+	return cmd.Start()
+}
+
+// Reads the text on the clipboard for -ids-from-clipboard, with the tool each
+// platform has for it; Linux needs wl-clipboard, xclip or xsel
+func readClipboard() (string, error) {
+	var tools [][]string
+	switch runtime.GOOS {
+	case "windows":
+		tools = [][]string{{"powershell", "-NoProfile", "-Command", "Get-Clipboard"}}
+	case "darwin":
+		tools = [][]string{{"pbpaste"}}
+	default:
+		tools = [][]string{
+			{"wl-paste", "--no-newline"},
+			{"xclip", "-selection", "clipboard", "-o"},
+			{"xsel", "--clipboard", "--output"},
+		}
+	}
+	var lastErr error
+	for _, tool := range tools {
+		path, err := exec.LookPath(tool[0])
+		if err != nil {
+			continue
+		}
+		out, err := exec.Command(path, tool[1:]...).Output()
+		if err != nil {
+			// e.g. wl-paste outside a Wayland session; try the next tool
+			lastErr = fmt.Errorf("%s failed: %v", tool[0], err)
+			continue
+		}
+		return string(out), nil
+	}
+	if lastErr != nil {
+		return "", lastErr
+	}
+	return "", errors.New("no clipboard tool found (install wl-clipboard, xclip or xsel)")
+}
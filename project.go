@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// -keep and -drop: the child elements of entries to write, as paths below the
+// entry element like title or meta/date. With -keep only the elements listed
+// are written, with their ancestors; -drop then removes elements from what is
+// left. Everything else is copied from the source as is.
+type projection struct {
+	keep, drop [][]string
+}
+
+// Parses the -keep and -drop paths, each given repeatedly or comma-separated
+func parseProjection(keep, drop []string) (*projection, error) {
+	if len(keep) == 0 && len(drop) == 0 {
+		return nil, nil
+	}
+	p := &projection{}
+	for _, f := range []struct {
+		flag  string
+		specs []string
+		paths *[][]string
+	}{{"-keep", keep, &p.keep}, {"-drop", drop, &p.drop}} {
+		for _, spec := range f.specs {
+			for _, path := range strings.Split(spec, ",") {
+				steps := strings.Split(strings.Trim(strings.TrimSpace(path), "/"), "/")
+				if slices.Contains(steps, "") || strings.ContainsAny(path, "@[]*") {
+					return nil, fmt.Errorf("invalid %s %q: expected child element paths like title or meta/date", f.flag, path)
+				}
+				*f.paths = append(*f.paths, steps)
+			}
+		}
+	}
+	return p, nil
+}
+
+// Reports whether an element at path, the qualified names below the entry
+// element, is written
+func (p *projection) writes(path []string) bool {
+	for _, d := range p.drop {
+		if len(d) == len(path) && stepsMatch(d, path) {
+			return false
+		}
+	}
+	if len(p.keep) == 0 {
+		return true
+	}
+	for _, k := range p.keep {
+		n := min(len(k), len(path))
+		// inside a kept element, or an ancestor of one
+		if stepsMatch(k[:n], path[:n]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether each step matches the qualified name at the same depth, see
+// nameMatches
+func stepsMatch(steps, path []string) bool {
+	for i, step := range steps {
+		if !nameMatches(step, localName(path[i]), path[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Removes the elements an entry doesn't keep, along with the whitespace
+// before them
+func (p *projection) apply(raw string) (string, error) {
+	decoder := newDecoder(strings.NewReader(raw))
+	var buf bytes.Buffer
+	var path []string // from the entry element down to the open element
+	skip := 0         // depth of the element being left out, if any
+	space := ""       // whitespace not written yet
+	for {
+		from := decoder.InputOffset()
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		source := raw[from:decoder.InputOffset()]
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			path = append(path, qualifiedName(t.Name))
+			if skip == 0 && len(path) > 1 && !p.writes(path[1:]) {
+				skip, space = len(path), ""
+			}
+		case xml.EndElement:
+			path = path[:len(path)-1]
+			if skip > len(path) {
+				skip = 0
+				continue
+			}
+		case xml.CharData:
+			if skip == 0 && len(bytes.TrimSpace(t)) == 0 && !strings.HasPrefix(source, "<![CDATA[") {
+				space += source
+				continue
+			}
+		}
+		if skip > 0 {
+			continue
+		}
+		buf.WriteString(space)
+		buf.WriteString(source)
+		space = ""
+	}
+	buf.WriteString(space)
+	return buf.String(), nil
+}
+
+// Applies -keep and -drop to every entry
+func (p *projection) entries(entries []entry) ([]entry, error) {
+	for i, e := range entries {
+		raw, err := p.apply(e.raw)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].raw = raw
+	}
+	return entries, nil
+}
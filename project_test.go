@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestProjection(t *testing.T) {
+	raw := `<book xmlns:dc="http://purl.org/dc/elements/1.1/">
+  <isbn>1</isbn>
+  <dc:title>Dune</dc:title>
+  <title>Dune (1965)</title>
+  <meta><dc:date>1965</dc:date><date>x</date></meta>
+</book>`
+	tests := []struct {
+		keep, drop []string
+		want       string
+	}{
+		{[]string{"isbn", "dc:title"}, nil, `<book xmlns:dc="http://purl.org/dc/elements/1.1/">
+  <isbn>1</isbn>
+  <dc:title>Dune</dc:title>
+</book>`},
+		// without a prefix a step matches any prefix
+		{[]string{"title"}, nil, `<book xmlns:dc="http://purl.org/dc/elements/1.1/">
+  <dc:title>Dune</dc:title>
+  <title>Dune (1965)</title>
+</book>`},
+		{[]string{"meta/dc:date"}, nil, `<book xmlns:dc="http://purl.org/dc/elements/1.1/">
+  <meta><dc:date>1965</dc:date></meta>
+</book>`},
+		{nil, []string{"dc:title", "meta/dc:date"}, `<book xmlns:dc="http://purl.org/dc/elements/1.1/">
+  <isbn>1</isbn>
+  <title>Dune (1965)</title>
+  <meta><date>x</date></meta>
+</book>`},
+	}
+	for _, test := range tests {
+		p, err := parseProjection(test.keep, test.drop)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := p.apply(raw)
+		if err != nil {
+			t.Errorf("-keep %v -drop %v: %v", test.keep, test.drop, err)
+		} else if got != test.want {
+			t.Errorf("-keep %v -drop %v:\n%s\nwant\n%s", test.keep, test.drop, got, test.want)
+		}
+	}
+}
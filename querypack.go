@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Exit status of a run that broke the expectations of its query pack
+const exitExpectations = 4
+
+// Counts a query pack can set expectations on
+var packCounts = []string{"ids", "matches", "files", "unmatched_ids"}
+
+// Flags that run commands or trust the input, which a pack from elsewhere
+// can't set; they can still be given on the command line beside the pack
+var packDenied = []string{"exec-hook", "decompress-cmd", "archive-password-cmd", "trust-entities"}
+
+// A query pack: an extraction bundled as one versioned artifact, a .tgz, .zip
+// or folder holding query.json and the ID lists and other files it reads, e.g.
+//
+//	{"name": "active-books", "version": "3",
+//	 "flags": {"node": "book", "ref": ["isbn"], "csv": "isbns.csv",
+//	           "where": ["price > 0"], "normalize": "isbn13"},
+//	 "expect": {"matches": {"min": 1000, "max": 1200}, "unmatched_ids": 0}}
+//
+// Flags are stored as in recipes; values naming a file in the pack point to
+// it. The run fails when a count is outside what the pack expects.
+type queryPack struct {
+	Name    string                `json:"name"`
+	Version string                `json:"version"`
+	Flags   map[string]any        `json:"flags"`
+	Expect  map[string]countRange `json:"expect"`
+
+	path   string
+	sha256 string
+	set    map[string]bool // flags the pack sets
+}
+
+// Expected bounds of a count, either {"min": 1, "max": 10} or an exact number
+type countRange struct {
+	Min *int `json:"min"`
+	Max *int `json:"max"`
+}
+
+func (r *countRange) UnmarshalJSON(data []byte) error {
+	var n int
+	if json.Unmarshal(data, &n) == nil {
+		r.Min, r.Max = &n, &n
+		return nil
+	}
+	type bounds countRange
+	return json.Unmarshal(data, (*bounds)(r))
+}
+
+// What the run manifest records of the query pack a run came from
+type packRecord struct {
+	Name     string   `json:"name,omitempty"`
+	Version  string   `json:"version"`
+	Path     string   `json:"path"`
+	SHA256   string   `json:"sha256,omitempty"`
+	Violated []string `json:"violated,omitempty"`
+}
+
+// Unpacks a query pack into dir, returning it and the command-line arguments
+// it stands for
+func loadQueryPack(path, dir string) (*queryPack, []string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := &queryPack{path: path, set: make(map[string]bool)}
+	root := path
+	if !info.IsDir() {
+		switch lower := strings.ToLower(path); {
+		case strings.HasSuffix(lower, ".tgz") || strings.HasSuffix(lower, ".tar.gz"):
+			_, err = untarGz(path, dir)
+		case strings.HasSuffix(lower, ".zip"):
+			_, err = unzip(path, dir, "")
+		default:
+			return nil, nil, fmt.Errorf("query pack %s must be a .tgz, .tar.gz, .zip or folder", path)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("unpacking query pack %s: %v", path, err)
+		}
+		f, err := describeFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		p.sha256, root = f.SHA256, dir
+	}
+
+	// a pack made from a folder, e.g. with tar czf q.tgz q/, has query.json
+	// in that folder
+	if _, err := os.Stat(filepath.Join(root, "query.json")); os.IsNotExist(err) {
+		if entries, _ := os.ReadDir(root); len(entries) == 1 && entries[0].IsDir() {
+			root = filepath.Join(root, entries[0].Name())
+		}
+	}
+	content, err := os.ReadFile(filepath.Join(root, "query.json"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("query pack %s: %v", path, err)
+	}
+	if err := json.Unmarshal(content, p); err != nil {
+		return nil, nil, fmt.Errorf("invalid query.json in %s: %v", path, err)
+	}
+	if p.Version == "" {
+		return nil, nil, fmt.Errorf("query pack %s has no version", path)
+	}
+	if len(p.Flags) == 0 {
+		return nil, nil, fmt.Errorf("query pack %s has no flags", path)
+	}
+	for name := range p.Expect {
+		if !slices.Contains(packCounts, name) {
+			return nil, nil, fmt.Errorf("query pack %s expects unknown count %q (use %s)", path, name, strings.Join(packCounts, ", "))
+		}
+	}
+
+	for name, v := range p.Flags {
+		if name == "query-pack" {
+			return nil, nil, fmt.Errorf("query pack %s cannot refer to another query pack", path)
+		}
+		if slices.Contains(packDenied, name) {
+			return nil, nil, fmt.Errorf("query pack %s sets -%s, which packs can't; give it on the command line if you trust it", path, name)
+		}
+		p.set[name] = true
+		if s, ok := v.(string); ok && filepath.IsLocal(s) {
+			if _, err := os.Stat(filepath.Join(root, s)); err == nil {
+				p.Flags[name] = filepath.Join(root, s)
+			}
+		}
+	}
+	if _, ok := p.Expect["unmatched_ids"]; ok && !p.set["report-unmatched"] {
+		// counting the IDs not found needs the report
+		p.Flags["report-unmatched"] = true
+		p.set["report-unmatched"] = true
+	}
+	args, err := flagArgs(p.Flags)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query pack %s: %v", path, err)
+	}
+	return p, args, nil
+}
+
+// Checks a run's counts against what the pack expects, returning the
+// expectations broken
+func (p *queryPack) check(s *runSummary) []string {
+	counts := map[string]int{"ids": s.ids, "matches": s.matches, "files": len(s.files), "unmatched_ids": s.unmatched}
+	names := make([]string, 0, len(p.Expect))
+	for name := range p.Expect {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var violated []string
+	for _, name := range names {
+		r, n := p.Expect[name], counts[name]
+		switch {
+		case name == "unmatched_ids" && !s.countedUnmatched:
+			violated = append(violated, "unmatched_ids: not counted, as the IDs of several inputs can't be")
+		case r.Min != nil && r.Max != nil && *r.Min == *r.Max && n != *r.Min:
+			violated = append(violated, fmt.Sprintf("%s: expected %d, got %d", name, *r.Min, n))
+		case r.Min != nil && n < *r.Min:
+			violated = append(violated, fmt.Sprintf("%s: expected at least %d, got %d", name, *r.Min, n))
+		case r.Max != nil && n > *r.Max:
+			violated = append(violated, fmt.Sprintf("%s: expected at most %d, got %d", name, *r.Max, n))
+		}
+	}
+	return violated
+}
+
+func (p *queryPack) record() *packRecord {
+	return &packRecord{Name: p.Name, Version: p.Version, Path: filepath.ToSlash(p.path), SHA256: p.sha256}
+}
+
+// The path after -query-pack in a command line, or ""
+func queryPackArg(args []string) string {
+	for i, arg := range args {
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-"), "=")
+		switch {
+		case !strings.HasPrefix(arg, "-") || name != "query-pack":
+		case hasValue:
+			return value
+		case i+1 < len(args):
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// The flag names given on a command line, e.g. force for --force
+func givenFlags(args []string) map[string]bool {
+	names := make(map[string]bool)
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if name, ok := strings.CutPrefix(arg, "-"); ok {
+			name, _, _ = strings.Cut(strings.TrimPrefix(name, "-"), "=")
+			names[name] = true
+		}
+	}
+	return names
+}
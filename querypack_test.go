@@ -0,0 +1,33 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQueryPackDeniedFlags(t *testing.T) {
+	for _, flag := range packDenied {
+		t.Run(flag, func(t *testing.T) {
+			dir := testDir(t, map[string]string{
+				"query.json": `{"version": "1", "flags": {"node": "book", "` + flag + `": "true"}}`,
+			})
+			_, _, err := loadQueryPack(dir, t.TempDir())
+			if err == nil || !strings.Contains(err.Error(), "-"+flag) {
+				t.Errorf("got %v, want the pack refused for -%s", err, flag)
+			}
+		})
+	}
+
+	dir := testDir(t, map[string]string{
+		"query.json": `{"version": "1", "flags": {"node": "book", "csv": "ids.csv"}}`,
+		"ids.csv":    "1\n",
+	})
+	_, args, err := loadQueryPack(dir, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "ids.csv"); !strings.Contains(strings.Join(args, " "), want) {
+		t.Errorf("args %v don't point -csv at %s", args, want)
+	}
+}
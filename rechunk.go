@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ds-xml rechunk <file.xml> -node <node> -chunk N: splits a document into
+// chunk files holding every parent node, without matching. Entries are
+// streamed to the chunks as they are parsed, so files of any size can be
+// split.
+func rechunk(args []string) error {
+	fs := flag.NewFlagSet("rechunk", flag.ExitOnError)
+	var opts options
+	fs.StringVar(&opts.parentNode, "node", "", "Parent node to split the document into")
+	fs.IntVar(&opts.chunkSize, "chunk", 0, "Number of entries per output xml file")
+	fs.Var(&opts.chunkBytes, "chunk-size", "Maximum size of each output xml file, e.g. 100MB")
+	fs.StringVar(&opts.compress, "compress", "", "Compress output xml files as they are written: gzip")
+	fs.StringVar(&opts.root, "root", "", "Root element wrapping the output entries, with any attributes and xmlns")
+	fs.StringVar(&opts.format, "format", "xml", "Format to write entries in: xml, json, ndjson, csv, tsv, parquet or avro")
+	fs.StringVar(&opts.avroSchema, "avro-schema", "", "With -format avro, a schema (.avsc) whose fields are filled from the -columns of the same names")
+	fs.StringVar(&opts.template, "template", "", "Go text/template file to render each entry through instead of writing XML")
+	fs.Var(&opts.columns, "columns", "With -format csv, tsv, parquet or avro, the fields of each row, by path like title or @id")
+	fs.BoolVar(&opts.noRoot, "no-root", false, "Write the entries alone, without a root element or XML declaration")
+	fs.BoolVar(&opts.preserveRoot, "preserve-root", false, "Wrap the output entries in the input's own root element")
+	fs.BoolVar(&opts.keepDoctype, "keep-doctype", false, "Start output files with the input's XML declaration and DOCTYPE")
+	fs.StringVar(&opts.encoding, "encoding", "", "Encoding of the input when its XML declaration is missing or wrong")
+	fs.StringVar(&opts.outputEncoding, "output-encoding", "", "Encoding to write output files in (default UTF-8)")
+	fs.BoolVar(&opts.trustEntities, "trust-entities", false, "Trust the input: load external entities and DTDs and don't limit entity expansion")
+	fs.BoolVar(&opts.lenient, "lenient", false, "Parse malformed XML, repairing it and logging a warning for each error recovered")
+	fs.Var(&opts.maxMemory, "max-memory", "Memory the run should stay within, e.g. 4GiB; inputs too big for it are streamed")
+	fs.BoolVar(&opts.skipMalformed, "skip-malformed", false, "Leave out entries that are not well-formed instead of stopping, listing them in <file>_errors.csv")
+	fs.Var(&opts.keep, "keep", "Write only these child elements of entries, by path like title or meta/date")
+	fs.Var(&opts.drop, "drop", "Leave these child elements out of entries, by path like fulltext or meta/notes")
+	fs.StringVar(&opts.indent, "indent", "", "Re-indent entries by this many spaces, or a string of spaces and tabs")
+	fs.BoolVar(&opts.minify, "minify", false, "Remove the whitespace between the elements of entries")
+	fs.BoolVar(&opts.force, "force", false, "Overwrite existing output files")
+	fs.BoolVar(&opts.appendSuffix, "append-suffix", false, "Write alongside existing output files, adding a suffix like _v2")
+	fs.Usage = func() {
+		fmt.Println("Usage: ds-xml rechunk <file.xml> -node <parentNode> -chunk <N>")
+		fs.PrintDefaults()
+	}
+
+	// the file may come before or after the flags
+	var input string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		input, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if input == "" && fs.NArg() > 0 {
+		input = fs.Arg(0)
+	}
+	switch {
+	case input == "" || opts.parentNode == "":
+		fs.Usage()
+		return fmt.Errorf("Error: rechunk needs a file and -node")
+	case opts.chunkSize <= 0 && opts.chunkBytes <= 0:
+		return fmt.Errorf("Error: rechunk needs -chunk or -chunk-size")
+	case opts.compress != "" && opts.compress != "gzip":
+		return fmt.Errorf("Error: -compress must be gzip")
+	case opts.force && opts.appendSuffix:
+		return fmt.Errorf("Error: --force and --append-suffix cannot be combined")
+	}
+	if opts.root != "" && opts.preserveRoot {
+		return fmt.Errorf("Error: -root and -preserve-root cannot be combined")
+	}
+	if err := opts.checkNoRoot(); err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+	if err := opts.checkFormat(); err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+	if err := opts.parseLayout(); err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+	project, err := parseProjection(opts.keep, opts.drop)
+	if err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+	for _, name := range []string{opts.encoding, opts.outputEncoding} {
+		if _, err := lookupCharset(name); err != nil {
+			return fmt.Errorf("Error: %v", err)
+		}
+	}
+	lenient.Store(opts.lenient)
+	trustEntities.Store(opts.trustEntities)
+	if opts.maxMemory > 0 {
+		setMemoryLimit(int64(opts.maxMemory))
+	}
+	tempDir, err := os.MkdirTemp("", "ds-xml-")
+	if err != nil {
+		return fmt.Errorf("Error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	source, err := utf8Input(input, opts.encoding, tempDir)
+	if err != nil {
+		return fmt.Errorf("Error reading XML file: %v", err)
+	}
+	prolog, err := readProlog(source, filepath.Dir(input))
+	if err != nil {
+		return fmt.Errorf("Error reading XML: %v", err)
+	}
+	if opts.keepDoctype {
+		opts.prolog = prolog.text()
+	}
+	if opts.preserveRoot {
+		root, err := sourceRoot(source, prolog.entities)
+		if err != nil {
+			return fmt.Errorf("Error reading the root element: %v", err)
+		}
+		opts.root = root
+	}
+	if _, err := parseRoot(opts.root); err != nil {
+		return fmt.Errorf("Error: %v", err)
+	}
+	parent, err := parseNodePath(opts.parentNode)
+	if err != nil {
+		return fmt.Errorf("Error parsing -node: %v", err)
+	}
+	m, err := newMatcher(nil, opts)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	summary := &runSummary{input: input, outputDir: "output"}
+	out := newOutputTarget(summary.outputDir, opts)
+	if err := out.prepare(); err != nil {
+		return err
+	}
+	baseName := strings.TrimSuffix(filepath.Base(input), ".xml")
+	w := &chunkWriter{out: out, baseName: baseName}
+
+	fmt.Println("Parsing XML file:", input)
+	summary.noteStreaming(source)
+	c := newCapture(selection{parent: parent}, m)
+	// rechunking only moves entries between files, so nothing is dropped
+	// unless -keep or -drop says so
+	c.keepComments, c.keepPIs = true, true
+	c.emit = func(e entry) error {
+		summary.matches++
+		if project != nil {
+			raw, err := project.apply(e.raw)
+			if err != nil {
+				return fmt.Errorf("Error projecting the entry at offset %d: %v", e.offset, err)
+			}
+			e.raw = raw
+		}
+		if opts.layout != nil {
+			raw, err := opts.layout.apply(e.raw)
+			if err != nil {
+				return fmt.Errorf("Error laying out the entry at offset %d: %v", e.offset, err)
+			}
+			e.raw = raw
+		}
+		e, err := out.root.formatEntry(e)
+		if err != nil {
+			return fmt.Errorf("Error converting the entry at offset %d to %s: %v", e.offset, out.root.format, err)
+		}
+		return w.write(e)
+	}
+	var skipped *[]malformedEntry
+	if opts.skipMalformed {
+		skipped = new([]malformedEntry)
+	}
+	err = parseXMLMulti(context.Background(), source, prolog.entities, []*capture{c}, nil, skipped)
+	if err != nil {
+		err = fmt.Errorf("Error parsing XML: %v", err)
+	}
+	files, closeErr := w.close(err != nil)
+	summary.files = files
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil && skipped != nil && len(*skipped) > 0 {
+		files, err = writeErrorReport(out, baseName, *skipped)
+		summary.files = append(summary.files, files...)
+	}
+	if err == nil {
+		fmt.Printf("Split %d entries into %d files\n", summary.matches, len(summary.files))
+	}
+	summary.duration = time.Since(start)
+	if manifestErr := writeManifest(summary, start, err); manifestErr != nil {
+		fmt.Println("Error writing run manifest:", manifestErr)
+	}
+	if err == nil && summary.matches == 0 {
+		fmt.Printf("No %s nodes found.\n", opts.parentNode)
+	}
+	return err
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Flags left out of recipes: secrets, and ones that only make sense for the
+// run that was given them
+var recipeSkipFlags = map[string]bool{
+	"archive-password": true,
+	"redact-salt":      true,
+	"dry-run":          true,
+	"resume":           true,
+}
+
+// recipe.json: the flags of a successful run and fingerprints of the files it
+// read, so the extraction can be repeated with `ds-xml run recipe.json`
+type recipe struct {
+	Version  string         `json:"version"`
+	Created  time.Time      `json:"created"`
+	Flags    map[string]any `json:"flags"` // a string, or a list for repeatable flags
+	Input    *manifestFile  `json:"input,omitempty"`
+	IDs      *manifestFile  `json:"ids,omitempty"`
+	Excluded *manifestFile  `json:"excluded_ids,omitempty"`
+}
+
+// Writes recipe.json for a run to its output folder, leaving out flags set
+// by its query pack, which -query-pack sets again
+func writeRecipe(summary *runSummary, packed map[string]bool) error {
+	r := recipe{
+		Version:  version,
+		Created:  time.Now().UTC(),
+		Flags:    make(map[string]any),
+		Input:    summary.inputFile,
+		IDs:      summary.idsFile,
+		Excluded: summary.excludedFile,
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if recipeSkipFlags[f.Name] || packed[f.Name] {
+			return
+		}
+		if list, ok := f.Value.(*stringList); ok {
+			r.Flags[f.Name] = []string(*list)
+		} else {
+			r.Flags[f.Name] = f.Value.String()
+		}
+	})
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(summary.outputDir, "recipe.json")
+	if err := writeFileAtomic(path, append(content, '\n')); err != nil {
+		return err
+	}
+	fmt.Println("Recipe written to", path)
+	return nil
+}
+
+// Reads a recipe, returning the command-line arguments it stands for
+func loadRecipe(path string) (*recipe, []string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var r recipe
+	if err := json.Unmarshal(content, &r); err != nil {
+		return nil, nil, fmt.Errorf("invalid recipe %s: %v", path, err)
+	}
+	if len(r.Flags) == 0 {
+		return nil, nil, fmt.Errorf("recipe %s has no flags", path)
+	}
+
+	args, err := flagArgs(r.Flags)
+	if err != nil {
+		return nil, nil, fmt.Errorf("recipe %s: %v", path, err)
+	}
+	return &r, args, nil
+}
+
+// The command-line arguments for flags as recipes and query packs store them
+func flagArgs(flags map[string]any) ([]string, error) {
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var args []string
+	for _, name := range names {
+		switch v := flags[name].(type) {
+		case string, bool:
+			args = append(args, fmt.Sprintf("-%s=%v", name, v))
+		case float64:
+			args = append(args, fmt.Sprintf("-%s=%s", name, strconv.FormatFloat(v, 'f', -1, 64)))
+		case []any:
+			for _, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("flag %s holds a non-string value", name)
+				}
+				args = append(args, fmt.Sprintf("-%s=%s", name, s))
+			}
+		default:
+			return nil, fmt.Errorf("flag %s must be a string, number, boolean or list of strings", name)
+		}
+	}
+	return args, nil
+}
+
+// Describes a file read by a run, recorded under name (its URL when it was
+// downloaded)
+func fingerprint(path, name string) (*manifestFile, error) {
+	f, err := describeFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f.Path = name
+	return &f, nil
+}
+
+// Warns when a file read by a recipe's run differs from the one the recipe
+// was made from
+func checkRecipeFile(kind string, want, got *manifestFile) {
+	if want == nil || got == nil || want.SHA256 == got.SHA256 {
+		return
+	}
+	fmt.Printf("Warning: the %s differs from the recipe's (%s, %d bytes, sha256 %s; the recipe had %s, %d bytes, sha256 %s)\n",
+		kind, got.Path, got.Size, got.SHA256, want.Path, want.Size, want.SHA256)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// A -redact rule: the element or attribute at path, below the entry element,
+// is blanked, hashed or replaced by a fixed value. Element paths are like
+// email or customer/name, attribute paths like @id or customer@email.
+type redaction struct {
+	spec     string
+	steps    []string
+	attr     string
+	strategy string // blank, hash or fixed
+	value    string // with fixed
+}
+
+// Parses a spec like "customer/email=hash", "@id=blank" or
+// "price=fixed:0"
+func parseRedaction(spec string) (redaction, error) {
+	path, strategy, ok := strings.Cut(spec, "=")
+	elem, attr, _ := strings.Cut(path, "@")
+	r := redaction{spec: spec, attr: attr, strategy: strategy}
+	if elem != "" {
+		r.steps = strings.Split(strings.Trim(elem, "/"), "/")
+	}
+	if value, ok := strings.CutPrefix(strategy, "fixed:"); ok {
+		r.strategy, r.value = "fixed", value
+	}
+	switch {
+	case !ok || path == "" || slices.Contains(r.steps, "") || strings.ContainsAny(path, "[]*") || strings.Contains(attr, "@") || (strings.Contains(path, "@") && attr == ""):
+		return redaction{}, fmt.Errorf("invalid -redact %q: expected <path>=<strategy>, e.g. email=hash or customer@id=blank", spec)
+	case r.strategy != "blank" && r.strategy != "hash" && r.strategy != "fixed":
+		return redaction{}, fmt.Errorf("invalid -redact %q: strategy must be blank, hash or fixed:<value>", spec)
+	}
+	return r, nil
+}
+
+// The -redact rules and the salt hashed values are keyed with
+type redactor struct {
+	rules   []redaction
+	salt    string
+	matched []bool // per rule, whether it redacted anything
+}
+
+// What a value is replaced by
+func (rd *redactor) replace(r redaction, value string) string {
+	switch r.strategy {
+	case "hash":
+		if rd.salt == "" {
+			sum := sha256.Sum256([]byte(value))
+			return hex.EncodeToString(sum[:])
+		}
+		mac := hmac.New(sha256.New, []byte(rd.salt))
+		mac.Write([]byte(value))
+		return hex.EncodeToString(mac.Sum(nil))
+	case "fixed":
+		return r.value
+	}
+	return ""
+}
+
+// The rule for the element or attribute at path, if any. Path and attr are
+// qualified names, matched as nameMatches does.
+func (rd *redactor) rule(path []string, attr string) (redaction, bool) {
+	if rd.matched == nil {
+		rd.matched = make([]bool, len(rd.rules))
+	}
+	for i, r := range rd.rules {
+		if len(r.steps) == len(path) && stepsMatch(r.steps, path) && nameMatches(r.attr, localName(attr), attr) {
+			rd.matched[i] = true
+			return r, true
+		}
+	}
+	return redaction{}, false
+}
+
+// Fails when a rule redacted nothing, so a mistyped path doesn't leave the
+// field it meant to scrub in the clear
+func (rd *redactor) checkMatched() error {
+	for i, r := range rd.rules {
+		if rd.matched == nil || !rd.matched[i] {
+			return fmt.Errorf("-redact %s matched nothing in the entries; check its path", r.spec)
+		}
+	}
+	return nil
+}
+
+// Redacts an entry. Attribute values are replaced in place in their start
+// tag; a redacted element's content, text and child elements alike, is
+// replaced by one text value. Everything else is copied from the source.
+func (rd *redactor) apply(raw string) (string, error) {
+	decoder := newDecoder(strings.NewReader(raw))
+	var buf bytes.Buffer
+	var path []string // from the entry element down to the open element
+
+	// the open redacted element: its depth, rule and text so far
+	depth := 0
+	var rule redaction
+	var text strings.Builder
+	for {
+		from := decoder.InputOffset()
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		source := raw[from:decoder.InputOffset()]
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			path = append(path, qualifiedName(t.Name))
+			if depth > 0 {
+				continue
+			}
+			source = rd.attrs(source, path[1:], t.Attr)
+			if len(path) == 1 {
+				break
+			}
+			if r, ok := rd.rule(path[1:], ""); ok {
+				depth, rule = len(path), r
+				text.Reset()
+				if strings.HasSuffix(source, "/>") {
+					// written with an end tag, to hold the value
+					source = strings.TrimRight(strings.TrimSuffix(source, "/>"), " \t\r\n") + ">"
+				}
+			}
+		case xml.EndElement:
+			path = path[:len(path)-1]
+			switch {
+			case depth == 0:
+			case len(path) >= depth:
+				// inside the redacted element
+				continue
+			default:
+				depth = 0
+				xml.EscapeText(&buf, []byte(rd.replace(rule, text.String())))
+				if source == "" {
+					source = "</" + qualifiedName(t.Name) + ">"
+				}
+			}
+		case xml.CharData:
+			if depth > 0 {
+				text.Write(t)
+				continue
+			}
+		default:
+			if depth > 0 {
+				continue
+			}
+		}
+		buf.WriteString(source)
+	}
+	return buf.String(), nil
+}
+
+// Replaces the values of the redacted attributes in a start tag, whose
+// attributes are attrs in the order written
+func (rd *redactor) attrs(tag string, path []string, attrs []xml.Attr) string {
+	var b strings.Builder
+	i := strings.IndexAny(tag, " \t\r\n")
+	if i < 0 {
+		return tag
+	}
+	b.WriteString(tag[:i])
+	for _, a := range attrs {
+		// the attribute's quoted value is the next one in the tag
+		eq := strings.IndexByte(tag[i:], '=')
+		if eq < 0 {
+			break
+		}
+		open := i + eq + strings.IndexAny(tag[i+eq:], `"'`)
+		end := open + 1 + strings.IndexByte(tag[open+1:], tag[open])
+		b.WriteString(tag[i : open+1])
+		// namespace declarations are never redacted
+		if a.Name.Space == "xmlns" || a.Name.Local == "xmlns" {
+			b.WriteString(tag[open+1 : end])
+		} else if r, ok := rd.rule(path, qualifiedName(a.Name)); ok {
+			var escaped bytes.Buffer
+			xml.EscapeText(&escaped, []byte(rd.replace(r, a.Value)))
+			b.Write(escaped.Bytes())
+		} else {
+			b.WriteString(tag[open+1 : end])
+		}
+		i = end
+	}
+	b.WriteString(tag[i:])
+	return b.String()
+}
+
+// Applies the -redact rules to every entry
+func (rd *redactor) entries(entries []entry) ([]entry, error) {
+	for i, e := range entries {
+		raw, err := rd.apply(e.raw)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].raw = raw
+	}
+	return entries, nil
+}
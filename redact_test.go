@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedactPrefixed(t *testing.T) {
+	raw := `<book xmlns:dc="http://purl.org/dc/elements/1.1/" dc:id="7" id="8">` +
+		`<dc:title>Dune</dc:title><title>Dune (1965)</title><meta><dc:date>1965</dc:date></meta></book>`
+	tests := []struct {
+		specs []string
+		want  string
+	}{
+		{[]string{"dc:title=fixed:X"}, `<book xmlns:dc="http://purl.org/dc/elements/1.1/" dc:id="7" id="8">` +
+			`<dc:title>X</dc:title><title>Dune (1965)</title><meta><dc:date>1965</dc:date></meta></book>`},
+		// without a prefix a rule matches any prefix
+		{[]string{"title=blank", "meta/date=fixed:X"}, `<book xmlns:dc="http://purl.org/dc/elements/1.1/" dc:id="7" id="8">` +
+			`<dc:title></dc:title><title></title><meta><dc:date>X</dc:date></meta></book>`},
+		{[]string{"@dc:id=fixed:X"}, `<book xmlns:dc="http://purl.org/dc/elements/1.1/" dc:id="X" id="8">` +
+			`<dc:title>Dune</dc:title><title>Dune (1965)</title><meta><dc:date>1965</dc:date></meta></book>`},
+	}
+	for _, test := range tests {
+		rd := &redactor{}
+		for _, spec := range test.specs {
+			r, err := parseRedaction(spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rd.rules = append(rd.rules, r)
+		}
+		got, err := rd.apply(raw)
+		if err != nil {
+			t.Errorf("-redact %v: %v", test.specs, err)
+		} else if got != test.want {
+			t.Errorf("-redact %v:\n%s\nwant\n%s", test.specs, got, test.want)
+		}
+		if err := rd.checkMatched(); err != nil {
+			t.Errorf("-redact %v: %v", test.specs, err)
+		}
+	}
+}
+
+// A rule that redacts nothing fails the run rather than leave the field it
+// was meant for in the clear
+func TestRedactUnmatched(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"in.xml":  `<catalog xmlns:dc="http://purl.org/dc/elements/1.1/"><book n="1"><dc:title>Dune</dc:title></book></catalog>`,
+		"ids.csv": "1\n",
+	})
+	for _, spec := range []string{"dc:titel=hash", "x:title=hash", "@dc:title=hash"} {
+		opts := testOptions(t, "-node", "book", "-ref", "@n", "-csv", "ids.csv", "-force", "-redact", spec)
+		opts.inputPath = filepath.Join(dir, "in.xml")
+		_, err := run(context.Background(), opts)
+		if err == nil || !strings.Contains(err.Error(), "matched nothing") {
+			t.Errorf("-redact %s: got %v, want the rule reported", spec, err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A -related join: records elsewhere in the document whose key appears in a
+// foreign-key field of the matched entries, e.g. the <author> records whose
+// IDs are listed in a matched <book>
+type relation struct {
+	fk   *pathExpr // field of the matched entry, relative to it
+	node nodePath  // the related records
+	key  refSpec   // the field of a related record holding its key
+}
+
+// Parses a spec like "author_ref=author:id" or "authors/author@ref=author:@id"
+// into the foreign-key path, the related node and its key
+func parseRelation(spec string) (relation, error) {
+	var r relation
+	fk, target, ok := strings.Cut(spec, "=")
+	nodeSpec, keySpec, ok2 := strings.Cut(target, ":")
+	if !ok || !ok2 || fk == "" || nodeSpec == "" || keySpec == "" {
+		return r, fmt.Errorf("invalid -related %q: expected <fk>=<node>:<key>", spec)
+	}
+
+	r.fk = parseFieldPath(fk)
+
+	var err error
+	r.node, err = parseNodePath(nodeSpec)
+	if err != nil {
+		return r, err
+	}
+	r.key = parseRef(keySpec, r.node.name())
+	return r, nil
+}
+
+// Collects the distinct foreign-key values referenced by the entries
+func (r relation) collectKeys(entries []entry) ([]string, error) {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, e := range entries {
+		n, err := parseNode(e.raw)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range r.fk.values(n, nil) {
+			if v != "" && !seen[v] {
+				seen[v] = true
+				keys = append(keys, v)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// Runs the second pass for a relation, capturing the related records whose
+// key was referenced by the matched entries
+func extractRelated(xmlFilePath string, r relation, matched []entry, opts options) ([]entry, error) {
+	keys, err := r.collectKeys(matched)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	// keys are literal values even when the CSV holds patterns
+	keyOpts := opts
+	keyOpts.refRegex = false
+	keyOpts.refWildcard = false
+	m, err := newMatcher(keys, keyOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Capturing %s records for %d referenced keys\n", r.node.name(), len(keys))
+	return parseXML(xmlFilePath, opts.entities, m, selection{parent: r.node, refs: []refSpec{r.key}})
+}
+
+// A -referenced-by lookup: entries of another node type whose reference
+// field holds one of the IDs, answering "which records reference these IDs?"
+type referrer struct {
+	node  nodePath
+	field refSpec
+}
+
+// Parses a spec like "book:author_ref" or "order:customer@id"
+func parseReferrer(spec string) (referrer, error) {
+	var r referrer
+	nodeSpec, fieldSpec, ok := strings.Cut(spec, ":")
+	if !ok || nodeSpec == "" || fieldSpec == "" {
+		return r, fmt.Errorf("invalid -referenced-by %q: expected <node>:<field>", spec)
+	}
+	var err error
+	r.node, err = parseNodePath(nodeSpec)
+	if err != nil {
+		return r, err
+	}
+	r.field = parseRef(fieldSpec, r.node.name())
+	return r, nil
+}
+
+// Captures the entries of each referrer type that reference the IDs and
+// writes them to their own output series, returning the paths written
+func findReferrers(xmlFilePath string, entities map[string]string, m *matcher, referrers []referrer, out outputTarget) ([]string, error) {
+	if err := out.prepare(); err != nil {
+		return nil, err
+	}
+
+	var written []string
+	for _, r := range referrers {
+		fmt.Printf("Looking up %s records that reference the IDs\n", r.node.name())
+		entries, err := parseXML(xmlFilePath, entities, m, selection{parent: r.node, refs: []refSpec{r.field}})
+		if err != nil {
+			return written, fmt.Errorf("Error parsing XML: %v", err)
+		}
+
+		referenced := make(map[string]bool)
+		for _, e := range entries {
+			referenced[e.ref] = true
+		}
+		fmt.Printf("%d %s records reference %d of the IDs\n", len(entries), r.node.name(), len(referenced))
+		if len(entries) == 0 {
+			continue
+		}
+
+		baseName := fmt.Sprintf("%s_references", strings.Join(r.node.steps, "-"))
+		files, err := out.writeChunks(baseName, entries)
+		written = append(written, files...)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
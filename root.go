@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// The element output files wrap their entries in, set with -root
+type rootElement struct {
+	name     string         // the qualified name, for the closing tag
+	start    string         // the whole start tag, attributes and xmlns as given
+	prolog   string         // written before it, the XML declaration when empty
+	encoding *charset       // -output-encoding, nil for UTF-8
+	format   string         // -format the entries are written in, "" for XML
+	columns  *tableColumns  // with -format csv, tsv, parquet or avro
+	avro     *avroSchema    // with -format avro
+	template *entryTemplate // with -template
+	xslt     *xsltTransform // with -xslt-scope document, what files are transformed by
+	xsd      *xsdSchema     // with -xsd-scope document, what files are validated against
+}
+
+var defaultRoot = rootElement{name: "root", start: "<root>"}
+
+// With -format json, files hold a JSON array of the entries
+var jsonArray = rootElement{start: "[", format: "json"}
+
+// With -format ndjson, files hold the entries one per line
+var jsonLines = rootElement{format: "ndjson"}
+
+// Parses a -root value: an element name optionally followed by attributes
+// and xmlns declarations, e.g. `records xmlns="urn:acme:feed" version="2.1"`
+func parseRoot(spec string) (rootElement, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return defaultRoot, nil
+	}
+	spec = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(spec, "<"), ">"))
+
+	// check it is a well-formed start tag by parsing it as an empty element
+	decoder := xml.NewDecoder(strings.NewReader("<" + spec + "/>"))
+	token, err := decoder.RawToken()
+	if err != nil {
+		return rootElement{}, fmt.Errorf("invalid -root %q: %v", spec, err)
+	}
+	start, ok := token.(xml.StartElement)
+	if !ok {
+		return rootElement{}, fmt.Errorf("invalid -root %q: expected an element name and attributes", spec)
+	}
+	if _, err := decoder.RawToken(); err != nil {
+		return rootElement{}, fmt.Errorf("invalid -root %q: %v", spec, err)
+	}
+	if _, err := decoder.RawToken(); err != io.EOF {
+		return rootElement{}, fmt.Errorf("invalid -root %q: expected a single element", spec)
+	}
+	seen := make(map[xml.Name]bool)
+	for _, attr := range start.Attr {
+		if seen[attr.Name] {
+			return rootElement{}, fmt.Errorf("invalid -root %q: attribute %s given twice", spec, qualifiedName(attr.Name))
+		}
+		seen[attr.Name] = true
+	}
+	return rootElement{name: qualifiedName(start.Name), start: "<" + spec + ">"}, nil
+}
+
+// Returns the document element's start tag as a -root value, with its
+// attributes and namespace declarations as written but for references to
+// the declared entities, which are expanded, for -preserve-root
+func sourceRoot(filePath string, entities map[string]string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	decoder := newInputDecoder(bufio.NewReader(f), entities)
+	for {
+		from := decoder.InputOffset()
+		token, err := decoder.RawToken()
+		if err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("no root element found")
+			}
+			return "", err
+		}
+		if _, ok := token.(xml.StartElement); !ok {
+			continue
+		}
+		tag := make([]byte, decoder.InputOffset()-from)
+		if _, err := f.ReadAt(tag, from); err != nil {
+			return "", err
+		}
+		spec := strings.TrimSuffix(strings.TrimSuffix(expandEntities(string(tag), entities), ">"), "/")
+		return strings.TrimPrefix(spec, "<"), nil
+	}
+}
+
+// prefix:local for a name read with RawToken
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// Checks -no-root isn't combined with flags about the root element
+func (opts *options) checkNoRoot() error {
+	switch {
+	case !opts.noRoot:
+		return nil
+	case opts.root != "" || opts.preserveRoot:
+		return fmt.Errorf("-no-root cannot be combined with -root or -preserve-root")
+	case opts.keepDoctype:
+		return fmt.Errorf("-no-root cannot be combined with -keep-doctype, as files have no prolog")
+	}
+	return nil
+}
+
+// -no-root: output files hold the entries alone, one after another, without
+// a root element or XML declaration
+func (r rootElement) bare() bool {
+	return r.start == ""
+}
+
+// What output files start with: the XML declaration, and with
+// -keep-doctype the input's DOCTYPE, or the row of column names of a table
+func (r rootElement) header() string {
+	switch {
+	case r.format == "csv" || r.format == "tsv":
+		return r.columns.header()
+	case r.template != nil:
+		return r.template.header
+	case r.bare() || r.format != "":
+		return ""
+	}
+	header := xml.Header
+	if r.prolog != "" {
+		header = r.prolog
+	}
+	if r.encoding != nil {
+		header = setDeclaredEncoding(header, r.encoding.name)
+	}
+	return header
+}
+
+// The closing tag, or a -template's footer
+func (r rootElement) end() string {
+	switch {
+	case r.template != nil:
+		return r.template.footer
+	case r.bare():
+		return ""
+	case r.format == "json":
+		return "]"
+	}
+	return "</" + r.name + ">"
+}
+
+// Bytes an output file takes beyond its entries: the XML declaration,
+// DOCTYPE and root element
+func (r rootElement) overhead() int64 {
+	if r.bare() {
+		return int64(len(r.header()) + len(r.end()))
+	}
+	return int64(len(r.header()) + len(r.start) + len(r.end()) + 2)
+}
+
+// What goes between the entries of a file besides a newline
+func (r rootElement) separator() string {
+	if r.format == "json" {
+		return ","
+	}
+	return ""
+}
+
+// Bytes an entry takes in an output file
+func (r rootElement) entrySize(e entry) int64 {
+	if r.template != nil {
+		// written as rendered
+		return int64(len(e.written()))
+	}
+	return int64(len(e.written()) + 1 + len(r.separator()))
+}
+
+func (r rootElement) entriesSize(entries []entry) int64 {
+	var size int64
+	for _, e := range entries {
+		size += r.entrySize(e)
+	}
+	return size
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// One extraction in a -rules file
+type rule struct {
+	Name     string   `json:"name"`
+	Node     string   `json:"node"`
+	Ref      []string `json:"ref"`
+	MatchAll bool     `json:"match_all"`
+	Exclude  bool     `json:"exclude"`
+	CSV      string   `json:"csv"` // relative to the rules file
+	Where    []string `json:"where"`
+	Filter   string   `json:"filter"`
+	Output   string   `json:"output"` // output file base name, defaults to name
+	Chunk    int      `json:"chunk"`
+}
+
+// A -rules file describing several extractions done in one pass
+type rulesFile struct {
+	Rules []rule `json:"rules"`
+}
+
+// A rule ready to run
+type compiledRule struct {
+	rule
+	capture *capture
+	filters *entryFilter
+	ids     []string
+}
+
+// Reads a rules file, e.g.
+//
+//	{"rules": [
+//	  {"name": "books", "node": "book", "ref": ["isbn"], "csv": "isbns.csv"},
+//	  {"name": "authors", "node": "author", "ref": ["name"], "csv": "names.csv",
+//	   "where": ["born > 1900"]}
+//	]}
+func loadRules(path string) ([]rule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f rulesFile
+	if err := json.Unmarshal(content, &f); err != nil {
+		return nil, fmt.Errorf("invalid rules file %s: %v", path, err)
+	}
+	if len(f.Rules) == 0 {
+		return nil, fmt.Errorf("rules file %s has no rules", path)
+	}
+	return f.Rules, nil
+}
+
+// Prepares a rule's selection, ID list and filters
+func compileRule(r rule, rulesDir string, opts options) (*compiledRule, error) {
+	if r.Name == "" {
+		return nil, fmt.Errorf("rule without a name")
+	}
+	if r.Node == "" {
+		return nil, fmt.Errorf("rule %s: node is required", r.Name)
+	}
+	if r.Output == "" {
+		r.Output = r.Name
+	}
+	cr := &compiledRule{rule: r, filters: &entryFilter{}}
+
+	parent, err := parseNodePath(r.Node)
+	if err != nil {
+		return nil, fmt.Errorf("rule %s: %v", r.Name, err)
+	}
+	sel := selection{parent: parent, matchAll: r.MatchAll, exclude: r.Exclude}
+	for _, ref := range r.Ref {
+		sel.refs = append(sel.refs, parseRef(ref, parent.name()))
+	}
+
+	whereUsesIDs := false
+	for _, w := range r.Where {
+		cond, usesIDs, err := parsePredicate(w)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: where %q: %v", r.Name, w, err)
+		}
+		cr.filters.conditions = append(cr.filters.conditions, cond)
+		whereUsesIDs = whereUsesIDs || usesIDs
+	}
+	if r.Filter != "" {
+		cr.filters.filter, err = parseFilter(r.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: filter: %v", r.Name, err)
+		}
+	}
+
+	if len(r.Ref) > 0 || whereUsesIDs {
+		if r.CSV == "" {
+			return nil, fmt.Errorf("rule %s: csv is required with ref", r.Name)
+		}
+		csvPath := r.CSV
+		if !filepath.IsAbs(csvPath) {
+			csvPath = filepath.Join(rulesDir, csvPath)
+		}
+		cr.ids, err = readCSV(csvPath, opts.refRegex, opts.headerMode())
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: reading %s: %v", r.Name, csvPath, err)
+		}
+	}
+	m, err := newMatcher(cr.ids, opts)
+	if err != nil {
+		return nil, fmt.Errorf("rule %s: %v", r.Name, err)
+	}
+
+	cr.filters.ids = cr.ids
+
+	cr.capture = newCapture(sel, m)
+	cr.capture.keepComments, cr.capture.keepPIs = opts.keepComments, opts.keepPIs
+	cr.capture.emit = func(e entry) error {
+		ok, err := cr.filters.keep(&e)
+		if err != nil {
+			return fmt.Errorf("rule %s: %v", r.Name, err)
+		}
+		if ok {
+			cr.capture.results = append(cr.capture.results, e)
+		}
+		return nil
+	}
+	return cr, nil
+}
+
+// Runs every rule over the document in a single pass, writing each rule's
+// matches to its own output series
+func runRules(ctx context.Context, xmlFilePath string, rules []rule, rulesPath string, opts options, out outputTarget, summary *runSummary) error {
+	var compiled []*compiledRule
+	var captures []*capture
+	for _, r := range rules {
+		cr, err := compileRule(r, filepath.Dir(rulesPath), opts)
+		if err != nil {
+			return fmt.Errorf("Error in rules file: %v", err)
+		}
+		compiled = append(compiled, cr)
+		captures = append(captures, cr.capture)
+		summary.ids += len(cr.ids)
+	}
+
+	fmt.Printf("Parsing XML file: %s (%d rules)\n", xmlFilePath, len(compiled))
+	summary.noteStreaming(xmlFilePath)
+	var skipped *[]malformedEntry
+	if opts.skipMalformed {
+		skipped = new([]malformedEntry)
+	}
+	if err := parseXMLMulti(ctx, xmlFilePath, opts.entities, captures, nil, skipped); err != nil {
+		var partial *partialError
+		if !errors.As(err, &partial) {
+			return fmt.Errorf("Error parsing XML: %v", err)
+		}
+		summary.stopEarly(partial, opts)
+		// write everything captured before the stop
+		out.ctx = nil
+	}
+
+	if err := out.prepare(); err != nil {
+		return err
+	}
+	if skipped != nil && len(*skipped) > 0 {
+		files, err := writeErrorReport(out, strings.TrimSuffix(filepath.Base(xmlFilePath), ".xml"), *skipped)
+		summary.files = append(summary.files, files...)
+		if err != nil {
+			return fmt.Errorf("Error writing errors report: %v", err)
+		}
+	}
+
+	var failed []string
+	for _, cr := range compiled {
+		cr.capture.reportMixed()
+		entries := cr.capture.results
+		summary.matches += len(entries)
+		if len(entries) == 0 {
+			fmt.Printf("Rule %s: no matching entries found.\n", cr.Name)
+			continue
+		}
+
+		ruleOut := out
+		if cr.Chunk != 0 {
+			ruleOut.chunkSize = cr.Chunk
+		}
+		files, err := ruleOut.writeChunks(cr.Output, entries)
+		summary.files = append(summary.files, files...)
+		if err != nil {
+			fmt.Printf("Error in rule %s: %v\n", cr.Name, err)
+			failed = append(failed, cr.Name)
+		}
+	}
+
+	if summary.partial {
+		if err := writePartialRecord(out, summary); err != nil {
+			return fmt.Errorf("Error recording partial run: %v", err)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Error: rules failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
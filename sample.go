@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sort"
+)
+
+// A fixed-size uniform random sample of a stream of entries (reservoir
+// sampling), so -sample never holds more than N entries
+type reservoir struct {
+	rng     *rand.Rand
+	size    int
+	seen    int
+	entries []entry
+	pos     []int // document position of each sampled entry
+}
+
+func newReservoir(size int, rng *rand.Rand) *reservoir {
+	return &reservoir{rng: rng, size: size}
+}
+
+// Offers the next entry of the stream to the sample
+func (r *reservoir) add(e entry) {
+	r.seen++
+	if len(r.entries) < r.size {
+		r.entries = append(r.entries, e)
+		r.pos = append(r.pos, r.seen)
+		return
+	}
+	if j := r.rng.IntN(r.seen); j < r.size {
+		r.entries[j] = e
+		r.pos[j] = r.seen
+	}
+}
+
+// Returns the sampled entries in document order
+func (r *reservoir) sample() []entry {
+	sort.Sort(r)
+	return r.entries
+}
+
+func (r *reservoir) Len() int           { return len(r.entries) }
+func (r *reservoir) Less(i, j int) bool { return r.pos[i] < r.pos[j] }
+func (r *reservoir) Swap(i, j int) {
+	r.entries[i], r.entries[j] = r.entries[j], r.entries[i]
+	r.pos[i], r.pos[j] = r.pos[j], r.pos[i]
+}
+
+// Keeps each entry of a stream with a fixed probability, so -sample-rate
+// samples a share of the entries without knowing how many there are
+type rateSampler struct {
+	rng  *rand.Rand
+	rate float64
+	seen int
+	kept int
+}
+
+// Reports whether the next entry of the stream is in the sample
+func (s *rateSampler) keep() bool {
+	s.seen++
+	if s.rng.Float64() >= s.rate {
+		return false
+	}
+	s.kept++
+	return true
+}
+
+// Returns the random source for sampling: seeded with -seed so a sample can
+// be repeated, otherwise with a random seed that is printed for the same reason
+func newSampleRand(seed uint64, seeded bool) *rand.Rand {
+	if !seeded {
+		seed = rand.Uint64()
+		fmt.Printf("Sampling with seed %d (pass -seed %d to repeat this sample)\n", seed, seed)
+	}
+	return rand.New(rand.NewPCG(seed, seed))
+}
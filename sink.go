@@ -0,0 +1,541 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// An output XML file being written entry by entry. It is written to a
+// hidden temp file beside path and renamed into place when finished, so a
+// crash never leaves a truncated file under the final name.
+type xmlSink struct {
+	path     string
+	tmp      string
+	compress bool // gzip the file; each reopening appends a gzip member
+	root     rootElement
+	file     *os.File
+	gz       *gzip.Writer
+	w        io.Writer
+	entries  int
+	size     int64 // uncompressed bytes, including the closing root element
+	ordinals ordinalRange
+	done     bool
+	parquet  *parquetWriter // with -format parquet, the rows to write
+	avro     *avroWriter    // with -format avro, the records to write
+}
+
+// Temp file an output file is written to before being renamed into place
+func tempPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+}
+
+// Writes a whole file through a temp file, like os.WriteFile but never
+// leaving a partial file under path
+func writeFileAtomic(path string, data []byte) error {
+	tmp := tempPath(path)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Creates the file and writes the XML declaration and opening root element
+func createXMLSink(path string, compress bool, root rootElement) (*xmlSink, error) {
+	// Create or overwrite the XML
+	file, err := os.Create(tempPath(path))
+	if err != nil {
+		return nil, fmt.Errorf("Error creating XML file: %v", err)
+	}
+	s := &xmlSink{path: path, tmp: file.Name(), compress: compress, root: root, size: root.overhead()}
+	if root.format == "parquet" {
+		// Parquet compresses its pages itself
+		s.parquet, s.compress = newParquetWriter(root.columns, compress), false
+	}
+	if root.format == "avro" {
+		// as does Avro its blocks
+		s.avro, s.compress = newAvroWriter(root.avro, root.columns, compress), false
+	}
+	s.attach(file)
+
+	// Write XML declaration, after a byte order mark in UTF-16
+	header := s.root.header()
+	if root.encoding != nil && root.encoding.utf16() {
+		header = "\uFEFF" + header
+	}
+	if _, err := io.WriteString(s.w, header); err != nil {
+		s.abort()
+		return nil, fmt.Errorf("Error writing XML header: %v", err)
+	}
+
+	// Write opening root element
+	if s.root.bare() {
+		return s, nil
+	}
+	if _, err := io.WriteString(s.w, s.root.start+"\n"); err != nil {
+		s.abort()
+		return nil, fmt.Errorf("Error writing root element: %v", err)
+	}
+	return s, nil
+}
+
+// Starts writing to file, through a gzip writer if compressing
+func (s *xmlSink) attach(file *os.File) {
+	s.file, s.w = file, file
+	if s.compress {
+		s.gz = gzip.NewWriter(file)
+		s.w = s.gz
+	}
+	if s.root.encoding != nil {
+		s.w = s.root.encoding.newWriter(s.w)
+	}
+}
+
+// Reopens a suspended sink for appending
+func (s *xmlSink) reopen() error {
+	if s.file != nil {
+		return nil
+	}
+	file, err := os.OpenFile(s.tmp, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return fmt.Errorf("Error reopening XML file: %v", err)
+	}
+	s.attach(file)
+	return nil
+}
+
+// Flushes any compressed data and closes the file
+func (s *xmlSink) close() error {
+	var err error
+	if s.gz != nil {
+		err = s.gz.Close()
+	}
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.file, s.gz, s.w = nil, nil, nil
+	return err
+}
+
+// Discards an unfinished file
+func (s *xmlSink) abort() {
+	if s.file != nil {
+		s.close()
+	}
+	os.Remove(s.tmp)
+}
+
+func (s *xmlSink) write(e entry) error {
+	if s.parquet != nil {
+		if err := s.parquet.add(e.raw); err != nil {
+			return fmt.Errorf("Error converting entry to parquet: %v", err)
+		}
+		s.entries++
+		s.size += s.root.entrySize(e)
+		s.noteOrdinal(e)
+		return nil
+	}
+	if s.avro != nil {
+		if err := s.avro.add(e.raw); err != nil {
+			return fmt.Errorf("Error converting the entry at offset %d to avro: %v", e.offset, err)
+		}
+		s.entries++
+		s.size += s.root.entrySize(e)
+		s.noteOrdinal(e)
+		return nil
+	}
+	if err := s.reopen(); err != nil {
+		return err
+	}
+	text := e.written() + "\n"
+	if s.root.template != nil {
+		text = e.written()
+	}
+	if sep := s.root.separator(); sep != "" {
+		// the separator and newline end the entry before, once one follows
+		text = e.written()
+		if s.entries > 0 {
+			text = sep + "\n" + text
+		}
+	}
+	if _, err := io.WriteString(s.w, text); err != nil {
+		return fmt.Errorf("Error writing to XML file: %v", err)
+	}
+	s.entries++
+	s.size += s.root.entrySize(e)
+	s.noteOrdinal(e)
+	return nil
+}
+
+// Closes the file without finishing it, to free the descriptor; the next
+// write reopens it
+func (s *xmlSink) suspend() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.close()
+}
+
+// Writes the closing root element, closes the file and moves it into place
+func (s *xmlSink) finish() error {
+	if err := s.reopen(); err != nil {
+		s.abort()
+		return err
+	}
+
+	if s.parquet != nil {
+		if err := s.parquet.writeTo(s.w); err != nil {
+			s.abort()
+			return fmt.Errorf("Error writing parquet file: %v", err)
+		}
+	}
+	if s.avro != nil {
+		if err := s.avro.writeTo(s.w); err != nil {
+			s.abort()
+			return fmt.Errorf("Error writing avro file: %v", err)
+		}
+	}
+
+	// Write closing root element, or a -template's footer
+	if end := s.root.end(); end != "" {
+		if !s.root.bare() {
+			end += "\n"
+		}
+		if s.root.separator() != "" && s.entries > 0 {
+			end = "\n" + end
+		}
+		if _, err := io.WriteString(s.w, end); err != nil {
+			s.abort()
+			return fmt.Errorf("Error writing closing root element: %v", err)
+		}
+	}
+	if err := s.file.Sync(); err != nil {
+		s.abort()
+		return fmt.Errorf("Error writing XML file: %v", err)
+	}
+	if err := s.close(); err != nil {
+		s.abort()
+		return fmt.Errorf("Error writing XML file: %v", err)
+	}
+	if s.root.xslt != nil {
+		if err := s.root.xslt.file(s.tmp, s.compress); err != nil {
+			os.Remove(s.tmp)
+			return fmt.Errorf("Error transforming %s with -xslt: %v", s.path, err)
+		}
+	}
+	if s.root.xsd != nil {
+		if err := s.root.xsd.file(s.tmp, s.compress); err != nil {
+			os.Remove(s.tmp)
+			return fmt.Errorf("Error validating %s with -xsd: %v", s.path, err)
+		}
+	}
+	if err := os.Rename(s.tmp, s.path); err != nil {
+		os.Remove(s.tmp)
+		return fmt.Errorf("Error moving XML file into place: %v", err)
+	}
+	s.done = true
+	if s.ordinals.first != 0 {
+		fileOrdinals.Store(filepath.ToSlash(s.path), s.ordinals)
+	}
+	return nil
+}
+
+// Writes entries to numbered chunk files as they arrive, for output too
+// large to hold in memory. Compressed chunks are collected and handed to a
+// chunkPool instead, so they are compressed while parsing continues.
+type chunkWriter struct {
+	out      outputTarget
+	baseName string
+	sink     *xmlSink
+	part     int
+	written  []string
+
+	pool    *chunkPool
+	pending []entry // the chunk being collected for the pool
+	size    int64
+	paths   []string // of the chunks handed to the pool
+}
+
+func (w *chunkWriter) write(e entry) error {
+	if w.out.compress {
+		return w.collect(e)
+	}
+	if w.sink != nil && w.sink.entries > 0 && w.full(w.sink.entries, w.sink.size, e) {
+		if err := w.finish(); err != nil {
+			return err
+		}
+	}
+	if w.sink == nil {
+		path, err := w.nextPath()
+		if err != nil {
+			return err
+		}
+		if w.sink, err = createXMLSink(path, w.out.compress, w.out.root); err != nil {
+			return err
+		}
+	}
+	return w.sink.write(e)
+}
+
+// Claims the path of the next chunk
+func (w *chunkWriter) nextPath() (string, error) {
+	w.part++
+	name := safeFileName(fmt.Sprintf("%s_part-%d%s", w.baseName, w.part, w.out.extension()))
+	path, err := w.out.claim(filepath.Join(w.out.dir, name))
+	if err != nil {
+		return "", fmt.Errorf("Error: %v", err)
+	}
+	fmt.Printf("Writing chunk %d to %s ... \n", w.part, path)
+	return path, nil
+}
+
+// Reports whether e would take a chunk of entries and size bytes past the
+// entry or byte limit
+func (w *chunkWriter) full(entries int, size int64, e entry) bool {
+	if w.out.chunkSize > 0 && entries >= w.out.chunkSize {
+		return true
+	}
+	return w.out.maxBytes > 0 && size+w.out.root.entrySize(e) > w.out.maxBytes
+}
+
+// Adds e to the chunk being collected, handing the chunk to the pool when
+// it is full
+func (w *chunkWriter) collect(e entry) error {
+	if w.pool == nil {
+		w.pool = newChunkPool(w.out)
+		w.size = w.out.root.overhead()
+	}
+	if len(w.pending) > 0 && w.full(len(w.pending), w.size, e) {
+		if err := w.submit(); err != nil {
+			return err
+		}
+	}
+	w.pending = append(w.pending, e)
+	w.size += w.out.root.entrySize(e)
+	return nil
+}
+
+func (w *chunkWriter) submit() error {
+	// stop parsing once a chunk has failed
+	if err := w.pool.err(); err != nil {
+		return err
+	}
+	path, err := w.nextPath()
+	if err != nil {
+		return err
+	}
+	w.pool.write(w.part, path, w.pending)
+	w.paths = append(w.paths, path)
+	w.pending, w.size = nil, w.out.root.overhead()
+	return nil
+}
+
+func (w *chunkWriter) finish() error {
+	sink := w.sink
+	w.sink = nil
+	if err := sink.finish(); err != nil {
+		return err
+	}
+	w.written = append(w.written, sink.path)
+	return nil
+}
+
+// Finishes the last chunk, returning the paths written; with failed set the
+// last chunk is discarded instead
+func (w *chunkWriter) close(failed bool) ([]string, error) {
+	if w.pool != nil {
+		var err error
+		if !failed && len(w.pending) > 0 {
+			err = w.submit()
+		}
+		for i, chunkErr := range w.pool.wait() {
+			if chunkErr == nil {
+				w.written = append(w.written, w.paths[i])
+			} else if err == nil {
+				err = chunkErr
+			}
+		}
+		return w.written, err
+	}
+	if w.sink == nil {
+		return w.written, nil
+	}
+	if failed {
+		w.sink.abort()
+		return w.written, nil
+	}
+	return w.written, w.finish()
+}
+
+// Open files kept by a partitionWriter before the least recently used is
+// suspended
+const maxOpenSinks = 128
+
+// Routes entries to one output series per distinct value of a field, for
+// -partition-by. Each partition rotates to a new part at the chunk size or
+// -chunk-size.
+type partitionWriter struct {
+	out      outputTarget
+	baseName string
+	field    *pathExpr
+	label    string // the field, as used in file names
+
+	current map[string]*xmlSink // the part being written per value
+	parts   map[string]int
+	open    []*xmlSink // open sinks, least recently used first
+	sinks   []*xmlSink
+}
+
+func newPartitionWriter(out outputTarget, baseName, field string) *partitionWriter {
+	return &partitionWriter{
+		out:      out,
+		baseName: baseName,
+		field:    parseFieldPath(field),
+		label:    strings.NewReplacer("@", "", "/", "-").Replace(field),
+		current:  make(map[string]*xmlSink),
+		parts:    make(map[string]int),
+	}
+}
+
+// Name of a partition's part file, e.g. book_isbn_country-US_part-1.xml
+func (p *partitionWriter) fileName(value string, part int) string {
+	if value == "" {
+		value = "none"
+	}
+	return safeFileName(fmt.Sprintf("%s_%s-%s_part-%d%s", p.baseName, p.label, value, part, p.out.extension()))
+}
+
+func (p *partitionWriter) write(e entry) error {
+	value := entryKey(e, p.field)
+	sink := p.current[value]
+	if sink != nil && sink.entries > 0 && p.full(sink, e) {
+		if err := sink.finish(); err != nil {
+			return err
+		}
+		p.forget(sink)
+		sink = nil
+	}
+
+	if sink == nil {
+		p.parts[value]++
+		path, err := p.out.claim(filepath.Join(p.out.dir, p.fileName(value, p.parts[value])))
+		if err != nil {
+			return fmt.Errorf("Error: %v", err)
+		}
+		if sink, err = createXMLSink(path, p.out.compress, p.out.root); err != nil {
+			return err
+		}
+		p.current[value] = sink
+		p.sinks = append(p.sinks, sink)
+	} else {
+		p.forget(sink)
+	}
+
+	// keep the number of open files bounded however many values there are
+	for len(p.open) >= maxOpenSinks {
+		if err := p.open[0].suspend(); err != nil {
+			return err
+		}
+		p.open = p.open[1:]
+	}
+	if err := sink.write(e); err != nil {
+		return err
+	}
+	p.open = append(p.open, sink)
+	return nil
+}
+
+// Reports whether e would take a part past the entry or byte limit
+func (p *partitionWriter) full(sink *xmlSink, e entry) bool {
+	if p.out.chunkSize > 0 && sink.entries >= p.out.chunkSize {
+		return true
+	}
+	return p.out.maxBytes > 0 && sink.size+p.out.root.entrySize(e) > p.out.maxBytes
+}
+
+// Drops a sink from the open list
+func (p *partitionWriter) forget(sink *xmlSink) {
+	for i, s := range p.open {
+		if s == sink {
+			p.open = append(p.open[:i], p.open[i+1:]...)
+			return
+		}
+	}
+}
+
+// Finishes every part, returning the paths written
+func (p *partitionWriter) close() ([]string, error) {
+	var written []string
+	failed := 0
+	for _, sink := range p.sinks {
+		if sink.done {
+			written = append(written, sink.path)
+			continue
+		}
+		if err := sink.finish(); err != nil {
+			fmt.Printf("Error finishing %s: %v\n", sink.path, err)
+			failed++
+			continue
+		}
+		written = append(written, sink.path)
+	}
+	if failed > 0 {
+		return written, fmt.Errorf("Error: failed to write %d partition file(s) of %s", failed, p.baseName)
+	}
+	return written, nil
+}
+
+// Writes entries to one output series per distinct value of field,
+// returning the paths written
+func (o outputTarget) writePartitions(baseName, field string, entries []entry) ([]string, error) {
+	if err := o.root.formatEntries(entries); err != nil {
+		return nil, fmt.Errorf("Error converting entries to %s: %v", o.root.format, err)
+	}
+	p := newPartitionWriter(o, baseName, field)
+	if o.dryRun {
+		counts := make(map[string]int)
+		var order []string
+		for _, e := range entries {
+			value := entryKey(e, p.field)
+			if counts[value] == 0 {
+				order = append(order, value)
+			}
+			counts[value]++
+		}
+		for _, value := range order {
+			path, err := o.claim(filepath.Join(o.dir, p.fileName(value, 1)))
+			if err != nil {
+				return nil, fmt.Errorf("Error: %v", err)
+			}
+			fmt.Printf("Would write %d entries to %s\n", counts[value], path)
+		}
+		return nil, nil
+	}
+
+	for _, e := range entries {
+		if err := p.write(e); err != nil {
+			p.close()
+			return nil, err
+		}
+	}
+	written, err := p.close()
+	fmt.Printf("Wrote %d entries to %d partition files\n", len(entries), len(written))
+	return written, err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// An entry -skip-malformed left out: where it started, where parsing picked
+// up again and the error that stopped it
+type malformedEntry struct {
+	offset int64
+	next   int64 // -1 when no parent element followed
+	err    string
+}
+
+// Drops the entry being captured, which can't be parsed to its end
+func (c *capture) abandon() {
+	c.buffer.Reset()
+	c.content = c.content[:0]
+	c.insideParent = false
+	c.captureDepth = -1
+}
+
+// Finds the next start tag of a parent element of any capture at or after
+// offset, where parsing can pick up again after an error
+func nextBoundary(src io.ReaderAt, size, offset int64, captures []*capture) (int64, bool) {
+	var names []string
+	for _, c := range captures {
+		name := c.sel.parent.name()
+		if name == "*" {
+			name = `[\w.-]+`
+		} else {
+			name = regexp.QuoteMeta(name)
+		}
+		names = append(names, name)
+	}
+	// any prefix, as the parent path matches local names
+	re := regexp.MustCompile(`<(?:[\w.-]+:)?(?:` + strings.Join(names, "|") + `)[\s/>]`)
+	r := bufio.NewReader(io.NewSectionReader(src, offset, size-offset))
+	loc := re.FindReaderIndex(r)
+	if loc == nil {
+		return 0, false
+	}
+	// FindReaderIndex counts runes' bytes, so the index is a byte offset
+	return offset + int64(loc[0]), true
+}
+
+// Writes <base>_errors.csv listing the entries -skip-malformed left out
+func writeErrorReport(out outputTarget, baseName string, skipped []malformedEntry) ([]string, error) {
+	fmt.Printf("Skipped %d malformed entries\n", len(skipped))
+	rows := [][]string{{"offset", "skipped_to", "error"}}
+	for _, s := range skipped {
+		next := ""
+		if s.next >= 0 {
+			next = strconv.FormatInt(s.next, 10)
+		}
+		rows = append(rows, []string{strconv.FormatInt(s.offset, 10), next, s.err})
+	}
+	for _, s := range skipped[:min(len(skipped), 10)] {
+		fmt.Printf("  offset %d: %s\n", s.offset, s.err)
+	}
+
+	path, err := out.claim(filepath.Join(out.dir, safeFileName(baseName+"_errors.csv")))
+	if err != nil {
+		return nil, err
+	}
+	if out.dryRun {
+		fmt.Printf("Would write %s\n", path)
+		return nil, nil
+	}
+	if err := out.prepare(); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := csv.NewWriter(&buf).WriteAll(rows); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, buf.Bytes()); err != nil {
+		return nil, err
+	}
+	fmt.Println("Errors written to", path)
+	return []string{path}, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+)
+
+// How -sort-by orders entries
+type sortSpec struct {
+	key     *pathExpr
+	desc    bool
+	numeric bool
+}
+
+// An entry with its sort key and position in the input, which keeps the
+// sort stable
+type sortRecord struct {
+	seq uint64
+	key string
+	e   entry
+}
+
+// Reports whether a sorts before b. Entries without the key, or with a
+// non-numeric key when sorting numerically, always go last.
+func (s sortSpec) less(a, b sortRecord) bool {
+	if s.numeric {
+		x, errX := strconv.ParseFloat(a.key, 64)
+		y, errY := strconv.ParseFloat(b.key, 64)
+		switch {
+		case errX != nil || errY != nil:
+			if (errX == nil) != (errY == nil) {
+				return errX == nil
+			}
+		case x != y:
+			return (x < y) != s.desc
+		}
+	} else if a.key != b.key {
+		switch {
+		case a.key == "":
+			return false
+		case b.key == "":
+			return true
+		}
+		return (a.key < b.key) != s.desc
+	}
+	return a.seq < b.seq
+}
+
+// Returns the value of the sort key for an entry, or "" if it has none
+func (s sortSpec) keyOf(e entry) (string, error) {
+	n, err := parseNode(e.raw)
+	if err != nil {
+		return "", err
+	}
+	if values := s.key.values(n, nil); len(values) > 0 {
+		return values[0], nil
+	}
+	return "", nil
+}
+
+// Orders entries for -sort-by. The entries are already all in memory, as
+// every step of a run after matching works on the whole set, so they are
+// sorted there.
+func sortEntries(entries []entry, spec sortSpec) ([]entry, error) {
+	records := make([]sortRecord, len(entries))
+	for i, e := range entries {
+		key, err := spec.keyOf(e)
+		if err != nil {
+			return nil, err
+		}
+		records[i] = sortRecord{seq: uint64(i), key: key, e: e}
+	}
+	sort.Slice(records, func(i, j int) bool { return spec.less(records[i], records[j]) })
+	for i, r := range records {
+		entries[i] = r.e
+	}
+	return entries, nil
+}
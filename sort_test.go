@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Sorted entries keep their input offsets, which -ordinal stamps
+func TestSortOrdinal(t *testing.T) {
+	input := `<catalog><book n="1"><y>3</y></book><book n="2"><y>1</y></book><book n="3"><y>2</y></book></catalog>`
+	dir := testDir(t, map[string]string{"in.xml": input, "ids.csv": "1\n2\n3\n"})
+	opts := testOptions(t, "-node", "book", "-ref", "@n", "-csv", "ids.csv", "-sort-by", "y", "-ordinal")
+	opts.inputPath = filepath.Join(dir, "in.xml")
+	if _, err := run(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "output", "book_@n_part-1.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, n := range []string{"2", "3", "1"} {
+		offset := strings.Index(input, `<book n="`+n+`"`)
+		want := fmt.Sprintf(`<book n="%s" ordinal="%d" offset="%d">`, n, i+1, offset)
+		if !strings.Contains(string(got), want) {
+			t.Errorf("output has no %s:\n%s", want, got)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ds-xml stats <file.xml>: scans a document and prints how often each
+// element and attribute name occurs and how many elements sit at each depth,
+// and with -node how many entries there are, their sizes and the largest of
+// them, for planning extraction jobs before running them.
+func stats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	var opts options
+	var scanSize byteSize
+	var top int
+	fs.StringVar(&opts.parentNode, "node", "", "Parent node whose entries to measure")
+	fs.IntVar(&top, "top", 10, "Largest entries to list, with -node")
+	fs.Var(&scanSize, "scan-size", "Scan only the first part of the input, e.g. 100MB, to report on a huge file quickly")
+	fs.StringVar(&opts.encoding, "encoding", "", "Encoding of the input when its XML declaration is missing or wrong")
+	fs.BoolVar(&opts.trustEntities, "trust-entities", false, "Trust the input: load external entities and DTDs and don't limit entity expansion")
+	fs.Usage = func() {
+		fmt.Println("Usage: ds-xml stats <file.xml> [-node <parentNode>]")
+		fs.PrintDefaults()
+	}
+
+	// the file may come before or after the flags
+	var input string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		input, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if input == "" && fs.NArg() > 0 {
+		input = fs.Arg(0)
+	}
+	if input == "" {
+		fs.Usage()
+		return fmt.Errorf("Error: stats needs a file")
+	}
+	s := &docStats{top: top}
+	if opts.parentNode != "" {
+		parent, err := parseNodePath(opts.parentNode)
+		if err != nil {
+			return fmt.Errorf("Error parsing -node: %v", err)
+		}
+		s.node = &parent
+	}
+	tempDir, err := os.MkdirTemp("", "ds-xml-")
+	if err != nil {
+		return fmt.Errorf("Error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	source, entities, err := scanSource(input, opts, tempDir)
+	if err != nil {
+		return err
+	}
+	s.entities = entities
+
+	fmt.Println("Scanning XML file:", input)
+	complete, err := s.scan(source, int64(scanSize))
+	if err != nil {
+		return fmt.Errorf("Error reading XML: %v", err)
+	}
+	scanned := "the input"
+	if !complete {
+		scanned = fmt.Sprintf("the first %d bytes of the input", int64(scanSize))
+	}
+	fmt.Printf("Statistics of %s:\n", scanned)
+	s.print()
+	return nil
+}
+
+// An entry measured by stats
+type sizedEntry struct {
+	offset int64
+	line   int
+	size   int64
+}
+
+// What stats found in a document
+type docStats struct {
+	entities map[string]string // the input declares
+	elements map[string]int
+	attrs    map[string]int
+	depths   []int // elements per depth, the document element's first
+
+	// with -node
+	node     *nodePath
+	entries  int
+	total    int64
+	smallest int64
+	biggest  int64
+	top      int
+	largest  []sizedEntry // largest first
+}
+
+// Scans the input, or its first limit bytes if limit is set, reporting
+// whether all of it was read
+func (s *docStats) scan(filePath string, limit int64) (bool, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	var limited *io.LimitedReader
+	if limit > 0 {
+		limited = &io.LimitedReader{R: f, N: limit}
+		r = limited
+	}
+
+	s.elements = make(map[string]int)
+	s.attrs = make(map[string]int)
+	var stack []string
+	var open []sizedEntry // entries being read, one per open element with -node
+	decoder := newInputDecoder(bufio.NewReader(r), s.entities)
+	for {
+		from := decoder.InputOffset()
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			if limited != nil && limited.N == 0 {
+				// the scan ended mid-document
+				return false, nil
+			}
+			return false, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			s.elements[t.Name.Local]++
+			if len(s.depths) < len(stack) {
+				s.depths = append(s.depths, 0)
+			}
+			s.depths[len(stack)-1]++
+			for _, a := range t.Attr {
+				if a.Name.Space != "xmlns" && a.Name.Local != "xmlns" {
+					s.attrs["@"+a.Name.Local]++
+				}
+			}
+			if s.node != nil {
+				e := sizedEntry{offset: -1}
+				if s.node.matches(stack) {
+					line, _ := decoder.InputPos()
+					e = sizedEntry{offset: from, line: line}
+				}
+				open = append(open, e)
+			}
+		case xml.EndElement:
+			if len(stack) == 0 {
+				return false, fmt.Errorf("unexpected </%s>", t.Name.Local)
+			}
+			stack = stack[:len(stack)-1]
+			if s.node != nil {
+				e := open[len(open)-1]
+				open = open[:len(open)-1]
+				if e.offset >= 0 {
+					e.size = decoder.InputOffset() - e.offset
+					s.measure(e)
+				}
+			}
+		}
+	}
+}
+
+// Counts an entry, keeping it if it is among the largest
+func (s *docStats) measure(e sizedEntry) {
+	if s.entries == 0 || e.size < s.smallest {
+		s.smallest = e.size
+	}
+	s.biggest = max(s.biggest, e.size)
+	s.entries++
+	s.total += e.size
+	if s.top <= 0 || len(s.largest) == s.top && e.size <= s.largest[len(s.largest)-1].size {
+		return
+	}
+	i := sort.Search(len(s.largest), func(i int) bool { return s.largest[i].size < e.size })
+	s.largest = append(s.largest[:i], append([]sizedEntry{e}, s.largest[i:]...)...)
+	if len(s.largest) > s.top {
+		s.largest = s.largest[:s.top]
+	}
+}
+
+func (s *docStats) print() {
+	printCounts("Elements", s.elements)
+	printCounts("Attributes", s.attrs)
+
+	fmt.Println("Elements per depth:")
+	most := 0
+	for _, n := range s.depths {
+		most = max(most, n)
+	}
+	for depth, n := range s.depths {
+		bar := strings.Repeat("#", (n*40+most-1)/most)
+		fmt.Printf("  %3d %12d %s\n", depth+1, n, bar)
+	}
+
+	if s.node == nil {
+		return
+	}
+	if s.entries == 0 {
+		fmt.Println("No entries found for -node")
+		return
+	}
+	fmt.Printf("Entries: %d, %s in all, %s on average, %s to %s\n", s.entries,
+		formatSize(s.total), formatSize(s.total/int64(s.entries)), formatSize(s.smallest), formatSize(s.biggest))
+	if len(s.largest) == 0 {
+		return
+	}
+	fmt.Println("Largest entries:")
+	for _, e := range s.largest {
+		fmt.Printf("  %10s at offset %d (line %d)\n", formatSize(e.size), e.offset, e.line)
+	}
+}
+
+// Prints names by how often they occur, most often first
+func printCounts(title string, counts map[string]int) {
+	if len(counts) == 0 {
+		return
+	}
+	names := make([]string, 0, len(counts))
+	width := 0
+	for name := range counts {
+		names = append(names, name)
+		width = max(width, len(name))
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	fmt.Printf("%s by name:\n", title)
+	for _, name := range names {
+		fmt.Printf("  %-*s %12d\n", width, name, counts[name])
+	}
+}
+
+// A size in bytes as B, KB, MB or GB, in powers of 1000 like -chunk-size
+func formatSize(n int64) string {
+	switch {
+	case n < 1000:
+		return fmt.Sprintf("%d B", n)
+	case n < 1000*1000:
+		return fmt.Sprintf("%.1f KB", float64(n)/1e3)
+	case n < 1000*1000*1000:
+		return fmt.Sprintf("%.1f MB", float64(n)/1e6)
+	}
+	return fmt.Sprintf("%.1f GB", float64(n)/1e9)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// -format csv and tsv: each entry is written as a row of the -columns, paths
+// below the entry element like title, @id or author@role, in files starting
+// with a row of the column names. A column with several values, like a
+// repeated element, holds them joined by |; a missing one is empty. Parquet
+// and Avro files take their columns the same way.
+type tableColumns struct {
+	names []string
+	paths []*pathExpr
+	comma rune
+}
+
+// Parses -columns, given repeatedly or comma-separated
+func parseColumns(specs []string, format string) (*tableColumns, error) {
+	t, err := parseFieldList("-columns", specs, format)
+	if err == nil && len(t.names) == 0 {
+		err = fmt.Errorf("-format %s needs -columns", format)
+	}
+	return t, err
+}
+
+// Parses a list of fields given to the named flag, as columns of format
+func parseFieldList(flag string, specs []string, format string) (*tableColumns, error) {
+	t := &tableColumns{comma: ','}
+	if format == "tsv" {
+		t.comma = '\t'
+	}
+	var given []string // the paths of the names
+	for _, spec := range specs {
+		for _, name := range strings.Split(spec, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" || strings.ContainsAny(name, "[]*") || strings.Count(name, "@") > 1 || strings.HasSuffix(name, "@") {
+				return nil, fmt.Errorf("invalid %s %q: expected paths like title, @id or author@role", flag, spec)
+			}
+			t.paths = append(t.paths, parseFieldPath(strings.Trim(name, "/")))
+			path := name
+			switch format {
+			case "parquet":
+				name = parquetName(name)
+			case "avro":
+				name = avroName(name)
+			}
+			if i := slices.Index(t.names, name); i != -1 {
+				if given[i] == path {
+					return nil, fmt.Errorf("invalid %s: %s is given twice", flag, path)
+				}
+				// parquetName("@id") and parquetName("id") are both id
+				return nil, fmt.Errorf("invalid %s: %s and %s would both be named %s in %s; leave one out", flag, given[i], path, name, format)
+			}
+			t.names = append(t.names, name)
+			given = append(given, path)
+		}
+	}
+	return t, nil
+}
+
+// Writes one row, without its line end
+func (t *tableColumns) row(fields []string) string {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Comma = t.comma
+	w.Write(fields)
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// The row of column names output files start with
+func (t *tableColumns) header() string {
+	return t.row(t.names) + "\n"
+}
+
+// Fails on a column none of the entries has, such as a misspelt path or a
+// prefix the input doesn't use, rather than writing it empty throughout
+func (t *tableColumns) checkMatched(entries []entry) error {
+	found := make([]bool, len(t.paths))
+	left := len(t.paths)
+	for _, e := range entries {
+		if left == 0 {
+			break
+		}
+		n, err := parseNode(e.raw)
+		if err != nil {
+			continue
+		}
+		for i, p := range t.paths {
+			if !found[i] && len(p.values(n, nil)) > 0 {
+				found[i] = true
+				left--
+			}
+		}
+	}
+	for i := range found {
+		if !found[i] {
+			return fmt.Errorf("no entry has a value for column %s", t.names[i])
+		}
+	}
+	return nil
+}
+
+// An entry's row
+func (t *tableColumns) entryRow(raw string) (string, error) {
+	n, err := parseNode(raw)
+	if err != nil {
+		return "", err
+	}
+	fields := make([]string, len(t.paths))
+	for i, p := range t.paths {
+		fields[i] = strings.Join(p.values(n, nil), "|")
+	}
+	return t.row(fields), nil
+}
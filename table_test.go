@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTableColumns(t *testing.T) {
+	raw := `<book id="1" xml:lang="en"><dc:creator>Ann</dc:creator><creator>Bob</creator>` +
+		`<link xlink:href="x"/><tag>a</tag><tag>b</tag></book>`
+	columns, err := parseColumns([]string{"@id,dc:creator,creator", "@xml:lang,link@xlink:href,tag,isbn"}, "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	row, err := columns.entryRow(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1,Ann,Ann|Bob,en,x,a|b,"; row != want {
+		t.Errorf("row = %s, want %s", row, want)
+	}
+
+	err = columns.checkMatched([]entry{{raw: raw}, {raw: `<book id="2"><isbn>9</isbn></book>`}})
+	if err != nil {
+		t.Errorf("every column is in some entry: %v", err)
+	}
+	err = columns.checkMatched([]entry{{raw: raw}})
+	if err == nil || !strings.Contains(err.Error(), "isbn") {
+		t.Errorf("got %v, want an error about isbn", err)
+	}
+}
+
+func TestColumnNameCollisions(t *testing.T) {
+	tests := []struct {
+		columns []string
+		format  string
+		err     string
+	}{
+		{[]string{"@id,id"}, "parquet", "@id and id would both be named id in parquet"},
+		{[]string{"a/b", "a@b"}, "avro", "a/b and a@b would both be named a_b in avro"},
+		{[]string{"title,title"}, "csv", "title is given twice"},
+	}
+	for _, test := range tests {
+		_, err := parseColumns(test.columns, test.format)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("parseColumns(%v, %s) = %v, want %q", test.columns, test.format, err, test.err)
+		}
+	}
+	if _, err := parseColumns([]string{"@id,id"}, "csv"); err != nil {
+		t.Errorf("@id and id are distinct CSV columns: %v", err)
+	}
+}
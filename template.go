@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// -template: each entry is rendered through a Go text/template, for output
+// of any shape such as SQL statements, Markdown or an HTML report. Templates
+// named header and footer, given with {{define}}, are written once at the
+// start and end of each file. Files take the template's extension, less
+// .tmpl.
+type entryTemplate struct {
+	tmpl   *template.Template
+	header string
+	footer string
+	ext    string
+}
+
+// What a -template is executed with for each entry
+type templateEntry struct {
+	Name    string // the entry element's name
+	Ref     string // the matched reference value
+	Ordinal int    // the position in the output, with -ordinal
+	Offset  int64  // of the entry in the input
+	XML     string // the entry as captured
+
+	node *node
+}
+
+// The values of a field, by path like -columns: title, @id or author@role
+func (t templateEntry) Fields(path string) []string {
+	return parseFieldPath(strings.Trim(path, "/")).values(t.node, nil)
+}
+
+// A field's value, several joined by | as in -columns, or "" when missing
+func (t templateEntry) Field(path string) string {
+	return strings.Join(t.Fields(path), "|")
+}
+
+// All text inside the entry
+func (t templateEntry) Text() string {
+	return t.Field("")
+}
+
+// Functions for quoting values in templates
+var templateFuncs = template.FuncMap{
+	// a SQL string literal
+	"sql": func(s string) string {
+		return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+	},
+	// a JSON string
+	"json": func(s string) string {
+		var b strings.Builder
+		writeJSONString(&b, s)
+		return b.String()
+	},
+}
+
+// Reads a -template file, rendering its header and footer
+func loadTemplate(path string) (*entryTemplate, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(filepath.Base(path)).Funcs(templateFuncs).Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+	t := &entryTemplate{tmpl: tmpl, ext: ".txt"}
+	for _, part := range []struct {
+		name string
+		text *string
+	}{{"header", &t.header}, {"footer", &t.footer}} {
+		if tmpl.Lookup(part.name) == nil {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := tmpl.ExecuteTemplate(&buf, part.name, nil); err != nil {
+			return nil, err
+		}
+		*part.text = buf.String()
+	}
+
+	name := filepath.Base(path)
+	for _, suffix := range []string{".tmpl", ".tpl", ".gotmpl"} {
+		name = strings.TrimSuffix(name, suffix)
+	}
+	if ext := filepath.Ext(name); len(ext) > 1 {
+		t.ext = ext
+	}
+	return t, nil
+}
+
+// Renders an entry
+func (t *entryTemplate) render(e entry) (string, error) {
+	n, err := parseNode(e.raw)
+	if err != nil {
+		return "", err
+	}
+	data := templateEntry{Name: n.name, Ref: e.ref, Ordinal: e.ordinal, Offset: e.offset, XML: e.raw, node: n}
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
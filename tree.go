@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// An element of a captured entry, parsed so its fields can be inspected
+type node struct {
+	name     string
+	qname    string     // the name as written, with any prefix
+	attr     []xml.Attr // with their prefixes as the name space
+	children []*node
+	text     string // character data directly inside this element
+}
+
+// Parses a captured entry into a tree of nodes. Tokens are read raw so
+// names keep their prefixes.
+func parseNode(raw string) (*node, error) {
+	decoder := newDecoder(strings.NewReader(raw))
+	var stack []*node
+	var root *node
+
+	for {
+		token, err := decoder.RawToken()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			n := &node{name: t.Name.Local, qname: qualifiedName(t.Name), attr: t.Attr}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			} else if root == nil {
+				root = n
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			// RawToken leaves matching end tags to the caller
+			name := qualifiedName(t.Name)
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("unexpected end element </%s>", name)
+			}
+			if open := stack[len(stack)-1].qname; open != name {
+				return nil, fmt.Errorf("element <%s> closed by </%s>", open, name)
+			}
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += string(t)
+			}
+		}
+	}
+
+	if root == nil || len(stack) > 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return root, nil
+}
+
+// Returns the value of the named attribute and whether it was present
+func (n *node) attrValue(name string) (string, bool) {
+	for _, a := range n.attr {
+		if nameMatches(name, a.Name.Local, qualifiedName(a.Name)) {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// Returns the direct children with the given name ("*" matches any)
+func (n *node) childrenNamed(name string) []*node {
+	var result []*node
+	for _, c := range n.children {
+		if name == "*" || nameMatches(name, c.name, c.qname) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// A name given with a prefix, like dc:creator, matches only that prefix;
+// one without matches the local name whatever its prefix
+func nameMatches(name, local, qname string) bool {
+	if strings.Contains(name, ":") {
+		return name == qname
+	}
+	return name == local
+}
+
+// Returns all text inside the element, including that of its descendants
+func (n *node) textContent() string {
+	if len(n.children) == 0 {
+		return n.text
+	}
+	var buf bytes.Buffer
+	n.writeText(&buf)
+	return buf.String()
+}
+
+func (n *node) writeText(buf *bytes.Buffer) {
+	buf.WriteString(n.text)
+	for _, c := range n.children {
+		c.writeText(buf)
+	}
+}
+
+// Parses a field of an entry relative to it: "name", "a/b", "@attr" or
+// "a/b@attr"
+func parseFieldPath(spec string) *pathExpr {
+	p := &pathExpr{}
+	elem, attr, _ := strings.Cut(spec, "@")
+	if elem != "" {
+		p.steps = strings.Split(elem, "/")
+	}
+	p.attr = attr
+	return p
+}
+
+// Returns the value entries are grouped by: the first value of field, or the
+// matched ref value when field is nil
+func entryKey(e entry, field *pathExpr) string {
+	if field == nil {
+		return e.ref
+	}
+	n, err := parseNode(e.raw)
+	if err != nil {
+		return ""
+	}
+	if values := field.values(n, nil); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
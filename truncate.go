@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A -truncate rule: the text of every element with this name is capped at
+// max characters
+type truncation struct {
+	field string
+	max   int
+}
+
+// Parses a spec like "description=500"
+func parseTruncation(spec string) (truncation, error) {
+	field, n, ok := strings.Cut(spec, "=")
+	max, err := strconv.Atoi(n)
+	if !ok || field == "" || err != nil || max < 0 {
+		return truncation{}, fmt.Errorf("invalid -truncate %q: expected <field>=<length>", spec)
+	}
+	return truncation{field: field, max: max}, nil
+}
+
+// Caps the text of the truncated fields in an entry, appending marker to
+// text that was cut. Text in elements nested inside a field counts towards
+// the field's length.
+func truncateEntry(raw string, rules []truncation, marker string) (string, error) {
+	// the limit of an element, by its qualified name; a field with a prefix
+	// matches only that prefix and wins over one without
+	limit := func(qname string) (int, bool) {
+		max, found := 0, false
+		for _, r := range rules {
+			switch {
+			case !nameMatches(r.field, localName(qname), qname):
+			case strings.Contains(r.field, ":"):
+				return r.max, true
+			default:
+				max, found = r.max, true
+			}
+		}
+		return max, found
+	}
+
+	// tokens are copied in their source form, so prefixes, escaping and
+	// CDATA sections are kept; only cut text is written again
+	decoder := newDecoder(strings.NewReader(raw))
+	var buf bytes.Buffer
+
+	// the outermost open truncated field: its depth, remaining budget and
+	// whether it has been cut
+	depth, fieldDepth, remaining, cut := 0, 0, 0, false
+	for {
+		from := decoder.InputOffset()
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			if max, ok := limit(qualifiedName(t.Name)); ok && fieldDepth == 0 {
+				fieldDepth, remaining, cut = depth, max, false
+			}
+		case xml.EndElement:
+			if depth == fieldDepth {
+				fieldDepth = 0
+			}
+			depth--
+		case xml.CharData:
+			if fieldDepth == 0 {
+				break
+			}
+			if cut {
+				continue
+			}
+			text := []rune(string(t))
+			if len(text) <= remaining {
+				remaining -= len(text)
+				break
+			}
+			kept := string(text[:remaining]) + marker
+			if strings.HasPrefix(raw[from:], "<![CDATA[") {
+				writeCDATA(&buf, kept)
+			} else if err := xml.EscapeText(&buf, []byte(kept)); err != nil {
+				return "", err
+			}
+			remaining, cut = 0, true
+			continue
+		}
+		buf.WriteString(raw[from:decoder.InputOffset()])
+	}
+	return buf.String(), nil
+}
+
+// Writes text as a CDATA section, splitting it where it holds the ]]> that
+// would end the section early
+func writeCDATA(buf *bytes.Buffer, text string) {
+	buf.WriteString("<![CDATA[")
+	buf.WriteString(strings.ReplaceAll(text, "]]>", "]]]]><![CDATA[>"))
+	buf.WriteString("]]>")
+}
+
+// Applies the -truncate rules to every entry
+func truncateEntries(entries []entry, rules []truncation, marker string) ([]entry, error) {
+	for i, e := range entries {
+		raw, err := truncateEntry(e.raw, rules, marker)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].raw = raw
+	}
+	return entries, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestTruncatePrefixed(t *testing.T) {
+	raw := `<book xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title>Dune Messiah</dc:title><title>Children of Dune</title></book>`
+	tests := []struct {
+		specs []string
+		want  string
+	}{
+		{[]string{"dc:title=4"}, `<book xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title>Dune…</dc:title><title>Children of Dune</title></book>`},
+		// without a prefix a field matches any prefix
+		{[]string{"title=4"}, `<book xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title>Dune…</dc:title><title>Chil…</title></book>`},
+		// and a prefixed one wins over it
+		{[]string{"dc:title=2", "title=4"}, `<book xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title>Du…</dc:title><title>Chil…</title></book>`},
+		{[]string{"x:title=4"}, raw},
+	}
+	for _, test := range tests {
+		var rules []truncation
+		for _, spec := range test.specs {
+			r, err := parseTruncation(spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rules = append(rules, r)
+		}
+		got, err := truncateEntry(raw, rules, "…")
+		if err != nil {
+			t.Errorf("-truncate %v: %v", test.specs, err)
+		} else if got != test.want {
+			t.Errorf("-truncate %v:\n%s\nwant\n%s", test.specs, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Limits on what unpacking a downloaded archive may write, so a zip bomb
+// fails instead of filling the disk. main sets them from the flags before
+// anything is downloaded.
+var unpackLimits = struct {
+	total int64 // bytes across all files of an archive
+	file  int64 // bytes of one file
+	files int   // files in an archive
+}{total: 100 << 30, file: 100 << 30, files: 10000}
+
+// Counts what unpacking one archive wrote against unpackLimits
+type unpacking struct {
+	written int64
+	files   int
+}
+
+// Checks an archive member's name: it must be a relative path within the
+// destination, so an archive can't write outside it
+func memberPath(dest, name string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", fmt.Errorf("illegal file path: %s", name)
+	}
+	fPath := filepath.Join(dest, name)
+	if !strings.HasPrefix(fPath, filepath.Clean(dest)+string(os.PathSeparator)) {
+		return "", fmt.Errorf("illegal file path: %s", fPath)
+	}
+	return fPath, nil
+}
+
+// Copies one unpacked file, failing once it or the archive as a whole goes
+// over the limits
+func (u *unpacking) copy(w io.Writer, r io.Reader, name string) error {
+	if u.files++; u.files > unpackLimits.files {
+		return fmt.Errorf("archive holds more than %d files (-max-extract-files)", unpackLimits.files)
+	}
+	n, err := io.Copy(w, io.LimitReader(r, min(unpackLimits.file, unpackLimits.total-u.written)+1))
+	u.written += n
+	switch {
+	case err != nil:
+		return err
+	case n > unpackLimits.file:
+		return fmt.Errorf("%s unpacks to more than %d bytes (-max-extract-file-size)", name, unpackLimits.file)
+	case u.written > unpackLimits.total:
+		return fmt.Errorf("archive unpacks to more than %d bytes (-max-extract-size)", unpackLimits.total)
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Set at release time with -ldflags "-X main.version=v1.2.3 -X main.updatePublicKey=<base64>"
+var (
+	version         = "dev"
+	updatePublicKey = "" // base64 ed25519 key that signs checksums.txt
+)
+
+// Latest release metadata, overridable with DSXML_UPDATE_URL for mirrors
+const defaultUpdateURL = "https://api.github.com/repos/karlthomas3/ds-xml/releases/latest"
+
+// The parts of a release the updater needs
+type release struct {
+	Tag    string `json:"tag_name"`
+	Assets []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func (r release) assetURL(name string) (string, bool) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL, true
+		}
+	}
+	return "", false
+}
+
+// Name of a release's binary for this platform, e.g.
+// ds-xml_v1.2.3_linux_amd64. The version in it is what ties the signed
+// checksums.txt to a release, as the tag itself is not signed.
+func assetName(tag string) string {
+	name := fmt.Sprintf("ds-xml_%s_%s_%s", tag, runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// Implements "ds-xml self-update": fetches the latest release, verifies the
+// signed checksum of this platform's binary and replaces the running one.
+// A release older than the running version is only installed with
+// -allow-downgrade, so a stale mirror can't roll a binary back.
+func selfUpdate(args []string) error {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	var allowDowngrade bool
+	fs.BoolVar(&allowDowngrade, "allow-downgrade", false, "Install the latest release even when it is older than this version")
+	fs.Usage = func() {
+		fmt.Println("Usage: ds-xml self-update [-allow-downgrade]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	execPath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("Error getting executable path: %v", err)
+	}
+	if execPath, err = filepath.EvalSymlinks(execPath); err != nil {
+		return fmt.Errorf("Error resolving executable path: %v", err)
+	}
+
+	// package managers track the files they install, so let them update it
+	switch slashed := filepath.ToSlash(execPath); {
+	case strings.Contains(slashed, "/Cellar/") || strings.Contains(slashed, "/homebrew/"):
+		return fmt.Errorf("ds-xml was installed with Homebrew; run: brew upgrade ds-xml")
+	case strings.Contains(strings.ToLower(slashed), "/scoop/apps/"):
+		return fmt.Errorf("ds-xml was installed with Scoop; run: scoop update ds-xml")
+	}
+
+	if updatePublicKey == "" {
+		return fmt.Errorf("this build has no update signing key; download a release build to use self-update")
+	}
+	pub, err := base64.StdEncoding.DecodeString(updatePublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid update signing key in this build")
+	}
+
+	endpoint := os.Getenv("DSXML_UPDATE_URL")
+	if endpoint == "" {
+		endpoint = defaultUpdateURL
+	}
+	fmt.Println("Checking for updates:", endpoint)
+	body, err := fetch(endpoint)
+	if err != nil {
+		return fmt.Errorf("Error checking for updates: %v", err)
+	}
+	var rel release
+	if err := json.Unmarshal(body, &rel); err != nil {
+		return fmt.Errorf("Error reading release information: %v", err)
+	}
+	order, err := compareRelease(rel.Tag, version)
+	if err != nil {
+		return err
+	}
+	if order == 0 {
+		fmt.Printf("ds-xml %s is up to date\n", version)
+		return nil
+	}
+	if order < 0 && !allowDowngrade {
+		return fmt.Errorf("the latest release, %s, is older than ds-xml %s; use -allow-downgrade to install it", rel.Tag, version)
+	}
+
+	name := assetName(rel.Tag)
+	binURL, ok := rel.assetURL(name)
+	sumsURL, ok2 := rel.assetURL("checksums.txt")
+	sigURL, ok3 := rel.assetURL("checksums.txt.sig")
+	if !ok || !ok2 || !ok3 {
+		return fmt.Errorf("release %s has no %s with a signed checksums.txt", rel.Tag, name)
+	}
+
+	sums, err := fetch(sumsURL)
+	if err != nil {
+		return fmt.Errorf("Error downloading checksums: %v", err)
+	}
+	sig, err := fetch(sigURL)
+	if err != nil {
+		return fmt.Errorf("Error downloading checksum signature: %v", err)
+	}
+	want, err := signedChecksum(pub, sums, sig, rel.Tag, name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Downloading ds-xml %s (current: %s)\n", rel.Tag, version)
+	bin, err := fetch(binURL)
+	if err != nil {
+		return fmt.Errorf("Error downloading release: %v", err)
+	}
+	sum := sha256.Sum256(bin)
+	if hex.EncodeToString(sum[:]) != want {
+		return fmt.Errorf("checksum mismatch for %s, not updating", name)
+	}
+
+	if err := replaceExecutable(execPath, bin); err != nil {
+		return fmt.Errorf("Error replacing %s: %v", execPath, err)
+	}
+	fmt.Printf("Updated ds-xml to %s\n", rel.Tag)
+	return nil
+}
+
+// Orders a release tag against the running version, as compareVersions. A
+// running version that isn't a semantic one, like "dev", is older than any.
+func compareRelease(release, current string) (int, error) {
+	r, ok := parseVersion(release)
+	if !ok {
+		return 0, fmt.Errorf("release tag %s is not a version like v1.2.3, not updating", release)
+	}
+	c, ok := parseVersion(current)
+	if !ok {
+		return 1, nil
+	}
+	return compareVersions(r, c), nil
+}
+
+// A version's major, minor and patch numbers, then its pre-release
+// identifiers if it has any
+type semver struct {
+	core [3]int
+	pre  []string
+}
+
+// Parses v1.2.3, v1.2.3-rc.1 or the same without the v; build metadata
+// after a + is ignored, as semver orders versions without it
+func parseVersion(s string) (semver, bool) {
+	var v semver
+	s = strings.TrimPrefix(s, "v")
+	s, _, _ = strings.Cut(s, "+")
+	s, pre, hasPre := strings.Cut(s, "-")
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return v, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || p == "" || len(p) > 1 && p[0] == '0' {
+			return v, false
+		}
+		v.core[i] = n
+	}
+	if hasPre {
+		v.pre = strings.Split(pre, ".")
+		for _, id := range v.pre {
+			if id == "" {
+				return v, false
+			}
+		}
+	}
+	return v, true
+}
+
+// Orders versions as semver does: by their numbers, then a pre-release
+// before the release, then pre-releases by identifier, numbers before words
+func compareVersions(a, b semver) int {
+	for i := range a.core {
+		if a.core[i] != b.core[i] {
+			return cmp.Compare(a.core[i], b.core[i])
+		}
+	}
+	switch {
+	case len(a.pre) == 0 && len(b.pre) == 0:
+		return 0
+	case len(a.pre) == 0:
+		return 1
+	case len(b.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(a.pre) && i < len(b.pre); i++ {
+		x, errX := strconv.Atoi(a.pre[i])
+		y, errY := strconv.Atoi(b.pre[i])
+		switch {
+		case errX == nil && errY == nil:
+			if x != y {
+				return cmp.Compare(x, y)
+			}
+		case errX == nil:
+			return -1
+		case errY == nil:
+			return 1
+		case a.pre[i] != b.pre[i]:
+			return strings.Compare(a.pre[i], b.pre[i])
+		}
+	}
+	return cmp.Compare(len(a.pre), len(b.pre))
+}
+
+func fetch(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d from %s", resp.StatusCode, url)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Verifies the signature of a release's checksums.txt and returns the
+// checksum it lists for the binary name. The signature covers checksums.txt,
+// which covers the binary; as the name carries the version, checksums signed
+// for another release don't list it, so a mirror can't serve an older
+// binary under a newer tag.
+func signedChecksum(pub ed25519.PublicKey, sums, sig []byte, tag, name string) (string, error) {
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig))); err == nil {
+		sig = decoded
+	}
+	if !ed25519.Verify(pub, sums, sig) {
+		return "", fmt.Errorf("checksum signature of release %s is invalid, not updating", tag)
+	}
+	want, err := checksumFor(sums, name)
+	if err != nil {
+		return "", fmt.Errorf("the signed checksums of release %s don't list %s, not updating", tag, name)
+	}
+	return want, nil
+}
+
+// Finds a file's SHA-256 in a "<hex>  <name>" checksums file
+func checksumFor(sums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no checksum for %s in checksums.txt", name)
+}
+
+// Swaps in the new binary next to the old one. Windows cannot overwrite a
+// running executable but can rename it, so the old one is moved aside first.
+func replaceExecutable(execPath string, bin []byte) error {
+	dir := filepath.Dir(execPath)
+	tmp, err := os.CreateTemp(dir, ".ds-xml-update-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bin); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return err
+	}
+
+	old := execPath + ".old"
+	os.Remove(old)
+	if err := os.Rename(execPath, old); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), execPath); err != nil {
+		os.Rename(old, execPath)
+		return err
+	}
+	// removing fails on Windows while the old binary runs; it is cleared on
+	// the next update instead
+	os.Remove(old)
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCompareRelease(t *testing.T) {
+	tests := []struct {
+		release, current string
+		want             int
+	}{
+		{"v1.2.3", "v1.2.3", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"v1.2.4", "v1.2.3", 1},
+		{"v1.10.0", "v1.9.0", 1},
+		{"v1.9.0", "v1.10.0", -1},
+		{"v2.0.0", "v1.99.99", 1},
+		{"v1.2.3", "v1.2.3-rc.1", 1},
+		{"v1.2.3-rc.1", "v1.2.3", -1},
+		{"v1.2.3-rc.10", "v1.2.3-rc.9", 1},
+		{"v1.2.3-rc.1", "v1.2.3-beta.2", 1},
+		{"v1.2.3-alpha", "v1.2.3-alpha.1", -1},
+		{"v1.2.3-1", "v1.2.3-alpha", -1},
+		{"v1.2.3+build.5", "v1.2.3", 0},
+		{"v0.1.0", "dev", 1},
+	}
+	for _, test := range tests {
+		got, err := compareRelease(test.release, test.current)
+		if err != nil || got != test.want {
+			t.Errorf("compareRelease(%q, %q) = %d, %v, want %d", test.release, test.current, got, err, test.want)
+		}
+	}
+
+	for _, tag := range []string{"latest", "v1.2", "v1.02.3", "v1.2.3-", "v1.2.3-rc..1"} {
+		if _, err := compareRelease(tag, "v1.0.0"); err == nil {
+			t.Errorf("compareRelease(%q) accepted a tag that isn't a version", tag)
+		}
+	}
+}
+
+func TestSignedChecksum(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := fmt.Sprintf("%064x  %s\n", 1, assetName("v1.0.0"))
+	sig := []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(old))))
+
+	want := fmt.Sprintf("%064x", 1)
+	if got, err := signedChecksum(pub, []byte(old), sig, "v1.0.0", assetName("v1.0.0")); err != nil || got != want {
+		t.Errorf("got %s, %v, want %s", got, err, want)
+	}
+	// validly signed checksums of an old release, served under a newer tag
+	if _, err := signedChecksum(pub, []byte(old), sig, "v2.0.0", assetName("v2.0.0")); err == nil || !strings.Contains(err.Error(), "don't list") {
+		t.Errorf("old checksums under a new tag: got %v, want them refused", err)
+	}
+	forged := strings.Replace(old, "v1.0.0", "v2.0.0", 1)
+	if _, err := signedChecksum(pub, []byte(forged), sig, "v2.0.0", assetName("v2.0.0")); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("edited checksums: got %v, want the signature refused", err)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ds-xml validate <file.xml>: streams the whole document checking it is
+// well-formed, and reports the first error, or with -all every one it can
+// find, with its line, column and byte offset, so a bad feed can be
+// rejected before a long extraction starts. After a syntax error checking
+// picks up again at the next tag.
+func validate(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	var opts options
+	var all bool
+	var maxErrors int
+	fs.BoolVar(&all, "all", false, "Report every error found instead of stopping at the first")
+	fs.IntVar(&maxErrors, "max-errors", 100, "With -all, stop after this many errors")
+	fs.StringVar(&opts.encoding, "encoding", "", "Encoding of the input when its XML declaration is missing or wrong")
+	fs.BoolVar(&opts.trustEntities, "trust-entities", false, "Trust the input: load external entities and DTDs and don't limit entity expansion")
+	fs.Usage = func() {
+		fmt.Println("Usage: ds-xml validate <file.xml>")
+		fs.PrintDefaults()
+	}
+
+	// the file may come before or after the flags
+	var input string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		input, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if input == "" && fs.NArg() > 0 {
+		input = fs.Arg(0)
+	}
+	if input == "" {
+		fs.Usage()
+		return fmt.Errorf("Error: validate needs a file")
+	}
+	limit := 1
+	if all {
+		limit = maxErrors
+	}
+	tempDir, err := os.MkdirTemp("", "ds-xml-")
+	if err != nil {
+		return fmt.Errorf("Error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	source, entities, err := scanSource(input, opts, tempDir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Validating XML file:", input)
+	v := &validator{limit: limit, entities: entities}
+	if err := v.check(source); err != nil {
+		return fmt.Errorf("Error reading XML file: %v", err)
+	}
+	switch {
+	case len(v.errors) == 0:
+		fmt.Printf("%s is well-formed (%d elements)\n", input, v.elements)
+		return nil
+	case len(v.errors) >= limit && all:
+		return fmt.Errorf("Error: %s is not well-formed; stopped after %d errors (-max-errors)", input, len(v.errors))
+	case all && len(v.errors) == 1:
+		return fmt.Errorf("Error: %s is not well-formed: 1 error", input)
+	case all:
+		return fmt.Errorf("Error: %s is not well-formed: %d errors", input, len(v.errors))
+	}
+	return fmt.Errorf("Error: %s is not well-formed", input)
+}
+
+// A well-formedness error and where it is
+type validationError struct {
+	line, column int
+	offset       int64
+	msg          string
+}
+
+// Checks a document's well-formedness, collecting up to limit errors
+type validator struct {
+	entities map[string]string // the input declares
+	limit    int
+	errors   []validationError
+	elements int
+
+	open   []string // the qualified names of the open elements
+	closed bool     // the document element has ended
+	// parsing started again after an error, not knowing which elements
+	// were open, so only those opened since are tracked
+	resynced bool
+
+	// where the current decoder started in the input
+	base             int64
+	baseLine, baseCo int
+}
+
+// Records an error at a position of the current decoder, reporting whether
+// to go on
+func (v *validator) report(line, column int, offset int64, format string, args ...any) bool {
+	line, column = v.position(line, column)
+	e := validationError{line: line, column: column, offset: offset + v.base, msg: fmt.Sprintf(format, args...)}
+	v.errors = append(v.errors, e)
+	fmt.Printf("line %d, column %d (offset %d): %s\n", e.line, e.column, e.offset, e.msg)
+	return len(v.errors) < v.limit
+}
+
+// A line and column of the current decoder as ones in the input
+func (v *validator) position(line, column int) (int, int) {
+	if line == 1 {
+		column += v.baseCo - 1
+	}
+	return line + v.baseLine - 1, column
+}
+
+func (v *validator) check(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	v.baseLine, v.baseCo = 1, 1
+	for {
+		resume, err := v.decode(f)
+		if err != nil || resume < 0 {
+			return err
+		}
+		// start again at the next tag, counting the lines skipped
+		if _, err := f.Seek(resume, io.SeekStart); err != nil {
+			return err
+		}
+		next, skipped, err := nextTag(f)
+		if err != nil {
+			return err
+		}
+		if n := bytes.Count(skipped, []byte("\n")); n > 0 {
+			v.baseLine += n
+			v.baseCo = len(skipped) - bytes.LastIndexByte(skipped, '\n')
+		} else {
+			v.baseCo += len(skipped)
+		}
+		v.base = resume + int64(len(skipped))
+		v.open, v.resynced = nil, true
+		if next < 0 {
+			v.finish(1, 1, 0)
+			return nil
+		}
+		if _, err := f.Seek(v.base, io.SeekStart); err != nil {
+			return err
+		}
+	}
+}
+
+// The bytes before the next < in r, and its offset from where r was, or
+// -1 when there is none
+func nextTag(r io.Reader) (int64, []byte, error) {
+	var skipped []byte
+	br := bufio.NewReader(r)
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			return -1, skipped, nil
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if c == '<' && len(skipped) > 0 {
+			return int64(len(skipped)), skipped, nil
+		}
+		skipped = append(skipped, c)
+	}
+}
+
+// Decodes from the current position of f, returning the offset in the
+// input to resume from after a syntax error, or -1 when done
+func (v *validator) decode(f *os.File) (int64, error) {
+	decoder := newInputDecoder(bufio.NewReader(f), v.entities)
+	for {
+		line, column := decoder.InputPos()
+		from := decoder.InputOffset()
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			v.finish(line, column, from)
+			return -1, nil
+		}
+		if err != nil {
+			var syntax *xml.SyntaxError
+			if !errors.As(err, &syntax) {
+				return 0, err
+			}
+			line, column := decoder.InputPos()
+			if !v.report(line, column, decoder.InputOffset(), "%s", tokenError(err)) {
+				return -1, nil
+			}
+			// the next decoder starts where this one stopped
+			v.baseLine, v.baseCo = v.position(line, column)
+			return v.base + decoder.InputOffset(), nil
+		}
+
+		ok := true
+		switch t := token.(type) {
+		case xml.StartElement:
+			v.elements++
+			name := qualifiedName(t.Name)
+			if v.closed {
+				ok = v.report(line, column, from, "element <%s> after the end of the document element", name)
+			}
+			seen := make(map[string]bool)
+			for _, a := range t.Attr {
+				attr := qualifiedName(a.Name)
+				if seen[attr] && ok {
+					ok = v.report(line, column, from, "attribute %s given twice on <%s>", attr, name)
+				}
+				seen[attr] = true
+			}
+			v.open = append(v.open, name)
+		case xml.EndElement:
+			name := qualifiedName(t.Name)
+			switch {
+			case len(v.open) == 0 && v.resynced:
+				// closes an element opened before the resync
+			case len(v.open) == 0:
+				ok = v.report(line, column, from, "end tag </%s> without a start tag", name)
+			case v.open[len(v.open)-1] != name:
+				ok = v.report(line, column, from, "element <%s> closed by </%s>", v.open[len(v.open)-1], name)
+				// carry on as if the element it names was closed, if it is
+				// open, or was opened before the resync
+				i := len(v.open) - 1
+				for i >= 0 && v.open[i] != name {
+					i--
+				}
+				if i == -1 && v.resynced {
+					i = 0
+				}
+				if i != -1 {
+					v.open = v.open[:i]
+				}
+			default:
+				v.open = v.open[:len(v.open)-1]
+			}
+			if len(v.open) == 0 && !v.resynced {
+				v.closed = true
+			}
+		case xml.CharData:
+			if len(v.open) == 0 && !v.resynced && len(bytes.TrimSpace(t)) > 0 {
+				ok = v.report(line, column, from, "text outside the document element")
+			}
+		}
+		if !ok {
+			return -1, nil
+		}
+	}
+}
+
+// Checks the document ended with its elements closed
+func (v *validator) finish(line, column int, offset int64) {
+	switch {
+	case len(v.open) > 0:
+		v.report(line, column, offset, "the input ends with <%s> not closed", strings.Join(v.open, ">, <"))
+	case !v.closed && len(v.errors) == 0:
+		v.report(line, column, offset, "no document element")
+	}
+}
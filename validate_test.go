@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateResync(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"<a><c>t</c></a>", nil},
+		{"<a><c>&bad;</c></a>", []string{"invalid character entity &bad;"}},
+		{"<a><b><c>&bad;</c></b><d></a>", []string{"invalid character entity &bad;", "element <d> closed by </a>"}},
+		{"<a>\n<c>&bad;</c>\n<d/>\n<e>x</f>\n</a>\n", []string{"invalid character entity &bad;", "element <e> closed by </f>"}},
+		{"<a><c>&bad;</c><e><f></e></a>", []string{"invalid character entity &bad;", "element <f> closed by </e>"}},
+		{"<a><c></a>", []string{"element <c> closed by </a>"}},
+		{"<a><c>", []string{"the input ends with <a>, <c> not closed"}},
+	}
+	dir := t.TempDir()
+	for _, test := range tests {
+		path := filepath.Join(dir, "in.xml")
+		if err := os.WriteFile(path, []byte(test.input), 0666); err != nil {
+			t.Fatal(err)
+		}
+		v := &validator{limit: 100}
+		captureStdout(t, func() {
+			if err := v.check(path); err != nil {
+				t.Fatal(err)
+			}
+		})
+		var got []string
+		for _, e := range v.errors {
+			got = append(got, e.msg)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%q: got errors %q, want %q", test.input, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%q: got errors %q, want %q", test.input, got, test.want)
+				break
+			}
+		}
+	}
+}
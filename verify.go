@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Reads an output file back and calls fn with each entry under its root
+// element, or each top-level element of a bare file, failing if the file is
+// not well-formed to the end
+func readOutputEntries(path string, bare bool, fn func(raw string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	// entries are sliced out of the text, so it must be UTF-8
+	if data, err = toUTF8(data); err != nil {
+		return err
+	}
+
+	decoder := newDecoder(bytes.NewReader(data))
+	depth := 0
+	if bare {
+		// as if the entries were under a root
+		depth = 1
+	}
+	var start int64
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			if depth != 0 && !(bare && depth == 1) {
+				return fmt.Errorf("unexpected end of file")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 2 {
+				start = offset
+			}
+		case xml.EndElement:
+			depth--
+			if depth == 1 {
+				if err := fn(string(data[start:decoder.InputOffset()])); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// Re-parses the files written for entries and checks that together they
+// hold exactly those entries, comparing canonical forms, so that encoding
+// bugs and corruption are caught before delivery
+func verifyOutputs(paths []string, entries []entry, bare bool) error {
+	expected := make(map[string]int, len(entries))
+	for _, e := range entries {
+		h, err := hashEntry(e.raw)
+		if err != nil {
+			return err
+		}
+		expected[h]++
+	}
+
+	unexpected := 0
+	for _, path := range paths {
+		err := readOutputEntries(path, bare, func(raw string) error {
+			h, err := hashEntry(raw)
+			if err != nil {
+				return err
+			}
+			if expected[h] == 0 {
+				unexpected++
+			} else {
+				expected[h]--
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("Verification failed: %s: %v", path, err)
+		}
+	}
+
+	missing := 0
+	for _, n := range expected {
+		missing += n
+	}
+	if missing > 0 || unexpected > 0 {
+		return fmt.Errorf("Verification failed: %d captured entries missing from the output, %d output entries not captured", missing, unexpected)
+	}
+	fmt.Printf("Verified %d entries in %d files\n", len(entries), len(paths))
+	return nil
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Supports a streaming-friendly subset of XPath:
+//
+//	//name[predicate]   select elements named name anywhere
+//	/a/b/c[predicate]   select elements by absolute path
+//	//a/b[predicate]    select b elements that are children of an a
+//
+// Predicates may use child paths (a/b, @attr, a/@attr, .), string and number
+// literals, the comparison operators = != < <= > >=, and, or, parentheses and
+// the functions not(), contains() and starts-with(). $id stands for the
+// reference IDs read from the CSV and matches if any of them compares true.
+// Positional predicates like [1] and prefixed names like dc:creator are
+// rejected rather than matching everything or nothing.
+
+// A slash-separated element path; relative paths match at any depth
+type nodePath struct {
+	steps    []string // element names, "*" matches any
+	anchored bool     // path must start at the document root
+}
+
+// Parses a path like "catalog/book/chapter" or "/catalog/book"
+func parseNodePath(s string) (nodePath, error) {
+	var p nodePath
+	switch {
+	case strings.HasPrefix(s, "//"):
+		s = s[2:]
+	case strings.HasPrefix(s, "/"):
+		p.anchored = true
+		s = s[1:]
+	}
+	for _, step := range strings.Split(s, "/") {
+		if step == "" {
+			return p, fmt.Errorf("invalid path %q: empty or // step (descendant steps are only supported at the start)", s)
+		}
+		p.steps = append(p.steps, step)
+	}
+	return p, nil
+}
+
+// Reports whether the stack of open element names ends with this path
+func (p nodePath) matches(stack []string) bool {
+	if len(stack) < len(p.steps) || (p.anchored && len(stack) != len(p.steps)) {
+		return false
+	}
+	offset := len(stack) - len(p.steps)
+	for i, step := range p.steps {
+		if step != "*" && step != stack[offset+i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the name of the element the path selects
+func (p nodePath) name() string {
+	return p.steps[len(p.steps)-1]
+}
+
+// A parsed -xpath expression
+type xpathExpr struct {
+	path      nodePath
+	predicate exprNode // nil when every selected element matches
+	usesIDs   bool     // predicate refers to $id
+}
+
+// State for evaluating a predicate against one entry
+type evalContext struct {
+	ids       []string
+	matchedID string // the $id value that satisfied a comparison
+}
+
+// A predicate expression tree node
+type exprNode interface {
+	// values returns the strings the expression produces
+	values(n *node, ctx *evalContext) []string
+	// truth returns the expression's boolean value
+	truth(n *node, ctx *evalContext) bool
+}
+
+// Parses an XPath expression like //article[year > 2020 and author/@id = $id]
+func parseXPath(s string) (*xpathExpr, error) {
+	s = strings.TrimSpace(s)
+	pathEnd := strings.Index(s, "[")
+	if pathEnd == -1 {
+		pathEnd = len(s)
+	}
+
+	path, err := parseNodePath(s[:pathEnd])
+	if err != nil {
+		return nil, err
+	}
+	for _, step := range path.steps {
+		if err := checkXPathName(step); err != nil {
+			return nil, fmt.Errorf("invalid xpath %q: %v", s, err)
+		}
+	}
+	x := &xpathExpr{path: path}
+
+	if pathEnd < len(s) {
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("invalid xpath %q: unterminated predicate", s)
+		}
+		x.predicate, x.usesIDs, err = parsePredicate(s[pathEnd+1 : len(s)-1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return x, nil
+}
+
+// Parses a predicate expression, reporting whether it refers to $id
+func parsePredicate(s string) (exprNode, bool, error) {
+	p := &exprParser{input: s}
+	if err := p.tokenize(); err != nil {
+		return nil, false, err
+	}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, false, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, false, fmt.Errorf("invalid xpath predicate: unexpected %q", p.tokens[p.pos].text)
+	}
+	if literal, ok := expr.(*literalExpr); ok && literal.number {
+		return nil, false, fmt.Errorf("invalid xpath predicate: positional predicates like [%s] are not supported", literal.value)
+	}
+	return expr, p.usesIDs, nil
+}
+
+// Names are matched without their prefix, so a prefixed name would never
+// match anything
+func checkXPathName(name string) error {
+	if strings.Contains(name, ":") {
+		return fmt.Errorf("prefixed names like %s are not supported; use the local name", name)
+	}
+	return nil
+}
+
+// Reports whether a captured entry satisfies the predicate, and the $id value
+// that matched it (if any)
+func (x *xpathExpr) eval(n *node, ids []string) (string, bool) {
+	if x.predicate == nil {
+		return "", true
+	}
+	ctx := &evalContext{ids: ids}
+	ok := x.predicate.truth(n, ctx)
+	return ctx.matchedID, ok
+}
+
+type tokenKind int
+
+const (
+	tokName tokenKind = iota
+	tokString
+	tokNumber
+	tokVar
+	tokOp
+)
+
+type exprToken struct {
+	kind tokenKind
+	text string
+}
+
+type exprParser struct {
+	input   string
+	tokens  []exprToken
+	pos     int
+	usesIDs bool
+}
+
+func isNameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.' || r == ':'
+}
+
+func (p *exprParser) tokenize() error {
+	runes := []rune(p.input)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '\'' || r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				end++
+			}
+			if end == len(runes) {
+				return fmt.Errorf("invalid xpath predicate: unterminated string")
+			}
+			p.tokens = append(p.tokens, exprToken{tokString, string(runes[i+1 : end])})
+			i = end + 1
+		case unicode.IsDigit(r):
+			// numbers, and dates or times like 2023-01-01 which are
+			// compared as strings
+			end := i
+			for end < len(runes) && (unicode.IsDigit(runes[end]) || strings.ContainsRune(".-:T", runes[end])) {
+				end++
+			}
+			kind := tokNumber
+			if _, err := strconv.ParseFloat(string(runes[i:end]), 64); err != nil {
+				kind = tokString
+			}
+			p.tokens = append(p.tokens, exprToken{kind, string(runes[i:end])})
+			i = end
+		case r == '$':
+			end := i + 1
+			for end < len(runes) && isNameRune(runes[end]) {
+				end++
+			}
+			p.tokens = append(p.tokens, exprToken{tokVar, string(runes[i+1 : end])})
+			i = end
+		case r == '!' || r == '<' || r == '>':
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				p.tokens = append(p.tokens, exprToken{tokOp, string(runes[i : i+2])})
+				i += 2
+			} else if r == '!' {
+				return fmt.Errorf("invalid xpath predicate: unexpected '!'")
+			} else {
+				p.tokens = append(p.tokens, exprToken{tokOp, string(r)})
+				i++
+			}
+		case strings.ContainsRune("=()/@,*", r):
+			p.tokens = append(p.tokens, exprToken{tokOp, string(r)})
+			i++
+		case isNameRune(r):
+			end := i
+			for end < len(runes) && isNameRune(runes[end]) {
+				end++
+			}
+			p.tokens = append(p.tokens, exprToken{tokName, string(runes[i:end])})
+			i = end
+		default:
+			return fmt.Errorf("invalid xpath predicate: unexpected %q", r)
+		}
+	}
+	return nil
+}
+
+func (p *exprParser) peek() (exprToken, bool) {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos], true
+	}
+	return exprToken{}, false
+}
+
+// Consumes the next token if it is the given operator or keyword
+func (p *exprParser) accept(kind tokenKind, text string) bool {
+	if t, ok := p.peek(); ok && t.kind == kind && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(text string) error {
+	if !p.accept(tokOp, text) {
+		return fmt.Errorf("invalid xpath predicate: expected %q", text)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokName, "or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicExpr{or: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokName, "and") {
+		right, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicExpr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := p.peek(); ok && t.kind == tokOp {
+		switch t.text {
+		case "=", "!=", "<", "<=", ">", ">=":
+			p.pos++
+			right, err := p.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			return &compareExpr{op: t.text, left: left, right: right}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("invalid xpath predicate: unexpected end of expression")
+	}
+
+	switch t.kind {
+	case tokString:
+		p.pos++
+		return &literalExpr{value: t.text}, nil
+	case tokNumber:
+		p.pos++
+		return &literalExpr{value: t.text, number: true}, nil
+	case tokVar:
+		p.pos++
+		if t.text != "id" {
+			return nil, fmt.Errorf("invalid xpath predicate: unknown variable $%s", t.text)
+		}
+		p.usesIDs = true
+		return &idsExpr{}, nil
+	case tokOp:
+		if t.text == "(" {
+			p.pos++
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+		}
+	case tokName:
+		// function call
+		if p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].text == "(" {
+			return p.parseFunction(t.text)
+		}
+	}
+	return p.parsePath()
+}
+
+func (p *exprParser) parseFunction(name string) (exprNode, error) {
+	p.pos += 2 // name and "("
+	var args []exprNode
+	if !p.accept(tokOp, ")") {
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.accept(tokOp, ")") {
+				break
+			}
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	want := map[string]int{"not": 1, "contains": 2, "starts-with": 2}
+	n, ok := want[name]
+	if !ok {
+		return nil, fmt.Errorf("invalid xpath predicate: unknown function %s()", name)
+	}
+	if len(args) != n {
+		return nil, fmt.Errorf("invalid xpath predicate: %s() takes %d argument(s)", name, n)
+	}
+	return &funcExpr{name: name, args: args}, nil
+}
+
+func (p *exprParser) parsePath() (exprNode, error) {
+	path := &pathExpr{}
+	for {
+		if p.accept(tokOp, "@") {
+			t, ok := p.peek()
+			if !ok || t.kind != tokName {
+				return nil, fmt.Errorf("invalid xpath predicate: expected attribute name after @")
+			}
+			if err := checkXPathName(t.text); err != nil {
+				return nil, fmt.Errorf("invalid xpath predicate: %v", err)
+			}
+			p.pos++
+			path.attr = t.text
+			break
+		}
+		t, ok := p.peek()
+		if !ok {
+			return nil, fmt.Errorf("invalid xpath predicate: unexpected end of expression")
+		}
+		if t.kind == tokName || (t.kind == tokOp && t.text == "*") {
+			if err := checkXPathName(t.text); err != nil {
+				return nil, fmt.Errorf("invalid xpath predicate: %v", err)
+			}
+			p.pos++
+			if t.text != "." {
+				path.steps = append(path.steps, t.text)
+			}
+		} else {
+			return nil, fmt.Errorf("invalid xpath predicate: unexpected %q", t.text)
+		}
+		if !p.accept(tokOp, "/") {
+			break
+		}
+	}
+	return path, nil
+}
+
+// A relative path of child steps, optionally ending in an attribute
+type pathExpr struct {
+	steps []string
+	attr  string
+}
+
+func (e *pathExpr) values(n *node, ctx *evalContext) []string {
+	nodes := []*node{n}
+	for _, step := range e.steps {
+		var next []*node
+		for _, c := range nodes {
+			next = append(next, c.childrenNamed(step)...)
+		}
+		nodes = next
+	}
+
+	var result []string
+	for _, c := range nodes {
+		if e.attr != "" {
+			if v, ok := c.attrValue(e.attr); ok {
+				result = append(result, strings.TrimSpace(v))
+			}
+		} else {
+			result = append(result, strings.TrimSpace(c.textContent()))
+		}
+	}
+	return result
+}
+
+func (e *pathExpr) truth(n *node, ctx *evalContext) bool {
+	return len(e.values(n, ctx)) > 0
+}
+
+type literalExpr struct {
+	value  string
+	number bool
+}
+
+func (e *literalExpr) values(n *node, ctx *evalContext) []string {
+	return []string{e.value}
+}
+
+func (e *literalExpr) truth(n *node, ctx *evalContext) bool {
+	return e.value != ""
+}
+
+// $id: the set of reference IDs
+type idsExpr struct{}
+
+func (e *idsExpr) values(n *node, ctx *evalContext) []string {
+	return ctx.ids
+}
+
+func (e *idsExpr) truth(n *node, ctx *evalContext) bool {
+	return len(ctx.ids) > 0
+}
+
+type logicExpr struct {
+	or          bool
+	left, right exprNode
+}
+
+func (e *logicExpr) values(n *node, ctx *evalContext) []string {
+	return []string{strconv.FormatBool(e.truth(n, ctx))}
+}
+
+func (e *logicExpr) truth(n *node, ctx *evalContext) bool {
+	if e.or {
+		return e.left.truth(n, ctx) || e.right.truth(n, ctx)
+	}
+	return e.left.truth(n, ctx) && e.right.truth(n, ctx)
+}
+
+// A comparison, true if any pair of values from both sides compares true
+type compareExpr struct {
+	op          string
+	left, right exprNode
+}
+
+func (e *compareExpr) values(n *node, ctx *evalContext) []string {
+	return []string{strconv.FormatBool(e.truth(n, ctx))}
+}
+
+func (e *compareExpr) truth(n *node, ctx *evalContext) bool {
+	_, leftIDs := e.left.(*idsExpr)
+	_, rightIDs := e.right.(*idsExpr)
+	// document values are read in the -locale, but not when matched
+	// against the IDs, which are compared as written
+	_, leftLiteral := e.left.(*literalExpr)
+	_, rightLiteral := e.right.(*literalExpr)
+	localizeLeft := !leftLiteral && !leftIDs && !rightIDs
+	localizeRight := !rightLiteral && !rightIDs && !leftIDs
+	for _, l := range e.left.values(n, ctx) {
+		if localizeLeft {
+			l = localized(l)
+		}
+		for _, r := range e.right.values(n, ctx) {
+			if localizeRight {
+				r = localized(r)
+			}
+			if compareValues(l, r, e.op) {
+				if leftIDs {
+					ctx.matchedID = l
+				} else if rightIDs {
+					ctx.matchedID = r
+				}
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Compares numerically when both sides are numbers, otherwise as strings
+func compareValues(l, r, op string) bool {
+	cmp := 0
+	lf, lerr := strconv.ParseFloat(l, 64)
+	rf, rerr := strconv.ParseFloat(r, 64)
+	if lerr == nil && rerr == nil {
+		switch {
+		case lf < rf:
+			cmp = -1
+		case lf > rf:
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(l, r)
+	}
+
+	switch op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+type funcExpr struct {
+	name string
+	args []exprNode
+}
+
+func (e *funcExpr) values(n *node, ctx *evalContext) []string {
+	return []string{strconv.FormatBool(e.truth(n, ctx))}
+}
+
+func (e *funcExpr) truth(n *node, ctx *evalContext) bool {
+	if e.name == "not" {
+		return !e.args[0].truth(n, ctx)
+	}
+
+	for _, s := range e.args[0].values(n, ctx) {
+		for _, sub := range e.args[1].values(n, ctx) {
+			if (e.name == "contains" && strings.Contains(s, sub)) ||
+				(e.name == "starts-with" && strings.HasPrefix(s, sub)) {
+				if _, ok := e.args[1].(*idsExpr); ok {
+					ctx.matchedID = sub
+				}
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestXPath(t *testing.T) {
+	entry := `<book id="b1" lang="en"><title>The Big Sleep</title><year>2021</year>` +
+		`<author role="main"><name>Ann</name></author><author><name>Bob</name></author></book>`
+	n, err := parseNode(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		expr    string
+		ids     []string
+		match   bool
+		matchID string
+	}{
+		{expr: "//book", match: true},
+		{expr: "/catalog/book", match: true},
+		{expr: "//catalog/book", match: true},
+		{expr: "//book[year > 2020]", match: true},
+		{expr: "//book[year >= 2022]", match: false},
+		{expr: "//book[year < 2022 and @lang = 'en']", match: true},
+		{expr: "//book[year = 1999 or @lang != 'fr']", match: true},
+		{expr: "//book[(year = 1999 or year = 2021) and title]", match: true},
+		{expr: "//book[author/name = 'Bob']", match: true},
+		{expr: "//book[author/@role = 'main']", match: true},
+		{expr: "//book[author/@role = 'other']", match: false},
+		{expr: "//book[*/name = 'Ann']", match: true},
+		{expr: "//book[./title = \"The Big Sleep\"]", match: true},
+		{expr: "//book[contains(title, 'Big')]", match: true},
+		{expr: "//book[starts-with(title, 'Big')]", match: false},
+		{expr: "//book[not(isbn)]", match: true},
+		{expr: "//book[@id = $id]", ids: []string{"b0", "b1"}, match: true, matchID: "b1"},
+		{expr: "//book[contains(title, $id)]", ids: []string{"Sleep"}, match: true, matchID: "Sleep"},
+		{expr: "//book[@id = $id]", ids: []string{"b2"}, match: false},
+	}
+	for _, test := range tests {
+		x, err := parseXPath(test.expr)
+		if err != nil {
+			t.Errorf("parseXPath(%q): %v", test.expr, err)
+			continue
+		}
+		if !x.path.matches([]string{"catalog", "book"}) {
+			t.Errorf("%q does not select catalog/book", test.expr)
+		}
+		id, ok := x.eval(n, test.ids)
+		if ok != test.match || id != test.matchID {
+			t.Errorf("%q with %v = %q, %v, want %q, %v", test.expr, test.ids, id, ok, test.matchID, test.match)
+		}
+	}
+}
+
+func TestXPathRejected(t *testing.T) {
+	tests := []struct{ expr, err string }{
+		{"//book[1]", "positional"},
+		{"//book[(2)]", "positional"},
+		{"//book[last()]", "unknown function"},
+		{"//book[position() = 1]", "unknown function"},
+		{"//dc:record", "prefixed"},
+		{"//book[dc:creator = 'Ann']", "prefixed"},
+		{"//book[@xlink:href]", "prefixed"},
+		{"//book[author/dc:name]", "prefixed"},
+		{"//book[year > 2020", "unterminated"},
+		{"//book[title = 'x]", "unterminated string"},
+		{"//book[$ref = 1]", "unknown variable"},
+		{"//book[contains(title)]", "argument"},
+		{"//catalog//book", "descendant"},
+	}
+	for _, test := range tests {
+		_, err := parseXPath(test.expr)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("parseXPath(%q) = %v, want an error about %s", test.expr, err, test.err)
+		}
+	}
+}
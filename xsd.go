@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// -xsd: an XML Schema each matched entry, or with -xsd-scope document each
+// output file, is validated against. Go has no schema validator, so xmllint
+// (libxml2) is run, on batches of entries or once per file.
+type xsdSchema struct {
+	ctx     context.Context
+	schema  string
+	command string // the path of xmllint
+	network bool   // let the schema import documents over the network
+}
+
+// Entries validated per run of xmllint
+const xsdBatch = 500
+
+// Finds xmllint and checks the schema can be read
+func newXSD(ctx context.Context, schema string, network bool) (*xsdSchema, error) {
+	if _, err := os.Stat(schema); err != nil {
+		return nil, fmt.Errorf("invalid -xsd: %v", err)
+	}
+	// entries are validated from a temp directory
+	schema, err := filepath.Abs(schema)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -xsd: %v", err)
+	}
+	command, err := exec.LookPath("xmllint")
+	if err != nil {
+		return nil, fmt.Errorf("-xsd needs xmllint, from libxml2, on the PATH")
+	}
+	return &xsdSchema{ctx: ctx, schema: schema, command: command, network: network}, nil
+}
+
+// Checks -xsd-scope and the flags a document check can't be combined with,
+// since only XML documents can be validated
+func (opts *options) checkXSD() error {
+	switch {
+	case opts.xsdScope != "entry" && opts.xsdScope != "document":
+		return fmt.Errorf("-xsd-scope must be entry or document")
+	case opts.xsd == "" && opts.xsdScope != "entry":
+		return fmt.Errorf("-xsd-scope requires -xsd")
+	case opts.xsdScope != "document":
+		return nil
+	case opts.format != "xml":
+		return fmt.Errorf("-xsd-scope document validates XML files, so cannot be combined with -format or -template")
+	case opts.noRoot:
+		return fmt.Errorf("-xsd-scope document cannot be combined with -no-root, whose files are not documents")
+	}
+	return nil
+}
+
+// Runs xmllint over files in dir, or over stdin for the file "-", returning
+// the schema errors of each invalid file as "line N: message"
+func (x *xsdSchema) run(dir string, stdin io.Reader, files ...string) (map[string][]string, error) {
+	args := []string{"--noout"}
+	if !x.network {
+		args = append(args, "--nonet")
+	}
+	args = append(args, "--schema", x.schema)
+	args = append(args, files...)
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(x.ctx, x.command, args...)
+	cmd.Dir, cmd.Stdin, cmd.Stderr = dir, stdin, &stderr
+	err := cmd.Run()
+	var exit *exec.ExitError
+	// xmllint exits with 3 when a file is invalid, with others when it fails
+	if err != nil && (!errors.As(err, &exit) || exit.ExitCode() != 3) {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, err
+	}
+
+	found := make(map[string][]string)
+	scanner := bufio.NewScanner(&stderr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		for _, name := range files {
+			if line == name+" fails to validate" && len(found[name]) == 0 {
+				found[name] = []string{"fails to validate"}
+				break
+			}
+			rest, ok := strings.CutPrefix(line, name+":")
+			if !ok {
+				continue
+			}
+			// e.g. 3: Schemas validity error : Element 'price': ...
+			n, msg, ok := strings.Cut(rest, ": ")
+			if !ok {
+				continue
+			}
+			if _, after, ok := strings.Cut(msg, " : "); ok {
+				msg = after
+			}
+			found[name] = append(found[name], fmt.Sprintf("line %s: %s", n, msg))
+			break
+		}
+	}
+	return found, nil
+}
+
+// Validates every entry, returning the schema errors of each
+func (x *xsdSchema) entries(entries []entry) ([][]string, error) {
+	dir, err := os.MkdirTemp("", "ds-xml-xsd-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	found := make([][]string, len(entries))
+	for start := 0; start < len(entries); start += xsdBatch {
+		batch := entries[start:min(start+xsdBatch, len(entries))]
+		files := make([]string, len(batch))
+		for i, e := range batch {
+			files[i] = fmt.Sprintf("entry-%d.xml", start+i+1)
+			if err := os.WriteFile(filepath.Join(dir, files[i]), []byte(e.raw), 0666); err != nil {
+				return nil, err
+			}
+		}
+		errs, err := x.run(dir, nil, files...)
+		if err != nil {
+			return nil, err
+		}
+		for i, name := range files {
+			found[start+i] = errs[name]
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+	return found, nil
+}
+
+// Validates a finished output file, uncompressing it if gzipped. The
+// schema errors, if any, are the error.
+func (x *xsdSchema) file(path string, compressed bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if compressed {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		r = zr
+	}
+	found, err := x.run("", r, "-")
+	if err != nil {
+		return err
+	}
+	errs := found["-"]
+	switch {
+	case len(errs) == 0:
+		return nil
+	case len(errs) > 10:
+		errs = append(errs[:10], fmt.Sprintf("and %d more", len(errs)-10))
+	}
+	return fmt.Errorf("not valid against %s:\n  %s", x.schema, strings.Join(errs, "\n  "))
+}
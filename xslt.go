@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// -xslt: an XSLT stylesheet each captured entry, or with -xslt-scope
+// document each output file, is transformed by before it is written. Go has
+// no XSLT processor, so xsltproc (libxslt) is run: once per entry, or once
+// per file.
+type xsltTransform struct {
+	ctx        context.Context
+	stylesheet string
+	command    string // the path of xsltproc
+	network    bool   // let the stylesheet load documents over the network
+}
+
+// Finds xsltproc and checks the stylesheet can be read
+func newXSLT(ctx context.Context, stylesheet string, network bool) (*xsltTransform, error) {
+	if _, err := os.Stat(stylesheet); err != nil {
+		return nil, fmt.Errorf("invalid -xslt: %v", err)
+	}
+	command, err := exec.LookPath("xsltproc")
+	if err != nil {
+		return nil, fmt.Errorf("-xslt needs xsltproc, from libxslt, on the PATH")
+	}
+	return &xsltTransform{ctx: ctx, stylesheet: stylesheet, command: command, network: network}, nil
+}
+
+// Checks -xslt-scope and the flags a document transform can't be combined
+// with, since files are no longer written as the entries are
+func (opts *options) checkXSLT() error {
+	switch {
+	case opts.xsltScope != "entry" && opts.xsltScope != "document":
+		return fmt.Errorf("-xslt-scope must be entry or document")
+	case opts.xslt == "" && opts.xsltScope != "entry":
+		return fmt.Errorf("-xslt-scope requires -xslt")
+	case opts.xsltScope != "document":
+		return nil
+	case opts.format != "xml":
+		return fmt.Errorf("-xslt-scope document transforms XML files, so cannot be combined with -format or -template")
+	case opts.noRoot:
+		return fmt.Errorf("-xslt-scope document cannot be combined with -no-root, whose files are not documents")
+	case opts.verify:
+		return fmt.Errorf("-verify reads output files back as the entries, so cannot be combined with -xslt-scope document")
+	}
+	return nil
+}
+
+// Runs xsltproc on a document, with the given stylesheet parameters
+func (x *xsltTransform) transform(input []byte, params ...string) ([]byte, error) {
+	var args []string
+	if !x.network {
+		args = append(args, "--nonet")
+	}
+	for i := 0; i+1 < len(params); i += 2 {
+		args = append(args, "--stringparam", params[i], params[i+1])
+	}
+	args = append(args, x.stylesheet, "-")
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(x.ctx, x.command, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(input), &out, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Transforms an entry, which must come out as XML. The stylesheet gets the
+// entry's ref and offset as the parameters ref and offset.
+func (x *xsltTransform) apply(e entry) (string, error) {
+	out, err := x.transform([]byte(e.raw), "ref", e.ref, "offset", strconv.FormatInt(e.offset, 10))
+	if err != nil {
+		return "", err
+	}
+	raw := strings.TrimSpace(string(out))
+	if strings.HasPrefix(raw, "<?xml") {
+		if end := strings.Index(raw, "?>"); end >= 0 {
+			raw = strings.TrimSpace(raw[end+2:])
+		}
+	}
+	if _, err := parseNode(raw); err != nil {
+		return "", fmt.Errorf("the stylesheet's output is not XML: %v", err)
+	}
+	return raw, nil
+}
+
+// Transforms every entry
+func (x *xsltTransform) entries(entries []entry) ([]entry, error) {
+	for i, e := range entries {
+		raw, err := x.apply(e)
+		if err != nil {
+			return nil, fmt.Errorf("the entry at offset %d: %v", e.offset, err)
+		}
+		entries[i].raw = raw
+	}
+	return entries, nil
+}
+
+// Transforms a finished output file in place, uncompressing and
+// recompressing it if gzipped
+func (x *xsltTransform) file(path string, compressed bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if compressed {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if data, err = io.ReadAll(zr); err != nil {
+			return err
+		}
+	}
+	out, err := x.transform(data)
+	if err != nil {
+		return err
+	}
+	if compressed {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(out)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		out = buf.Bytes()
+	}
+	return os.WriteFile(path, out, 0666)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+// Compression method zip uses to mark WinZip AES encrypted members
+const zipMethodAES = 99
+
+var errZipPassword = errors.New("incorrect archive password")
+
+// Returns the password for encrypted zip downloads: -archive-password, else
+// the output of -archive-password-cmd, else DSXML_ARCHIVE_PASSWORD
+func archivePassword(opts options) (string, error) {
+	if opts.archivePassword != "" {
+		return opts.archivePassword, nil
+	}
+	if opts.archivePasswordCmd != "" {
+		cmd := shellCommand(context.Background(), opts.archivePasswordCmd)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("-archive-password-cmd failed: %v", err)
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	}
+	return os.Getenv("DSXML_ARCHIVE_PASSWORD"), nil
+}
+
+// Opens a zip member for reading, decrypting it with password when it is
+// encrypted with ZipCrypto or WinZip AES
+func openZipMember(f *zip.File, password string) (io.ReadCloser, error) {
+	if f.Flags&0x1 == 0 {
+		return f.Open()
+	}
+	if password == "" {
+		return nil, fmt.Errorf("%s is encrypted; give the password with -archive-password, -archive-password-cmd or DSXML_ARCHIVE_PASSWORD", f.Name)
+	}
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	var data io.Reader
+	method := f.Method
+	checkCRC := true
+	if f.Method == zipMethodAES {
+		var vendor uint16
+		data, method, vendor, err = decryptAES(f, raw, password)
+		// AE-2 leaves the CRC out, the authentication code covers the data
+		checkCRC = vendor == 1
+	} else {
+		data, err = decryptZipCrypto(f, raw, password)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f.Name, err)
+	}
+
+	var rc io.ReadCloser
+	switch method {
+	case zip.Store:
+		rc = io.NopCloser(data)
+	case zip.Deflate:
+		rc = flate.NewReader(data)
+	default:
+		return nil, fmt.Errorf("%s: unsupported compression method %d", f.Name, method)
+	}
+	if f.Method == zipMethodAES {
+		// the decompressor can stop short of the end of the data, where
+		// the authentication code is checked
+		rc = &drainReader{ReadCloser: rc, rest: data}
+	}
+	if !checkCRC {
+		return rc, nil
+	}
+	return &crcReader{rc: rc, want: f.CRC32, hash: crc32.NewIEEE()}, nil
+}
+
+// Checks the CRC-32 of a decrypted member once it has been read
+type crcReader struct {
+	rc   io.ReadCloser
+	want uint32
+	hash hash.Hash32
+}
+
+func (r *crcReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && r.hash.Sum32() != r.want {
+		return n, zip.ErrChecksum
+	}
+	return n, err
+}
+
+func (r *crcReader) Close() error {
+	return r.rc.Close()
+}
+
+// Reads the rest of the underlying data once the member has been read
+type drainReader struct {
+	io.ReadCloser
+	rest io.Reader
+}
+
+func (r *drainReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		if _, err := io.Copy(io.Discard, r.rest); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// Traditional PKWARE encryption: a 12-byte header, then every byte XORed
+// with a keystream derived from the password
+func decryptZipCrypto(f *zip.File, raw io.Reader, password string) (io.Reader, error) {
+	keys := [3]uint32{305419896, 591751049, 878082192}
+	update := func(b byte) {
+		keys[0] = crc32.IEEETable[byte(keys[0])^b] ^ keys[0]>>8
+		keys[1] = (keys[1]+keys[0]&0xff)*134775813 + 1
+		keys[2] = crc32.IEEETable[byte(keys[2])^byte(keys[1]>>24)] ^ keys[2]>>8
+	}
+	for i := range len(password) {
+		update(password[i])
+	}
+	decrypt := func(p []byte) {
+		for i, c := range p {
+			t := keys[2] | 2
+			p[i] = c ^ byte(t*(t^1)>>8)
+			update(p[i])
+		}
+	}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(raw, header); err != nil {
+		return nil, err
+	}
+	decrypt(header)
+	// the last header byte repeats the high byte of the CRC, or of the
+	// modification time when the sizes follow the data
+	check := byte(f.CRC32 >> 24)
+	if f.Flags&0x8 != 0 {
+		check = byte(f.ModifiedTime >> 8)
+	}
+	if header[11] != check {
+		return nil, errZipPassword
+	}
+	return readerFunc(func(p []byte) (int, error) {
+		n, err := raw.Read(p)
+		decrypt(p[:n])
+		return n, err
+	}), nil
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+// WinZip AES: a salt and password verifier, AES-CTR encrypted data and an
+// HMAC-SHA1 authentication code. Returns the decrypted (still compressed)
+// data, the member's real compression method and the AE vendor version.
+func decryptAES(f *zip.File, raw io.Reader, password string) (io.Reader, uint16, uint16, error) {
+	// the 0x9901 extra field holds the key strength and real method
+	var vendor, method uint16
+	var strength byte
+	for extra := f.Extra; len(extra) >= 4; {
+		id, size := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+		if id == 0x9901 && size >= 7 {
+			field := extra[4:]
+			vendor, strength, method = binary.LittleEndian.Uint16(field), field[4], binary.LittleEndian.Uint16(field[5:])
+		}
+		extra = extra[4+size:]
+	}
+	if strength < 1 || strength > 3 {
+		return nil, 0, 0, fmt.Errorf("unsupported AES encryption")
+	}
+	keyLen := 8 + 8*int(strength)
+	saltLen := keyLen / 2
+	dataLen := int64(f.CompressedSize64) - int64(saltLen) - 2 - 10
+	if dataLen < 0 {
+		return nil, 0, 0, fmt.Errorf("truncated AES data")
+	}
+
+	head := make([]byte, saltLen+2)
+	if _, err := io.ReadFull(raw, head); err != nil {
+		return nil, 0, 0, err
+	}
+	keys, err := pbkdf2.Key(sha1.New, password, head[:saltLen], 1000, 2*keyLen+2)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if !bytes.Equal(keys[2*keyLen:], head[saltLen:]) {
+		return nil, 0, 0, errZipPassword
+	}
+	block, err := aes.NewCipher(keys[:keyLen])
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	mac := hmac.New(sha1.New, keys[keyLen:2*keyLen])
+
+	// CTR mode with a little-endian counter starting at 1
+	var counter, stream [aes.BlockSize]byte
+	used := aes.BlockSize
+	xor := func(p []byte) {
+		for i := range p {
+			if used == aes.BlockSize {
+				for j := range counter {
+					counter[j]++
+					if counter[j] != 0 {
+						break
+					}
+				}
+				block.Encrypt(stream[:], counter[:])
+				used = 0
+			}
+			p[i] ^= stream[used]
+			used++
+		}
+	}
+
+	data := io.LimitReader(raw, dataLen)
+	verified := false
+	return readerFunc(func(p []byte) (int, error) {
+		n, err := data.Read(p)
+		mac.Write(p[:n])
+		xor(p[:n])
+		if err == io.EOF && !verified {
+			verified = true
+			code := make([]byte, 10)
+			if _, err := io.ReadFull(raw, code); err != nil {
+				return n, err
+			}
+			if !hmac.Equal(code, mac.Sum(nil)[:10]) {
+				return n, fmt.Errorf("authentication failed, the data is corrupt")
+			}
+		}
+		return n, err
+	}), method, vendor, nil
+}
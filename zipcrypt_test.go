@@ -0,0 +1,94 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The archives in testdata hold this as books.xml with the password
+// "secret". The ZipCrypto ones were made with Info-ZIP's zip -P (with -0
+// for the stored one), the AES ones with bsdtar --format zip --options
+// zip:encryption=aes128 or aes256, and all read back with unzip -P and
+// bsdtar --passphrase.
+const zipBooks = "<catalog>\n  <book n=\"1\"><title>Dune</title></book>\n  <book n=\"2\"><title>Emma</title></book>\n</catalog>\n"
+
+func openTestZip(t *testing.T, name string) *zip.File {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.File[0]
+}
+
+func readZipMember(f *zip.File, password string) (string, error) {
+	rc, err := openZipMember(f, password)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	return string(data), err
+}
+
+func TestEncryptedZip(t *testing.T) {
+	for _, name := range []string{"zipcrypto-deflate.zip", "zipcrypto-store.zip", "aes128.zip", "aes256.zip"} {
+		f := openTestZip(t, name)
+		if got, err := readZipMember(f, "secret"); err != nil || got != zipBooks {
+			t.Errorf("%s: got %q, %v, want books.xml", name, got, err)
+		}
+		if _, err := readZipMember(f, "wrong"); err == nil || !strings.Contains(err.Error(), errZipPassword.Error()) {
+			t.Errorf("%s with the wrong password: got %v, want %v", name, err, errZipPassword)
+		}
+		if _, err := readZipMember(f, ""); err == nil || !strings.Contains(err.Error(), "is encrypted") {
+			t.Errorf("%s without a password: got %v, want the password asked for", name, err)
+		}
+	}
+}
+
+// AE-2 leaves the CRC out of the archive, so only the authentication code
+// can catch corrupt data
+func TestEncryptedZipAE2(t *testing.T) {
+	f := openTestZip(t, "aes256.zip")
+	ae2 := *f
+	ae2.CRC32 = 0
+	ae2.Extra = bytes.Clone(f.Extra)
+	for extra := ae2.Extra; len(extra) >= 4; {
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if binary.LittleEndian.Uint16(extra) == 0x9901 {
+			binary.LittleEndian.PutUint16(extra[4:], 2)
+		}
+		extra = extra[4+size:]
+	}
+	if got, err := readZipMember(&ae2, "secret"); err != nil || got != zipBooks {
+		t.Errorf("AE-2: got %q, %v, want books.xml", got, err)
+	}
+
+	// the authentication code is the last 10 bytes of the member's data
+	content, err := os.ReadFile(filepath.Join("testdata", "aes256.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset, err := f.DataOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[offset+int64(f.CompressedSize64)-1] ^= 0xff
+	r, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readZipMember(r.File[0], "secret"); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("tampered: got %v, want the authentication to fail", err)
+	}
+}